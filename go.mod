@@ -2,6 +2,12 @@ module fsnotify
 
 go 1.25.4
 
-require github.com/fsnotify/fsnotify v1.9.0
-
-require golang.org/x/sys v0.38.0 // indirect
+require (
+	github.com/bmatcuk/doublestar/v4 v4.10.0
+	github.com/cespare/xxhash/v2 v2.3.0
+	github.com/coreos/go-systemd/v22 v22.7.0
+	github.com/fsnotify/fsnotify v1.9.0
+	github.com/pierrec/lz4/v4 v4.1.22
+	golang.org/x/sys v0.38.0
+	golang.org/x/time v0.9.0
+)
@@ -10,6 +10,10 @@ defmodule FSNotify do
 
     * `:watches` - an initial set of watches to add; failure to add
       any of them is considered fatal
+
+    * `:compress` - whether to have the port compress what it sends
+      with LZ4, which can help with very high event rates; defaults to
+      `false`
   """
 
   import FSNotify.Supervisor, only: [registry_name: 1]
@@ -19,13 +23,29 @@ defmodule FSNotify do
 
   @type name() :: GenServer.name()
 
+  @typedoc """
+  A message sent to subscribers. Anything that the port sends that
+  isn't one of the others, such as a burst summary, is sent as
+  `{:fsnotify_other, data}` with the decoded JSON.
+  """
   @type message() ::
           {:fsnotify_event, path :: String.t(), ops :: MapSet.t(op())}
           | {:fsnotify_error, error_message :: String.t()}
+          | {:fsnotify_warning, warning_message :: String.t()}
+          | {:fsnotify_suppressed, root :: String.t(), count :: pos_integer()}
+          | {:fsnotify_notice, notice :: String.t()}
+          | :fsnotify_overflow
           | {:fsnotify_stop, name()}
-  @type op() :: :create | :write | :remove | :rename | :chmod
+          | {:fsnotify_other, data :: map()}
+
+  @typedoc """
+  An operation in an event. Operations that the monitor doesn't know
+  about are given as the names that the port uses for them.
+  """
+  @type op() :: :create | :write | :remove | :rename | :chmod | :moved | String.t()
 
-  @type start_option() :: {:name, name()} | {:watches, Enumerable.t(Path.t())}
+  @type start_option() ::
+          {:name, name()} | {:watches, Enumerable.t(Path.t())} | {:compress, boolean()}
 
   @doc """
   Registers a path to be watched by the monitor.
@@ -53,6 +73,14 @@ defmodule FSNotify do
     GenServer.call(name, :watch_list)
   end
 
+  @doc """
+  Returns the number of paths registered to be watched by the monitor.
+  """
+  @spec watch_count(name()) :: non_neg_integer()
+  def watch_count(name) do
+    GenServer.call(name, :watch_count)
+  end
+
   @doc """
   Stops the monitor, causing the process to shutdown cleanly.
   """
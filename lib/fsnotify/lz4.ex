@@ -0,0 +1,56 @@
+defmodule FSNotify.LZ4 do
+  @moduledoc false
+
+  import Bitwise
+
+  @min_match 4
+
+  @doc """
+  Decompresses a payload sent by the port with compression on, which is
+  its uncompressed size as a big-endian uint32 followed by an LZ4 block.
+  """
+  @spec decompress(binary()) :: binary()
+  def decompress(<<size::32-big, block::binary>>) do
+    data = decode(block, <<>>)
+
+    if byte_size(data) != size do
+      raise "fsnotify port sent an LZ4 payload of the wrong size"
+    end
+
+    data
+  end
+
+  defp decode(<<token, rest::binary>>, out) do
+    {count, rest} = read_length(token >>> 4, rest)
+    <<literals::binary-size(count), rest::binary>> = rest
+    out = out <> literals
+
+    case rest do
+      <<>> ->
+        out
+
+      <<offset::16-little, rest::binary>> ->
+        {length, rest} = read_length(token &&& 0x0F, rest)
+        decode(rest, copy_match(out, offset, length + @min_match))
+    end
+  end
+
+  defp read_length(15, rest), do: read_extra_length(rest, 15)
+  defp read_length(n, rest), do: {n, rest}
+
+  defp read_extra_length(<<255, rest::binary>>, n), do: read_extra_length(rest, n + 255)
+  defp read_extra_length(<<b, rest::binary>>, n), do: {n + b, rest}
+
+  # Matches can overlap the bytes that they produce, in which case the
+  # last offset bytes repeat.
+  defp copy_match(out, offset, length) when offset > 0 and offset <= byte_size(out) do
+    match = binary_part(out, byte_size(out) - offset, min(offset, length))
+
+    repeated =
+      match
+      |> :binary.copy(div(length, byte_size(match)) + 1)
+      |> binary_part(0, length)
+
+    out <> repeated
+  end
+end
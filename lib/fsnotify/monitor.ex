@@ -18,28 +18,31 @@ defmodule FSNotify.Monitor do
 
   @impl true
   def init(opts) do
-    opts = Keyword.validate!(opts, [:name, watches: []])
+    opts = Keyword.validate!(opts, [:name, watches: [], compress: false])
 
     executable = Path.join(:code.priv_dir(:fsnotify), "fsnotify")
+    args = if opts[:compress], do: ["-compress", "lz4"], else: []
 
     port =
       Port.open({:spawn_executable, executable}, [
         :binary,
         :exit_status,
-        packet: 2
+        packet: 4,
+        args: args
       ])
 
     {:ok,
      %{
        port: port,
-       name: Keyword.fetch!(opts, :name)
+       name: Keyword.fetch!(opts, :name),
+       compress: opts[:compress]
      }, {:continue, {:add_initial_watches, opts[:watches]}}}
   end
 
   @impl true
   def handle_continue({:add_initial_watches, watches}, state) when is_list(watches) do
     for watch <- watches do
-      :ok = send_command(state.port, :add_watch, watch)
+      :ok = send_command(state, :add_watch, watch)
     end
 
     {:noreply, state}
@@ -47,22 +50,27 @@ defmodule FSNotify.Monitor do
 
   @impl true
   def handle_call({:add_watch, path}, _from, state) do
-    reply = send_command(state.port, :add_watch, path)
+    reply = send_command(state, :add_watch, path)
     {:reply, reply, state}
   end
 
   @impl true
   def handle_call({:remove, path}, _from, state) do
-    reply = send_command(state.port, :remove, path)
+    reply = send_command(state, :remove, path)
     {:reply, reply, state}
   end
 
   @impl true
   def handle_call(:watch_list, _from, state) do
-    reply = send_command(state.port, :watch_list)
+    reply = for %{"path" => path} <- send_command(state, :watch_list), do: path
     {:reply, reply, state}
   end
 
+  @impl true
+  def handle_call(:watch_count, _from, state) do
+    {:reply, send_command(state, :watch_count), state}
+  end
+
   @impl true
   def handle_cast(:stop, state) do
     Port.close(state.port)
@@ -71,23 +79,44 @@ defmodule FSNotify.Monitor do
   end
 
   @impl true
-  def handle_info({_port, {:data, <<0::8*8, data::binary>>}}, state) do
-    broadcast(state.name, data_to_message(JSON.decode!(data)))
+  def handle_info({_port, {:data, <<0::8*8, crc::8*4, data::binary>>}}, state) do
+    verify_frame!(0, crc, data)
+
+    case JSON.decode!(decode_payload(data, state)) do
+      %{"op" => "Keepalive"} -> :ok
+      batch when is_list(batch) -> Enum.each(batch, &broadcast(state.name, data_to_message(&1)))
+      data -> broadcast(state.name, data_to_message(data))
+    end
+
     {:noreply, state}
   end
 
-  defp send_command(port, command, arg \\ nil) do
+  defp send_command(%{port: port} = state, command, arg \\ nil) do
     id = :erlang.unique_integer([:positive])
-    Port.command(port, <<id::8*8-big, "#{command} #{arg}">>)
+    payload = "#{command} #{arg}"
+    crc = :erlang.crc32(<<id::8*8-big, payload::binary>>)
+    Port.command(port, <<id::8*8-big, crc::8*4, payload::binary>>)
 
     receive do
-      {^port, {:data, <<^id::8*8-big, data::binary>>}} ->
-        data_to_reply(JSON.decode!(data))
+      {^port, {:data, <<^id::8*8-big, crc::8*4, data::binary>>}} ->
+        verify_frame!(id, crc, data)
+        data_to_reply(JSON.decode!(decode_payload(data, state)))
     after
       1000 -> {:error, :timeout}
     end
   end
 
+  defp verify_frame!(id, crc, data) do
+    if :erlang.crc32(<<id::8*8-big, data::binary>>) != crc do
+      raise "fsnotify port frame #{id} failed its checksum"
+    end
+
+    :ok
+  end
+
+  defp decode_payload(data, %{compress: true}), do: FSNotify.LZ4.decompress(data)
+  defp decode_payload(data, _state), do: data
+
   defp broadcast(name, msg) do
     Registry.dispatch(
       registry_name(name),
@@ -106,12 +135,47 @@ defmodule FSNotify.Monitor do
   end
 
   defp data_to_reply("ok"), do: :ok
+  defp data_to_reply(%{"ok" => true}), do: :ok
   defp data_to_reply(%{"OK" => val}), do: {:ok, val}
   defp data_to_reply(%{"Err" => err}), do: {:error, err}
   defp data_to_reply(data), do: data
 
-  defp data_to_message(%{"Name" => name, "Op" => op}), do: {:fsnotify_event, name, op_to_set(op)}
+  defp data_to_message(%{"op" => "Overflow"}), do: :fsnotify_overflow
+
+  # Names that aren't valid UTF-8 are also sent in base64, which has
+  # the exact bytes.
+  defp data_to_message(%{"path_b64" => b64} = data) do
+    data
+    |> Map.delete("path_b64")
+    |> Map.put("Name", Base.decode64!(b64))
+    |> data_to_message()
+  end
+
+  defp data_to_message(%{"Name" => root, "suppressed" => count}),
+    do: {:fsnotify_suppressed, root, count}
+
+  defp data_to_message(%{"Name" => name, "op" => ops}),
+    do: {:fsnotify_event, name, MapSet.new(ops, &op_name/1)}
+
+  defp data_to_message(%{"Name" => name, "Op" => op}) when is_integer(op),
+    do: {:fsnotify_event, name, op_to_set(op)}
+
   defp data_to_message(%{"Err" => err}), do: {:fsnotify_error, err}
+  defp data_to_message(%{"Warn" => warning}), do: {:fsnotify_warning, warning}
+  defp data_to_message(%{"Notice" => notice}), do: {:fsnotify_notice, notice}
+
+  # Anything else, such as a burst summary or a frame that was added to
+  # the port after this was written, is passed on as is rather than
+  # crashing the monitor.
+  defp data_to_message(data), do: {:fsnotify_other, data}
+
+  defp op_name("create"), do: :create
+  defp op_name("write"), do: :write
+  defp op_name("remove"), do: :remove
+  defp op_name("rename"), do: :rename
+  defp op_name("chmod"), do: :chmod
+  defp op_name("moved"), do: :moved
+  defp op_name(name), do: name
 
   defp op_to_set(op) do
     <<chmod::1, rename::1, remove::1, write::1, create::1>> = <<op::5>>
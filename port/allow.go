@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+)
+
+// stringList is a flag.Value that collects every use of a repeatable
+// flag.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// resolvePath returns the absolute path of path with all symlinks
+// resolved. If path doesn't exist, its nearest existing ancestor is
+// resolved instead and the remainder appended to the result.
+func resolvePath(path string) (string, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+
+	resolved, err := filepath.EvalSymlinks(path)
+	if err == nil {
+		return resolved, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return "", err
+	}
+
+	parent := filepath.Dir(path)
+	if parent == path {
+		return path, nil
+	}
+	resolved, err = resolvePath(parent)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(resolved, filepath.Base(path)), nil
+}
+
+// checkAllowed returns an error if path, after resolving symlinks, is
+// not under one of the configured allowed prefixes. If no prefixes are
+// configured, every path is allowed.
+func (s *Server) checkAllowed(path string) error {
+	if len(s.allowPrefixes) == 0 {
+		return nil
+	}
+
+	resolved, err := resolvePath(path)
+	if err != nil {
+		return err
+	}
+	for _, prefix := range s.allowPrefixes {
+		if hasPathPrefix(resolved, prefix) {
+			return nil
+		}
+	}
+
+	return &codedError{
+		Code: "forbidden",
+		Err:  fmt.Errorf("%q is not under an allowed prefix", path),
+	}
+}
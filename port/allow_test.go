@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAllowPrefix(t *testing.T) {
+	config := DefaultConfig
+	config.AllowPrefixes = []string{"/tmp"}
+	ts := newTestServerConfig(t, config)
+
+	ts.send(1, "add_watch /etc/passwd")
+	ts.expect(1, `{"Err":"\"/etc/passwd\" is not under an allowed prefix","code":"forbidden"}`)
+
+	ts.send(2, "add_watch /tmp/../etc")
+	ts.expect(2, `{"Err":"\"/tmp/../etc\" is not under an allowed prefix","code":"forbidden"}`)
+
+	ts.send(3, "add_watch /tmp")
+	ts.expect(3, `"ok"`)
+
+	ts.send(4, "record /etc/recording")
+	ts.expect(4, `{"Err":"\"/etc/recording\" is not under an allowed prefix","code":"forbidden"}`)
+
+	ts.send(5, "journal_start /etc/journal")
+	ts.expect(5, `{"Err":"\"/etc/journal\" is not under an allowed prefix","code":"forbidden"}`)
+
+	ts.send(6, `journal_start {"path":"/tmp/../etc/journal"}`)
+	ts.expect(6, `{"Err":"\"/tmp/../etc/journal\" is not under an allowed prefix","code":"forbidden"}`)
+
+	ts.send(7, "journal_replay /etc/journal")
+	ts.expect(7, `{"Err":"\"/etc/journal\" is not under an allowed prefix","code":"forbidden"}`)
+}
+
+func TestAllowPrefixSymlink(t *testing.T) {
+	dir := t.TempDir()
+	link := filepath.Join(dir, "escape")
+	err := os.Symlink("/etc", link)
+	if err != nil {
+		t.Skip(err)
+	}
+
+	config := DefaultConfig
+	config.AllowPrefixes = []string{dir}
+	ts := newTestServerConfig(t, config)
+
+	ts.send(1, "add_watch "+link)
+	_, reply := ts.next()
+	if !strings.Contains(reply, `"code":"forbidden"`) {
+		t.Fatalf("expected symlink escape to be forbidden, got %s", reply)
+	}
+}
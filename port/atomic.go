@@ -0,0 +1,215 @@
+package main
+
+import (
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// atomicWriteData is sent in place of the events caused by writing a
+// file atomically by writing to a temporary file and renaming it over
+// the target.
+type atomicWriteData struct {
+	Op     string `json:"op"`
+	Name   string `json:"name"`
+	Tmp    string `json:"tmp"`
+	Root   string `json:"root,omitzero"`
+	Handle uint64 `json:"handle,omitzero"`
+	Tag    string `json:"tag,omitzero"`
+	Time   string `json:"time,omitzero"`
+	MonoNS int64  `json:"mono_ns,omitzero"`
+}
+
+// heldEvent is an event that is being held along with what would have
+// been sent for it.
+type heldEvent struct {
+	event fsnotify.Event
+	data  eventData
+}
+
+// atomicWrite is a path that was just created and might turn out to
+// be the temporary file of an atomic write.
+type atomicWrite struct {
+	path    string
+	held    []heldEvent
+	written bool
+
+	// renamed is when the temporary file was renamed, or zero if it
+	// hasn't been.
+	renamed time.Time
+	timer   timer
+}
+
+// atomicWrites detects atomic writes, which show up as a create of,
+// write to, and rename of a temporary file followed by a create of the
+// target, and sends a single event for each. Created paths are held
+// for up to a window in case they turn out to be temporary files, after
+// which their events are passed on as they were.
+type atomicWrites struct {
+	clock  clock
+	window time.Duration
+
+	// reported is true if the watcher reports what created paths were
+	// renamed from. Otherwise, the create of the target is assumed to
+	// be the next one in the same directory as the temporary file.
+	reported bool
+
+	// next is passed events that aren't part of an atomic write, with
+	// emit as the function to send them with if they were held.
+	next func(event fsnotify.Event, data eventData, send func(any))
+	emit func(any)
+
+	m       sync.Mutex
+	pending map[string]*atomicWrite
+}
+
+func newAtomicWrites(clock clock, window time.Duration, reported bool, next func(fsnotify.Event, eventData, func(any)), emit func(any)) *atomicWrites {
+	return &atomicWrites{
+		clock:    clock,
+		window:   window,
+		reported: reported,
+		next:     next,
+		emit:     emit,
+		pending:  make(map[string]*atomicWrite),
+	}
+}
+
+// handle passes data, which was created for event, on to a.next unless
+// it might be part of an atomic write, in which case it is held.
+func (a *atomicWrites) handle(event fsnotify.Event, data eventData, send func(any)) {
+	if a.window <= 0 {
+		a.next(event, data, send)
+		return
+	}
+
+	done, flushed, held := a.track(event, data)
+	for _, e := range flushed {
+		a.next(e.event, e.data, send)
+	}
+	if done != nil {
+		send(*done)
+	}
+	if !held && done == nil {
+		a.next(event, data, send)
+	}
+}
+
+// track updates the pending atomic writes with event. It returns the
+// event to send if it completed an atomic write, any previously held
+// events that should be sent first because they turned out not to be
+// part of one, and whether event itself is being held.
+func (a *atomicWrites) track(event fsnotify.Event, data eventData) (done *atomicWriteData, flushed []heldEvent, held bool) {
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	path := filepath.Clean(event.Name)
+	if event.Op == fsnotify.Create {
+		if w := a.renamedTo(event, path); w != nil {
+			a.forget(w)
+			tmp := w.held[0].data
+			return &atomicWriteData{
+				Op:     "WriteAtomic",
+				Name:   data.Name,
+				Tmp:    tmp.Name,
+				Root:   data.Root,
+				Handle: data.Handle,
+				Tag:    data.Tag,
+				Time:   data.Time,
+				MonoNS: data.MonoNS,
+			}, nil, false
+		}
+	}
+
+	w, ok := a.pending[path]
+	switch {
+	case !ok:
+	case (event.Op == fsnotify.Write || event.Op == fsnotify.Chmod) && w.renamed.IsZero():
+		// Some programs set the permissions of the temporary file
+		// before renaming it, which doesn't count as writing to it.
+		w.written = w.written || event.Op == fsnotify.Write
+		w.held = append(w.held, heldEvent{event, data})
+		return nil, nil, true
+	case event.Op == fsnotify.Rename && w.written && w.renamed.IsZero():
+		w.renamed = a.clock.Now()
+		w.held = append(w.held, heldEvent{event, data})
+		return nil, nil, true
+	default:
+		// Anything else means that it isn't an atomic write after all.
+		a.forget(w)
+		flushed = w.held
+	}
+
+	if event.Op == fsnotify.Create {
+		w := &atomicWrite{path: path, held: []heldEvent{{event, data}}}
+		w.timer = a.clock.AfterFunc(a.window, func() { a.expire(w) })
+		a.pending[path] = w
+		return nil, flushed, true
+	}
+	return nil, flushed, false
+}
+
+// renamedTo returns the pending atomic write, if any, whose temporary
+// file was renamed to create path. a.m must be held.
+func (a *atomicWrites) renamedTo(event fsnotify.Event, path string) *atomicWrite {
+	if a.reported {
+		from, ok := renamedFrom(event)
+		if !ok {
+			return nil
+		}
+		w, ok := a.pending[filepath.Clean(from)]
+		if !ok || w.renamed.IsZero() {
+			return nil
+		}
+		return w
+	}
+
+	var candidates []*atomicWrite
+	for _, w := range a.pending {
+		if !w.renamed.IsZero() && filepath.Dir(w.path) == filepath.Dir(path) {
+			candidates = append(candidates, w)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	// The oldest rename is the most likely to be the one that caused
+	// this create.
+	return slices.MinFunc(candidates, func(w1, w2 *atomicWrite) int {
+		return w1.renamed.Compare(w2.renamed)
+	})
+}
+
+// forget stops tracking w. a.m must be held.
+func (a *atomicWrites) forget(w *atomicWrite) {
+	w.timer.Stop()
+	delete(a.pending, w.path)
+}
+
+// expire passes on the events held for w if it is still pending.
+func (a *atomicWrites) expire(w *atomicWrite) {
+	a.m.Lock()
+	if a.pending[w.path] != w {
+		a.m.Unlock()
+		return
+	}
+	delete(a.pending, w.path)
+	a.m.Unlock()
+
+	for _, e := range w.held {
+		a.next(e.event, e.data, a.emit)
+	}
+}
+
+// dropAll discards all held events without sending them.
+func (a *atomicWrites) dropAll() {
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	for _, w := range a.pending {
+		w.timer.Stop()
+	}
+	clear(a.pending)
+}
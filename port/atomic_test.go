@@ -0,0 +1,79 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func TestAtomicWrites(t *testing.T) {
+	var sent, emitted []any
+	clock := newFakeClock()
+	next := func(event fsnotify.Event, data eventData, send func(any)) { send(data) }
+	a := newAtomicWrites(clock, 50*time.Millisecond, false, next, func(v any) { emitted = append(emitted, v) })
+
+	handle := func(name string, op fsnotify.Op) {
+		a.handle(fsnotify.Event{Name: name, Op: op}, eventData{Name: name, Op: eventOp(op)}, func(v any) { sent = append(sent, v) })
+	}
+
+	handle("/data/.file.tmp", fsnotify.Create)
+	handle("/data/.file.tmp", fsnotify.Write)
+	handle("/data/.file.tmp", fsnotify.Write)
+	handle("/data/.file.tmp", fsnotify.Rename)
+	if len(sent) != 0 {
+		t.Fatalf("sent %v before the write was complete", sent)
+	}
+	handle("/data/file", fsnotify.Create)
+
+	expected := atomicWriteData{Op: "WriteAtomic", Name: "/data/file", Tmp: "/data/.file.tmp"}
+	if len(sent) != 1 || sent[0] != expected {
+		t.Fatalf("got %v, expected [%v]", sent, expected)
+	}
+	clock.Advance(time.Second)
+	if len(emitted) != 0 {
+		t.Fatalf("emitted %v after the write was complete", emitted)
+	}
+
+	// A created file that isn't renamed is passed on once the window
+	// has passed.
+	sent = nil
+	handle("/data/other", fsnotify.Create)
+	handle("/data/other", fsnotify.Write)
+	clock.Advance(60 * time.Millisecond)
+	if len(sent) != 0 || len(emitted) != 2 {
+		t.Fatalf("got %v and %v, expected the held create and write to be emitted", sent, emitted)
+	}
+
+	// As is one that is removed instead.
+	emitted = nil
+	handle("/data/gone", fsnotify.Create)
+	handle("/data/gone", fsnotify.Remove)
+	if len(sent) != 2 || sent[0].(eventData).Op != eventOp(fsnotify.Create) || sent[1].(eventData).Op != eventOp(fsnotify.Remove) {
+		t.Fatalf("got %v, expected the create and then the remove", sent)
+	}
+}
+
+func TestWriteAtomic(t *testing.T) {
+	if !watcherReportsRenames {
+		t.Skip("fsnotify doesn't report renames on this platform")
+	}
+
+	dir := t.TempDir()
+	tmp := filepath.Join(dir, ".file.tmp")
+
+	p := startPort(t, "-atomic-window", "1s")
+	p.roundTrip(1, "add_watch "+dir, `"ok"`)
+
+	err := os.WriteFile(tmp, []byte("data"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Rename(tmp, filepath.Join(dir, "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.expect(0, `{"id":1,"op":"WriteAtomic","name":"`+dir+`/file","tmp":"`+tmp+`","root":"`+dir+`"}`)
+}
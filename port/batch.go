@@ -0,0 +1,69 @@
+package main
+
+import (
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// maxBatch is the most events that are sent in a single frame with
+// -batch.
+const maxBatch = 256
+
+// eventBatch collects encoded events to be sent as a single frame.
+type eventBatch struct {
+	s      *Server
+	events [][]byte
+	ops    []fsnotify.Op
+	size   int
+}
+
+// add adds msg to the batch, first sending what's already there if
+// msg wouldn't fit.
+func (b *eventBatch) add(msg any) {
+	data := b.s.encodeEvent(msg)
+
+	// Leave room for the brackets and commas, as well as for sequence
+	// numbers.
+	size := len(data) + 1 + maxSeqSize
+	if len(b.events) == maxBatch || b.size+size+1 > maxPayloadSize {
+		b.flush()
+	}
+
+	b.events = append(b.events, data)
+	b.ops = append(b.ops, messageOp(msg))
+	b.size += size
+}
+
+// flush sends the events in the batch, if there are any.
+func (b *eventBatch) flush() {
+	if len(b.events) == 0 {
+		return
+	}
+	b.s.sendEvents(b.events, b.ops)
+	b.events = nil
+	b.ops = nil
+	b.size = 0
+}
+
+// handleBatch handles first along with any other events that are
+// already waiting, sending them together. It reports false if the
+// watcher was closed.
+func (s *Server) handleBatch(h *handle, first fsnotify.Event) bool {
+	batch := eventBatch{s: s}
+	defer batch.flush()
+
+	s.handleEvent(h, first, time.Now(), batch.add)
+	for range maxBatch - 1 {
+		select {
+		case event, ok := <-h.watcher.Events():
+			if !ok {
+				return false
+			}
+			s.handleEvent(h, event, time.Now(), batch.add)
+		default:
+			return true
+		}
+	}
+	return true
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json/jsontext"
+	"encoding/json/v2"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// readFrames reads frames from r until n frames have been read and
+// then closes done.
+func readFrames(b *testing.B, r io.Reader, n int, done chan<- struct{}) {
+	defer close(done)
+
+	var size [4]byte
+	buf := make([]byte, 1<<16)
+	for range n {
+		_, err := io.ReadFull(r, size[:])
+		if err != nil {
+			b.Error(err)
+			return
+		}
+		_, err = io.ReadFull(r, buf[:binary.BigEndian.Uint32(size[:])])
+		if err != nil {
+			b.Error(err)
+			return
+		}
+	}
+}
+
+func startBenchServer(b *testing.B) (*mockWatcher, *io.PipeWriter, *io.PipeReader) {
+	return startBenchServerConfig(b, DefaultConfig)
+}
+
+func startBenchServerConfig(b *testing.B, config Config) (*mockWatcher, *io.PipeWriter, *io.PipeReader) {
+	ctx, cancel := context.WithCancel(b.Context())
+	watcher := newMockWatcher()
+	inr, inw := io.Pipe()
+	outr, outw := io.Pipe()
+
+	s := NewServer(watcher, cancel, config)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Run(ctx, inr, outw)
+	}()
+	b.Cleanup(func() {
+		inw.Close()
+		<-done
+		outr.Close()
+		watcher.Close()
+	})
+
+	return watcher, inw, outr
+}
+
+func BenchmarkEventThroughput(b *testing.B) {
+	watcher, _, out := startBenchServer(b)
+	event := fsnotify.Event{Name: "/data/some/fairly/typical/path.txt", Op: fsnotify.Write}
+
+	done := make(chan struct{})
+	go readFrames(b, out, b.N, done)
+
+	b.ResetTimer()
+	for range b.N {
+		watcher.Inject(event)
+	}
+	<-done
+}
+
+// BenchmarkEventThroughputStat is BenchmarkEventThroughput with
+// -stat-events for comparison.
+func BenchmarkEventThroughputStat(b *testing.B) {
+	path := filepath.Join(b.TempDir(), "path.txt")
+	err := os.WriteFile(path, []byte("data"), 0o644)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	config := DefaultConfig
+	config.StatEvents = true
+	watcher, _, out := startBenchServerConfig(b, config)
+	event := fsnotify.Event{Name: path, Op: fsnotify.Write}
+
+	done := make(chan struct{})
+	go readFrames(b, out, b.N, done)
+
+	b.ResetTimer()
+	for range b.N {
+		watcher.Inject(event)
+	}
+	<-done
+}
+
+// readEvents is like readFrames but reads until n events have been
+// read, whether or not they were batched, and returns the number of
+// frames that they were sent in.
+func readEvents(b *testing.B, r io.Reader, n int, done chan<- int) {
+	var size [4]byte
+	buf := make([]byte, 1<<16)
+	var frames int
+	defer func() { done <- frames }()
+
+	for n > 0 {
+		_, err := io.ReadFull(r, size[:])
+		if err != nil {
+			b.Error(err)
+			return
+		}
+		payload := buf[:binary.BigEndian.Uint32(size[:])]
+		_, err = io.ReadFull(r, payload)
+		if err != nil {
+			b.Error(err)
+			return
+		}
+		frames++
+
+		payload = payload[12:]
+		if payload[0] != '[' {
+			n--
+			continue
+		}
+		var events []jsontext.Value
+		err = json.Unmarshal(payload, &events)
+		if err != nil {
+			b.Error(err)
+			return
+		}
+		n -= len(events)
+	}
+}
+
+func benchmarkEventFlood(b *testing.B, config Config) {
+	watcher, _, out := startBenchServerConfig(b, config)
+	event := fsnotify.Event{Name: "/data/some/fairly/typical/path.txt", Op: fsnotify.Write}
+
+	done := make(chan int)
+	go readEvents(b, out, b.N, done)
+
+	b.ResetTimer()
+	for range b.N {
+		watcher.Inject(event)
+	}
+	frames := <-done
+	b.ReportMetric(float64(frames)/float64(b.N), "frames/op")
+}
+
+// BenchmarkEventFlood and BenchmarkEventFloodBatch compare sending a
+// flood of events with and without -batch. Each frame is a separate
+// write, and so a separate syscall when writing to a real pipe.
+func BenchmarkEventFlood(b *testing.B) {
+	benchmarkEventFlood(b, DefaultConfig)
+}
+
+func BenchmarkEventFloodBatch(b *testing.B) {
+	config := DefaultConfig
+	config.Batch = true
+	benchmarkEventFlood(b, config)
+}
+
+func BenchmarkCommandThroughput(b *testing.B) {
+	_, in, out := startBenchServer(b)
+
+	var cmd bytes.Buffer
+	sendData(&cmd, 1, "watch_list", frameFormat{crc: true})
+
+	done := make(chan struct{})
+	go readFrames(b, out, b.N, done)
+
+	b.ResetTimer()
+	for range b.N {
+		_, err := in.Write(cmd.Bytes())
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	<-done
+}
+
+func BenchmarkEncodeEvent(b *testing.B) {
+	data := eventData{
+		Name: "/data/some/fairly/typical/path.txt",
+		Op:   eventOp(fsnotify.Write),
+		Tag:  "job:42",
+	}
+
+	b.ReportAllocs()
+	for range b.N {
+		_, err := json.Marshal(data)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSendData(b *testing.B) {
+	payload := []byte(`{"Name":"/data/some/fairly/typical/path.txt","op":["write"]}`)
+
+	b.ReportAllocs()
+	b.SetBytes(int64(16 + len(payload)))
+	for range b.N {
+		sendData(io.Discard, 1, payload, frameFormat{crc: true})
+	}
+}
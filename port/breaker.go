@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"sync"
+	"time"
+)
+
+const (
+	breakerThreshold = 5
+	breakerCooldown  = 10 * time.Second
+)
+
+var errCircuitOpen = &codedError{
+	Code: "circuit_open",
+	Err:  errors.New("adding watches is temporarily disabled after repeated failures"),
+}
+
+// breaker is a circuit breaker for adding watches. After
+// breakerThreshold consecutive failures it opens, failing every
+// attempt immediately until breakerCooldown has passed. It then lets
+// a single attempt through, closing again if it succeeds.
+type breaker struct {
+	clock clock
+
+	m        sync.Mutex
+	failures int
+	openedAt time.Time
+	trial    bool
+}
+
+func (b *breaker) state() string {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	switch {
+	case b.failures < breakerThreshold:
+		return "closed"
+	case b.clock.Now().Sub(b.openedAt) < breakerCooldown:
+		return "open"
+	default:
+		return "half-open"
+	}
+}
+
+// allow reports whether an attempt may be made. If it returns true,
+// the outcome must be reported with done.
+func (b *breaker) allow() bool {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	if b.failures < breakerThreshold {
+		return true
+	}
+	if b.trial || b.clock.Now().Sub(b.openedAt) < breakerCooldown {
+		return false
+	}
+	b.trial = true
+	return true
+}
+
+func (b *breaker) done(err error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	b.trial = false
+	if !countsAsFailure(err) {
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.failures >= breakerThreshold {
+		b.openedAt = b.clock.Now()
+	}
+}
+
+// countsAsFailure reports whether err indicates a problem with the
+// system rather than with the path being watched. Mistakes by the
+// client, such as watching a path that doesn't exist, shouldn't trip
+// the breaker.
+func countsAsFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	return !errors.Is(err, fs.ErrNotExist) && !errors.Is(err, fs.ErrPermission) && !errors.Is(err, fs.ErrInvalid)
+}
+
+// breakerWatcher is a Watcher whose Add calls go through a breaker.
+type breakerWatcher struct {
+	Watcher
+	breaker *breaker
+}
+
+func (w breakerWatcher) Add(path string) error {
+	if !w.breaker.allow() {
+		return errCircuitOpen
+	}
+	err := w.Watcher.Add(path)
+	w.breaker.done(err)
+	return err
+}
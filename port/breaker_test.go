@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"strings"
+	"testing"
+	"time"
+)
+
+var errTooManyWatches = errors.New("too many watches")
+
+// breakerStep is something that happens to a breaker, after which it
+// should be in state.
+type breakerStep struct {
+	advance time.Duration
+
+	// do is "fail", "succeed", or "ignore" to make an attempt that
+	// has that outcome, "begin" to start an attempt without finishing
+	// it, "reject" to expect an attempt not to be allowed, or empty
+	// to only advance the clock.
+	do    string
+	state string
+}
+
+func TestBreaker(t *testing.T) {
+	fail := breakerStep{do: "fail", state: "closed"}
+	opened := []breakerStep{fail, fail, fail, fail, {do: "fail", state: "open"}}
+
+	tests := []struct {
+		name  string
+		steps []breakerStep
+	}{
+		{"Opens", append(opened, breakerStep{do: "reject", state: "open"})},
+		{"Resets", []breakerStep{fail, fail, fail, fail, {do: "succeed", state: "closed"}, fail, fail, fail, fail}},
+		{"IgnoresClientErrors", []breakerStep{fail, fail, fail, fail, {do: "ignore", state: "closed"}, fail, fail, fail, fail}},
+		{"HalfOpens", append(opened,
+			breakerStep{advance: breakerCooldown - time.Nanosecond, do: "reject", state: "open"},
+			breakerStep{advance: time.Nanosecond, state: "half-open"},
+			// Only one attempt is let through at a time.
+			breakerStep{do: "begin", state: "half-open"},
+			breakerStep{do: "reject", state: "half-open"},
+		)},
+		{"Closes", append(opened,
+			breakerStep{advance: breakerCooldown, do: "succeed", state: "closed"},
+			fail,
+		)},
+		{"Reopens", append(opened,
+			breakerStep{advance: breakerCooldown, do: "fail", state: "open"},
+			breakerStep{advance: breakerCooldown - time.Nanosecond, do: "reject", state: "open"},
+			breakerStep{advance: time.Nanosecond, do: "succeed", state: "closed"},
+		)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clock := newFakeClock()
+			b := breaker{clock: clock}
+			for i, step := range test.steps {
+				clock.Advance(step.advance)
+				switch step.do {
+				case "fail", "succeed", "ignore", "begin":
+					if !b.allow() {
+						t.Fatalf("step %v: attempt wasn't allowed", i)
+					}
+				}
+				switch step.do {
+				case "fail":
+					b.done(errTooManyWatches)
+				case "succeed":
+					b.done(nil)
+				case "ignore":
+					b.done(fs.ErrNotExist)
+				case "reject":
+					if b.allow() {
+						t.Fatalf("step %v: attempt was allowed", i)
+					}
+				}
+				if got := b.state(); got != step.state {
+					t.Fatalf("step %v: breaker is %v, expected %v", i, got, step.state)
+				}
+			}
+		})
+	}
+}
+
+func TestBreakerCapabilities(t *testing.T) {
+	ts := newTestServer(t)
+	clock := newFakeClock()
+	ts.server.breaker.clock = clock
+
+	circuit := func(id uint64, want string) {
+		t.Helper()
+		ts.send(id, "capabilities")
+		_, caps := ts.next()
+		if !strings.Contains(caps, `"circuit":"`+want+`"`) {
+			t.Fatalf("got %s, expected the circuit to be %v", caps, want)
+		}
+	}
+
+	circuit(1, "closed")
+	for range breakerThreshold {
+		ts.server.breaker.allow()
+		ts.server.breaker.done(errTooManyWatches)
+	}
+	circuit(2, "open")
+	ts.send(3, "add_watch /data")
+	ts.expect(3, `{"Err":"adding watches is temporarily disabled after repeated failures","code":"circuit_open"}`)
+
+	clock.Advance(breakerCooldown)
+	circuit(4, "half-open")
+	ts.send(5, "add_watch /data")
+	ts.expect(5, `"ok"`)
+	circuit(6, "closed")
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// broadcastFrame is a frame to be fanned out to clients. If to is
+// nil, the frame is sent to every client.
+type broadcastFrame struct {
+	id        uint64
+	data      []byte
+	to        *conn
+	droppable bool
+
+	// urgent frames, which are errors and warnings, are sent ahead of
+	// any other frames that are still queued. They are kept in order
+	// among themselves.
+	urgent bool
+
+	// ops, if set, holds the operation of each event in the frame, so
+	// that only clients subscribed to them are sent it. With -batch,
+	// events holds the events themselves so that the frame can be
+	// rebuilt without the others.
+	ops    []fsnotify.Op
+	events [][]byte
+
+	// seq is the sequence number of the last event in the frame, if
+	// the replay buffer is enabled.
+	seq uint64
+
+	// remove, if set, causes the connection to be deregistered once
+	// all frames before this one have been sent to it.
+	remove *conn
+
+	// setCompression, if set, causes every frame after this one to be
+	// compressed for to if compress is set, or not if it isn't.
+	setCompression bool
+	compress       bool
+
+	// ping, if set, is closed when the frame reaches the front of the
+	// queue.
+	ping chan struct{}
+}
+
+// broadcaster distributes frames to every registered connection. All
+// frames, including replies to individual connections, go through a
+// single channel so that their relative order is preserved. Each
+// connection's outbox applies the drop policy independently and
+// never blocks, so a slow client doesn't hold up the others.
+type broadcaster struct {
+	frames chan broadcastFrame
+	urgent chan broadcastFrame
+	quit   chan struct{}
+	done   chan struct{}
+
+	// format is the format that frames are encoded in.
+	format frameFormat
+
+	m     sync.Mutex
+	conns map[*conn]struct{}
+}
+
+func newBroadcaster(format frameFormat) *broadcaster {
+	return &broadcaster{
+		format: format,
+		frames: make(chan broadcastFrame, 256),
+		urgent: make(chan broadcastFrame, 16),
+		quit:   make(chan struct{}),
+		done:   make(chan struct{}),
+		conns:  make(map[*conn]struct{}),
+	}
+}
+
+func (b *broadcaster) add(c *conn) {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	b.conns[c] = struct{}{}
+}
+
+// all returns every registered connection.
+func (b *broadcaster) all() []*conn {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	return slices.Collect(maps.Keys(b.conns))
+}
+
+// remove deregisters c and waits until everything that was sent to it
+// before the call has been written.
+func (b *broadcaster) remove(c *conn) {
+	b.send(broadcastFrame{remove: c})
+	<-c.out.done
+}
+
+// skipThrough keeps c from being sent any events up to seq that
+// haven't been sent to it yet.
+func (b *broadcaster) skipThrough(c *conn, seq uint64) {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	c.replayedThrough = seq
+}
+
+func (b *broadcaster) send(f broadcastFrame) {
+	frames := b.frames
+	if f.urgent {
+		frames = b.urgent
+	}
+	select {
+	case frames <- f:
+	case <-b.quit:
+	}
+}
+
+// ping reports whether the broadcaster gets through the frames that
+// are already queued within timeout.
+func (b *broadcaster) ping(timeout time.Duration) bool {
+	ping := make(chan struct{})
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+
+	select {
+	case b.frames <- broadcastFrame{ping: ping}:
+	case <-b.quit:
+		return false
+	case <-t.C:
+		return false
+	}
+
+	select {
+	case <-ping:
+		return true
+	case <-t.C:
+		return false
+	}
+}
+
+func (b *broadcaster) run() {
+	defer close(b.done)
+
+	for {
+		// Urgent frames are checked for first, since select picks at
+		// random between channels that are both ready.
+		select {
+		case f := <-b.urgent:
+			b.fanOut(f)
+			continue
+		default:
+		}
+
+		select {
+		case f := <-b.urgent:
+			b.fanOut(f)
+		case f := <-b.frames:
+			b.fanOut(f)
+		case <-b.quit:
+			for {
+				select {
+				case f := <-b.urgent:
+					b.fanOut(f)
+					continue
+				default:
+				}
+				select {
+				case f := <-b.frames:
+					b.fanOut(f)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (b *broadcaster) fanOut(f broadcastFrame) {
+	if f.ping != nil {
+		close(f.ping)
+		return
+	}
+
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	if f.remove != nil {
+		if _, ok := b.conns[f.remove]; ok {
+			delete(b.conns, f.remove)
+			// remove waits for the frames to be written, which
+			// mustn't hold up the others.
+			f.remove.out.stop()
+		}
+		return
+	}
+
+	// Each frame is encoded at most once for clients with and without
+	// compression.
+	var frames [2][]byte
+	frame := func(c *conn) []byte {
+		i := 0
+		if c.compress {
+			i = 1
+		}
+		if frames[i] == nil {
+			frames[i] = encodeFrame(f.id, f.data, b.formatFor(c))
+		}
+		return frames[i]
+	}
+
+	if f.to != nil {
+		if _, ok := b.conns[f.to]; ok {
+			if f.setCompression {
+				f.to.out.putBarrier(frame(f.to))
+				f.to.compress = f.compress
+				return
+			}
+			f.to.out.put(frame(f.to), f.droppable, nil)
+		}
+		return
+	}
+	if f.urgent {
+		for c := range b.conns {
+			c.out.putUrgent(frame(c))
+		}
+		return
+	}
+
+	type filterKey struct {
+		mask     uint32
+		compress bool
+	}
+	type filteredFrame struct {
+		frame  []byte
+		events [][]byte
+	}
+	var filtered map[filterKey]filteredFrame
+	for c := range b.conns {
+		if f.seq != 0 && f.seq <= c.replayedThrough {
+			continue
+		}
+		if f.ops == nil || c.unsubscribed.Load() == 0 {
+			c.out.put(frame(c), f.droppable, f.eventList())
+			continue
+		}
+
+		// Clients with the same subscription get the same frame.
+		key := filterKey{mask: c.unsubscribed.Load(), compress: c.compress}
+		ff, ok := filtered[key]
+		if !ok {
+			ff.frame, ff.events = b.filter(f, c)
+			if filtered == nil {
+				filtered = make(map[filterKey]filteredFrame)
+			}
+			filtered[key] = ff
+		}
+		if ff.frame != nil {
+			c.out.put(ff.frame, f.droppable, ff.events)
+		}
+	}
+}
+
+// eventList returns the events in f, or nil if it isn't an event
+// frame. Only events sent live count, since they are the only ones
+// that are droppable.
+func (f broadcastFrame) eventList() [][]byte {
+	switch {
+	case !f.droppable:
+		return nil
+	case f.events != nil:
+		return f.events
+	default:
+		return [][]byte{f.data}
+	}
+}
+
+// filter returns f encoded with only the events that c is subscribed
+// to, along with the events themselves as returned by eventList, or
+// nil if there aren't any.
+func (b *broadcaster) filter(f broadcastFrame, c *conn) ([]byte, [][]byte) {
+	if f.events == nil {
+		if !c.wants(f.ops[0]) {
+			return nil, nil
+		}
+		return encodeFrame(f.id, f.data, b.formatFor(c)), f.eventList()
+	}
+
+	var events [][]byte
+	for i, data := range f.events {
+		if c.wants(f.ops[i]) {
+			events = append(events, data)
+		}
+	}
+	if events == nil {
+		return nil, nil
+	}
+	return encodeFrame(f.id, joinEvents(events), b.formatFor(c)), events
+}
+
+// formatFor returns the format of frames sent to c. b.m must be held.
+func (b *broadcaster) formatFor(c *conn) frameFormat {
+	f := b.format
+	f.lz4 = c.compress
+	return f
+}
+
+// setCompression sends "ok" to c in reply to id and then compresses
+// every frame sent to it after that if on is set, or stops compressing
+// them if it isn't.
+func (b *broadcaster) setCompression(c *conn, id uint64, on bool) {
+	b.send(broadcastFrame{id: id, data: []byte(ok), to: c, setCompression: true, compress: on})
+}
+
+// close stops the broadcaster after sending any frames that have
+// already been queued. Connections that are still registered are
+// closed.
+func (b *broadcaster) close() {
+	close(b.quit)
+	<-b.done
+
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	for c := range b.conns {
+		delete(b.conns, c)
+		c.out.close()
+	}
+}
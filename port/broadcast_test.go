@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"io"
+	"iter"
+	"net"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// stalledWriter blocks every write until release is closed.
+type stalledWriter struct {
+	release chan struct{}
+}
+
+func (w stalledWriter) Write(p []byte) (int, error) {
+	<-w.release
+	return len(p), nil
+}
+
+// TestStalledClient checks that a client that stops reading doesn't
+// hold up the others, whatever the drop policy.
+func TestStalledClient(t *testing.T) {
+	const events = 20
+
+	tests := []struct {
+		policy   dropPolicy
+		minDrops int64
+	}{
+		// Nothing is dropped, so everything is queued for the stalled
+		// client instead, since it's far below BlockMaxBytes.
+		{policyBlock, 0},
+		// At most one frame is being written, two are queued, and two
+		// wait for room. The rest are dropped without waiting for the
+		// hour-long timeout.
+		{policyDrop, events - 5},
+		// At most one frame is being written and two are queued.
+		{policyBuffer, events - 3},
+	}
+	for _, test := range tests {
+		t.Run(test.policy.String(), func(t *testing.T) {
+			release := make(chan struct{})
+			var drops atomic.Int64
+			stalled := &conn{out: newOutbox(stalledWriter{release}, test.policy, time.Hour, 2, func() { drops.Add(1) }, func(error) {})}
+			r, w := io.Pipe()
+			reading := &conn{out: newOutbox(w, test.policy, time.Hour, events, func() {}, func(error) {})}
+			go stalled.out.run()
+			go reading.out.run()
+
+			format := frameFormat{crc: true}
+			b := newBroadcaster(format)
+			b.add(stalled)
+			b.add(reading)
+			go b.run()
+			defer func() {
+				close(release)
+				b.close()
+				w.Close()
+			}()
+
+			received := make(chan uint64, events)
+			go func() {
+				defer close(received)
+				for id := range commands(r, format, nil) {
+					received <- id
+				}
+			}()
+
+			for i := range events {
+				b.send(broadcastFrame{id: uint64(i + 1), data: []byte(`{}`), droppable: true})
+			}
+			timeout := time.After(5 * time.Second)
+			for i := range events {
+				select {
+				case id := <-received:
+					if id != uint64(i+1) {
+						t.Fatalf("got frame %v, expected %v", id, i+1)
+					}
+				case <-timeout:
+					t.Fatalf("only got %v frames while the other client was stalled", i)
+				}
+			}
+
+			if got := drops.Load(); got < test.minDrops || (test.policy == policyBlock && got != 0) {
+				t.Fatalf("dropped %v frames for the stalled client, expected at least %v", got, test.minDrops)
+			}
+			if got := stalled.out.len(); test.policy == policyBlock && got < events-1 {
+				t.Fatalf("queued %v frames for the stalled client, expected at least %v", got, events-1)
+			}
+		})
+	}
+}
+
+// TestBlockMaxBytes checks that with policyBlock, a client that falls
+// too far behind fails instead of having frames queued for it without
+// limit.
+func TestBlockMaxBytes(t *testing.T) {
+	var errs []error
+	o := newOutbox(io.Discard, policyBlock, 0, 1, func() {}, func(err error) { errs = append(errs, err) })
+	o.maxBytes = 12
+	var lost []string
+	o.undelivered = func(events [][]byte) {
+		for _, event := range events {
+			lost = append(lost, string(event))
+		}
+	}
+
+	// The outbox isn't running yet, so nothing is written.
+	for _, event := range []string{"aaaaa", "bbbbbb", "cccccc", "dddddd"} {
+		o.put([]byte(event), true, [][]byte{[]byte(event)})
+	}
+	go o.run()
+	o.close()
+
+	if len(errs) != 1 || errs[0].Error() != "client fell more than 12 bytes behind" {
+		t.Fatalf("got errors %v, expected one", errs)
+	}
+	if want := []string{"aaaaa", "bbbbbb", "cccccc", "dddddd"}; !slices.Equal(lost, want) {
+		t.Fatalf("lost %q, expected %q", lost, want)
+	}
+}
+
+// TestServeDisconnect checks that clients that go away, whether by
+// resetting their connection or by the server shutting down while
+// they are connected, only end their own connection.
+func TestServeDisconnect(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	watcher := newMockWatcher()
+	defer watcher.Close()
+	s := NewServer(watcher, cancel, DefaultConfig)
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(ctx, l) }()
+
+	format := DefaultConfig.frameFormat()
+	dial := func() (*net.TCPConn, func(uint64, string) string) {
+		nc, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		next, stop := iter.Pull2(commands(nc, format, nil))
+		t.Cleanup(stop)
+
+		echo := func(id uint64, payload string) string {
+			t.Helper()
+			sendData(nc, id, "echo "+payload, format)
+			gotID, got, ok := next()
+			if !ok || gotID != id {
+				t.Fatalf("got frame %v (%v), expected the reply to %v", gotID, ok, id)
+			}
+			return got
+		}
+		return nc.(*net.TCPConn), echo
+	}
+
+	_, echoA := dial()
+	b, echoB := dial()
+	echoA(1, "a")
+	echoB(1, "b")
+
+	// Closing with a linger of zero resets the connection.
+	err = b.SetLinger(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Close()
+	if got := echoA(2, "still here"); got != "still here" {
+		t.Fatalf("got %q after the other client reset its connection", got)
+	}
+
+	cancel()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve didn't return after ctx was canceled")
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json/jsontext"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+const (
+	// maxBurstPaths is the most paths whose event rates are tracked
+	// for -burst-threshold at once.
+	maxBurstPaths = 4096
+
+	// defaultBurstWindow is the window that events are counted over if
+	// -burst-window isn't given.
+	defaultBurstWindow = time.Second
+)
+
+// opCounts counts events by operation, indexed like opNames. Events
+// with more than one operation are counted once for each.
+type opCounts [6]int
+
+func (c *opCounts) add(op fsnotify.Op) {
+	for i, n := range opNames {
+		if op.Has(n.op) {
+			c[i]++
+		}
+	}
+}
+
+// String describes the counts, such as "431 writes, 2 chmods".
+func (c *opCounts) String() string {
+	var parts []string
+	for i, n := range opNames {
+		if c[i] > 0 {
+			parts = append(parts, fmt.Sprintf("%v %vs", c[i], n.name))
+		}
+	}
+	if parts == nil {
+		return "no events"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// MarshalJSONTo encodes the counts as an object keyed by the names of
+// the operations, leaving out those without any events.
+func (c *opCounts) MarshalJSONTo(enc *jsontext.Encoder) error {
+	err := enc.WriteToken(jsontext.BeginObject)
+	if err != nil {
+		return err
+	}
+	for i, n := range opNames {
+		if c[i] == 0 {
+			continue
+		}
+		err = enc.WriteToken(jsontext.String(n.name))
+		if err != nil {
+			return err
+		}
+		err = enc.WriteToken(jsontext.Int(int64(c[i])))
+		if err != nil {
+			return err
+		}
+	}
+	return enc.WriteToken(jsontext.EndObject)
+}
+
+// burstData summarizes the events for a path that were suppressed
+// during a burst.
+type burstData struct {
+	Op      string    `json:"op"`
+	Name    string    `json:"name"`
+	Handle  uint64    `json:"handle,omitzero"`
+	NS      string    `json:"ns,omitzero"`
+	Summary bool      `json:"summary"`
+	Events  *opCounts `json:"events"`
+
+	// WindowMS is how long the events were counted over. Final is
+	// true for the last summary of a burst, after which events for the
+	// path are delivered normally again.
+	WindowMS int64  `json:"window_ms"`
+	Final    bool   `json:"final,omitzero"`
+	Message  string `json:"message"`
+
+	Time   string `json:"time,omitzero"`
+	MonoNS int64  `json:"mono_ns,omitzero"`
+}
+
+// burstState is the state of a single path. count is the number of
+// events since start. Once the path is hot, they are also counted by
+// operation in events, and summarized every window.
+type burstState struct {
+	start  time.Time
+	count  int
+	hot    bool
+	events opCounts
+	timer  timer
+}
+
+// bursts replaces the events for paths that get more than threshold
+// of them within a window with periodic summaries. The first threshold
+// events are delivered normally. A summary is sent every window for as
+// long as the path gets more than threshold, followed by a final one,
+// after which its events are delivered normally again.
+type bursts struct {
+	clock     clock
+	threshold int
+	window    time.Duration
+
+	// summarize is called with each summary, whose Name, Handle, and
+	// NS are left for it to fill in.
+	summarize func(path string, data burstData)
+
+	m     sync.Mutex
+	paths map[string]*burstState
+}
+
+// handle reports whether event should be suppressed because its path
+// is in the middle of a burst.
+func (b *bursts) handle(event fsnotify.Event) bool {
+	if b.threshold <= 0 {
+		return false
+	}
+
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	now := b.clock.Now()
+	path := filepath.Clean(event.Name)
+	state, ok := b.paths[path]
+	if !ok || !state.hot && now.Sub(state.start) >= b.window {
+		if !ok && !b.makeRoom(now) {
+			// It's better to deliver too many events than to lose
+			// track of one.
+			return false
+		}
+		if b.paths == nil {
+			b.paths = make(map[string]*burstState)
+		}
+		state = &burstState{start: now}
+		b.paths[path] = state
+	}
+
+	state.count++
+	if state.hot {
+		state.events.add(event.Op)
+		return true
+	}
+	if state.count <= b.threshold {
+		return false
+	}
+
+	state.hot = true
+	state.start, state.count = now, 1
+	state.events.add(event.Op)
+	state.timer = b.clock.AfterFunc(b.window, func() { b.tick(path, state) })
+	return true
+}
+
+// tick sends a summary for a hot path at the end of a window, letting
+// it cool down if it got few enough events.
+func (b *bursts) tick(path string, state *burstState) {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	if b.paths[path] != state {
+		return
+	}
+
+	events := state.events
+	data := burstData{
+		Op:       "Burst",
+		Summary:  true,
+		Events:   &events,
+		WindowMS: b.window.Milliseconds(),
+		Final:    state.count <= b.threshold,
+		Message:  fmt.Sprintf("%v: %v in the last %v", path, &events, b.window),
+	}
+	b.summarize(path, data)
+
+	if data.Final {
+		delete(b.paths, path)
+		return
+	}
+	state.start, state.count, state.events = b.clock.Now(), 0, opCounts{}
+	state.timer = b.clock.AfterFunc(b.window, func() { b.tick(path, state) })
+}
+
+// makeRoom forgets paths that aren't hot and haven't had an event
+// within the window if there are too many, reporting whether there is
+// room for another. b.m must be held.
+func (b *bursts) makeRoom(now time.Time) bool {
+	if len(b.paths) < maxBurstPaths {
+		return true
+	}
+	for path, state := range b.paths {
+		if !state.hot && now.Sub(state.start) >= b.window {
+			delete(b.paths, path)
+		}
+	}
+	return len(b.paths) < maxBurstPaths
+}
+
+// dropAll forgets every path without sending summaries.
+func (b *bursts) dropAll() {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	for _, state := range b.paths {
+		if state.timer != nil {
+			state.timer.Stop()
+		}
+	}
+	b.paths = nil
+}
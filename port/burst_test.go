@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json/v2"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func TestBursts(t *testing.T) {
+	clock := newFakeClock()
+	var out []string
+	b := bursts{
+		clock:     clock,
+		threshold: 3,
+		window:    time.Second,
+		summarize: func(path string, data burstData) {
+			data.Name = path
+			encoded, err := json.Marshal(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out = append(out, string(encoded))
+		},
+	}
+	write := fsnotify.Event{Name: "/data/file", Op: fsnotify.Write}
+	chmod := fsnotify.Event{Name: "/data/file", Op: fsnotify.Chmod}
+	expect := func(want ...string) {
+		t.Helper()
+		if len(out) != len(want) {
+			t.Fatalf("got %q, expected %q", out, want)
+		}
+		for i := range want {
+			if out[i] != want[i] {
+				t.Fatalf("got %q, expected %q", out, want)
+			}
+		}
+		out = nil
+	}
+
+	// The first few events are delivered, and so are events for other
+	// paths.
+	for i := range 3 {
+		if b.handle(write) {
+			t.Fatalf("event %v was suppressed", i+1)
+		}
+	}
+	for range 5 {
+		b.handle(write)
+	}
+	b.handle(chmod)
+	if b.handle(fsnotify.Event{Name: "/data/other", Op: fsnotify.Write}) {
+		t.Fatal("an event for another path was suppressed")
+	}
+
+	clock.Advance(time.Second)
+	expect(`{"op":"Burst","name":"/data/file","summary":true,"events":{"write":5,"chmod":1},"window_ms":1000,"message":"/data/file: 5 writes, 1 chmods in the last 1s"}`)
+
+	// Once the rate drops, there is a final summary, and then events
+	// are delivered again.
+	if !b.handle(write) {
+		t.Fatal("an event in a burst was delivered")
+	}
+	clock.Advance(time.Second)
+	expect(`{"op":"Burst","name":"/data/file","summary":true,"events":{"write":1},"window_ms":1000,"final":true,"message":"/data/file: 1 writes in the last 1s"}`)
+	if _, ok := b.paths["/data/file"]; ok {
+		t.Fatal("still tracking the path after the burst ended")
+	}
+	if b.handle(write) {
+		t.Fatal("an event was suppressed after the burst ended")
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// completedHistory is how many completed request IDs each connection
+// remembers so that cancelling one of them can be told apart from
+// cancelling an ID that was never used.
+const completedHistory = 1024
+
+// cancelled is the cause given when a request is cancelled by the
+// client.
+type cancelled struct {
+	// keep is true if the partial progress of the request should be
+	// kept instead of rolled back.
+	keep bool
+}
+
+func (*cancelled) Error() string { return "cancelled" }
+
+// rollback reports whether ctx was cancelled by the client asking for
+// partial progress to be undone. Progress is also undone if the
+// connection went away.
+func rollback(ctx context.Context) bool {
+	var cause *cancelled
+	if errors.As(context.Cause(ctx), &cause) {
+		return !cause.keep
+	}
+	return ctx.Err() != nil
+}
+
+// errCommandTimeout is the cause given when a request runs for longer
+// than -command-timeout.
+var errCommandTimeout = &codedError{Code: "timeout", Err: errors.New("request timed out; see -command-timeout")}
+
+// defaultCommandTimeout is how long requests can run for in the
+// background if -command-timeout isn't given.
+const defaultCommandTimeout = 30 * time.Second
+
+// cancelledError returns the error that a request replies with when
+// ctx is cancelled, either by the client or because it timed out.
+func cancelledError(ctx context.Context, details map[string]any) error {
+	if context.Cause(ctx) == errCommandTimeout {
+		return &codedError{Code: errCommandTimeout.Code, Err: errCommandTimeout.Err, Details: details}
+	}
+	return &codedError{Code: "cancelled", Err: errors.New("request was cancelled"), Details: details}
+}
+
+// inflight tracks the requests of a connection that run in the
+// background.
+type inflight struct {
+	wg sync.WaitGroup
+
+	// timeout, if positive, is how long requests can run for before
+	// they are cancelled.
+	timeout time.Duration
+
+	m         sync.Mutex
+	cancels   map[uint64]context.CancelCauseFunc
+	completed []uint64
+
+	// finished, if not nil, is closed when the next request returns.
+	finished chan struct{}
+}
+
+// start runs f in the background, making it possible to cancel it
+// using id until it returns. If it runs for longer than the timeout,
+// it is cancelled with errCommandTimeout as the cause.
+func (in *inflight) start(ctx context.Context, id uint64, f func(context.Context)) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	stop := func() {}
+	if in.timeout > 0 {
+		ctx, stop = context.WithTimeoutCause(ctx, in.timeout, errCommandTimeout)
+	}
+
+	in.m.Lock()
+	if in.cancels == nil {
+		in.cancels = make(map[uint64]context.CancelCauseFunc)
+	}
+	in.cancels[id] = cancel
+	in.m.Unlock()
+
+	in.wg.Go(func() {
+		defer cancel(nil)
+		defer stop()
+		f(ctx)
+
+		in.m.Lock()
+		defer in.m.Unlock()
+
+		delete(in.cancels, id)
+		if in.finished != nil {
+			close(in.finished)
+			in.finished = nil
+		}
+		if len(in.completed) == completedHistory {
+			in.completed = in.completed[1:]
+		}
+		in.completed = append(in.completed, id)
+	})
+}
+
+func (in *inflight) cancel(id uint64, keep bool) error {
+	in.m.Lock()
+	defer in.m.Unlock()
+
+	cancel, ok := in.cancels[id]
+	if ok {
+		cancel(&cancelled{keep: keep})
+		return nil
+	}
+
+	for _, completed := range in.completed {
+		if completed == id {
+			return &codedError{Code: "already_completed", Err: fmt.Errorf("request %v has already completed", id)}
+		}
+	}
+	return &codedError{Code: "unknown_request", Err: fmt.Errorf("no request with id %v", id)}
+}
+
+// idle waits until there are no requests running other than those
+// with the IDs in except, or until ctx is done.
+func (in *inflight) idle(ctx context.Context, except ...uint64) error {
+	for {
+		in.m.Lock()
+		running := len(in.cancels)
+		for _, id := range except {
+			if _, ok := in.cancels[id]; ok {
+				running--
+			}
+		}
+		if running == 0 {
+			in.m.Unlock()
+			return nil
+		}
+		if in.finished == nil {
+			in.finished = make(chan struct{})
+		}
+		finished := in.finished
+		in.m.Unlock()
+
+		select {
+		case <-finished:
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		}
+	}
+}
+
+// wait waits for every background request to return.
+func (in *inflight) wait() {
+	in.wg.Wait()
+}
+
+// parseCancel parses the argument of the cancel command, which is a
+// request ID optionally followed by "keep" to keep partial progress.
+func parseCancel(arg string) (id uint64, keep bool, err error) {
+	arg, flag, _ := strings.Cut(arg, " ")
+	switch flag {
+	case "", "rollback":
+	case "keep":
+		keep = true
+	default:
+		return 0, false, fmt.Errorf("unknown cancel argument: %q", flag)
+	}
+
+	id, err = strconv.ParseUint(arg, 10, 64)
+	return id, keep, err
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestInflightTimeout(t *testing.T) {
+	in := inflight{timeout: 10 * time.Millisecond}
+
+	codes := make(chan string, 2)
+	run := func(ctx context.Context) {
+		<-ctx.Done()
+		var coded *codedError
+		if errors.As(cancelledError(ctx, nil), &coded) {
+			codes <- coded.Code
+		}
+	}
+	in.start(t.Context(), 1, run)
+	if code := <-codes; code != "timeout" {
+		t.Fatalf("got code %q for a request that timed out, expected timeout", code)
+	}
+
+	in.timeout = time.Hour
+	in.start(t.Context(), 2, run)
+	err := in.cancel(2, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := <-codes; code != "cancelled" {
+		t.Fatalf("got code %q for a cancelled request, expected cancelled", code)
+	}
+	in.wait()
+}
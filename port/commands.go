@@ -0,0 +1,1259 @@
+package main
+
+import (
+	"context"
+	"encoding/json/v2"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// request is a single command from a client.
+type request struct {
+	// ctx is canceled when the client disconnects.
+	ctx context.Context
+	c   *conn
+	id  uint64
+	arg string
+
+	// ns is the namespace given with --ns, if any.
+	ns string
+}
+
+// commandArg describes an argument of a command for the help command.
+type commandArg struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Required bool   `json:"required,omitzero"`
+}
+
+// command is a command that clients can send. The exported fields are
+// reported by the help command.
+type command struct {
+	Name string       `json:"name"`
+	Args []commandArg `json:"args"`
+
+	// Object is true if the arguments can be given as a JSON object
+	// instead of as the bare path. Otherwise, they are separated by
+	// spaces in the order listed.
+	Object      bool   `json:"object,omitzero"`
+	Description string `json:"description"`
+
+	// run handles the command. If it returns an error, the error is
+	// sent to the client. Otherwise, the reply is sent, or "ok" if it
+	// is nil.
+	run func(s *Server, req request) (any, error)
+}
+
+// rawReply is a reply that is sent as is instead of as JSON.
+type rawReply []byte
+
+// asyncReply is returned by commands that send their reply
+// themselves.
+type asyncReply struct{}
+
+var (
+	argPath   = commandArg{Name: "path", Type: "string", Required: true}
+	argHandle = commandArg{Name: "handle", Type: "integer"}
+	argTag    = commandArg{Name: "tag", Type: "string"}
+	argSettle = commandArg{Name: "settle_ms", Type: "integer"}
+	argChmod  = commandArg{Name: "ignore_chmod", Type: "boolean"}
+	argHidden = commandArg{Name: "ignore_hidden", Type: "boolean"}
+	argDirs   = commandArg{Name: "dirs_only", Type: "boolean"}
+	argHash   = commandArg{Name: "hash", Type: "string"}
+	argDedup  = commandArg{Name: "hash_dedup", Type: "boolean"}
+	argOps    = commandArg{Name: "ops", Type: "array of operations"}
+	argSniff  = commandArg{Name: "sniff", Type: "boolean"}
+	argExists = commandArg{Name: "emit_existing", Type: "boolean"}
+)
+
+// commandList is every command in the order that they are listed by
+// help, and commandTable indexes them by name. They are set up in init
+// because help refers to them.
+var (
+	commandList  []*command
+	commandTable map[string]*command
+)
+
+func init() {
+	commandList = []*command{
+		{
+			Name:        "add_watch",
+			Args:        []commandArg{argPath, argHandle, argTag, {Name: "stat", Type: "boolean"}, argSettle, argChmod, argHidden, argDirs, argOps, argHash, argDedup, argSniff, argExists},
+			Object:      true,
+			Description: "Watch a file or directory.",
+			run:         (*Server).cmdAddWatch,
+		},
+		{
+			Name:        "watch_fd",
+			Args:        []commandArg{{Name: "fd", Type: "integer", Required: true}, argHandle, argTag},
+			Object:      true,
+			Description: "Watch the file that the port has open as a file descriptor, returning its path. Linux and macOS only.",
+			run:         (*Server).cmdWatchFD,
+		},
+		{
+			Name: "add_watch_recursive",
+			Args: []commandArg{
+				argPath,
+				argHandle,
+				argTag,
+				{Name: "exclude", Type: "array of globs"},
+				{Name: "max_depth", Type: "integer"},
+				{Name: "stat", Type: "boolean"},
+				argSettle,
+				argChmod,
+				argHidden,
+				argDirs,
+				argOps,
+				argHash,
+				argDedup,
+				argSniff,
+				argExists,
+			},
+			Object:      true,
+			Description: "Watch a directory and every directory under it, including ones created later.",
+			run:         (*Server).cmdAddWatchRecursive,
+		},
+		{
+			Name: "add_watch_tree_filtered",
+			Args: []commandArg{
+				argPath,
+				argHandle,
+				argTag,
+				{Name: "include", Type: "array of globs"},
+				{Name: "exclude", Type: "array of globs"},
+				{Name: "max_depth", Type: "integer"},
+				argExists,
+			},
+			Object:      true,
+			Description: "Watch the directories under a directory that match an include glob and no exclude glob, including ones created later, like add_watch_recursive. Globs support ** and are matched against paths relative to the directory. Also accepts <path> --include <glob> --exclude <glob>, with each flag repeated as needed.",
+			run:         (*Server).cmdAddWatchTreeFiltered,
+		},
+		{
+			Name: "watch_tree",
+			Args: []commandArg{
+				argPath,
+				argHandle,
+				argTag,
+				{Name: "exclude", Type: "array of globs"},
+				{Name: "max_depth", Type: "integer"},
+				{Name: "stat", Type: "boolean"},
+				argSettle,
+				argChmod,
+				argHidden,
+				argDirs,
+				argOps,
+				argHash,
+				argDedup,
+				argSniff,
+			},
+			Object:      true,
+			Description: "Watch a directory and every directory under it as separate watches, without following later changes.",
+			run:         (*Server).cmdWatchTree,
+		},
+		{
+			Name:        "prune_tree",
+			Args:        []commandArg{argPath, argHandle},
+			Object:      true,
+			Description: "Stop watching a path and every watched path under it.",
+			run:         (*Server).cmdPruneTree,
+		},
+		{
+			Name:        "watch_tree_status",
+			Args:        []commandArg{argPath, argHandle},
+			Object:      true,
+			Description: "Report which parts of a recursive watch are actually being watched.",
+			run:         (*Server).cmdWatchTreeStatus,
+		},
+		{
+			Name:        "add_sticky",
+			Args:        []commandArg{argPath, argHandle, argTag},
+			Object:      true,
+			Description: "Watch a path that survives being deleted and recreated, even if it doesn't exist yet.",
+			run:         (*Server).cmdAddSticky,
+		},
+		{
+			Name:        "tail",
+			Args:        []commandArg{argPath, argHandle, argTag, {Name: "chunk_size", Type: "integer"}},
+			Object:      true,
+			Description: "Watch a file like add_sticky and send whatever is appended to it.",
+			run:         (*Server).cmdTail,
+		},
+		{
+			Name:        "remove",
+			Args:        []commandArg{argPath, argHandle},
+			Object:      true,
+			Description: "Stop watching a path.",
+			run:         (*Server).cmdRemove,
+		},
+		{
+			Name:        "remove_all",
+			Args:        []commandArg{argHandle},
+			Description: "Stop watching every path.",
+			run:         (*Server).cmdRemoveAll,
+		},
+		{
+			Name:        "remove_matching",
+			Args:        []commandArg{{Name: "path", Type: "glob", Required: true}, argHandle},
+			Object:      true,
+			Description: "Stop watching every path that matches a glob, returning the removed paths.",
+			run:         (*Server).cmdRemoveMatching,
+		},
+		{
+			Name:        "watch_list",
+			Args:        []commandArg{argHandle},
+			Description: "List the watched paths.",
+			run:         (*Server).cmdWatchList,
+		},
+		{
+			Name:        "watch_count",
+			Args:        []commandArg{argHandle},
+			Description: "Count the watched paths.",
+			run:         (*Server).cmdWatchCount,
+		},
+		{
+			Name:        "gc",
+			Args:        []commandArg{argHandle, {Name: "dry_run", Type: "flag"}},
+			Description: "Remove watches on paths that no longer exist, returning the removed paths.",
+			run:         (*Server).cmdGC,
+		},
+		{
+			Name:        "export_watches",
+			Args:        []commandArg{argHandle},
+			Description: "Describe every watch in a form accepted by import_watches.",
+			run:         (*Server).cmdExportWatches,
+		},
+		{
+			Name:        "import_watches",
+			Args:        []commandArg{{Name: "document", Type: "object", Required: true}},
+			Description: "Add the watches described by export_watches that don't already exist.",
+			run:         (*Server).cmdImportWatches,
+		},
+		{
+			Name:        "create_watcher",
+			Args:        []commandArg{},
+			Description: "Create an additional watcher, returning its handle.",
+			run:         (*Server).cmdCreateWatcher,
+		},
+		{
+			Name:        "create_namespace",
+			Args:        []commandArg{{Name: "name", Type: "string", Required: true}},
+			Description: "Create a watcher that commands can select with --ns <name> in place of a handle, and reply with its handle.",
+			run:         (*Server).cmdCreateNamespace,
+		},
+		{
+			Name:        "list_namespaces",
+			Description: "List the names of every namespace.",
+			run:         (*Server).cmdListNamespaces,
+		},
+		{
+			Name:        "destroy_watcher",
+			Args:        []commandArg{{Name: "handle", Type: "integer", Required: true}},
+			Description: "Close a watcher created with create_watcher.",
+			run:         (*Server).cmdDestroyWatcher,
+		},
+		{
+			Name:        "reopen",
+			Args:        []commandArg{argHandle},
+			Description: "Replace a watcher with a new one watching the same paths.",
+			run:         (*Server).cmdReopen,
+		},
+		{
+			Name:        "reset",
+			Args:        []commandArg{},
+			Description: "Close every watcher and discard all state, as if the port had been restarted.",
+			run:         (*Server).cmdReset,
+		},
+		{
+			Name:        "set_tag",
+			Args:        []commandArg{argPath, argHandle, argTag},
+			Object:      true,
+			Description: "Change the tag included in events for a watch.",
+			run:         (*Server).cmdSetTag,
+		},
+		{
+			Name:        "set_ops",
+			Args:        []commandArg{argPath, argHandle, {Name: "ops", Type: "array of operations", Required: true}},
+			Object:      true,
+			Description: "Change which operations events are delivered for by a watch, replying with them. The bare form is the path followed by a comma-separated list, such as \"/tmp create,remove\".",
+			run:         (*Server).cmdSetOps,
+		},
+		{
+			Name: "set_debounce",
+			Args: []commandArg{
+				{Name: "pattern", Type: "glob", Required: true},
+				{Name: "quiet", Type: "duration", Required: true},
+				{Name: "max_hold", Type: "duration"},
+			},
+			Description: "Coalesce bursts of events for matching paths.",
+			run:         (*Server).cmdSetDebounce,
+		},
+		{
+			Name:        "set_filter_vcs",
+			Args:        []commandArg{{Name: "enabled", Type: "boolean", Required: true}},
+			Description: "Turn dropping events for paths in version control directories such as .git on or off.",
+			run:         (*Server).cmdSetFilterVCS,
+		},
+		{
+			Name:        "set_ext_filter",
+			Args:        []commandArg{{Name: "extensions", Type: "comma-separated list"}},
+			Description: "Only deliver events for files with one of the given extensions, and for directories. An empty list delivers events for every file.",
+			run:         (*Server).cmdSetExtFilter,
+		},
+		{
+			Name:        "set_rate_limit",
+			Args:        []commandArg{argPath, {Name: "rate", Type: "number", Required: true}, argHandle},
+			Object:      true,
+			Description: "Limit the number of events per second delivered for a watch.",
+			run:         (*Server).cmdSetRateLimit,
+		},
+		{
+			Name:        "pause_path",
+			Args:        []commandArg{argPath, argHandle, {Name: "coalesce", Type: "boolean"}},
+			Object:      true,
+			Description: "Stop delivering events for a watch until it is resumed.",
+			run:         (*Server).cmdPausePath,
+		},
+		{
+			Name:        "resume_path",
+			Args:        []commandArg{argPath, argHandle},
+			Object:      true,
+			Description: "Resume delivering events for a paused watch.",
+			run:         (*Server).cmdResumePath,
+		},
+		{
+			Name:        "scan",
+			Args:        []commandArg{argPath, argHandle, {Name: "depth", Type: "integer"}},
+			Object:      true,
+			Description: "Send a synthetic Create event for everything in a directory.",
+			run:         (*Server).cmdScan,
+		},
+		{
+			Name:        "cancel",
+			Args:        []commandArg{{Name: "id", Type: "integer", Required: true}, {Name: "keep", Type: "flag"}},
+			Description: "Cancel a request that is still running.",
+			run:         (*Server).cmdCancel,
+		},
+		{
+			Name:        "ping",
+			Args:        []commandArg{},
+			Description: "Do nothing, to check that the port is responding. Allowed while draining.",
+			run:         (*Server).cmdPing,
+		},
+		{
+			Name:        "drain",
+			Args:        []commandArg{},
+			Description: "Stop accepting commands other than shutdown and ping, replying once every request running in the background has finished. Events are still sent.",
+			run:         (*Server).cmdDrain,
+		},
+		{
+			Name:        "shutdown",
+			Args:        []commandArg{},
+			Description: "Stop the port once everything that has been sent, including the reply, has been written.",
+			run:         (*Server).cmdShutdown,
+		},
+		{
+			Name:        "checkpoint",
+			Args:        []commandArg{{Name: "seq", Type: "integer", Required: true}},
+			Description: "Tell the port which event was processed last for use by replay. There is no reply unless the argument is invalid.",
+			run:         (*Server).cmdCheckpoint,
+		},
+		{
+			Name:        "replay",
+			Args:        []commandArg{{Name: "seq", Type: "integer"}},
+			Description: "Send every buffered event after a sequence number, or after the last checkpoint. Requires -replay-buffer.",
+			run:         (*Server).cmdReplay,
+		},
+		{
+			Name:        "watch_since",
+			Args:        []commandArg{{Name: "seq", Type: "integer", Required: true}},
+			Description: "Send every buffered event after a sequence number, skipping any of them that are still waiting to be sent live, so that each is received once before any newer events. Requires -replay-buffer.",
+			run:         (*Server).cmdWatchSince,
+		},
+		{
+			Name:        "dead_letter_replay",
+			Args:        []commandArg{},
+			Description: "Send every event in the dead letter file and then empty it. Requires -dead-letter.",
+			run:         (*Server).cmdDeadLetterReplay,
+		},
+		{
+			Name:        "record",
+			Args:        []commandArg{argPath},
+			Description: "Record every event to a file for use with -playback.",
+			run:         (*Server).cmdRecord,
+		},
+		{
+			Name:        "stop_record",
+			Args:        []commandArg{},
+			Description: "Stop recording events.",
+			run:         (*Server).cmdStopRecord,
+		},
+		{
+			Name:        "journal_start",
+			Args:        []commandArg{argPath, {Name: "fsync", Type: "string"}},
+			Object:      true,
+			Description: "Append every event to a journal that can be replayed after a restart.",
+			run:         (*Server).cmdJournalStart,
+		},
+		{
+			Name:        "journal_stop",
+			Args:        []commandArg{},
+			Description: "Stop appending events to the journal.",
+			run:         (*Server).cmdJournalStop,
+		},
+		{
+			Name:        "journal_replay",
+			Args:        []commandArg{argPath},
+			Description: "Send every event in a journal.",
+			run:         (*Server).cmdJournalReplay,
+		},
+		{
+			Name:        "watch_stats",
+			Args:        []commandArg{},
+			Description: "Report queueing statistics for the connection.",
+			run:         (*Server).cmdWatchStats,
+		},
+		{
+			Name:        "subscribe",
+			Args:        []commandArg{{Name: "ops", Type: "comma-separated operations, or *", Required: true}},
+			Description: "Only send the connection events with one of the given operations, on top of any per-watch filters, or every event again with *. Replies with the operations subscribed to.",
+			run:         (*Server).cmdSubscribe,
+		},
+		{
+			Name:        "unsubscribe",
+			Args:        []commandArg{{Name: "ops", Type: "comma-separated operations, or *", Required: true}},
+			Description: "Stop sending the connection events with the given operations. Replies with the operations still subscribed to.",
+			run:         (*Server).cmdUnsubscribe,
+		},
+		{
+			Name:        "compress",
+			Args:        []commandArg{{Name: "algorithm", Type: "string", Required: true}},
+			Description: "Compress the payloads of every frame sent to this connection after the reply with the given algorithm, which must be listed under \"compression\" by capabilities, or stop compressing them with none.",
+			run:         (*Server).cmdCompress,
+		},
+		{
+			Name:        "top_paths",
+			Args:        []commandArg{{Name: "n", Type: "integer"}},
+			Description: "List the paths that the most events have been received for, with the number of events and the operation of the last one. Defaults to 10 paths.",
+			run:         (*Server).cmdTopPaths,
+		},
+		{
+			Name:        "echo",
+			Args:        []commandArg{{Name: "payload", Type: "string"}},
+			Description: "Reply with the payload unchanged.",
+			run:         (*Server).cmdEcho,
+		},
+		{
+			Name:        "echo_event",
+			Args:        []commandArg{{Name: "payload", Type: "string"}},
+			Description: "Send the payload unchanged as an event.",
+			run:         (*Server).cmdEchoEvent,
+		},
+		{
+			Name:        "inotify_info",
+			Args:        []commandArg{},
+			Description: "Report the kernel's inotify limits and their usage. Linux only.",
+			run:         (*Server).cmdInotifyInfo,
+		},
+		{
+			Name:        "watch_limit_info",
+			Args:        []commandArg{},
+			Description: "Report the system's limit on the number of watches.",
+			run:         (*Server).cmdWatchLimitInfo,
+		},
+		{
+			Name:        "capabilities",
+			Args:        []commandArg{},
+			Description: "Report the optional features that are supported and available.",
+			run:         (*Server).cmdCapabilities,
+		},
+		{
+			Name:        "list_ops",
+			Args:        []commandArg{},
+			Description: "List the names of the operations that events can have along with their bits in -legacy-ops bitmasks.",
+			run:         (*Server).cmdListOps,
+		},
+		{
+			Name:        "info",
+			Args:        []commandArg{},
+			Description: "Describe the environment that the port is running in.",
+			run:         (*Server).cmdInfo,
+		},
+		{
+			Name:        "uptime",
+			Args:        []commandArg{},
+			Description: "Report when the process started and how long it has been running.",
+			run:         (*Server).cmdUptime,
+		},
+		{
+			Name:        "memory_stats",
+			Args:        []commandArg{},
+			Description: "Report the Go runtime's memory statistics. This briefly pauses the port, so avoid polling it frequently.",
+			run:         (*Server).cmdMemoryStats,
+		},
+		{
+			Name:        "counters",
+			Args:        []commandArg{{Name: "reset", Type: "flag"}},
+			Description: "Report how many events were dropped and why.",
+			run:         (*Server).cmdCounters,
+		},
+		{
+			Name:        "help",
+			Args:        []commandArg{},
+			Description: "List every command.",
+			run:         (*Server).cmdHelp,
+		},
+	}
+
+	commandTable = make(map[string]*command, len(commandList))
+	for _, cmd := range commandList {
+		commandTable[cmd.Name] = cmd
+	}
+}
+
+// watchRequest parses the arguments of a command that operates on a
+// single watch and looks up the handle that it refers to.
+func (s *Server) watchRequest(req request) (watchOptions, *handle, error) {
+	opts, err := parseWatchOptions(req.arg)
+	if err != nil {
+		return opts, nil, err
+	}
+	h, err := s.requestHandle(req, opts.Handle)
+	return opts, h, err
+}
+
+// handleRequest looks up the handle given as the argument of a
+// command.
+func (s *Server) handleRequest(req request) (*handle, error) {
+	id, err := parseHandle(req.arg)
+	if err != nil {
+		return nil, err
+	}
+	return s.requestHandle(req, id)
+}
+
+func (s *Server) cmdAddWatch(req request) (any, error) {
+	opts, h, err := s.watchRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	warning, err := s.addWatch(req.c, h, opts)
+	if err != nil {
+		return nil, err
+	}
+	if opts.EmitExisting {
+		c, id := req.c, req.id
+		c.inflight.start(req.ctx, id, func(ctx context.Context) {
+			count, err := s.emitExisting(ctx, h, opts.Path, dirEntries(opts.Path))
+			if err != nil {
+				c.sendError(id, err)
+				return
+			}
+			c.sendMessage(id, okData{OK: true, Warning: warning, Existing: &count})
+		})
+		return asyncReply{}, nil
+	}
+	if warning != "" {
+		return okData{OK: true, Warning: warning}, nil
+	}
+	return nil, nil
+}
+
+// addWatch adds a watch on behalf of c, returning a warning if the
+// watch was added but might not work as expected.
+func (s *Server) addWatch(c *conn, h *handle, opts watchOptions) (warning string, err error) {
+	err = s.checkAllowed(opts.Path)
+	if err != nil {
+		return "", err
+	}
+	err = c.reserveWatch(s.config.MaxWatches)
+	if err != nil {
+		return "", err
+	}
+	err = h.watcher.Add(opts.Path)
+	if err != nil {
+		c.releaseWatches(1)
+		return "", err
+	}
+	h.watches.set(opts)
+	if isNetworkFilesystem(opts.Path) {
+		// The watch is kept anyway, just like fsnotify would, but it
+		// probably won't see changes made elsewhere.
+		return "network_filesystem_events_unreliable", nil
+	}
+	return "", nil
+}
+
+// fdOptions are the arguments of watch_fd. They can be given either
+// as a bare file descriptor or as a JSON object.
+type fdOptions struct {
+	FD     int    `json:"fd"`
+	Handle uint64 `json:"handle,omitzero"`
+	Tag    string `json:"tag,omitzero"`
+}
+
+type fdData struct {
+	Path    string `json:"path"`
+	Warning string `json:"warning,omitzero"`
+}
+
+func (s *Server) cmdWatchFD(req request) (any, error) {
+	var opts fdOptions
+	var err error
+	if strings.HasPrefix(req.arg, "{") {
+		err = json.Unmarshal([]byte(req.arg), &opts)
+	} else {
+		opts.FD, err = strconv.Atoi(req.arg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	h, err := s.requestHandle(req, opts.Handle)
+	if err != nil {
+		return nil, err
+	}
+	path, err := fdPath(opts.FD)
+	if err != nil {
+		return nil, err
+	}
+
+	warning, err := s.addWatch(req.c, h, watchOptions{Path: path, Handle: opts.Handle, Tag: opts.Tag})
+	if err != nil {
+		return nil, err
+	}
+	return fdData{Path: path, Warning: warning}, nil
+}
+
+func (s *Server) cmdAddWatchRecursive(req request) (any, error) {
+	opts, h, err := s.watchRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	return s.addTree(req, h, opts)
+}
+
+func (s *Server) cmdAddWatchTreeFiltered(req request) (any, error) {
+	opts, err := parseFilteredTree(req.arg)
+	if err != nil {
+		return nil, err
+	}
+	h, err := s.requestHandle(req, opts.Handle)
+	if err != nil {
+		return nil, err
+	}
+	return s.addTree(req, h, opts)
+}
+
+// addTree adds a recursive watch to h in the background on behalf of
+// req.
+func (s *Server) addTree(req request, h *handle, opts watchOptions) (any, error) {
+	err := s.checkAllowed(opts.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	c, id := req.c, req.id
+	c.inflight.start(req.ctx, id, func(ctx context.Context) {
+		// Every directory in the tree counts as a watch.
+		result, err := h.addTree(ctx, opts, c, s.config.MaxWatches)
+		if err != nil {
+			c.sendError(id, err)
+			return
+		}
+		if opts.EmitExisting {
+			count, err := s.emitExisting(ctx, h, opts.Path, h.treeEntries(opts.Path))
+			if err != nil {
+				c.sendError(id, err)
+				return
+			}
+			result.Existing = &count
+		}
+		c.sendMessage(id, result)
+	})
+	return asyncReply{}, nil
+}
+
+func (s *Server) cmdWatchTree(req request) (any, error) {
+	opts, h, err := s.watchRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.checkAllowed(opts.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	c, id := req.c, req.id
+	c.inflight.start(req.ctx, id, func(ctx context.Context) {
+		result, err := s.watchTree(ctx, c, h, opts)
+		if err != nil {
+			c.sendError(id, err)
+			return
+		}
+		c.sendMessage(id, result)
+	})
+	return asyncReply{}, nil
+}
+
+func (s *Server) cmdPruneTree(req request) (any, error) {
+	opts, h, err := s.watchRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	return h.pruneTree(req.c, opts.Path), nil
+}
+
+func (s *Server) cmdWatchTreeStatus(req request) (any, error) {
+	opts, h, err := s.watchRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	status, ok := h.treeStatus(opts.Path)
+	if !ok {
+		return nil, fmt.Errorf("%q is not watched recursively", opts.Path)
+	}
+	return status, nil
+}
+
+func (s *Server) cmdAddSticky(req request) (any, error) {
+	opts, h, err := s.watchRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.checkAllowed(opts.Path)
+	if err != nil {
+		return nil, err
+	}
+	err = req.c.reserveWatch(s.config.MaxWatches)
+	if err != nil {
+		return nil, err
+	}
+	err = h.addSticky(opts)
+	if err != nil {
+		req.c.releaseWatches(1)
+		return nil, err
+	}
+	return nil, nil
+}
+
+func (s *Server) cmdTail(req request) (any, error) {
+	opts, h, err := s.watchRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	if opts.ChunkSize < 0 || opts.ChunkSize > maxTailChunk {
+		return nil, fmt.Errorf("chunk_size must be between 0 (the default) and %v", maxTailChunk)
+	}
+	if opts.ChunkSize == 0 {
+		opts.ChunkSize = maxTailChunk
+	}
+
+	_, err = s.cmdAddSticky(req)
+	if err != nil {
+		return nil, err
+	}
+	h.tails.add(filepath.Clean(opts.Path), opts.ChunkSize)
+	return nil, nil
+}
+
+func (s *Server) cmdRemove(req request) (any, error) {
+	opts, h, err := s.watchRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	err = h.remove(opts.Path)
+	if err != nil {
+		return nil, err
+	}
+	req.c.releaseWatches(1)
+	return nil, nil
+}
+
+func (s *Server) cmdRemoveAll(req request) (any, error) {
+	h, err := s.handleRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var errs []error
+	for _, entry := range h.list() {
+		err := h.remove(entry.Path)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		req.c.releaseWatches(1)
+	}
+	return nil, errors.Join(errs...)
+}
+
+func (s *Server) cmdRemoveMatching(req request) (any, error) {
+	opts, h, err := s.watchRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	removed := []string{}
+	var errs []error
+	for _, entry := range h.list() {
+		if !matchGlob(opts.Path, entry.Path) {
+			continue
+		}
+
+		err := h.remove(entry.Path)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		removed = append(removed, entry.Path)
+	}
+	req.c.releaseWatches(len(removed))
+	err = errors.Join(errs...)
+	if err != nil {
+		return nil, err
+	}
+	return removed, nil
+}
+
+func (s *Server) cmdWatchList(req request) (any, error) {
+	h, err := s.handleRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	return h.list(), nil
+}
+
+func (s *Server) cmdWatchCount(req request) (any, error) {
+	h, err := s.handleRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	return len(h.list()), nil
+}
+
+func (s *Server) cmdGC(req request) (any, error) {
+	handle, dryRun, err := parseGC(req.arg)
+	if err != nil {
+		return nil, err
+	}
+	h, err := s.requestHandle(req, handle)
+	if err != nil {
+		return nil, err
+	}
+	return h.gc(dryRun), nil
+}
+
+func (s *Server) cmdExportWatches(req request) (any, error) {
+	h, err := s.handleRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	return s.exportWatches(h), nil
+}
+
+func (s *Server) cmdImportWatches(req request) (any, error) {
+	return s.importWatches(req.c, req.arg)
+}
+
+func (s *Server) cmdCreateWatcher(req request) (any, error) {
+	// Each watcher uses up kernel resources of its own, so it counts
+	// against the quota like a watch.
+	err := req.c.reserveWatch(s.config.MaxWatches)
+	if err != nil {
+		return nil, err
+	}
+	watcher, err := s.newWatcher()
+	if err != nil {
+		req.c.releaseWatches(1)
+		return nil, err
+	}
+	// The handle outlives the connection that created it, so it
+	// isn't tied to the request's context.
+	h := s.startHandle(s.ctx, watcher, "")
+	return h.id, nil
+}
+
+func (s *Server) cmdCreateNamespace(req request) (any, error) {
+	err := req.c.reserveWatch(s.config.MaxWatches)
+	if err != nil {
+		return nil, err
+	}
+	h, err := s.createNamespace(req.arg)
+	if err != nil {
+		req.c.releaseWatches(1)
+		return nil, err
+	}
+	return h.id, nil
+}
+
+func (s *Server) cmdListNamespaces(req request) (any, error) {
+	return s.namespaces.list(), nil
+}
+
+func (s *Server) cmdDestroyWatcher(req request) (any, error) {
+	handle, err := strconv.ParseUint(req.arg, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	return nil, s.destroyHandle(req.c, handle)
+}
+
+func (s *Server) cmdReopen(req request) (any, error) {
+	h, err := s.handleRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// The new watcher is opened before the old one is closed.
+	err = req.c.reserveWatch(s.config.MaxWatches)
+	if err != nil {
+		return nil, err
+	}
+	defer req.c.releaseWatches(1)
+	return s.reopen(h)
+}
+
+func (s *Server) cmdReset(req request) (any, error) {
+	return nil, s.reset(req.c)
+}
+
+func (s *Server) cmdSetTag(req request) (any, error) {
+	opts, h, err := s.watchRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if !h.watches.setTag(opts.Path, opts.Tag) && !h.setStickyTag(opts.Path, opts.Tag) {
+		return nil, fmt.Errorf("not watching %q", opts.Path)
+	}
+	return nil, nil
+}
+
+func (s *Server) cmdSetOps(req request) (any, error) {
+	arg := req.arg
+	var ops []string
+	if !strings.HasPrefix(arg, "{") {
+		i := strings.LastIndexByte(arg, ' ')
+		if i < 0 {
+			return nil, errors.New("expected a path followed by operations")
+		}
+		arg, ops = arg[:i], strings.Split(arg[i+1:], ",")
+	}
+	req.arg = arg
+	opts, h, err := s.watchRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	if ops != nil {
+		opts.Ops, err = parseOps(ops)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if opts.Ops == 0 {
+		return nil, errors.New("no operations given")
+	}
+
+	if !h.watches.setOps(opts.Path, opts.Ops) {
+		return nil, &codedError{Code: "not_watching", Err: fmt.Errorf("not watching %q", opts.Path)}
+	}
+	return opts.Ops, nil
+}
+
+func (s *Server) cmdSetDebounce(req request) (any, error) {
+	rule, err := parseDebounceRule(req.arg)
+	if err != nil {
+		return nil, err
+	}
+	s.debounceRules.set(rule.pattern, rule.quiet, rule.maxHold)
+	return nil, nil
+}
+
+func (s *Server) cmdSetFilterVCS(req request) (any, error) {
+	enabled, err := strconv.ParseBool(req.arg)
+	if err != nil {
+		return nil, err
+	}
+	s.filterVCS.Store(enabled)
+	return nil, nil
+}
+
+func (s *Server) cmdSetExtFilter(req request) (any, error) {
+	f := parseExtFilter(req.arg)
+	s.extFilter.Store(&f)
+	return nil, nil
+}
+
+func (s *Server) cmdSetRateLimit(req request) (any, error) {
+	opts, err := parseRateLimit(req.arg)
+	if err != nil {
+		return nil, err
+	}
+	h, err := s.requestHandle(req, opts.Handle)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := h.watches.get(opts.Path); !ok {
+		return nil, fmt.Errorf("not watching %q", opts.Path)
+	}
+
+	h.limits.set(opts.Path, opts.Rate)
+	return nil, nil
+}
+
+func (s *Server) cmdPausePath(req request) (any, error) {
+	opts, h, err := s.watchRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := h.watches.get(opts.Path); !ok {
+		return nil, fmt.Errorf("not watching %q", opts.Path)
+	}
+
+	h.pauses.pause(opts.Path, opts.Coalesce)
+	return nil, nil
+}
+
+func (s *Server) cmdResumePath(req request) (any, error) {
+	opts, h, err := s.watchRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	state := h.pauses.resume(opts.Path)
+	if state == nil {
+		return nil, fmt.Errorf("%q is not paused", opts.Path)
+	}
+	s.resume(h, filepath.Clean(opts.Path), state)
+	return nil, nil
+}
+
+func (s *Server) cmdScan(req request) (any, error) {
+	opts, h, err := s.watchRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.checkAllowed(opts.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	c, id := req.c, req.id
+	c.inflight.start(req.ctx, id, func(ctx context.Context) {
+		count, err := s.scan(ctx, h, opts.Path, opts.Depth)
+		if err != nil {
+			c.sendError(id, err)
+			return
+		}
+		c.sendMessage(id, scanData{Count: count})
+	})
+	return asyncReply{}, nil
+}
+
+func (s *Server) cmdPing(req request) (any, error) {
+	return nil, nil
+}
+
+func (s *Server) cmdDrain(req request) (any, error) {
+	s.draining.Store(true)
+
+	c, id := req.c, req.id
+	c.inflight.start(req.ctx, id, func(ctx context.Context) {
+		c.reply(id, nil, s.drain(ctx, c, id))
+	})
+	return asyncReply{}, nil
+}
+
+func (s *Server) cmdShutdown(req request) (any, error) {
+	s.draining.Store(true)
+	s.cancel()
+	return nil, nil
+}
+
+func (s *Server) cmdCancel(req request) (any, error) {
+	target, keep, err := parseCancel(req.arg)
+	if err != nil {
+		return nil, err
+	}
+	return nil, req.c.inflight.cancel(target, keep)
+}
+
+func (s *Server) cmdCheckpoint(req request) (any, error) {
+	seq, err := strconv.ParseUint(req.arg, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	req.c.lastAcked.Store(seq)
+
+	// This is called for nearly every event, so it doesn't get a reply
+	// to keep it from slowing the client down.
+	return asyncReply{}, nil
+}
+
+func (s *Server) cmdReplay(req request) (any, error) {
+	seq, err := parseReplay(req.c, req.arg)
+	if err != nil {
+		return nil, err
+	}
+	return s.replayTo(req.c, seq)
+}
+
+func (s *Server) cmdWatchSince(req request) (any, error) {
+	seq, err := strconv.ParseUint(req.arg, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	return s.watchSince(req.c, seq)
+}
+
+func (s *Server) cmdDeadLetterReplay(req request) (any, error) {
+	return s.replayDeadLetter(req.c)
+}
+
+func (s *Server) cmdRecord(req request) (any, error) {
+	err := s.checkAllowed(req.arg)
+	if err != nil {
+		return nil, err
+	}
+	return nil, s.recorder.start(req.arg)
+}
+
+func (s *Server) cmdStopRecord(req request) (any, error) {
+	return nil, s.recorder.stop()
+}
+
+func (s *Server) cmdJournalStart(req request) (any, error) {
+	opts, err := parseJournalOptions(req.arg)
+	if err != nil {
+		return nil, err
+	}
+	err = s.checkAllowed(opts.Path)
+	if err != nil {
+		return nil, err
+	}
+	return nil, s.journal.start(opts)
+}
+
+func (s *Server) cmdJournalStop(req request) (any, error) {
+	return nil, s.journal.stop()
+}
+
+func (s *Server) cmdJournalReplay(req request) (any, error) {
+	err := s.checkAllowed(req.arg)
+	if err != nil {
+		return nil, err
+	}
+	return s.replayJournal(req.arg)
+}
+
+func (s *Server) cmdWatchStats(req request) (any, error) {
+	return s.stats(req.c), nil
+}
+
+func (s *Server) cmdSubscribe(req request) (any, error) {
+	op, err := parseSubscription(req.arg)
+	if err != nil {
+		return nil, err
+	}
+	req.c.unsubscribed.Store(uint32(allOps &^ op))
+	return req.c.subscribed(), nil
+}
+
+func (s *Server) cmdUnsubscribe(req request) (any, error) {
+	op, err := parseSubscription(req.arg)
+	if err != nil {
+		return nil, err
+	}
+	req.c.unsubscribed.Or(uint32(op))
+	return req.c.subscribed(), nil
+}
+
+func (s *Server) cmdCompress(req request) (any, error) {
+	on := req.arg != compressNone
+	if on && (req.arg == "" || req.arg != s.config.Compress) {
+		return nil, errCompressionDisabled
+	}
+	req.c.bcast.setCompression(req.c, req.id, on)
+	return asyncReply{}, nil
+}
+
+func (s *Server) cmdTopPaths(req request) (any, error) {
+	n := defaultTopPaths
+	if req.arg != "" {
+		var err error
+		n, err = strconv.Atoi(req.arg)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, errors.New("the number of paths must not be negative")
+		}
+	}
+	return s.pathStats.top(n), nil
+}
+
+func (s *Server) cmdEcho(req request) (any, error) {
+	return rawReply(req.arg), nil
+}
+
+func (s *Server) cmdEchoEvent(req request) (any, error) {
+	// The payload is sent as is rather than as an event so that
+	// clients can check that arbitrary frames round-trip.
+	s.bcast.send(broadcastFrame{data: []byte(req.arg)})
+	return nil, nil
+}
+
+func (s *Server) cmdInotifyInfo(req request) (any, error) {
+	info := readInotifyInfo()
+	if info == nil {
+		return nil, errNotSupported
+	}
+	return info, nil
+}
+
+func (s *Server) cmdWatchLimitInfo(req request) (any, error) {
+	return watchLimitInfo()
+}
+
+func (s *Server) cmdCapabilities(req request) (any, error) {
+	return s.capabilities(), nil
+}
+
+func (s *Server) cmdListOps(req request) (any, error) {
+	return opTable{}, nil
+}
+
+func (s *Server) cmdInfo(req request) (any, error) {
+	return s.info(req.c), nil
+}
+
+func (s *Server) cmdUptime(req request) (any, error) {
+	return uptime(), nil
+}
+
+func (s *Server) cmdMemoryStats(req request) (any, error) {
+	return readMemoryStats(), nil
+}
+
+func (s *Server) cmdCounters(req request) (any, error) {
+	switch req.arg {
+	case "":
+		return s.counters.snapshot(false), nil
+	case "reset":
+		return s.counters.snapshot(true), nil
+	default:
+		return nil, fmt.Errorf("unknown counters argument: %q", req.arg)
+	}
+}
+
+func (s *Server) cmdHelp(req request) (any, error) {
+	return commandList, nil
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"hash/crc32"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// The conformance tests run the port as a subprocess and check the
+// exact bytes that it writes in response to a known sequence of
+// commands. They're intended as a reference for authors of clients in
+// other languages.
+
+const conformanceEnv = "FSNOTIFY_CONFORMANCE_PORT"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(conformanceEnv) == "1" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+type portProcess struct {
+	t     *testing.T
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+	out   io.Reader
+
+	// crc is whether frames are in the format with checksums rather
+	// than the one used with -no-crc.
+	crc bool
+}
+
+// wireFrame returns a frame as described by the protocol documentation
+// rather than by the port's own encoder, so that the two can't agree on
+// a mistake.
+func wireFrame(id uint64, payload string, crc bool) []byte {
+	var frame []byte
+	if crc {
+		frame = binary.BigEndian.AppendUint32(frame, uint32(8+4+len(payload)))
+	} else {
+		frame = binary.BigEndian.AppendUint16(frame, uint16(8+len(payload)))
+	}
+	frame = binary.BigEndian.AppendUint64(frame, id)
+	if crc {
+		sum := crc32.ChecksumIEEE(append(binary.BigEndian.AppendUint64(nil, id), payload...))
+		frame = binary.BigEndian.AppendUint32(frame, sum)
+	}
+	return append(frame, payload...)
+}
+
+func startPort(t *testing.T, args ...string) *portProcess {
+	t.Helper()
+
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), conformanceEnv+"=1")
+	cmd.Stderr = os.Stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cmd.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := portProcess{t: t, cmd: cmd, stdin: stdin, out: out, crc: !slices.Contains(args, "-no-crc")}
+	t.Cleanup(func() {
+		stdin.Close()
+		cmd.Wait()
+	})
+	return &p
+}
+
+func (p *portProcess) send(id uint64, cmd string) {
+	p.t.Helper()
+
+	_, err := p.stdin.Write(wireFrame(id, cmd, p.crc))
+	if err != nil {
+		p.t.Fatal(err)
+	}
+}
+
+// read reads the next frame as is.
+func (p *portProcess) read() []byte {
+	p.t.Helper()
+
+	sizeLen := 2
+	if p.crc {
+		sizeLen = 4
+	}
+	size := make([]byte, sizeLen)
+	_, err := io.ReadFull(p.out, size)
+	if err != nil {
+		p.t.Fatalf("read frame size: %v", err)
+	}
+	var n int
+	if p.crc {
+		n = int(binary.BigEndian.Uint32(size))
+	} else {
+		n = int(binary.BigEndian.Uint16(size))
+	}
+	frame := make([]byte, sizeLen+n)
+	copy(frame, size)
+	_, err = io.ReadFull(p.out, frame[sizeLen:])
+	if err != nil {
+		p.t.Fatalf("read frame: %v", err)
+	}
+	return frame
+}
+
+// next reads the next frame, returning its ID and payload, for frames
+// whose contents can't be known in advance. It doesn't check checksums
+// or tags.
+func (p *portProcess) next() (uint64, []byte) {
+	p.t.Helper()
+
+	frame := p.read()
+	if p.crc {
+		return binary.BigEndian.Uint64(frame[4:]), frame[16:]
+	}
+	return binary.BigEndian.Uint64(frame[2:]), frame[10:]
+}
+
+// expectFrame reads the next frame and checks that it is exactly want.
+func (p *portProcess) expectFrame(want []byte) {
+	p.t.Helper()
+
+	got := p.read()
+	if !bytes.Equal(got, want) {
+		p.t.Fatalf("frame mismatch\n got: %x\nwant: %x", got, want)
+	}
+}
+
+// expectHex is like expectFrame, but takes the frame in each format as
+// hex, with spaces between its fields for readability. The size, ID,
+// checksum and payload of a frame with checksums look like
+//
+//	0000000e 0000000000000001 aeddab97 5b5d
+//
+// and without them like
+//
+//	000a 0000000000000001 5b5d
+func (p *portProcess) expectHex(crc, noCRC string) {
+	p.t.Helper()
+
+	want := noCRC
+	if p.crc {
+		want = crc
+	}
+	p.expectFrame(unhex(p.t, want))
+}
+
+// unhex decodes s, ignoring spaces.
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// expect is like expectFrame, for payloads that depend on the
+// environment, such as paths, and so can't be written out in advance.
+func (p *portProcess) expect(id uint64, payload string) {
+	p.t.Helper()
+
+	p.expectFrame(wireFrame(id, payload, p.crc))
+}
+
+func (p *portProcess) roundTrip(id uint64, cmd, reply string) {
+	p.t.Helper()
+
+	p.send(id, cmd)
+	p.expect(id, reply)
+}
+
+func TestConformance(t *testing.T) {
+	testConformance(t, startPort(t))
+}
+
+func TestConformanceNoCRC(t *testing.T) {
+	testConformance(t, startPort(t, "-no-crc"))
+}
+
+func testConformance(t *testing.T, p *portProcess) {
+	dir := t.TempDir()
+	missing := filepath.Join(dir, "missing")
+
+	// There is no handshake: the first frame the port writes is the
+	// reply to the first command.
+	p.send(1, "watch_list")
+	p.expectHex(
+		"0000000e 0000000000000001 aeddab97 5b5d",
+		"000a 0000000000000001 5b5d",
+	)
+
+	p.send(2, "add_watch "+dir)
+	p.expectHex(
+		"00000010 0000000000000002 1bcc8d2f 226f6b22",
+		"000c 0000000000000002 226f6b22",
+	)
+	p.roundTrip(3, "add_watch "+missing, `{"Err":"`+syscall.ENOENT.Error()+`"}`)
+	p.roundTrip(4, "watch_list", `[{"path":"`+dir+`"}]`)
+
+	p.send(5, "remove "+dir)
+	p.expectHex(
+		"00000010 0000000000000005 a9ec513f 226f6b22",
+		"000c 0000000000000005 226f6b22",
+	)
+	p.roundTrip(6, "remove "+dir, `{"Err":"`+fsnotify.ErrNonExistentWatch.Error()+`: `+dir+`"}`)
+	p.send(7, "watch_list")
+	p.expectHex(
+		"0000000e 0000000000000007 aa50d725 5b5d",
+		"000a 0000000000000007 5b5d",
+	)
+
+	// IDs are echoed verbatim, including ones with high bits set.
+	p.send(1<<63|1, "watch_list")
+	p.expectHex(
+		"0000000e 8000000000000001 48d8a296 5b5d",
+		"000a 8000000000000001 5b5d",
+	)
+
+	p.stdin.Close()
+	rest, err := io.ReadAll(p.out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rest) != 0 {
+		t.Fatalf("unexpected output after closing input: %q", rest)
+	}
+	err = p.cmd.Wait()
+	if err != nil {
+		t.Fatalf("port did not exit cleanly: %v", err)
+	}
+}
+
+func TestConformanceCorruptFrame(t *testing.T) {
+	p := startPort(t)
+
+	p.roundTrip(1, "watch_list", `[]`)
+
+	// A frame that fails its checksum is reported on ID 0, after which
+	// the port stops reading, since it can't trust anything after it.
+	frame := wireFrame(2, "watch_list", p.crc)
+	frame[len(frame)-1] ^= 1
+	_, err := p.stdin.Write(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.expectFrame(unhex(t, "00000044 0000000000000000 ed118546 "+
+		// {"Err":"frame checksum mismatch","code":"frame_corrupt"}
+		"7b22457272223a226672616d6520636865636b73756d206d69736d61746368222c22636f6465223a226672616d655f636f7272757074227d"))
+
+	rest, err := io.ReadAll(p.out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rest) != 0 {
+		t.Fatalf("unexpected output after corrupt frame: %q", rest)
+	}
+	err = p.cmd.Wait()
+	if err != nil {
+		t.Fatalf("port did not exit cleanly: %v", err)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json/v2"
+	"errors"
+	"io"
+	"maps"
+	"sync/atomic"
+
+	"golang.org/x/time/rate"
+)
+
+// conn is a single client connection. Commands are read from r and
+// frames are written via out.
+type conn struct {
+	r     io.Reader
+	out   *outbox
+	bcast *broadcaster
+
+	// transport describes how the client is connected, such as
+	// "stdio" or "unix".
+	transport string
+
+	// watches is the number of watches added by this connection.
+	watches atomic.Int64
+
+	// limiter limits the rate of commands from the client. It is nil
+	// if commands aren't limited.
+	limiter *rate.Limiter
+
+	inflight inflight
+
+	// lastAcked is the sequence number of the last event that the
+	// client said it has processed with checkpoint.
+	lastAcked atomic.Uint64
+
+	// unsubscribed holds the operations of events that the client
+	// doesn't want, so that by default it gets all of them.
+	unsubscribed atomic.Uint32
+
+	// replayedThrough is the sequence number of the last event that
+	// was replayed to the client by watch_since. Events up to it that
+	// were still queued are skipped instead of being sent twice. It is
+	// guarded by the broadcaster's mutex.
+	replayedThrough uint64
+
+	// compress is whether frames sent to the client are compressed,
+	// which starts out set with -compress and can be changed with the
+	// compress command. It is guarded by the broadcaster's mutex.
+	compress bool
+}
+
+func (s *Server) newConn(r io.Reader, w io.Writer, onError func(error)) *conn {
+	c := conn{
+		r:     r,
+		bcast: s.bcast,
+
+		compress: s.config.Compress != "",
+	}
+	c.out = newOutbox(w, s.config.DropPolicy, s.config.DropTimeout, s.config.BufferSize, func() {
+		// This is called while frames are being fanned out, so the
+		// warning can't be sent synchronously.
+		if s.counters.drop(dropQueueFull, 1) {
+			go s.broadcastWarning(dropWarning(dropQueueFull))
+		}
+	}, onError)
+	c.out.maxBytes = s.config.BlockMaxBytes
+	c.inflight.timeout = s.config.CommandTimeout
+	if s.deadLetter != nil {
+		c.out.undelivered = s.deadLetter.write
+	}
+	if s.config.CommandRate > 0 {
+		c.limiter = rate.NewLimiter(rate.Limit(s.config.CommandRate), max(int(s.config.CommandRate), 1))
+	}
+	go c.out.run()
+	return &c
+}
+
+func (c *conn) sendData(id uint64, buf []byte) {
+	c.bcast.send(broadcastFrame{id: id, data: buf, to: c})
+}
+
+func (c *conn) sendOK(id uint64) {
+	c.bcast.send(broadcastFrame{id: id, data: []byte(ok), to: c})
+}
+
+func (c *conn) sendMessage(id uint64, msg any) {
+	data, err := json.Marshal(msg, lossyUTF8)
+	if err != nil {
+		panic(err)
+	}
+	c.sendData(id, data)
+}
+
+// reply sends the outcome of a command as returned by its handler.
+func (c *conn) reply(id uint64, reply any, err error) {
+	switch reply := reply.(type) {
+	case asyncReply:
+	case rawReply:
+		c.sendData(id, reply)
+	default:
+		if err != nil {
+			c.sendError(id, err)
+			return
+		}
+		if reply == nil {
+			c.sendOK(id)
+			return
+		}
+		c.sendMessage(id, reply)
+	}
+}
+
+func (c *conn) sendError(id uint64, err error) {
+	c.sendMessage(id, newErrorData(err))
+}
+
+// newErrorData returns the message sent to clients to report err.
+func newErrorData(err error) any {
+	err = explainWatchLimit(err)
+
+	var coded *codedError
+	if !errors.As(err, &coded) {
+		return errorData{Err: err.Error()}
+	}
+	if len(coded.Details) == 0 {
+		return errorData{Err: err.Error(), Code: coded.Code}
+	}
+
+	data := make(map[string]any, len(coded.Details)+2)
+	maps.Copy(data, coded.Details)
+	data["Err"] = err.Error()
+	data["code"] = coded.Code
+	return data
+}
+
+type errorData struct {
+	Err  string
+	Code string `json:"code,omitzero"`
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"sync"
+	"unsafe"
+
+	"github.com/fsnotify/fsnotify"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// cookiePolls is how many times to wait for a move to show up in
+	// the cookie watcher's queue before giving up on it. Each wait is up
+	// to a millisecond.
+	cookiePolls = 2
+
+	// maxCookies is the most cookies that are remembered before old
+	// ones that were never asked for are discarded.
+	maxCookies = 4096
+)
+
+// cookieKey identifies the cookies of moves from or to a path.
+type cookieKey struct {
+	path string
+	to   bool
+}
+
+// cookieWatcher is a Watcher backed by fsnotify that also reports the
+// cookies that inotify uses to pair the two halves of a move. fsnotify
+// doesn't expose them, so a second inotify instance watches the same
+// directories for moves. The kernel queues each move to both instances
+// at the same time, so the cookie for an event from fsnotify is always
+// in the second queue by the time that the event is received, give or
+// take a few microseconds.
+type cookieWatcher struct {
+	Watcher
+	fd int
+
+	m       sync.Mutex
+	wds     map[int32]string
+	paths   map[string]int32
+	cookies map[cookieKey][]uint32
+	count   int
+	buf     [64 * (unix.SizeofInotifyEvent + unix.NAME_MAX + 1)]byte
+}
+
+// newCookieWatcher returns a Watcher backed by fsnotify that reports
+// inotify cookies. It uses twice as many inotify watches as
+// NewWatcher.
+func newCookieWatcher() (Watcher, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	w, err := NewWatcher()
+	if err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	return &cookieWatcher{
+		Watcher: w,
+		fd:      fd,
+		wds:     make(map[int32]string),
+		paths:   make(map[string]int32),
+		cookies: make(map[cookieKey][]uint32),
+	}, nil
+}
+
+func (w *cookieWatcher) Add(path string) error {
+	err := w.Watcher.Add(path)
+	if err != nil {
+		return err
+	}
+
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	// Only directories have entries that can be moved. Failing to
+	// watch one just means that its events won't have cookies.
+	path = filepath.Clean(path)
+	wd, err := unix.InotifyAddWatch(w.fd, path, unix.IN_ONLYDIR|unix.IN_MOVED_FROM|unix.IN_MOVED_TO)
+	if err == nil {
+		w.wds[int32(wd)] = path
+		w.paths[path] = int32(wd)
+	}
+	return nil
+}
+
+func (w *cookieWatcher) Remove(path string) error {
+	err := w.Watcher.Remove(path)
+
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	path = filepath.Clean(path)
+	if wd, ok := w.paths[path]; ok {
+		unix.InotifyRmWatch(w.fd, uint32(wd))
+		delete(w.paths, path)
+		delete(w.wds, wd)
+	}
+	return err
+}
+
+func (w *cookieWatcher) Close() error {
+	return errors.Join(w.Watcher.Close(), unix.Close(w.fd))
+}
+
+// cookie returns the cookie of the move that caused event, or 0 if it
+// wasn't caused by one.
+func (w *cookieWatcher) cookie(event fsnotify.Event) uint32 {
+	var key cookieKey
+	var wait bool
+	switch {
+	case event.Has(fsnotify.Rename):
+		// Renames of watched paths themselves don't have cookies, but
+		// there's no way to tell them apart.
+		key, wait = cookieKey{path: filepath.Clean(event.Name)}, true
+	case event.Has(fsnotify.Create):
+		key = cookieKey{path: filepath.Clean(event.Name), to: true}
+		_, wait = renamedFrom(event)
+	default:
+		return 0
+	}
+
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	for i := 0; ; i++ {
+		w.read()
+		if cookies := w.cookies[key]; len(cookies) > 0 {
+			w.cookies[key] = cookies[1:]
+			if len(cookies) == 1 {
+				delete(w.cookies, key)
+			}
+			w.count--
+			return cookies[0]
+		}
+		if !wait || i == cookiePolls {
+			return 0
+		}
+		unix.Poll([]unix.PollFd{{Fd: int32(w.fd), Events: unix.POLLIN}}, 1)
+	}
+}
+
+// read reads everything that is queued on the inotify instance. w.m
+// must be held.
+func (w *cookieWatcher) read() {
+	for {
+		n, err := unix.Read(w.fd, w.buf[:])
+		if err != nil || n <= 0 {
+			return
+		}
+
+		for buf := w.buf[:n]; len(buf) >= unix.SizeofInotifyEvent; {
+			raw := (*unix.InotifyEvent)(unsafe.Pointer(&buf[0]))
+			size := unix.SizeofInotifyEvent + int(raw.Len)
+			name := string(bytes.TrimRight(buf[unix.SizeofInotifyEvent:size], "\x00"))
+			buf = buf[size:]
+
+			switch {
+			case raw.Mask&unix.IN_Q_OVERFLOW != 0:
+				// Anything could be missing now, so start over.
+				clear(w.cookies)
+				w.count = 0
+			case raw.Mask&unix.IN_IGNORED != 0:
+				delete(w.paths, w.wds[raw.Wd])
+				delete(w.wds, raw.Wd)
+			case raw.Mask&(unix.IN_MOVED_FROM|unix.IN_MOVED_TO) != 0:
+				dir, ok := w.wds[raw.Wd]
+				if !ok {
+					continue
+				}
+				if w.count >= maxCookies {
+					clear(w.cookies)
+					w.count = 0
+				}
+				key := cookieKey{path: filepath.Join(dir, name), to: raw.Mask&unix.IN_MOVED_TO != 0}
+				w.cookies[key] = append(w.cookies[key], raw.Cookie)
+				w.count++
+			}
+		}
+	}
+}
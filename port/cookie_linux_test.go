@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json/v2"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCookies(t *testing.T) {
+	from, to := t.TempDir(), t.TempDir()
+	err := os.WriteFile(filepath.Join(from, "file"), nil, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := startPort(t, "-cookies")
+	p.roundTrip(1, "add_watch "+from, `"ok"`)
+	p.roundTrip(2, "add_watch "+to, `"ok"`)
+
+	err = os.Rename(filepath.Join(from, "file"), filepath.Join(to, "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var events [2]struct {
+		Name   string
+		Op     []string `json:"op"`
+		Cookie uint32   `json:"cookie"`
+	}
+	for i := range events {
+		id, payload := p.next()
+		if id != 0 {
+			t.Fatalf("got frame %v %s, expected an event", id, payload)
+		}
+		err = json.Unmarshal(payload, &events[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rename, create := events[0], events[1]
+	if rename.Name != filepath.Join(from, "file") || len(rename.Op) != 1 || rename.Op[0] != "rename" {
+		t.Fatalf("got %+v, expected a rename of the old path", rename)
+	}
+	if create.Name != filepath.Join(to, "file") || len(create.Op) != 1 || create.Op[0] != "create" {
+		t.Fatalf("got %+v, expected a create of the new path", create)
+	}
+	if rename.Cookie == 0 || rename.Cookie != create.Cookie {
+		t.Fatalf("got cookies %v and %v, expected the same nonzero cookie", rename.Cookie, create.Cookie)
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+// newCookieWatcher returns a Watcher from NewWatcher because cookies
+// are only reported on Linux.
+func newCookieWatcher() (Watcher, error) {
+	return NewWatcher()
+}
@@ -0,0 +1,63 @@
+package main
+
+import "sync/atomic"
+
+type dropReason int
+
+const (
+	dropQueueFull dropReason = iota
+	dropIgnored
+	dropFiltered
+	dropOverflow
+	dropChmod
+	dropHidden
+	dropDeadLetter
+	dropSelf
+	dropExt
+	numDropReasons
+)
+
+var dropReasonNames = [numDropReasons]string{
+	dropQueueFull:  "queue_full",
+	dropIgnored:    "ignored",
+	dropFiltered:   "op_filtered",
+	dropOverflow:   "overflow",
+	dropChmod:      "chmod",
+	dropHidden:     "hidden",
+	dropDeadLetter: "dead_letter",
+	dropSelf:       "self_suppressed",
+	dropExt:        "ext_filtered",
+}
+
+func (r dropReason) String() string {
+	return dropReasonNames[r]
+}
+
+// counters tracks events that were never delivered to the client,
+// broken down by why.
+type counters struct {
+	drops  [numDropReasons]atomic.Uint64
+	warned atomic.Bool
+}
+
+// drop records n dropped events. It returns true the first time that
+// any events are dropped for any reason.
+func (c *counters) drop(reason dropReason, n uint64) bool {
+	c.drops[reason].Add(n)
+	return !c.warned.Load() && c.warned.CompareAndSwap(false, true)
+}
+
+// snapshot returns the current value of every counter, resetting
+// them to zero if reset is true.
+func (c *counters) snapshot(reset bool) map[string]uint64 {
+	m := make(map[string]uint64, len(c.drops))
+	for reason := range c.drops {
+		counter := &c.drops[reason]
+		if reset {
+			m[dropReason(reason).String()] = counter.Swap(0)
+			continue
+		}
+		m[dropReason(reason).String()] = counter.Load()
+	}
+	return m
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+const (
+	// createOverlap is how long after a synthetic create is sent for
+	// an entry of a new directory that a real create for the same path
+	// is taken to be a duplicate of it.
+	createOverlap = time.Second
+
+	// maxSynthesizedCreates is the most synthetic creates that are
+	// remembered at once.
+	maxSynthesizedCreates = 4096
+)
+
+// synthesizedCreates remembers the paths that synthetic creates were
+// recently sent for so that the real ones can be dropped if they show
+// up after all. It is only used by a handle's event loop, so it isn't
+// safe for concurrent use.
+type synthesizedCreates struct {
+	sent map[string]time.Time
+}
+
+// add records that a synthetic create was sent for path.
+func (c *synthesizedCreates) add(path string, now time.Time) {
+	if len(c.sent) >= maxSynthesizedCreates {
+		for path, at := range c.sent {
+			if now.Sub(at) >= createOverlap {
+				delete(c.sent, path)
+			}
+		}
+		if len(c.sent) >= maxSynthesizedCreates {
+			return
+		}
+	}
+	if c.sent == nil {
+		c.sent = make(map[string]time.Time)
+	}
+	c.sent[path] = now
+}
+
+// duplicate reports whether event, received at the given time, is a
+// create that a synthetic create was already sent for. Removing or
+// renaming a path forgets about it so that it can be created again.
+func (c *synthesizedCreates) duplicate(event fsnotify.Event, received time.Time) bool {
+	if len(c.sent) == 0 {
+		return false
+	}
+
+	path := filepath.Clean(event.Name)
+	at, ok := c.sent[path]
+	if !ok {
+		return false
+	}
+	if event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename) || received.Sub(at) >= createOverlap {
+		delete(c.sent, path)
+		return false
+	}
+	if event.Op != fsnotify.Create {
+		return false
+	}
+	delete(c.sent, path)
+	return true
+}
+
+// sendCreated sends synthetic creates for the paths that were found
+// in a new subdirectory of a tree, as long as they would have been
+// delivered.
+func (s *Server) sendCreated(h *handle, paths []string, received time.Time, send func(any)) {
+	for _, path := range paths {
+		h.creates.add(path, received)
+		if data, ok := s.syntheticCreate(h, path, received); ok {
+			send(data)
+		}
+	}
+}
+
+// syntheticCreate returns a synthetic create for path, received at the
+// given time, unless path no longer exists or the create would have
+// been filtered out.
+func (s *Server) syntheticCreate(h *handle, path string, received time.Time) (eventData, bool) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return eventData{}, false
+	}
+	isDir := info.IsDir()
+
+	event := fsnotify.Event{Name: path, Op: fsnotify.Create}
+	entry, _ := h.watches.lookup(path)
+	if s.filtered(event, entry) || entry.DirsOnly && !isDir {
+		return eventData{}, false
+	}
+	if !s.allowsExt(entry, path, &isDir) {
+		return eventData{}, false
+	}
+
+	data := s.newEventData(h, event)
+	data.Synthetic = true
+	data.Time, data.MonoNS = s.timestamp(received)
+	return data, true
+}
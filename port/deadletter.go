@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+// defaultDeadLetterMaxBytes is how large the dead letter file can get
+// by default.
+const defaultDeadLetterMaxBytes = 64 << 20
+
+var errDeadLetterDisabled = &codedError{Code: "not_supported", Err: errors.New("there is no dead letter file; see -dead-letter")}
+
+// deadLetter appends events that couldn't be written to a client,
+// because writing to it failed, to a file as NDJSON, so that they can
+// be replayed once a client is back. The file is opened when it is
+// first needed.
+type deadLetter struct {
+	path string
+	max  int64
+
+	// onDrop is called with the number of events that were dropped
+	// because the file is full or can't be written to.
+	onDrop func(n int)
+
+	m    sync.Mutex
+	file *os.File
+	size int64
+}
+
+// write appends events to the file, one per line, dropping those that
+// don't fit.
+func (d *deadLetter) write(events [][]byte) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	err := d.open()
+	if err != nil {
+		d.onDrop(len(events))
+		return
+	}
+
+	var dropped int
+	for _, event := range events {
+		line := append(event[:len(event):len(event)], '\n')
+		if d.size+int64(len(line)) > d.max {
+			dropped++
+			continue
+		}
+		n, err := d.file.Write(line)
+		d.size += int64(n)
+		if err != nil {
+			dropped++
+		}
+	}
+	if dropped > 0 {
+		d.onDrop(dropped)
+	}
+}
+
+// open opens the file if it isn't already. d.m must be held.
+func (d *deadLetter) open() error {
+	if d.file != nil {
+		return nil
+	}
+	file, err := os.OpenFile(d.path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	d.file = file
+	d.size = info.Size()
+	return nil
+}
+
+// close closes the file if it was opened.
+func (d *deadLetter) close() {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	if d.file != nil {
+		d.file.Close()
+		d.file = nil
+	}
+}
+
+// replayDeadLetter sends every event in the dead letter file to c and
+// then empties it, so that they are only replayed once.
+func (s *Server) replayDeadLetter(c *conn) (replayData, error) {
+	d := s.deadLetter
+	if d == nil {
+		return replayData{}, errDeadLetterDisabled
+	}
+
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	err := d.open()
+	if err != nil {
+		return replayData{}, err
+	}
+	_, err = d.file.Seek(0, 0)
+	if err != nil {
+		return replayData{}, err
+	}
+
+	var result replayData
+	r := bufio.NewReader(d.file)
+	for {
+		line, err := r.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			// A line without a newline at the end was cut short by the
+			// process being killed while writing it.
+			result.Truncated = len(line) > 0
+			break
+		}
+		if err != nil {
+			return result, err
+		}
+		line = bytes.TrimSuffix(line, []byte("\n"))
+		c.bcast.send(broadcastFrame{data: s.eventPayload(line), to: c})
+		result.Replayed++
+	}
+
+	err = d.file.Truncate(0)
+	if err != nil {
+		return result, err
+	}
+	d.size = 0
+	return result, nil
+}
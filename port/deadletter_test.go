@@ -0,0 +1,60 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func TestDeadLetter(t *testing.T) {
+	events := []string{
+		`{"id":1,"Name":"/data/a","root":"/data","op":["create"],"is_dir":null}`,
+		`{"id":2,"Name":"/data/b","root":"/data","op":["create"],"is_dir":null}`,
+		`{"id":3,"Name":"/data/c","root":"/data","op":["create"],"is_dir":null}`,
+	}
+
+	config := DefaultConfig
+	config.DeadLetter = filepath.Join(t.TempDir(), "dead")
+	// Only the first two events fit.
+	config.DeadLetterMaxBytes = int64(len(events[0]) + len(events[1]) + 2)
+	ts := newTestServerConfig(t, config)
+
+	ts.send(1, "add_watch /data")
+	ts.expect(1, `"ok"`)
+	ts.out.Close()
+	for _, name := range []string{"a", "b", "c"} {
+		ts.watcher.Inject(fsnotify.Event{Name: "/data/" + name, Op: fsnotify.Create})
+	}
+	for ts.server.counters.drops[dropDeadLetter].Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	got, err := os.ReadFile(config.DeadLetter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := events[0] + "\n" + events[1] + "\n"
+	if string(got) != want {
+		t.Fatalf("got %q, expected %q", got, want)
+	}
+
+	// Another instance can send them once the client is back.
+	config.DeadLetterMaxBytes = DefaultConfig.DeadLetterMaxBytes
+	ts = newTestServerConfig(t, config)
+	ts.send(1, "dead_letter_replay")
+	ts.expect(0, events[0])
+	ts.expect(0, events[1])
+	ts.expect(1, `{"replayed":2}`)
+	ts.send(2, "dead_letter_replay")
+	ts.expect(2, `{"replayed":0}`)
+}
+
+func TestDeadLetterDisabled(t *testing.T) {
+	ts := newTestServer(t)
+
+	ts.send(1, "dead_letter_replay")
+	ts.expect(1, `{"Err":"there is no dead letter file; see -dead-letter","code":"not_supported"}`)
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// defaultMaxHoldFactor determines the maximum amount of time that
+// events are held when a debounce rule doesn't specify it explicitly,
+// as a multiple of the quiet period.
+const defaultMaxHoldFactor = 10
+
+type debounceRule struct {
+	pattern string
+	quiet   time.Duration
+	maxHold time.Duration
+}
+
+func (r debounceRule) match(path string) bool {
+	if hasPathPrefix(path, r.pattern) {
+		return true
+	}
+	ok, _ := filepath.Match(r.pattern, path)
+	return ok
+}
+
+// parseDebounceRule parses the arguments of the set_debounce command,
+// which have the form "<path-or-glob> <quiet> [<max-hold>]".
+func parseDebounceRule(arg string) (rule debounceRule, err error) {
+	fields := strings.Fields(arg)
+	if len(fields) < 2 || len(fields) > 3 {
+		return rule, fmt.Errorf("expected <path-or-glob> <quiet> [<max-hold>], got %q", arg)
+	}
+
+	rule.pattern = fields[0]
+	rule.quiet, err = time.ParseDuration(fields[1])
+	if err != nil {
+		return rule, err
+	}
+	if len(fields) == 3 {
+		rule.maxHold, err = time.ParseDuration(fields[2])
+		if err != nil {
+			return rule, err
+		}
+	}
+	return rule, nil
+}
+
+type pendingEvent struct {
+	event fsnotify.Event
+	count int
+	first time.Time
+	rule  debounceRule
+	timer timer
+}
+
+// debounceRules is a set of debounce rules that can be shared between
+// debouncers.
+type debounceRules struct {
+	m     sync.RWMutex
+	rules []debounceRule
+}
+
+// set adds or replaces the rule for pattern. A quiet period of zero
+// removes the rule. If maxHold is zero, a default based on quiet is
+// used.
+func (r *debounceRules) set(pattern string, quiet, maxHold time.Duration) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	pattern = filepath.Clean(pattern)
+	rules := r.rules[:0]
+	for _, rule := range r.rules {
+		if rule.pattern != pattern {
+			rules = append(rules, rule)
+		}
+	}
+	r.rules = rules
+
+	if quiet <= 0 {
+		return
+	}
+	if maxHold <= 0 {
+		maxHold = defaultMaxHoldFactor * quiet
+	}
+	r.rules = append(r.rules, debounceRule{
+		pattern: pattern,
+		quiet:   quiet,
+		maxHold: maxHold,
+	})
+}
+
+// all returns a copy of every rule.
+func (r *debounceRules) all() []debounceRule {
+	r.m.RLock()
+	defer r.m.RUnlock()
+
+	return slices.Clone(r.rules)
+}
+
+func (r *debounceRules) find(path string) (debounceRule, bool) {
+	r.m.RLock()
+	defer r.m.RUnlock()
+
+	for _, rule := range r.rules {
+		if rule.match(path) {
+			return rule, true
+		}
+	}
+	return debounceRule{}, false
+}
+
+// debouncer coalesces bursts of Write and Chmod events for paths
+// that match one of its rules into a single event. Held events are
+// emitted once the path has been quiet for the rule's quiet period or
+// once they've been held for the rule's maximum hold time, whichever
+// comes first.
+type debouncer struct {
+	clock clock
+	rules *debounceRules
+	emit  func(event fsnotify.Event, count int)
+
+	m       sync.Mutex
+	pending map[string]*pendingEvent
+}
+
+func newDebouncer(clock clock, rules *debounceRules, emit func(fsnotify.Event, int)) *debouncer {
+	return &debouncer{
+		clock:   clock,
+		rules:   rules,
+		emit:    emit,
+		pending: make(map[string]*pendingEvent),
+	}
+}
+
+// handle reports whether event was held. If it was not, the caller is
+// responsible for emitting it. Any event that is not held flushes a
+// pending event for the same path first so that ordering is
+// preserved.
+func (d *debouncer) handle(event fsnotify.Event) bool {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	if event.Op.Has(fsnotify.Create) || event.Op.Has(fsnotify.Remove) || event.Op.Has(fsnotify.Rename) {
+		d.flush(event.Name)
+		return false
+	}
+
+	rule, ok := d.rules.find(event.Name)
+	if !ok {
+		d.flush(event.Name)
+		return false
+	}
+
+	now := d.clock.Now()
+	p, ok := d.pending[event.Name]
+	if !ok {
+		p = &pendingEvent{event: event, first: now, rule: rule}
+		d.pending[event.Name] = p
+	} else {
+		p.event.Op |= event.Op
+		p.timer.Stop()
+	}
+	p.count++
+
+	wait := min(rule.quiet, rule.maxHold-now.Sub(p.first))
+	if wait <= 0 {
+		d.flush(event.Name)
+		return true
+	}
+	p.timer = d.clock.AfterFunc(wait, func() {
+		d.m.Lock()
+		defer d.m.Unlock()
+
+		if d.pending[event.Name] == p {
+			d.flush(event.Name)
+		}
+	})
+
+	return true
+}
+
+// flush emits the pending event for path, if any. d.m must be held.
+func (d *debouncer) flush(path string) {
+	p, ok := d.pending[path]
+	if !ok {
+		return
+	}
+	delete(d.pending, path)
+
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+	d.emit(p.event, p.count)
+}
+
+// drop discards pending events for root and everything under it
+// without emitting them.
+func (d *debouncer) drop(root string) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	root = filepath.Clean(root)
+	for path, p := range d.pending {
+		if hasPathPrefix(path, root) {
+			p.timer.Stop()
+			delete(d.pending, path)
+		}
+	}
+}
+
+// dropAll discards all pending events without emitting them.
+func (d *debouncer) dropAll() {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	for path, p := range d.pending {
+		p.timer.Stop()
+		delete(d.pending, path)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+type emitted struct {
+	event fsnotify.Event
+	count int
+}
+
+func newTestDebouncer() (*debouncer, *fakeClock, *[]emitted) {
+	var out []emitted
+	clock := newFakeClock()
+	d := newDebouncer(clock, new(debounceRules), func(event fsnotify.Event, count int) {
+		out = append(out, emitted{event: event, count: count})
+	})
+	return d, clock, &out
+}
+
+// send passes event through d, recording it as emitted immediately if
+// it isn't held.
+func send(d *debouncer, out *[]emitted, event fsnotify.Event) {
+	if !d.handle(event) {
+		*out = append(*out, emitted{event: event})
+	}
+}
+
+func TestDebounceQuiet(t *testing.T) {
+	d, clock, out := newTestDebouncer()
+	d.rules.set("/data/log", 100*time.Millisecond, 0)
+
+	for range 5 {
+		send(d, out, fsnotify.Event{Name: "/data/log", Op: fsnotify.Write})
+		clock.Advance(50 * time.Millisecond)
+	}
+	if len(*out) != 0 {
+		t.Fatalf("expected no events while writes continue, got %v", *out)
+	}
+
+	clock.Advance(50 * time.Millisecond)
+	if len(*out) != 1 {
+		t.Fatalf("expected 1 event after quiet period, got %v", *out)
+	}
+	if got := (*out)[0]; got.count != 5 || got.event.Op != fsnotify.Write {
+		t.Fatalf("unexpected coalesced event: %+v", got)
+	}
+}
+
+func TestDebounceMaxHold(t *testing.T) {
+	d, clock, out := newTestDebouncer()
+	d.rules.set("/data/*.db", 100*time.Millisecond, 300*time.Millisecond)
+
+	for range 10 {
+		send(d, out, fsnotify.Event{Name: "/data/a.db", Op: fsnotify.Write})
+		clock.Advance(50 * time.Millisecond)
+	}
+	if len(*out) == 0 {
+		t.Fatal("expected event to be emitted after maximum hold time")
+	}
+	if got := (*out)[0]; got.count != 6 {
+		t.Fatalf("expected 6 coalesced events, got %+v", got)
+	}
+}
+
+func TestDebounceFlushOnCreateAndRemove(t *testing.T) {
+	d, clock, out := newTestDebouncer()
+	d.rules.set("/data", time.Second, 0)
+
+	send(d, out, fsnotify.Event{Name: "/data/f", Op: fsnotify.Write})
+	send(d, out, fsnotify.Event{Name: "/data/f", Op: fsnotify.Chmod})
+	send(d, out, fsnotify.Event{Name: "/data/f", Op: fsnotify.Remove})
+
+	want := []emitted{
+		{event: fsnotify.Event{Name: "/data/f", Op: fsnotify.Write | fsnotify.Chmod}, count: 2},
+		{event: fsnotify.Event{Name: "/data/f", Op: fsnotify.Remove}},
+	}
+	if len(*out) != len(want) {
+		t.Fatalf("got %v, expected %v", *out, want)
+	}
+	for i := range want {
+		if (*out)[i] != want[i] {
+			t.Fatalf("event %v: got %+v, expected %+v", i, (*out)[i], want[i])
+		}
+	}
+
+	clock.Advance(2 * time.Second)
+	if len(*out) != len(want) {
+		t.Fatalf("unexpected events after flush: %v", (*out)[len(want):])
+	}
+}
+
+func TestDebounceUnmatched(t *testing.T) {
+	d, _, out := newTestDebouncer()
+	d.rules.set("/data", time.Second, 0)
+
+	send(d, out, fsnotify.Event{Name: "/other/f", Op: fsnotify.Write})
+	if len(*out) != 1 {
+		t.Fatalf("expected unmatched event to pass through, got %v", *out)
+	}
+}
+
+func TestDebounceDrop(t *testing.T) {
+	d, clock, out := newTestDebouncer()
+	d.rules.set("/data", time.Second, 0)
+
+	send(d, out, fsnotify.Event{Name: "/data/f", Op: fsnotify.Write})
+	d.drop("/data")
+	clock.Advance(2 * time.Second)
+
+	if len(*out) != 0 {
+		t.Fatalf("expected dropped events not to be emitted, got %v", *out)
+	}
+	if len(clock.timers) != 0 {
+		t.Fatalf("expected timers to be cleaned up, got %v", len(clock.timers))
+	}
+}
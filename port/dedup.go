@@ -0,0 +1,71 @@
+package main
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// maxDedupPaths is the most paths that dedup keeps track of at once.
+const maxDedupPaths = 4096
+
+// dedup suppresses events that repeat the previous event for the same
+// path within a window. It is only used by a handle's event loop, so
+// it isn't safe for concurrent use.
+type dedup struct {
+	window time.Duration
+	seen   map[string]dedupEntry
+}
+
+type dedupEntry struct {
+	op   fsnotify.Op
+	at   time.Time
+	skip int
+}
+
+// check reports whether event, received at the given time, should be
+// delivered. If it should, it also returns how many duplicates of the
+// previous event for the same path were suppressed before it.
+func (d *dedup) check(event fsnotify.Event, received time.Time) (coalesced int, deliver bool) {
+	if d.window <= 0 {
+		return 0, true
+	}
+
+	path := filepath.Clean(event.Name)
+	entry, ok := d.seen[path]
+	if ok && entry.op == event.Op && received.Sub(entry.at) < d.window {
+		entry.at = received
+		entry.skip++
+		d.seen[path] = entry
+		return 0, false
+	}
+
+	if !ok && !d.makeRoom(received) {
+		// There's no room to remember the path, so it can't be
+		// deduplicated, but it's better to deliver duplicates than to
+		// lose events.
+		return 0, true
+	}
+	if d.seen == nil {
+		d.seen = make(map[string]dedupEntry)
+	}
+	d.seen[path] = dedupEntry{op: event.Op, at: received}
+	return entry.skip, true
+}
+
+// makeRoom prunes paths that haven't been seen within the window if
+// there are too many, reporting whether there is room for another.
+// Suppressed counts that haven't been delivered yet are lost for the
+// paths that are pruned.
+func (d *dedup) makeRoom(now time.Time) bool {
+	if len(d.seen) < maxDedupPaths {
+		return true
+	}
+	for path, entry := range d.seen {
+		if now.Sub(entry.at) >= d.window {
+			delete(d.seen, path)
+		}
+	}
+	return len(d.seen) < maxDedupPaths
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func TestDedup(t *testing.T) {
+	d := dedup{window: 50 * time.Millisecond}
+	start := time.Now()
+	write := fsnotify.Event{Name: "/data/file", Op: fsnotify.Write}
+	chmod := fsnotify.Event{Name: "/data/file", Op: fsnotify.Chmod}
+	other := fsnotify.Event{Name: "/data/other", Op: fsnotify.Write}
+
+	tests := []struct {
+		event     fsnotify.Event
+		after     time.Duration
+		deliver   bool
+		coalesced int
+	}{
+		{write, 0, true, 0},
+		{write, 10 * time.Millisecond, false, 0},
+		{other, 15 * time.Millisecond, true, 0},
+		{write, 40 * time.Millisecond, false, 0},
+		{write, 80 * time.Millisecond, false, 0},
+		{chmod, 85 * time.Millisecond, true, 3},
+		{write, 90 * time.Millisecond, true, 0},
+		{write, 200 * time.Millisecond, true, 0},
+	}
+	for i, test := range tests {
+		coalesced, deliver := d.check(test.event, start.Add(test.after))
+		if deliver != test.deliver || coalesced != test.coalesced {
+			t.Fatalf("event %v: got (%v, %v), expected (%v, %v)", i, coalesced, deliver, test.coalesced, test.deliver)
+		}
+	}
+}
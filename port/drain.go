@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+// errDraining is returned for commands that are sent after drain.
+var errDraining = &codedError{Code: "draining", Err: errors.New("the port is draining; only shutdown and ping are accepted")}
+
+// allowedWhileDraining lists the commands that are still run after
+// drain.
+var allowedWhileDraining = map[string]bool{
+	"shutdown": true,
+	"ping":     true,
+}
+
+// drain waits for every request that is running in the background to
+// finish, other than the one with the given ID on c.
+func (s *Server) drain(ctx context.Context, c *conn, id uint64) error {
+	for _, other := range s.bcast.all() {
+		var err error
+		if other == c {
+			err = other.inflight.idle(ctx, id)
+		} else {
+			err = other.inflight.idle(ctx)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
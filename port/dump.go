@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json/v2"
+	"io"
+	"runtime"
+	"sort"
+)
+
+// dumpData is a snapshot of the server's internal state for
+// debugging.
+type dumpData struct {
+	Watches    map[uint64][]watchEntry `json:"watches"`
+	Counters   map[string]uint64       `json:"counters"`
+	Suppressed uint64                  `json:"suppressed"`
+	Goroutines int                     `json:"goroutines"`
+	Memory     memoryData              `json:"memory"`
+	DropPolicy string                  `json:"drop_policy"`
+	Conns      []connData              `json:"conns"`
+	Circuit    string                  `json:"circuit"`
+}
+
+type memoryData struct {
+	Alloc      uint64 `json:"alloc"`
+	TotalAlloc uint64 `json:"total_alloc"`
+	Sys        uint64 `json:"sys"`
+	HeapInuse  uint64 `json:"heap_inuse"`
+	NumGC      uint32 `json:"num_gc"`
+}
+
+// connData describes the backpressure on a single connection.
+type connData struct {
+	Transport string `json:"transport"`
+	Queued    int    `json:"queued"`
+}
+
+func (s *Server) snapshot() dumpData {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	s.hmu.RLock()
+	watches := make(map[uint64][]watchEntry, len(s.handles))
+	for id, h := range s.handles {
+		watches[id] = h.list()
+	}
+	s.hmu.RUnlock()
+
+	return dumpData{
+		Watches:    watches,
+		Counters:   s.counters.snapshot(false),
+		Suppressed: s.suppressed.Load(),
+		Goroutines: runtime.NumGoroutine(),
+		Memory: memoryData{
+			Alloc:      mem.Alloc,
+			TotalAlloc: mem.TotalAlloc,
+			Sys:        mem.Sys,
+			HeapInuse:  mem.HeapInuse,
+			NumGC:      mem.NumGC,
+		},
+		DropPolicy: s.config.DropPolicy.String(),
+		Conns:      s.bcast.connData(),
+		Circuit:    s.breaker.state(),
+	}
+}
+
+// dump writes a snapshot of the server's state to w as a single line
+// of JSON.
+func (s *Server) dump(w io.Writer) error {
+	data, err := json.Marshal(s.snapshot(), lossyUTF8)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+func (b *broadcaster) connData() []connData {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	conns := make([]connData, 0, len(b.conns))
+	for c := range b.conns {
+		conns = append(conns, connData{
+			Transport: c.transport,
+			Queued:    c.out.len(),
+		})
+	}
+	sort.Slice(conns, func(i, j int) bool { return conns[i].Queued > conns[j].Queued })
+	return conns
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+import "context"
+
+// handleDumps does nothing on platforms without SIGUSR1.
+func (s *Server) handleDumps(ctx context.Context) {}
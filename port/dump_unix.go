@@ -0,0 +1,31 @@
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// handleDumps writes a snapshot of the server's state to stderr
+// whenever the process receives SIGUSR1 until ctx is canceled.
+func (s *Server) handleDumps(ctx context.Context) {
+	usr1 := make(chan os.Signal, 1)
+	signal.Notify(usr1, syscall.SIGUSR1)
+	defer signal.Stop(usr1)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-usr1:
+			err := s.dump(os.Stderr)
+			if err != nil {
+				slog.Error("dump state", "err", err)
+			}
+		}
+	}
+}
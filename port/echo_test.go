@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// TestEcho checks that echo and echo_event send back exactly the bytes
+// that they are given in both frame formats.
+func TestEcho(t *testing.T) {
+	allBytes := make([]byte, 0, 512)
+	for i := range 256 {
+		allBytes = append(allBytes, byte(i), byte(255-i))
+	}
+
+	formats := []struct {
+		name  string
+		noCRC bool
+	}{
+		{"CRC", false},
+		{"NoCRC", true},
+	}
+	for _, format := range formats {
+		config := DefaultConfig
+		config.NoCRC = format.noCRC
+		limit := config.frameFormat().maxPayload()
+
+		payloads := []struct {
+			name    string
+			payload []byte
+		}{
+			{"Empty", nil},
+			{"Binary", allBytes},
+			{"NotUTF8", []byte("\xff\xfe\xc3(\xed\xa0\x80")},
+			{"Max", bytes.Repeat([]byte{'x'}, limit-len("echo_event "))},
+		}
+		for _, payload := range payloads {
+			t.Run(format.name+"/"+payload.name, func(t *testing.T) {
+				ts := newTestServerConfig(t, config)
+
+				ts.send(1, "echo "+string(payload.payload))
+				id, got := ts.next()
+				if id != 1 || got != string(payload.payload) {
+					t.Fatalf("echo sent frame %v with %v bytes, expected frame 1 with %v bytes", id, len(got), len(payload.payload))
+				}
+
+				ts.send(2, "echo_event "+string(payload.payload))
+				id, got = ts.next()
+				if id != 0 || got != string(payload.payload) {
+					t.Fatalf("echo_event sent frame %v with %v bytes, expected frame 0 with %v bytes", id, len(got), len(payload.payload))
+				}
+				ts.expect(2, `"ok"`)
+			})
+		}
+	}
+}
@@ -0,0 +1,18 @@
+package main
+
+// codedError is an error with a machine-readable code. When it is
+// sent to the client, the code and any details are included alongside
+// the message.
+type codedError struct {
+	Code    string
+	Err     error
+	Details map[string]any
+}
+
+func (err *codedError) Error() string {
+	return err.Err.Error()
+}
+
+func (err *codedError) Unwrap() error {
+	return err.Err
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// existingData is sent after the synthetic creates for the entries
+// that were already in a watch when it was added with emit_existing,
+// so that clients know that they have seen all of them.
+type existingData struct {
+	Op     string `json:"op"`
+	Name   string `json:"name"`
+	Handle uint64 `json:"handle,omitzero"`
+	NS     string `json:"ns,omitzero"`
+	Count  int    `json:"count"`
+}
+
+// dirEntries returns the paths of the entries of dir. A path that
+// isn't a directory has none.
+func dirEntries(dir string) []string {
+	entries, _ := os.ReadDir(dir)
+	paths := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		paths = append(paths, filepath.Join(dir, entry.Name()))
+	}
+	return paths
+}
+
+// treeEntries returns the paths of everything in the watched
+// directories of the tree rooted at root.
+func (h *handle) treeEntries(root string) []string {
+	h.trees.m.Lock()
+	defer h.trees.m.Unlock()
+
+	t, ok := h.trees.roots[filepath.Clean(root)]
+	if !ok {
+		return nil
+	}
+	return t.entries(t.root)
+}
+
+// emitExisting sends a synthetic create for each of the entries that
+// were found in the watch on root, skipping those that have been
+// removed since, followed by an existingData. It returns the number of
+// creates that were sent. If ctx is canceled, it stops early.
+func (s *Server) emitExisting(ctx context.Context, h *handle, root string, paths []string) (int, error) {
+	var count int
+	for _, path := range paths {
+		if ctx.Err() != nil {
+			return count, cancelledError(ctx, map[string]any{"existing": count})
+		}
+		data, ok := s.syntheticCreate(h, path, time.Now())
+		if !ok {
+			continue
+		}
+		s.sendEvent(data)
+		count++
+	}
+
+	s.sendEvent(existingData{
+		Op:     "Existing",
+		Name:   filepath.Clean(root),
+		Handle: h.id,
+		NS:     h.ns,
+		Count:  count,
+	})
+	return count, nil
+}
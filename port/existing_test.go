@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEmitExisting(t *testing.T) {
+	ts := newTestServer(t)
+	dir := t.TempDir()
+	for _, path := range []string{"a", "sub/b"} {
+		path = filepath.Join(dir, path)
+		err := os.MkdirAll(filepath.Dir(path), 0o755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(path, nil, 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expect := func(id uint64, reply string, events ...string) {
+		t.Helper()
+		for _, event := range events {
+			ts.expect(0, event)
+		}
+		ts.expect(id, reply)
+	}
+
+	ts.send(1, fmt.Sprintf(`add_watch {"path":%q,"emit_existing":true}`, dir))
+	expect(1, `{"ok":true,"existing":2}`,
+		fmt.Sprintf(`{"id":1,"Name":%q,"root":%q,"op":["create"],"synthetic":true,"is_dir":false}`, filepath.Join(dir, "a"), dir),
+		fmt.Sprintf(`{"id":2,"Name":%q,"root":%q,"op":["create"],"synthetic":true,"is_dir":true}`, filepath.Join(dir, "sub"), dir),
+		fmt.Sprintf(`{"id":3,"op":"Existing","name":%q,"count":2}`, dir),
+	)
+	ts.send(2, "remove "+dir)
+	ts.expect(2, `"ok"`)
+
+	ts.send(3, fmt.Sprintf(`add_watch_recursive {"path":%q,"emit_existing":true}`, dir))
+	expect(3, `{"watched":2,"skipped":0,"beyond_depth":0,"existing":3}`,
+		fmt.Sprintf(`{"id":4,"Name":%q,"root":%q,"op":["create"],"synthetic":true,"is_dir":false}`, filepath.Join(dir, "a"), dir),
+		fmt.Sprintf(`{"id":5,"Name":%q,"root":%q,"op":["create"],"synthetic":true,"is_dir":true}`, filepath.Join(dir, "sub"), dir),
+		fmt.Sprintf(`{"id":6,"Name":%q,"root":%q,"op":["create"],"synthetic":true,"is_dir":false}`, filepath.Join(dir, "sub", "b"), dir),
+		fmt.Sprintf(`{"id":7,"op":"Existing","name":%q,"count":3}`, dir),
+	)
+}
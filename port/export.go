@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json/v2"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// watchExport describes a single watch well enough to recreate it,
+// using the same options that it was added with. Handle is never
+// exported, since watches are imported into whichever watcher the
+// document names.
+type watchExport struct {
+	watchOptions
+	Sticky    bool `json:"sticky,omitzero"`
+	Recursive bool `json:"recursive,omitzero"`
+}
+
+type debounceExport struct {
+	Pattern string `json:"pattern"`
+	Quiet   string `json:"quiet"`
+	MaxHold string `json:"max_hold,omitzero"`
+}
+
+// watchesExport is the document produced by export_watches and
+// accepted by import_watches. Handle is only used by import_watches
+// to choose which watcher to import into.
+type watchesExport struct {
+	Handle   uint64           `json:"handle,omitzero"`
+	Watches  []watchExport    `json:"watches"`
+	Debounce []debounceExport `json:"debounce,omitzero"`
+}
+
+func (s *Server) exportWatches(h *handle) watchesExport {
+	doc := watchesExport{Watches: []watchExport{}}
+	for _, entry := range h.list() {
+		w := watchExport{watchOptions: entry.options(), Sticky: entry.Sticky}
+		w.PathB64 = entry.PathB64
+		w.Rate = h.limits.rate(entry.Path)
+		if opts, ok := h.trees.options(entry.Path); ok {
+			w.Recursive = true
+			w.Exclude = opts.Exclude
+			w.Include = opts.Include
+			w.MaxDepth = opts.MaxDepth
+		}
+		doc.Watches = append(doc.Watches, w)
+	}
+
+	for _, rule := range s.debounceRules.all() {
+		d := debounceExport{Pattern: rule.pattern, Quiet: rule.quiet.String()}
+		if rule.maxHold > 0 {
+			d.MaxHold = rule.maxHold.String()
+		}
+		doc.Debounce = append(doc.Debounce, d)
+	}
+	return doc
+}
+
+// importResult is the outcome of importing a single watch.
+type importResult struct {
+	Path   string `json:"path"`
+	Result string `json:"result"`
+	Err    string `json:"error,omitzero"`
+}
+
+// importWatches recreates the watches described by an exported
+// document. Watches that already exist are left as they are, so
+// importing the same document more than once is harmless.
+func (s *Server) importWatches(c *conn, arg string) ([]importResult, error) {
+	var doc watchesExport
+	err := json.Unmarshal([]byte(arg), &doc)
+	if err != nil {
+		return nil, err
+	}
+	h, err := s.handle(doc.Handle)
+	if err != nil {
+		return nil, err
+	}
+	for i, w := range doc.Watches {
+		doc.Watches[i].Path, err = decodePath(w.Path, w.PathB64)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	rules := make([]debounceRule, 0, len(doc.Debounce))
+	for _, d := range doc.Debounce {
+		quiet, err := time.ParseDuration(d.Quiet)
+		if err != nil {
+			return nil, err
+		}
+		maxHold, err := parseDuration(d.MaxHold)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, debounceRule{pattern: d.Pattern, quiet: quiet, maxHold: maxHold})
+	}
+	for _, rule := range rules {
+		s.debounceRules.set(rule.pattern, rule.quiet, rule.maxHold)
+	}
+
+	present := make(map[string]bool)
+	for _, entry := range h.list() {
+		present[entry.Path] = true
+	}
+
+	results := make([]importResult, 0, len(doc.Watches))
+	for _, w := range doc.Watches {
+		result := importResult{Path: w.Path, Result: "added"}
+		if present[filepath.Clean(w.Path)] {
+			result.Result = "already_present"
+		} else if err := s.importWatch(c, h, w); err != nil {
+			result.Result = "error"
+			result.Err = err.Error()
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func (s *Server) importWatch(c *conn, h *handle, w watchExport) error {
+	opts := w.watchOptions
+	opts.Handle = h.id
+
+	if opts.Regex != "" {
+		_, err := regexp.Compile(opts.Regex)
+		if err != nil {
+			return err
+		}
+	}
+	err := s.checkAllowed(opts.Path)
+	if err != nil {
+		return err
+	}
+	if w.Recursive {
+		// Every directory in the tree counts as a watch.
+		_, err = h.addTree(context.Background(), opts, c, s.config.MaxWatches)
+		if err != nil {
+			return err
+		}
+	} else {
+		err = c.reserveWatch(s.config.MaxWatches)
+		if err != nil {
+			return err
+		}
+		if w.Sticky {
+			err = h.addSticky(opts)
+		} else {
+			err = h.watcher.Add(opts.Path)
+			if err == nil {
+				h.watches.set(opts)
+			}
+		}
+		if err != nil {
+			c.releaseWatches(1)
+			return err
+		}
+	}
+
+	if w.Rate > 0 {
+		h.limits.set(opts.Path, w.Rate)
+	}
+	return nil
+}
+
+// parseDuration is like time.ParseDuration but treats an empty string
+// as zero.
+func parseDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(s)
+}
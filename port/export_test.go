@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json/v2"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExportImport(t *testing.T) {
+	root := t.TempDir()
+	err := os.MkdirAll(filepath.Join(root, "a", "b"), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Mkdir(filepath.Join(root, "skip"), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := newTestServer(t)
+	ts.send(1, `add_watch {"path":"/data","tag":"data","stat":true,"settle_ms":50,"ignore_chmod":false,"dirs_only":true,"ops":["create","remove"]}`)
+	ts.expect(1, `"ok"`)
+	ts.send(2, `add_watch {"path":"/src","hash":"sha256","hash_dedup":true,"sniff":true,"ext":["go"],"ext_exclude":["tmp"],"regex":"^cmd/"}`)
+	ts.expect(2, `"ok"`)
+	ts.send(3, `add_watch_recursive {"path":"`+root+`","exclude":["skip"],"max_depth":1,"ignore_hidden":true}`)
+	ts.expect(3, `{"watched":2,"skipped":1,"beyond_depth":1}`)
+	ts.send(4, `add_sticky {"path":"/etc/app.toml","tag":"config"}`)
+	ts.expect(4, `"ok"`)
+	ts.send(5, "set_rate_limit /data 2.5")
+	ts.expect(5, `"ok"`)
+	ts.send(6, "export_watches")
+	_, exported := ts.next()
+
+	var doc watchesExport
+	err = json.Unmarshal([]byte(exported), &doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(doc.Watches) != 4 {
+		t.Fatalf("exported %v watches, expected 4: %s", len(doc.Watches), exported)
+	}
+
+	ts = newTestServer(t)
+	ts.send(1, "import_watches "+exported)
+	ts.expect(1, `[{"path":"/data","result":"added"},{"path":"/src","result":"added"},{"path":"`+root+`","result":"added"},{"path":"/etc/app.toml","result":"added"}]`)
+	ts.send(2, "watch_count")
+	ts.expect(2, `4`)
+
+	// Importing the same document again changes nothing.
+	ts.send(3, "import_watches "+exported)
+	ts.expect(3, `[{"path":"/data","result":"already_present"},{"path":"/src","result":"already_present"},{"path":"`+root+`","result":"already_present"},{"path":"/etc/app.toml","result":"already_present"}]`)
+	ts.send(4, "watch_count")
+	ts.expect(4, `4`)
+	if n := len(ts.watcher.WatchList()); n != 5 {
+		t.Fatalf("watcher has %v watches, expected 5: %q", n, ts.watcher.WatchList())
+	}
+
+	ts.send(5, "export_watches")
+	_, reexported := ts.next()
+	if reexported != exported {
+		t.Fatalf("options changed on import:\n%s\n%s", exported, reexported)
+	}
+	if !strings.Contains(exported, `"rate":2.5`) || !strings.Contains(exported, `"max_depth":1`) {
+		t.Fatalf("exported document is missing options: %s", exported)
+	}
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"bytes"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// fdPath returns the path of the file that the process has open as
+// fd.
+func fdPath(fd int) (string, error) {
+	buf := make([]byte, unix.PathMax)
+	_, err := unix.FcntlInt(uintptr(fd), unix.F_GETPATH, int(uintptr(unsafe.Pointer(&buf[0]))))
+	if err != nil {
+		return "", err
+	}
+	path, _, _ := bytes.Cut(buf, []byte{0})
+	return string(path), nil
+}
@@ -0,0 +1,12 @@
+package main
+
+import (
+	"os"
+	"strconv"
+)
+
+// fdPath returns the path of the file that the process has open as
+// fd.
+func fdPath(fd int) (string, error) {
+	return os.Readlink("/proc/self/fd/" + strconv.Itoa(fd))
+}
@@ -0,0 +1,9 @@
+//go:build !linux && !darwin
+
+package main
+
+// fdPath fails because there's no way to find the path of a file
+// descriptor on this platform.
+func fdPath(fd int) (string, error) {
+	return "", errNotSupported
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// editorPatterns match the names of the temporary files that editors
+// create while files are being edited.
+var editorPatterns = []string{
+	// Vim's swap files, and the file that it creates to check whether
+	// it can write to a directory.
+	"*.swp", "*.swo", "*.swx", "4913",
+	// Backups made by Vim, Emacs, and many others.
+	"*~",
+	// Emacs's lock and auto-save files.
+	".#*", "#*#",
+	// JetBrains IDEs' safe writes.
+	"*___jb_tmp___", "*___jb_old___",
+	// Kate's swap files.
+	"*.kate-swp",
+}
+
+// filterPatterns returns the globs that paths whose events are
+// dropped match according to config.
+func filterPatterns(config Config) []string {
+	var patterns []string
+	if config.FilterEditors {
+		patterns = append(patterns, editorPatterns...)
+	}
+	return append(patterns, config.FilterPatterns...)
+}
+
+// matchesFilter reports whether path matches any of patterns. Patterns
+// that contain a separator are matched against the whole path, and the
+// rest against its last element.
+func matchesFilter(patterns []string, path string) bool {
+	base := filepath.Base(path)
+	for _, pattern := range patterns {
+		if strings.ContainsRune(pattern, filepath.Separator) {
+			if matchGlob(pattern, path) {
+				return true
+			}
+			continue
+		}
+		if ok, _ := filepath.Match(pattern, base); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// filtered reports whether event, on a path in the watch described by
+// entry, should be dropped by the watch's operations or by one of the
+// filters that can be turned on for everything.
+func (s *Server) filtered(event fsnotify.Event, entry watchEntry) bool {
+	if entry.Ops != 0 && event.Op&fsnotify.Op(entry.Ops) == 0 {
+		s.drop(dropFiltered, 1)
+		return true
+	}
+	if !entry.matchesRegex(event.Name) {
+		return true
+	}
+	if s.touches.suppress(event) {
+		s.counters.drops[dropSelf].Add(1)
+		return true
+	}
+	if event.Op == fsnotify.Chmod && s.ignoreChmod(entry) {
+		s.counters.drops[dropChmod].Add(1)
+		return true
+	}
+	path := filepath.Clean(event.Name)
+	if s.filterVCS.Load() && inVCSDir(path, entry.Path) {
+		s.drop(dropIgnored, 1)
+		return true
+	}
+	if matchesFilter(s.filterPatterns, path) {
+		s.drop(dropIgnored, 1)
+		return true
+	}
+	if s.ignoreHidden(entry) && isHidden(event, entry.Path) {
+		s.counters.drops[dropHidden].Add(1)
+		return true
+	}
+	return false
+}
+
+// ignoreHidden reports whether events on hidden files in the watch
+// described by entry should be dropped.
+func (s *Server) ignoreHidden(entry watchEntry) bool {
+	if entry.IgnoreHidden != nil {
+		return *entry.IgnoreHidden
+	}
+	return s.config.IgnoreHidden
+}
+
+// isHidden reports whether the path of event is hidden, either because
+// its name starts with a dot or, on Windows, because it has the hidden
+// attribute. The root of a watch is never considered hidden, since it
+// was watched on purpose.
+func isHidden(event fsnotify.Event, root string) bool {
+	path := filepath.Clean(event.Name)
+	if path == root {
+		return false
+	}
+	return strings.HasPrefix(filepath.Base(path), ".") || hasHiddenAttribute(event)
+}
+
+// ignoreChmod reports whether events on paths in the watch described
+// by entry that are only Chmod should be dropped.
+func (s *Server) ignoreChmod(entry watchEntry) bool {
+	if entry.IgnoreChmod != nil {
+		return *entry.IgnoreChmod
+	}
+	return s.config.IgnoreChmod
+}
+
+// isVCSDir reports whether name is the name of a directory that a
+// version control system keeps its data in.
+func isVCSDir(name string) bool {
+	switch name {
+	case ".git", ".hg", ".svn", ".bzr", "CVS":
+		return true
+	}
+	return false
+}
+
+// inVCSDir reports whether path is or is in a version control
+// directory. Only the part of path under root is checked, so that
+// watching such a directory directly still works.
+func inVCSDir(path, root string) bool {
+	if root != "" && hasPathPrefix(path, root) {
+		path = path[len(root):]
+	}
+	for path != "" {
+		elem, rest, _ := strings.Cut(path, string(filepath.Separator))
+		if isVCSDir(elem) {
+			return true
+		}
+		path = rest
+	}
+	return false
+}
+
+// extFilter is the set of file extensions that events are delivered
+// for. If it is empty, events are delivered for every extension.
+type extFilter map[string]bool
+
+// parseExtFilter parses a comma-separated list of extensions, with or
+// without their leading dots.
+func parseExtFilter(list string) extFilter {
+	f := make(extFilter)
+	for ext := range strings.SplitSeq(list, ",") {
+		ext = strings.TrimSpace(ext)
+		if ext == "" {
+			continue
+		}
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		f[ext] = true
+	}
+	return f
+}
+
+// allows reports whether events for path should be delivered. isDir
+// is whether path is a directory, if that is known. Directories are
+// always allowed, as are paths that might be directories.
+func (f extFilter) allows(path string, isDir *bool) bool {
+	if len(f) == 0 || isDir == nil || *isDir {
+		return true
+	}
+	return f[filepath.Ext(path)]
+}
+
+// matchesRegex reports whether path matches the "regex" of the watch
+// described by entry, if it has one. The root of the watch itself
+// always matches.
+func (entry watchEntry) matchesRegex(path string) bool {
+	if entry.regex == nil {
+		return true
+	}
+	rel, err := filepath.Rel(entry.Path, filepath.Clean(path))
+	if err != nil || rel == "." {
+		return true
+	}
+	return entry.regex.MatchString(filepath.ToSlash(rel))
+}
+
+// normalizeExts returns exts lowercased and without leading dots, as
+// they are given as "ext" and "ext_exclude" when adding a watch.
+func normalizeExts(exts []string) []string {
+	if exts == nil {
+		return nil
+	}
+	normalized := make([]string, 0, len(exts))
+	for _, ext := range exts {
+		normalized = append(normalized, strings.ToLower(strings.TrimPrefix(ext, ".")))
+	}
+	return normalized
+}
+
+// allowsExt reports whether events for path are allowed by its
+// extension lists, "ext" and "ext_exclude", which are matched
+// case-insensitively against the last extension of path, with an empty
+// string matching paths that don't have one. isDir is as for
+// extFilter.allows.
+func (entry watchEntry) allowsExt(path string, isDir *bool) bool {
+	if entry.Ext == nil && entry.ExtExclude == nil || isDir == nil || *isDir {
+		return true
+	}
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(path), "."))
+	if entry.Ext != nil && !slices.Contains(entry.Ext, ext) {
+		return false
+	}
+	return !slices.Contains(entry.ExtExclude, ext)
+}
+
+// allowsExt reports whether events for path, in the watch described
+// by entry, are allowed by both -ext and the watch's own extension
+// lists, counting those that aren't.
+func (s *Server) allowsExt(entry watchEntry, path string, isDir *bool) bool {
+	if s.extFilter.Load().allows(path, isDir) && entry.allowsExt(path, isDir) {
+		return true
+	}
+	s.counters.drops[dropExt].Add(1)
+	return false
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func TestInVCSDir(t *testing.T) {
+	tests := []struct {
+		path string
+		root string
+		want bool
+	}{
+		{"/src/main.go", "/src", false},
+		{"/src/.git", "/src", true},
+		{"/src/.git/index", "/src", true},
+		{"/src/sub/.hg/store", "/src", true},
+		{"/src/CVS/Entries", "/src", true},
+		{"/src/.github/workflows", "/src", false},
+		{"/src/git/file", "/src", false},
+		{"/repo/.git/index", "/repo/.git", false},
+		{"/repo/.git/objects/.svn", "/repo/.git", true},
+		{"/unwatched/.bzr/file", "", true},
+	}
+	for _, test := range tests {
+		got := inVCSDir(test.path, test.root)
+		if got != test.want {
+			t.Errorf("inVCSDir(%q, %q) = %v, expected %v", test.path, test.root, got, test.want)
+		}
+	}
+}
+
+func TestFilterVCS(t *testing.T) {
+	ts := newTestServer(t)
+
+	ts.send(1, "add_watch /src")
+	ts.expect(1, `"ok"`)
+	ts.send(2, "set_filter_vcs true")
+	ts.expect(2, `"ok"`)
+
+	go func() {
+		ts.watcher.Inject(fsnotify.Event{Name: "/src/.git/index", Op: fsnotify.Write})
+		ts.watcher.Inject(fsnotify.Event{Name: "/src/main.go", Op: fsnotify.Write})
+	}()
+	ts.expect(0, `{"Warn":"events are being dropped (ignored); see the counters command"}`)
+	ts.expect(0, `{"id":1,"Name":"/src/main.go","root":"/src","op":["write"],"is_dir":null}`)
+	if n := ts.server.counters.drops[dropIgnored].Load(); n != 1 {
+		t.Fatalf("counted %v ignored events, expected 1", n)
+	}
+
+	ts.send(3, "set_filter_vcs false")
+	ts.expect(3, `"ok"`)
+	go ts.watcher.Inject(fsnotify.Event{Name: "/src/.git/index", Op: fsnotify.Write})
+	ts.expect(0, `{"id":2,"Name":"/src/.git/index","root":"/src","op":["write"],"is_dir":null}`)
+
+	ts.send(4, "set_filter_vcs maybe")
+	ts.expect(4, `{"Err":"strconv.ParseBool: parsing \"maybe\": invalid syntax"}`)
+}
+
+func TestIgnoreHidden(t *testing.T) {
+	config := DefaultConfig
+	config.IgnoreHidden = true
+	ts := newTestServerConfig(t, config)
+
+	ts.send(1, "add_watch /src")
+	ts.expect(1, `"ok"`)
+	ts.send(2, "add_watch /home/.config")
+	ts.expect(2, `"ok"`)
+	ts.send(3, `add_watch {"path":"/all","ignore_hidden":false}`)
+	ts.expect(3, `"ok"`)
+
+	go func() {
+		ts.watcher.Inject(fsnotify.Event{Name: "/src/.DS_Store", Op: fsnotify.Write})
+		ts.watcher.Inject(fsnotify.Event{Name: "/src/.main.go.swp", Op: fsnotify.Create})
+		ts.watcher.Inject(fsnotify.Event{Name: "/src/main.go", Op: fsnotify.Write})
+		ts.watcher.Inject(fsnotify.Event{Name: "/home/.config", Op: fsnotify.Chmod})
+		ts.watcher.Inject(fsnotify.Event{Name: "/home/.config/app.toml", Op: fsnotify.Write})
+		ts.watcher.Inject(fsnotify.Event{Name: "/all/.env", Op: fsnotify.Write})
+	}()
+	ts.expect(0, `{"id":1,"Name":"/src/main.go","root":"/src","op":["write"],"is_dir":null}`)
+	ts.expect(0, `{"id":2,"Name":"/home/.config","root":"/home/.config","op":["chmod"],"is_dir":null}`)
+	ts.expect(0, `{"id":3,"Name":"/home/.config/app.toml","root":"/home/.config","op":["write"],"is_dir":null}`)
+	ts.expect(0, `{"id":4,"Name":"/all/.env","root":"/all","op":["write"],"is_dir":null}`)
+
+	if n := ts.server.counters.drops[dropHidden].Load(); n != 2 {
+		t.Fatalf("counted %v ignored hidden events, expected 2", n)
+	}
+}
+
+func TestMatchesFilter(t *testing.T) {
+	patterns := filterPatterns(Config{FilterEditors: true, FilterPatterns: []string{"*.log", "/src/build/**"}})
+
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"/src/main.go", false},
+		{"/src/.main.go.swp", true},
+		{"/src/4913", true},
+		{"/src/49130", false},
+		{"/src/main.go~", true},
+		{"/src/.#main.go", true},
+		{"/src/#main.go#", true},
+		{"/src/main.go___jb_tmp___", true},
+		{"/src/debug.log", true},
+		{"/src/build/out/main", true},
+		{"/src/builds/main", false},
+	}
+	for _, test := range tests {
+		got := matchesFilter(patterns, test.path)
+		if got != test.want {
+			t.Errorf("matchesFilter(%q) = %v, expected %v", test.path, got, test.want)
+		}
+	}
+}
+
+func TestFilterPatterns(t *testing.T) {
+	config := DefaultConfig
+	config.FilterPatterns = []string{"*.log"}
+	ts := newTestServerConfig(t, config)
+
+	ts.send(1, "add_watch /src")
+	ts.expect(1, `"ok"`)
+
+	go func() {
+		ts.watcher.Inject(fsnotify.Event{Name: "/src/debug.log", Op: fsnotify.Write})
+		ts.watcher.Inject(fsnotify.Event{Name: "/src/main.go", Op: fsnotify.Write})
+	}()
+	ts.expect(0, `{"Warn":"events are being dropped (ignored); see the counters command"}`)
+	ts.expect(0, `{"id":1,"Name":"/src/main.go","root":"/src","op":["write"],"is_dir":null}`)
+
+	ts.send(2, "counters")
+	_, counters := ts.next()
+	if !strings.Contains(counters, `"ignored":1`) {
+		t.Fatalf("ignored event wasn't counted: %s", counters)
+	}
+}
+
+func TestDirsOnly(t *testing.T) {
+	ts := newTestServer(t)
+	root := t.TempDir()
+	dir := filepath.Join(root, "project")
+	file := filepath.Join(root, "file")
+
+	ts.send(1, `add_watch {"path":"`+root+`","dirs_only":true}`)
+	ts.expect(1, `"ok"`)
+
+	err := os.Mkdir(dir, 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(file, nil, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		ts.watcher.Inject(fsnotify.Event{Name: file, Op: fsnotify.Create})
+		ts.watcher.Inject(fsnotify.Event{Name: dir, Op: fsnotify.Create})
+	}()
+	ts.expect(0, `{"id":1,"Name":"`+dir+`","root":"`+root+`","op":["create"],"is_dir":true}`)
+
+	// Removed paths can't be stat'd, but the cache remembers what they
+	// were.
+	err = os.RemoveAll(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Remove(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		ts.watcher.Inject(fsnotify.Event{Name: file, Op: fsnotify.Remove})
+		ts.watcher.Inject(fsnotify.Event{Name: dir, Op: fsnotify.Remove})
+	}()
+	ts.expect(0, `{"id":2,"Name":"`+dir+`","root":"`+root+`","op":["remove"],"is_dir":true}`)
+
+	// If nothing is known about a removed path, it might have been a
+	// directory, so it is delivered.
+	unknown := filepath.Join(root, "unknown")
+	go ts.watcher.Inject(fsnotify.Event{Name: unknown, Op: fsnotify.Remove})
+	ts.expect(0, `{"id":3,"Name":"`+unknown+`","root":"`+root+`","op":["remove"],"is_dir":null}`)
+}
+
+func TestExtFilter(t *testing.T) {
+	config := DefaultConfig
+	config.Extensions = ".go, proto"
+	ts := newTestServerConfig(t, config)
+	root := t.TempDir()
+
+	ts.send(1, "add_watch "+root)
+	ts.expect(1, `"ok"`)
+
+	paths := make(map[string]string)
+	for _, name := range []string{"main.go", "api.proto", "README.md", "sub.d"} {
+		path := filepath.Join(root, name)
+		var err error
+		if name == "sub.d" {
+			err = os.Mkdir(path, 0o755)
+		} else {
+			err = os.WriteFile(path, nil, 0o644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		paths[name] = path
+	}
+
+	write := func(name string) {
+		ts.watcher.Inject(fsnotify.Event{Name: paths[name], Op: fsnotify.Write})
+	}
+	var id int
+	expect := func(name string, isDir bool) {
+		t.Helper()
+		id++
+		ts.expect(0, fmt.Sprintf(`{"id":%v,"Name":%q,"root":%q,"op":["write"],"is_dir":%v}`, id, paths[name], root, isDir))
+	}
+
+	go func() {
+		write("README.md")
+		write("main.go")
+		write("api.proto")
+		write("sub.d")
+	}()
+	expect("main.go", false)
+	expect("api.proto", false)
+	expect("sub.d", true)
+
+	ts.send(2, "set_ext_filter .md")
+	ts.expect(2, `"ok"`)
+	go func() {
+		write("main.go")
+		write("README.md")
+	}()
+	expect("README.md", false)
+
+	ts.send(3, "set_ext_filter")
+	ts.expect(3, `"ok"`)
+	go write("main.go")
+	expect("main.go", false)
+}
+
+func TestWatchExt(t *testing.T) {
+	ts := newTestServer(t)
+	allow, deny := t.TempDir(), t.TempDir()
+
+	ts.send(1, `add_watch {"path":"`+allow+`","ext":["LOG",".gz",""]}`)
+	ts.expect(1, `"ok"`)
+	ts.send(2, `add_watch {"path":"`+deny+`","ext_exclude":["tmp"]}`)
+	ts.expect(2, `"ok"`)
+	ts.send(3, "watch_list")
+	_, list := ts.next()
+	for _, want := range []string{`"ext":["log","gz",""]`, `"ext_exclude":["tmp"]`} {
+		if !strings.Contains(list, want) {
+			t.Fatalf("got %s, expected it to contain %s", list, want)
+		}
+	}
+
+	var paths []string
+	for _, path := range []string{
+		filepath.Join(allow, "app.Log"),
+		filepath.Join(allow, "app.txt"),
+		filepath.Join(allow, "Makefile"),
+		filepath.Join(allow, "logs.tar.gz"),
+		filepath.Join(deny, "a.tmp"),
+		filepath.Join(deny, "a.txt"),
+	} {
+		err := os.WriteFile(path, nil, 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+	go func() {
+		for _, path := range paths {
+			ts.watcher.Inject(fsnotify.Event{Name: path, Op: fsnotify.Write})
+		}
+	}()
+
+	var id int
+	for _, i := range []int{0, 2, 3, 5} {
+		id++
+		root := filepath.Dir(paths[i])
+		ts.expect(0, fmt.Sprintf(`{"id":%v,"Name":%q,"root":%q,"op":["write"],"is_dir":false}`, id, paths[i], root))
+	}
+	ts.send(4, "watch_stats")
+	_, stats := ts.next()
+	if want := `"ext_filtered":2`; !strings.Contains(stats, want) {
+		t.Fatalf("got %s, expected it to contain %s", stats, want)
+	}
+}
+
+func TestWatchRegex(t *testing.T) {
+	ts := newTestServer(t)
+	// The warning about dropped events would race with the events
+	// that are delivered.
+	ts.server.counters.warned.Store(true)
+
+	ts.send(1, `add_watch {"path":"/spool","regex":"("}`)
+	ts.expect(1, `{"Err":"error parsing regexp: missing closing ): `+"`(`"+`"}`)
+	// Unanchored patterns match anywhere in the relative path.
+	ts.send(2, `add_watch {"path":"/loose","regex":"[0-9a-f]{8}"}`)
+	ts.expect(2, `"ok"`)
+	ts.send(3, `add_watch {"path":"/spool","regex":"^[0-9a-f]{8}$","ops":["create"]}`)
+	ts.expect(3, `"ok"`)
+
+	events := []struct {
+		path    string
+		op      fsnotify.Op
+		deliver bool
+	}{
+		{"/loose/0123abcd", fsnotify.Create, true},
+		{"/loose/x0123abcd.tmp", fsnotify.Create, true},
+		{"/loose/0123", fsnotify.Create, false},
+		{"/spool/0123abcd", fsnotify.Create, true},
+		{"/spool/x0123abcd.tmp", fsnotify.Create, false},
+		{"/spool/sub/0123abcd", fsnotify.Create, false},
+		// Both the regex and the ops have to allow an event.
+		{"/spool/0123abcd", fsnotify.Write, false},
+		{"/spool/0123abcd", fsnotify.Remove, false},
+	}
+	go func() {
+		for _, e := range events {
+			ts.watcher.Inject(fsnotify.Event{Name: e.path, Op: e.op})
+		}
+		ts.watcher.Inject(fsnotify.Event{Name: "/spool/ffffffff", Op: fsnotify.Create})
+	}()
+
+	var id int
+	for _, e := range events {
+		if !e.deliver {
+			continue
+		}
+		id++
+		ts.expect(0, fmt.Sprintf(`{"id":%v,"Name":%q,"root":%q,"op":["create"],"is_dir":null}`, id, e.path, filepath.Dir(e.path)))
+	}
+	ts.expect(0, fmt.Sprintf(`{"id":%v,"Name":"/spool/ffffffff","root":"/spool","op":["create"],"is_dir":null}`, id+1))
+
+	if n := ts.server.counters.drops[dropFiltered].Load(); n != 2 {
+		t.Fatalf("counted %v events dropped by ops, expected 2", n)
+	}
+}
+
+func TestAddWatchTreeFiltered(t *testing.T) {
+	ts := newTestServer(t)
+	root := t.TempDir()
+	for _, dir := range []string{"src/a", "src/vendor/x", "src/b/node_modules/y", "docs"} {
+		err := os.MkdirAll(filepath.Join(root, dir), 0o755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ts.send(1, "add_watch_tree_filtered "+root+" --include src/** --exclude src/vendor --exclude **/node_modules")
+	ts.expect(1, `{"watched":4,"skipped":2,"beyond_depth":0}`)
+	expectWatches := func(dirs ...string) {
+		t.Helper()
+		want := []string{root}
+		for _, dir := range dirs {
+			want = append(want, filepath.Join(root, dir))
+		}
+		got := ts.watcher.WatchList()
+		slices.Sort(got)
+		slices.Sort(want)
+		if !slices.Equal(got, want) {
+			t.Fatalf("watching %q, expected %q", got, want)
+		}
+	}
+	expectWatches("src", "src/a", "src/b")
+
+	// New directories are filtered the same way.
+	for _, dir := range []string{"src/a/c", "src/a/node_modules"} {
+		path := filepath.Join(root, dir)
+		err := os.Mkdir(path, 0o755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go ts.watcher.Inject(fsnotify.Event{Name: path, Op: fsnotify.Create})
+		ts.next()
+	}
+	expectWatches("src", "src/a", "src/b", "src/a/c")
+
+	ts.send(2, "add_watch_tree_filtered "+root+" --include")
+	ts.expect(2, `{"Err":"missing glob after --include"}`)
+	ts.send(3, `add_watch_tree_filtered {"path":"`+root+`","include":["[a"]}`)
+	ts.expect(3, `{"Err":"invalid glob \"[a\""}`)
+}
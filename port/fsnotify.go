@@ -1,83 +1,214 @@
 package main
 
 import (
-	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
 	"encoding/binary"
-	"encoding/json/v2"
-	"fmt"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"hash/crc32"
 	"io"
 	"iter"
+	"math"
+	"net"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strings"
+	"time"
 	"unsafe"
-
-	"github.com/fsnotify/fsnotify"
 )
 
 const ok = `"ok"`
 
-func sendData[T string | []byte](id uint64, buf T) {
-	err := binary.Write(os.Stdout, binary.BigEndian, uint16(8+len(buf)))
-	if err != nil {
-		panic(err)
+// maxPayloadSize is the largest payload that fits in a frame after
+// its ID.
+const maxPayloadSize = math.MaxUint16 - 8
+
+// maxCRCFrameSize is the largest frame that will be read when frames
+// are checksummed. Anything larger is assumed to be corrupt rather
+// than allocated.
+const maxCRCFrameSize = 1 << 24
+
+// errFrameCorrupt is reported when a frame fails its checksum.
+var errFrameCorrupt = &codedError{Code: "frame_corrupt", Err: errors.New("frame checksum mismatch")}
+
+// errAuthFailed is reported for commands without a valid HMAC tag.
+var errAuthFailed = &codedError{Code: "auth_failed", Err: errors.New("missing or invalid HMAC tag")}
+
+// frameFormat describes how frames are laid out.
+type frameFormat struct {
+	// crc adds a CRC-32 of everything after it to each frame.
+	crc bool
+
+	// key, if not nil, is used to append an HMAC-SHA256 tag of the ID
+	// and payload to the payload of each frame.
+	key []byte
+
+	// lz4 compresses payloads with compressPayload before they are
+	// tagged.
+	lz4 bool
+}
+
+// tag returns the HMAC tag for a frame.
+func (f frameFormat) tag(id uint64, payload []byte) []byte {
+	mac := hmac.New(sha256.New, f.key)
+	mac.Write(binary.BigEndian.AppendUint64(nil, id))
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// open checks and removes the HMAC tag of a frame's payload,
+// reporting whether it was valid. If there's no key, the payload is
+// returned as is.
+func (f frameFormat) open(id uint64, payload string) (string, bool) {
+	if f.key == nil {
+		return payload, true
+	}
+	if len(payload) < sha256.Size {
+		return "", false
 	}
 
-	err = binary.Write(os.Stdout, binary.BigEndian, id)
+	payload, tag := payload[:len(payload)-sha256.Size], payload[len(payload)-sha256.Size:]
+	if !hmac.Equal(f.tag(id, []byte(payload)), []byte(tag)) {
+		return "", false
+	}
+	return payload, true
+}
+
+// maxPayload returns the largest payload that fits in a frame, which
+// is all that clients can be expected to read with f.crc.
+func (f frameFormat) maxPayload() int {
+	limit := maxPayloadSize
+	if f.crc {
+		limit = maxCRCFrameSize - 12
+	}
+	if f.key != nil {
+		limit -= sha256.Size
+	}
+	return limit
+}
+
+// sendData writes a frame to w. With f.crc, the frame has the layout
+// "uint32 size | uint64 id | uint32 crc32 | payload", with the
+// checksum covering the ID and payload. Otherwise, it is the older
+// "uint16 size | uint64 id | payload". With f.key, the payload is
+// followed by its HMAC tag. With f.lz4, the payload is compressed
+// first. Payloads that don't fit are reduced with fitPayload before
+// they are compressed.
+func sendData[T string | []byte](w io.Writer, id uint64, buf T, f frameFormat) {
+	if f.lz4 {
+		f.lz4 = false
+		compressed := compressPayload([]byte(buf))
+		if len(compressed) > f.maxPayload() {
+			limit := f.maxPayload() - lz4Overhead(f.maxPayload())
+			compressed = compressPayload(fitPayload(id, []byte(buf), limit))
+		}
+		sendData(w, id, compressed, f)
+		return
+	}
+
+	if len(buf) > f.maxPayload() {
+		sendData(w, id, fitPayload(id, []byte(buf), f.maxPayload()), f)
+		return
+	}
+
+	var tag []byte
+	if f.key != nil {
+		tag = f.tag(id, []byte(buf))
+	}
+
+	var header []byte
+	if f.crc {
+		header = binary.BigEndian.AppendUint32(make([]byte, 0, 16), uint32(12+len(buf)+len(tag)))
+		header = binary.BigEndian.AppendUint64(header, id)
+		sum := crc32.Update(crc32.ChecksumIEEE(header[4:]), crc32.IEEETable, []byte(buf))
+		sum = crc32.Update(sum, crc32.IEEETable, tag)
+		header = binary.BigEndian.AppendUint32(header, sum)
+	} else {
+		header = binary.BigEndian.AppendUint16(make([]byte, 0, 10), uint16(8+len(buf)+len(tag)))
+		header = binary.BigEndian.AppendUint64(header, id)
+	}
+
+	_, err := w.Write(header)
 	if err != nil {
 		panic(err)
 	}
 
 	switch buf := any(buf).(type) {
 	case []byte:
-		_, err = os.Stdout.Write(buf)
+		_, err = w.Write(buf)
 	case string:
-		_, err = os.Stdout.WriteString(buf)
+		_, err = io.WriteString(w, buf)
 	}
 	if err != nil {
 		panic(err)
 	}
-}
 
-func sendMessage(id uint64, msg any) {
-	data, err := json.Marshal(msg)
+	_, err = w.Write(tag)
 	if err != nil {
 		panic(err)
 	}
-	sendData(id, data)
 }
 
-func sendError(id uint64, err error) {
-	type errorData struct {
-		Err string
-	}
-	sendMessage(id, errorData{Err: err.Error()})
-}
-
-func commands() iter.Seq2[uint64, string] {
+// commands reads command frames in the format f from r until it ends
+// or reading fails, such as when a connection is closed or reset.
+// Frames that fail their checksum end the stream after calling
+// corrupt, if it isn't nil, since there's no telling where the next
+// frame starts. HMAC tags are left for the caller to check with
+// f.open.
+func commands(r io.Reader, f frameFormat, corrupt func()) iter.Seq2[uint64, string] {
+	crc := f.crc
 	return func(yield func(uint64, string) bool) {
 		for {
-			var size uint16
-			err := binary.Read(os.Stdin, binary.BigEndian, &size)
+			var size uint32
+			var err error
+			if crc {
+				err = binary.Read(r, binary.BigEndian, &size)
+			} else {
+				var size16 uint16
+				err = binary.Read(r, binary.BigEndian, &size16)
+				size = uint32(size16)
+			}
 			if err != nil {
-				if err == io.EOF {
-					return
+				return
+			}
+			if size > maxCRCFrameSize {
+				if corrupt != nil {
+					corrupt()
 				}
-				panic(err)
+				return
 			}
 
 			buf := make([]byte, size)
-			_, err = io.ReadFull(os.Stdin, buf)
+			_, err = io.ReadFull(r, buf)
 			if err != nil {
-				if err == io.EOF {
+				return
+			}
+
+			headerSize := 8
+			if crc {
+				headerSize = 12
+			}
+			if len(buf) < headerSize {
+				// Too short to carry an ID, so there's nobody to reply
+				// to.
+				continue
+			}
+			if crc {
+				sum := crc32.Update(crc32.ChecksumIEEE(buf[:8]), crc32.IEEETable, buf[12:])
+				if sum != binary.BigEndian.Uint32(buf[8:]) {
+					if corrupt != nil {
+						corrupt()
+					}
 					return
 				}
-				panic(err)
 			}
 
 			id := binary.BigEndian.Uint64(buf)
-			buf = buf[8:]
+			buf = buf[headerSize:]
 
 			str := unsafe.String(unsafe.SliceData(buf), len(buf))
 			if !yield(id, str) {
@@ -87,67 +218,106 @@ func commands() iter.Seq2[uint64, string] {
 	}
 }
 
-func watch(ctx context.Context, watcher *fsnotify.Watcher) {
-	var buf bytes.Buffer
-
-	for {
-		select {
-		case <-ctx.Done():
-			return
+// isEOF reports whether err indicates that the input ended, either
+// cleanly or in the middle of a frame.
+func isEOF(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
 
-		case event, ok := <-watcher.Events:
-			if !ok {
-				return
-			}
-			sendMessage(0, event)
+func main() {
+	processStart = time.Now()
 
-		case err, ok := <-watcher.Errors:
-			if !ok {
-				return
-			}
-			sendError(0, err)
+	config := DefaultConfig
+	flag.Var(&config.DropPolicy, "drop-policy", "what to do with events when the client falls behind: block, drop, or buffer")
+	flag.DurationVar(&config.DropTimeout, "drop-timeout", config.DropTimeout, "how long to wait to queue an event before dropping it with -drop-policy=drop")
+	flag.IntVar(&config.BufferSize, "buffer-size", config.BufferSize, "maximum number of queued frames with -drop-policy=drop or buffer")
+	flag.IntVar(&config.BlockMaxBytes, "block-max-bytes", config.BlockMaxBytes, "size in bytes that the frames queued for a client can grow to with -drop-policy=block before it is disconnected")
+	flag.StringVar(&config.Playback, "playback", "", "play back a recording made with the record command instead of watching the filesystem")
+	flag.Var((*stringList)(&config.AllowPrefixes), "allow-prefix", "only allow watching, recording and journaling to, and replaying journals from, paths under the given directory; may be repeated")
+	flag.IntVar(&config.MaxWatches, "max-watches", 0, "maximum number of watches each connection may add, counting each directory of recursive watches and each watcher created with create_watcher or create_namespace, or 0 for no limit")
+	flag.DurationVar(&config.CommandTimeout, "command-timeout", config.CommandTimeout, "cancel commands that run in the background, such as scan, after this long with the code \"timeout\", or 0 for no limit")
+	flag.Float64Var(&config.CommandRate, "command-rate", 0, "maximum number of commands per second from each connection, or 0 for no limit")
+	flag.StringVar(&config.StateFile, "state-file", "", "file listing paths to watch, one per line, which is reloaded on SIGHUP")
+	flag.BoolVar(&config.LegacyOps, "legacy-ops", false, "send the operation of events as a bitmask under \"Op\" instead of as an array of names under \"op\"")
+	flag.BoolVar(&config.Timestamps, "timestamps", false, "add the time at which each event was received to event and error frames")
+	flag.BoolVar(&config.StatEvents, "stat-events", false, "add the size, permissions, modification time, and type of the file to events")
+	flag.DurationVar(&config.StatCacheTTL, "stat-cache-ttl", config.StatCacheTTL, "how long the metadata of a file is reused for by later writes with -stat-events, or 0 to stat every event")
+	flag.DurationVar(&config.Keepalive, "keepalive", 0, "send a keepalive frame to clients that haven't been sent anything for the given duration, or 0 to never send them")
+	flag.BoolVar(&config.Batch, "batch", false, "send events that arrive together as a JSON array in a single frame; every event frame is an array when set")
+	flag.IntVar(&config.ReplayBuffer, "replay-buffer", 0, "number of recent events to keep for the replay command, or 0 to disable it and sequence numbers")
+	flag.DurationVar(&config.DedupWindow, "dedup-window", 0, "suppress events that repeat the previous event for the same path within the given duration, or 0 to disable")
+	flag.DurationVar(&config.WriteSettle, "write-settle", 0, "hold back bursts of writes to a path until it has been quiet for the given duration, sending a single settled write instead, or 0 to disable")
+	flag.BoolVar(&config.RelativePaths, "relative-paths", false, "send the names of events relative to the root of the watch that they belong to, which is sent as \"root\"")
+	flag.Func("hmac-key", "require commands to be tagged with an HMAC-SHA256 using the given hex-encoded key, and tag everything sent with it", func(key string) (err error) {
+		config.HMACKey, err = hex.DecodeString(key)
+		if err == nil && len(config.HMACKey) == 0 {
+			err = errors.New("key is empty")
 		}
+		return err
+	})
+	flag.BoolVar(&config.OwnerNames, "owner-names", false, "add the names of the owner and group of files to stat metadata")
+	flag.BoolVar(&config.ResolveSymlinks, "resolve-symlinks", false, "resolve symlinks in the directories of the paths of events so that each file is always reported under the same path")
+	flag.DurationVar(&config.MoveWindow, "move-window", 0, "hold renames for up to the given duration, such as 50ms, to pair them with the creates that they cause and send a single moved event instead, or 0 to disable")
+	flag.DurationVar(&config.AtomicWindow, "atomic-window", 0, "detect files written atomically by writing to a temporary file and renaming it into place within the given duration, sending a single WriteAtomic event instead, or 0 to disable")
+	flag.BoolVar(&config.IgnoreChmod, "ignore-chmod", false, "drop events that are only Chmod; events that combine Chmod with other operations are still sent")
+	flag.BoolVar(&config.FilterVCS, "filter-vcs", false, "drop events for paths in version control directories such as .git, which can be changed with set_filter_vcs")
+	flag.BoolVar(&config.IgnoreHidden, "ignore-hidden", false, "drop events for files whose names start with a dot, or that have the hidden attribute on Windows")
+	flag.BoolVar(&config.FilterEditors, "filter-editors", false, "drop events for the temporary files that editors create, such as *.swp and .#*")
+	flag.Func("filter-pattern", "drop events for paths matching the given glob, which is matched against the whole path if it contains a separator and the file's name otherwise; may be repeated", func(pattern string) error {
+		_, err := filepath.Match(pattern, "")
+		if err != nil {
+			return err
+		}
+		config.FilterPatterns = append(config.FilterPatterns, pattern)
+		return nil
+	})
+	flag.StringVar(&config.Extensions, "ext", "", "only send events for files with one of the given comma-separated extensions, such as .go,.proto, and for directories")
+	flag.Int64Var(&config.HashMaxSize, "hash-max-size", config.HashMaxSize, "size in bytes of the largest file to hash for watches with \"hash\"; larger files are sent with \"hash_skipped\"")
+	flag.DurationVar(&config.HashTimeout, "hash-timeout", config.HashTimeout, "how long hashing a file can take before it is sent with \"hash_skipped\"")
+	flag.BoolVar(&config.HashEvents, "hash-events", false, "add the SHA-256 hash of the file's contents to create and write events as \"sha256\"")
+	flag.BoolVar(&config.Cookies, "cookies", false, "add the cookie that pairs the two halves of a move to rename and create events on Linux, at the cost of using twice as many inotify watches")
+	flag.IntVar(&config.SizeCache, "size-cache", config.SizeCache, "number of paths whose last size is remembered to add \"size_delta\" to writes with stat metadata; the least recently reported are forgotten first, and 0 turns it off")
+	flag.IntVar(&config.BurstThreshold, "burst-threshold", 0, "send a summary every -burst-window in place of the events for paths that get more than this many within it, or 0 to disable")
+	flag.DurationVar(&config.BurstWindow, "burst-window", defaultBurstWindow, "the window that events are counted over for -burst-threshold")
+	flag.StringVar(&config.DeadLetter, "dead-letter", "", "append events to this file as NDJSON when writing them to a client fails, so that they can be sent later with dead_letter_replay")
+	flag.Int64Var(&config.DeadLetterMaxBytes, "dead-letter-max-bytes", config.DeadLetterMaxBytes, "size in bytes that the dead letter file can grow to before further events are dropped")
+	flag.Func("compress", "compress payloads with the given algorithm, which must be lz4, unless a client turns it off with the compress command", func(name string) (err error) {
+		config.Compress, err = parseCompression(name)
+		return err
+	})
+	flag.BoolVar(&config.NoCRC, "no-crc", false, "use the older frame format without a checksum, for clients that don't support it")
+	listen := flag.String("listen", "", "serve clients connecting to the given address, such as unix:/path/to/socket or tcp:localhost:1234, instead of using stdin and stdout")
+	flag.Parse()
 
-		buf.Reset()
-	}
-}
-
-func main() {
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer cancel()
 
-	watcher, err := fsnotify.NewWatcher()
+	watcher, err := config.newWatcher()()
 	if err != nil {
 		panic(err)
 	}
 	defer watcher.Close()
-	go watch(ctx, watcher)
 
-	for id, cmd := range commands() {
-		cmd, arg, _ := strings.Cut(cmd, " ")
-		switch cmd {
-		case "add_watch":
-			err := watcher.Add(arg)
-			if err != nil {
-				sendError(id, err)
-				continue
-			}
-			sendData(id, ok)
-
-		case "remove":
-			err := watcher.Remove(arg)
-			if err != nil {
-				sendError(id, err)
-				continue
-			}
-			sendData(id, ok)
+	s := NewServer(watcher, cancel, config)
 
-		case "watch_list":
-			list := watcher.WatchList()
-			sendMessage(id, list)
+	l, err := systemdListener()
+	if err != nil {
+		panic(err)
+	}
+	if l == nil {
+		if *listen == "" {
+			s.Run(ctx, os.Stdin, os.Stdout)
+			return
+		}
 
-		default:
-			panic(fmt.Errorf("unknown command: %q", cmd))
+		network, address, _ := strings.Cut(*listen, ":")
+		l, err = net.Listen(network, address)
+		if err != nil {
+			panic(err)
 		}
 	}
+	err = s.Serve(ctx, l)
+	if err != nil {
+		panic(err)
+	}
 }
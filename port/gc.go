@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// parseGC parses the arguments of the gc command, which are an
+// optional handle and an optional "dry_run" flag in either order.
+func parseGC(arg string) (handle uint64, dryRun bool, err error) {
+	for _, field := range strings.Fields(arg) {
+		if field == "dry_run" {
+			dryRun = true
+			continue
+		}
+
+		handle, err = strconv.ParseUint(field, 10, 64)
+		if err != nil {
+			return 0, false, fmt.Errorf("unknown gc argument: %q", field)
+		}
+	}
+	return handle, dryRun, nil
+}
+
+// dead reports whether the watched path described by entry no longer
+// exists or has turned from a directory into something else.
+func dead(entry watchEntry) bool {
+	info, err := os.Stat(entry.Path)
+	if err != nil {
+		return errors.Is(err, fs.ErrNotExist)
+	}
+	return entry.dir && !info.IsDir()
+}
+
+// gc removes the handle's watches on paths that no longer exist,
+// returning the paths that were removed. This includes watches that
+// the watcher has already dropped but that are still being tracked.
+// Sticky watches are left alone because they are expected to outlive
+// their paths. If dryRun is true, the paths that would be removed are
+// returned without removing them.
+func (h *handle) gc(dryRun bool) []string {
+	paths := h.watches.paths()
+	for _, entry := range h.list() {
+		if !entry.Sticky && !slices.Contains(paths, entry.Path) {
+			paths = append(paths, entry.Path)
+		}
+	}
+	slices.Sort(paths)
+
+	pruned := []string{}
+	for _, path := range paths {
+		entry, _ := h.watches.get(path)
+		if !dead(entry) {
+			continue
+		}
+		if dryRun {
+			pruned = append(pruned, entry.Path)
+			continue
+		}
+
+		err := h.remove(entry.Path)
+		if err != nil {
+			if !errors.Is(err, fsnotify.ErrNonExistentWatch) {
+				continue
+			}
+			// The watcher already dropped the watch on its own.
+			h.forget(entry.Path)
+		}
+
+		if !dead(entry) {
+			// The path came back between checking it and removing the
+			// watch, so put the watch back.
+			if h.watcher.Add(entry.Path) == nil {
+				h.watches.set(watchOptions{Path: entry.Path, Tag: entry.Tag})
+				continue
+			}
+		}
+		pruned = append(pruned, entry.Path)
+	}
+	return pruned
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// matchGlob reports whether path matches pattern. Patterns use the
+// syntax of [filepath.Match] with the addition of "**" as a path
+// element, which matches zero or more path elements.
+func matchGlob(pattern, path string) bool {
+	if !strings.Contains(pattern, "**") {
+		ok, _ := filepath.Match(pattern, path)
+		return ok
+	}
+
+	sep := string(filepath.Separator)
+	return matchElems(strings.Split(pattern, sep), strings.Split(path, sep))
+}
+
+func matchElems(pattern, path []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := range len(path) + 1 {
+				if matchElems(pattern[1:], path[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(path) == 0 {
+			return false
+		}
+		ok, _ := filepath.Match(pattern[0], path[0])
+		if !ok {
+			return false
+		}
+		pattern, path = pattern[1:], path[1:]
+	}
+	return len(path) == 0
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// defaultHandle is the handle of the watcher that exists for the
+// lifetime of the server. Commands that don't specify a handle
+// operate on it.
+const defaultHandle = 0
+
+// handle is a single watcher along with all of the state that
+// belongs to it.
+type handle struct {
+	id       uint64
+	ns       string
+	watcher  Watcher
+	watches  watchTable
+	sticky   stickySet
+	limits   rateLimits
+	bursts   bursts
+	pauses   pauses
+	trees    trees
+	dirs     dirCache
+	tails    tails
+	dedup    dedup
+	creates  synthesizedCreates
+	debounce *debouncer
+	settle   *settler
+	moves    *mover
+	atomic   *atomicWrites
+	hashes   *hasher
+	sniffs   *sniffer
+
+	// inner holds the underlying watcher so that it can be replaced
+	// by reopen.
+	inner *swapWatcher
+
+	// ctx is the context that the handle's event loop is derived
+	// from.
+	ctx context.Context
+
+	m      sync.Mutex
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// startHandle registers watcher under a new handle, which belongs to
+// the namespace ns if it isn't empty, and starts forwarding its
+// events.
+func (s *Server) startHandle(ctx context.Context, watcher Watcher, ns string) *handle {
+	s.hmu.Lock()
+	defer s.hmu.Unlock()
+
+	h := handle{
+		id:    s.nextHandle,
+		ns:    ns,
+		inner: &swapWatcher{w: watcher},
+		dedup: dedup{window: s.config.DedupWindow},
+		tails: tails{touches: &s.touches},
+		ctx:   ctx,
+	}
+	h.watcher = dirCacheWatcher{
+		Watcher: breakerWatcher{Watcher: h.inner, breaker: &s.breaker},
+		dirs:    &h.dirs,
+	}
+	h.limits = rateLimits{
+		clock: realClock{},
+		summarize: func(root string, suppressed int) {
+			s.suppressed.Add(uint64(suppressed))
+			s.sendEvent(summaryData{
+				Name:       root,
+				Handle:     h.id,
+				NS:         h.ns,
+				Suppressed: suppressed,
+				Summary:    fmt.Sprintf("suppressed %v events for %v in the last %v", suppressed, root, summaryInterval),
+			})
+		},
+	}
+	h.bursts = bursts{
+		clock:     realClock{},
+		threshold: s.config.BurstThreshold,
+		window:    cmp.Or(s.config.BurstWindow, defaultBurstWindow),
+		summarize: func(path string, data burstData) {
+			data.Name = path
+			data.Handle = h.id
+			data.NS = h.ns
+			data.Time, data.MonoNS = s.timestamp(time.Now())
+			s.sendEvent(data)
+		},
+	}
+	h.debounce = newDebouncer(realClock{}, &s.debounceRules, func(event fsnotify.Event, count int) {
+		data := s.newEventData(&h, event)
+		data.Count = count
+		if !h.sniffs.take(event, &data) && !h.hashes.take(event, &data) {
+			s.sendEvent(data)
+		}
+	})
+	h.settle = newSettler(realClock{}, func(event fsnotify.Event, count int, burst time.Duration) {
+		data := s.newEventData(&h, event)
+		data.Count = count
+		data.Settled = true
+		data.BurstMS = burst.Milliseconds()
+		if !h.sniffs.take(event, &data) && !h.hashes.take(event, &data) {
+			s.sendEvent(data)
+		}
+	})
+	h.moves = newMover(realClock{}, s.config.MoveWindow, watcherReportsRenames, func(data eventData) {
+		s.sendEvent(data)
+	})
+	entry := func(path string) watchEntry {
+		entry, _ := h.watches.lookup(path)
+		return entry
+	}
+	// Creates are sniffed and then hashed once they have been paired
+	// with any rename that caused them, and settled writes are sniffed
+	// before they are hashed.
+	h.sniffs = newSniffer(entry, func(event fsnotify.Event, data eventData) {
+		if !h.hashes.take(event, &data) {
+			s.sendEvent(data)
+		}
+	})
+	h.hashes = newHasher(s.config, entry, func(event fsnotify.Event, data eventData, send func(any)) {
+		h.moves.handle(event, data, func(v any) {
+			data := v.(eventData)
+			if !h.sniffs.take(event, &data) && !(event.Has(fsnotify.Create) && h.hashes.take(event, &data)) {
+				send(data)
+			}
+		})
+	}, s.sendEvent)
+	h.sniffs.touches = &s.touches
+	h.hashes.touches = &s.touches
+	h.atomic = newAtomicWrites(realClock{}, s.config.AtomicWindow, watcherReportsRenames, h.hashes.handle, s.sendEvent)
+	s.nextHandle++
+
+	if s.handles == nil {
+		s.handles = make(map[uint64]*handle)
+	}
+	s.handles[h.id] = &h
+
+	h.m.Lock()
+	defer h.m.Unlock()
+	s.run(&h)
+
+	return &h
+}
+
+// run starts forwarding events from the handle's current watcher.
+// The caller must hold h.m.
+func (s *Server) run(h *handle) {
+	ctx, cancel := context.WithCancel(h.ctx)
+	h.cancel = cancel
+	h.done = make(chan struct{})
+
+	done := h.done
+	go func() {
+		defer close(done)
+		s.watch(ctx, h)
+	}()
+}
+
+// stop stops forwarding events from the handle. Once it returns, no
+// further events from the handle will be sent.
+func (h *handle) stop() {
+	h.m.Lock()
+	h.cancel()
+	<-h.done
+	h.m.Unlock()
+
+	h.debounce.dropAll()
+	h.settle.dropAll()
+	h.atomic.dropAll()
+	h.moves.dropAll()
+	h.sniffs.stop()
+	h.hashes.stop()
+	h.limits.removeAll()
+	h.bursts.dropAll()
+}
+
+// remove removes the watch on path along with any state associated
+// with it.
+func (h *handle) remove(path string) error {
+	if h.removeSticky(path) {
+		h.debounce.drop(path)
+		h.tails.remove(filepath.Clean(path))
+		return nil
+	}
+
+	h.removeTree(path)
+	if h.isAnchor(path) {
+		// Keep the underlying watch for the sticky targets that rely
+		// on it.
+		if _, ok := h.watches.get(path); !ok {
+			return &os.PathError{Op: "remove", Path: path, Err: fsnotify.ErrNonExistentWatch}
+		}
+	} else {
+		err := h.watcher.Remove(path)
+		if err != nil {
+			return err
+		}
+	}
+
+	h.forget(path)
+	return nil
+}
+
+// removeDead stops tracking the watch on path, along with any tree
+// rooted at it, after path was removed. Sticky watches and the watches
+// that they rely on are left alone.
+func (h *handle) removeDead(path string) {
+	if _, ok := h.watches.get(path); !ok || h.isAnchor(path) {
+		return
+	}
+	h.removeTree(path)
+	// The watcher usually drops the watch on its own.
+	h.watcher.Remove(path)
+	h.forget(path)
+}
+
+// forget discards the state associated with the watch on path.
+func (h *handle) forget(path string) {
+	h.watches.delete(path)
+	h.debounce.drop(path)
+	h.settle.drop(path)
+	h.limits.remove(path)
+	h.pauses.resume(path)
+}
+
+// list returns the handle's watches, including sticky ones but
+// excluding the underlying watches that only exist for the sake of
+// sticky ones.
+func (h *handle) list() []watchEntry {
+	paths := h.watcher.WatchList()
+	sticky := h.stickyTargets()
+
+	list := make([]watchEntry, 0, len(paths)+len(sticky))
+	for _, path := range paths {
+		entry, ok := h.watches.get(path)
+		if !ok && (h.isAnchor(path) || h.trees.isSubdir(path)) {
+			continue
+		}
+		entry.Paused = h.pauses.paused(path)
+		entry.Recursive = h.trees.isRoot(path)
+		list = append(list, entry)
+	}
+	for _, t := range sticky {
+		list = append(list, watchEntry{Path: t.path, Tag: t.tag, Sticky: true})
+	}
+	for i := range list {
+		list[i].PathB64, list[i].PathEncoding = encodePath(list[i].Path)
+	}
+	return list
+}
+
+func (s *Server) handle(id uint64) (*handle, error) {
+	s.hmu.RLock()
+	defer s.hmu.RUnlock()
+
+	h, ok := s.handles[id]
+	if !ok {
+		return nil, fmt.Errorf("no watcher with handle %v", id)
+	}
+	return h, nil
+}
+
+// destroyHandle stops the handle with the given id and closes its
+// watcher on behalf of c.
+func (s *Server) destroyHandle(c *conn, id uint64) error {
+	if id == defaultHandle {
+		return errors.New("the default watcher can't be destroyed")
+	}
+
+	s.hmu.Lock()
+	h, ok := s.handles[id]
+	delete(s.handles, id)
+	s.hmu.Unlock()
+	if !ok {
+		return fmt.Errorf("no watcher with handle %v", id)
+	}
+
+	if h.ns != "" {
+		s.namespaces.forget(h.ns)
+	}
+
+	// The watcher and its watches are given back to the quota, with
+	// the subdirectories of trees going back to whoever added them.
+	entries := h.list()
+	for _, entry := range entries {
+		h.removeTree(entry.Path)
+	}
+	c.releaseWatches(len(entries) + 1)
+
+	h.stop()
+	return h.watcher.Close()
+}
+
+// stopHandles stops every handle, closing all watchers except for the
+// one that the server was created with, which is owned by its creator.
+func (s *Server) stopHandles() {
+	s.hmu.Lock()
+	handles := s.handles
+	s.handles = nil
+	s.hmu.Unlock()
+	s.namespaces.clear()
+
+	for _, h := range handles {
+		h.stop()
+		if h.inner.get() != s.watcher {
+			h.watcher.Close()
+		}
+	}
+}
+
+// cookie returns the cookie of the move that caused event if the
+// handle's watcher reports them, or 0.
+func (h *handle) cookie(event fsnotify.Event) uint32 {
+	if r, ok := h.inner.get().(cookieReporter); ok {
+		return r.cookie(event)
+	}
+	return 0
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/fsnotify/fsnotify"
+)
+
+const (
+	// hashQueueSize is the number of events that can be waiting to
+	// be hashed before further events are sent without a hash.
+	hashQueueSize = 1024
+
+	// maxHashedPaths is the most paths whose last hash is remembered
+	// for "hash_dedup".
+	maxHashedPaths = 4096
+
+	// defaultHashMaxSize is the size of the largest file that is
+	// hashed if -hash-max-size isn't given.
+	defaultHashMaxSize = 64 << 20
+
+	// defaultHashTimeout is how long hashing a file can take if
+	// -hash-timeout isn't given.
+	defaultHashTimeout = 10 * time.Second
+)
+
+// Reasons for events not being hashed, sent as "hash_skipped".
+const (
+	hashSkippedTooLarge = "too_large"
+	hashSkippedBusy     = "busy"
+	hashSkippedError    = "error"
+	hashSkippedTimeout  = "timeout"
+)
+
+// newHash returns a hash.Hash for the algorithm with the given name,
+// which is one of those that can be given as "hash" when adding a
+// watch.
+func newHash(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case "sha256":
+		return sha256.New(), nil
+	case "xxhash":
+		return xxhash.New(), nil
+	default:
+		return nil, fmt.Errorf("unknown hash algorithm %q", algorithm)
+	}
+}
+
+// hashJob is an event waiting to be hashed, or, if forget is true, a
+// path whose last hash should be forgotten. algorithm is the hash
+// asked for by the watch, if any, and sha256 is set for -hash-events.
+type hashJob struct {
+	path      string
+	data      eventData
+	algorithm string
+	sha256    bool
+	dedup     bool
+	forget    bool
+}
+
+// hasher adds hashes of the contents of files to write events for
+// watches that ask for them, and SHA-256 hashes to create and write
+// events with -hash-events. Files are hashed by a separate goroutine
+// so that large files don't hold up other events, which means that
+// events with hashes can be delivered after events that happened
+// after them.
+type hasher struct {
+	maxSize int64
+	timeout time.Duration
+	events  bool
+
+	// touches is told about files before they are read.
+	touches *selfTouches
+
+	// entry returns the watch that a path belongs to.
+	entry func(path string) watchEntry
+
+	// next is passed events that aren't hashed. Hashed events are sent
+	// with emit once they have been.
+	next func(event fsnotify.Event, data eventData, send func(any))
+	emit func(any)
+
+	once sync.Once
+	jobs chan hashJob
+	quit chan struct{}
+	done chan struct{}
+
+	// last holds the last hash of each path for watches with
+	// "hash_dedup". It is only used by the hashing goroutine.
+	last map[string]string
+}
+
+func newHasher(config Config, entry func(string) watchEntry, next func(fsnotify.Event, eventData, func(any)), emit func(any)) *hasher {
+	return &hasher{
+		maxSize: cmp.Or(max(config.HashMaxSize, 0), defaultHashMaxSize),
+		timeout: cmp.Or(max(config.HashTimeout, 0), defaultHashTimeout),
+		events:  config.HashEvents,
+		entry:   entry,
+		next:    next,
+		emit:    emit,
+		jobs:    make(chan hashJob, hashQueueSize),
+		quit:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// handle passes data, which was created for event, on to h.next
+// unless it is to be hashed first, in which case it is sent once it
+// has been. Creates are left to h.next, so that they are hashed once
+// they have been paired with any rename that caused them.
+func (h *hasher) handle(event fsnotify.Event, data eventData, send func(any)) {
+	if event.Has(fsnotify.Create) || !h.take(event, &data) {
+		h.next(event, data, send)
+	}
+}
+
+// take queues data, which was created for event, to be hashed and
+// sent, reporting whether it did. If the event should have been hashed
+// but there are too many waiting, data is marked as skipped instead.
+func (h *hasher) take(event fsnotify.Event, data *eventData) bool {
+	entry := h.entry(event.Name)
+	events := h.events && (event.Has(fsnotify.Create) || event.Has(fsnotify.Write)) && (data.IsDir == nil || !*data.IsDir)
+	if entry.Hash == "" && !events {
+		return false
+	}
+
+	path := filepath.Clean(event.Name)
+	if event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename) {
+		if entry.HashDedup {
+			// This goes through the queue so that it isn't overtaken
+			// by writes that happened before it.
+			h.queue(hashJob{path: path, forget: true})
+		}
+		return false
+	}
+
+	job := hashJob{path: path, data: *data, sha256: events}
+	if event.Has(fsnotify.Write) {
+		job.algorithm, job.dedup = entry.Hash, entry.HashDedup
+	}
+	if job.algorithm == "" && !job.sha256 {
+		return false
+	}
+	if !h.queue(job) {
+		data.HashSkipped = hashSkippedBusy
+		return false
+	}
+	return true
+}
+
+// queue queues job without blocking, reporting whether there was room.
+func (h *hasher) queue(job hashJob) bool {
+	h.once.Do(func() { go h.run() })
+
+	select {
+	case h.jobs <- job:
+		return true
+	default:
+		return false
+	}
+}
+
+func (h *hasher) run() {
+	defer close(h.done)
+
+	for {
+		select {
+		case <-h.quit:
+			return
+		case job := <-h.jobs:
+			if job.forget {
+				delete(h.last, job.path)
+				continue
+			}
+			data, ok := h.hash(job)
+			if ok {
+				h.emit(data)
+			}
+		}
+	}
+}
+
+// hash hashes the file that job is for, returning its event with the
+// hash added and whether it should be sent.
+func (h *hasher) hash(job hashJob) (eventData, bool) {
+	data := job.data
+	var algorithms []string
+	if job.algorithm != "" {
+		algorithms = append(algorithms, job.algorithm)
+	}
+	if job.sha256 && job.algorithm != "sha256" {
+		algorithms = append(algorithms, "sha256")
+	}
+
+	done := h.touches.touch(job.path, fsnotify.Chmod)
+	sums, err := hashFile(job.path, algorithms, h.maxSize, h.timeout)
+	done()
+	switch {
+	case err == errTooLarge:
+		data.HashSkipped = hashSkippedTooLarge
+		return data, true
+	case err == errHashTimeout:
+		data.HashSkipped = hashSkippedTimeout
+		return data, true
+	case err != nil:
+		data.HashSkipped = hashSkippedError
+		return data, true
+	}
+	if job.sha256 {
+		data.SHA256 = strings.TrimPrefix(sums[len(sums)-1], "sha256:")
+	}
+	if job.algorithm == "" {
+		return data, true
+	}
+	sum := sums[0]
+	data.Hash = sum
+
+	if !job.dedup {
+		return data, true
+	}
+	if h.last[job.path] == sum {
+		return data, false
+	}
+	if h.last == nil || len(h.last) >= maxHashedPaths {
+		h.last = make(map[string]string)
+	}
+	h.last[job.path] = sum
+	return data, true
+}
+
+// stop stops hashing. Events that were waiting to be hashed are
+// dropped.
+func (h *hasher) stop() {
+	h.once.Do(func() { close(h.done) })
+	close(h.quit)
+	<-h.done
+}
+
+var (
+	// errTooLarge is returned by hashFile for files that are too large
+	// to hash.
+	errTooLarge = fmt.Errorf("file too large to hash")
+
+	// errHashTimeout is returned by hashFile for files that take too
+	// long to read.
+	errHashTimeout = fmt.Errorf("timed out hashing file")
+
+	// errNotRegular is returned by hashFile for anything other than a
+	// regular file.
+	errNotRegular = fmt.Errorf("not a regular file")
+)
+
+// hashFile returns the hashes of the contents of the regular file at
+// path with each of the given algorithms, in the same order, as the
+// name of the algorithm followed by a colon and the hash in hex. Files
+// larger than maxSize and files that take longer than timeout to read
+// aren't hashed. Symlinks aren't followed, so that a path can't be
+// swapped out for one to somewhere else while it is being hashed.
+func hashFile(path string, algorithms []string, maxSize int64, timeout time.Duration) ([]string, error) {
+	hashes := make([]hash.Hash, len(algorithms))
+	writers := make([]io.Writer, len(algorithms))
+	for i, algorithm := range algorithms {
+		h, err := newHash(algorithm)
+		if err != nil {
+			return nil, err
+		}
+		hashes[i], writers[i] = h, h
+	}
+
+	file, err := openNoFollow(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, errNotRegular
+	}
+	if info.Size() > maxSize {
+		return nil, errTooLarge
+	}
+
+	// The file might grow while it is being read.
+	r := deadlineReader{r: io.LimitReader(file, maxSize+1), deadline: time.Now().Add(timeout)}
+	n, err := io.Copy(io.MultiWriter(writers...), r)
+	if err != nil {
+		return nil, err
+	}
+	if n > maxSize {
+		return nil, errTooLarge
+	}
+
+	sums := make([]string, len(hashes))
+	for i, h := range hashes {
+		sums[i] = algorithms[i] + ":" + hex.EncodeToString(h.Sum(nil))
+	}
+	return sums, nil
+}
+
+// deadlineReader fails with errHashTimeout once its deadline has
+// passed. A read that is already blocked isn't interrupted, but files
+// are opened without blocking, so only a file system that is slow to
+// return data can hold one up.
+type deadlineReader struct {
+	r        io.Reader
+	deadline time.Time
+}
+
+func (r deadlineReader) Read(p []byte) (int, error) {
+	if time.Now().After(r.deadline) {
+		return 0, errHashTimeout
+	}
+	return r.r.Read(p)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/fsnotify/fsnotify"
+)
+
+func TestHashFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+	err := os.WriteFile(path, []byte("hello"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sha256 := "sha256:2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	xxhash := fmt.Sprintf("xxhash:%016x", xxhash.Sum64String("hello"))
+	tests := []struct {
+		algorithms []string
+		maxSize    int64
+		want       []string
+		err        error
+	}{
+		{[]string{"sha256"}, 5, []string{sha256}, nil},
+		{[]string{"xxhash"}, 5, []string{xxhash}, nil},
+		{[]string{"xxhash", "sha256"}, 5, []string{xxhash, sha256}, nil},
+		{[]string{"sha256"}, 4, nil, errTooLarge},
+	}
+	for _, test := range tests {
+		got, err := hashFile(path, test.algorithms, test.maxSize, time.Second)
+		if !slices.Equal(got, test.want) || err != test.err {
+			t.Errorf("hashFile(%q, %d) = %q, %v, expected %q, %v", test.algorithms, test.maxSize, got, err, test.want, test.err)
+		}
+	}
+
+	_, err = hashFile(path, []string{"md5"}, 5, time.Second)
+	if err == nil {
+		t.Error("expected an error for an unknown algorithm")
+	}
+	_, err = hashFile(path, []string{"sha256"}, 5, -time.Second)
+	if err != errHashTimeout {
+		t.Errorf("got %v, expected %v", err, errHashTimeout)
+	}
+
+	link := filepath.Join(filepath.Dir(path), "link")
+	err = os.Symlink(path, link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = hashFile(link, []string{"sha256"}, 5, time.Second)
+	if err == nil {
+		t.Error("expected an error for a symlink")
+	}
+}
+
+func TestHashEvents(t *testing.T) {
+	config := DefaultConfig
+	config.HashMaxSize = 8
+	ts := newTestServerConfig(t, config)
+	root := t.TempDir()
+	path := filepath.Join(root, "file")
+	large := filepath.Join(root, "large")
+
+	ts.send(1, `add_watch {"path":"`+root+`","hash":"md5"}`)
+	ts.expect(1, `{"Err":"unknown hash algorithm \"md5\""}`)
+	ts.send(2, `add_watch {"path":"`+root+`","hash":"sha256","hash_dedup":true}`)
+	ts.expect(2, `"ok"`)
+
+	for path, contents := range map[string]string{path: "hello", large: "too large"} {
+		err := os.WriteFile(path, []byte(contents), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write := func(paths ...string) {
+		go func() {
+			for _, path := range paths {
+				ts.watcher.Inject(fsnotify.Event{Name: path, Op: fsnotify.Write})
+			}
+		}()
+	}
+	var id int
+	expect := func(path, op, extra string) {
+		t.Helper()
+		id++
+		ts.expect(0, fmt.Sprintf(`{"id":%v,"Name":%q,"root":%q,"op":[%q],"is_dir":false%v}`, id, path, root, op, extra))
+	}
+
+	write(path)
+	expect(path, "write", `,"hash":"sha256:2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"`)
+
+	// The contents haven't changed, so nothing is sent for the second
+	// write. Files are hashed in order, so the event for the other file
+	// shows that it was dropped rather than delayed.
+	write(path, large)
+	expect(large, "write", `,"hash_skipped":"too_large"`)
+
+	// Removing the file forgets its hash.
+	go ts.watcher.Inject(fsnotify.Event{Name: path, Op: fsnotify.Remove})
+	expect(path, "remove", "")
+	write(path)
+	expect(path, "write", `,"hash":"sha256:2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"`)
+}
+
+func TestHashAllEvents(t *testing.T) {
+	config := DefaultConfig
+	config.HashEvents = true
+	ts := newTestServerConfig(t, config)
+	root := t.TempDir()
+	path := filepath.Join(root, "file")
+	dir := filepath.Join(root, "dir")
+
+	err := os.WriteFile(path, []byte("hello"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Mkdir(dir, 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts.send(1, `add_watch {"path":"`+root+`","hash":"xxhash"}`)
+	ts.expect(1, `"ok"`)
+
+	// Events that aren't hashed can overtake those that are, so they
+	// are sent one at a time.
+	sha256 := `,"sha256":"2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"`
+	go func() {
+		ts.watcher.Inject(fsnotify.Event{Name: path, Op: fsnotify.Create})
+		ts.watcher.Inject(fsnotify.Event{Name: path, Op: fsnotify.Write})
+	}()
+	ts.expect(0, fmt.Sprintf(`{"id":1,"Name":%q,"root":%q,"op":["create"],"is_dir":false%v}`, path, root, sha256))
+	ts.expect(0, fmt.Sprintf(`{"id":2,"Name":%q,"root":%q,"op":["write"],"is_dir":false,"hash":"xxhash:%016x"%v}`, path, root, xxhash.Sum64String("hello"), sha256))
+
+	go ts.watcher.Inject(fsnotify.Event{Name: dir, Op: fsnotify.Create})
+	ts.expect(0, fmt.Sprintf(`{"id":3,"Name":%q,"root":%q,"op":["create"],"is_dir":true}`, dir, root))
+	go ts.watcher.Inject(fsnotify.Event{Name: path, Op: fsnotify.Remove})
+	ts.expect(0, fmt.Sprintf(`{"id":4,"Name":%q,"root":%q,"op":["remove"],"is_dir":false}`, path, root))
+}
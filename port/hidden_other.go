@@ -0,0 +1,12 @@
+//go:build !windows
+
+package main
+
+import "github.com/fsnotify/fsnotify"
+
+// hasHiddenAttribute always returns false because only Windows has a
+// hidden attribute. Elsewhere, being hidden is just a naming
+// convention.
+func hasHiddenAttribute(event fsnotify.Event) bool {
+	return false
+}
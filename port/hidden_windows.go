@@ -0,0 +1,54 @@
+package main
+
+import (
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// maxHiddenCache is the most paths whose hidden attribute is cached
+// at once.
+const maxHiddenCache = 4096
+
+// hiddenCache caches whether paths have the hidden attribute so that
+// it doesn't have to be checked for every event, and so that it is
+// still known once a path has been removed.
+var hiddenCache struct {
+	m      sync.Mutex
+	hidden map[string]bool
+}
+
+// hasHiddenAttribute reports whether the path of event has the hidden
+// attribute.
+func hasHiddenAttribute(event fsnotify.Event) bool {
+	path := filepath.Clean(event.Name)
+
+	hiddenCache.m.Lock()
+	hidden, ok := hiddenCache.hidden[path]
+	if event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename) {
+		delete(hiddenCache.hidden, path)
+		hiddenCache.m.Unlock()
+		return hidden
+	}
+	hiddenCache.m.Unlock()
+	if ok && !event.Has(fsnotify.Chmod) && !event.Has(fsnotify.Create) {
+		return hidden
+	}
+
+	name, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return false
+	}
+	attrs, err := syscall.GetFileAttributes(name)
+	hidden = err == nil && attrs&syscall.FILE_ATTRIBUTE_HIDDEN != 0
+
+	hiddenCache.m.Lock()
+	defer hiddenCache.m.Unlock()
+	if hiddenCache.hidden == nil || len(hiddenCache.hidden) >= maxHiddenCache {
+		hiddenCache.hidden = make(map[string]bool)
+	}
+	hiddenCache.hidden[path] = hidden
+	return hidden
+}
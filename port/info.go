@@ -0,0 +1,172 @@
+package main
+
+import (
+	"os"
+	"runtime"
+	"time"
+)
+
+// processStart is when the process started, as recorded by main.
+var processStart time.Time
+
+// uptimeData tells clients how long the process has been running so
+// that they can detect restarts.
+type uptimeData struct {
+	Start         string `json:"start"`
+	UptimeSeconds int64  `json:"uptime_seconds"`
+}
+
+// memoryStats is a subset of runtime.MemStats.
+type memoryStats struct {
+	Alloc        uint64
+	TotalAlloc   uint64
+	Sys          uint64
+	NumGC        uint32
+	PauseTotalNs uint64
+	HeapInuse    uint64
+}
+
+// readMemoryStats reads the runtime's memory statistics. This stops
+// the world, pausing event delivery, so it shouldn't be called
+// frequently.
+func readMemoryStats() memoryStats {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return memoryStats{
+		Alloc:        stats.Alloc,
+		TotalAlloc:   stats.TotalAlloc,
+		Sys:          stats.Sys,
+		NumGC:        stats.NumGC,
+		PauseTotalNs: stats.PauseTotalNs,
+		HeapInuse:    stats.HeapInuse,
+	}
+}
+
+func uptime() uptimeData {
+	return uptimeData{
+		Start:         processStart.Format(time.RFC3339),
+		UptimeSeconds: int64(time.Since(processStart).Seconds()),
+	}
+}
+
+// infoData describes the environment that the port is running in.
+// Fields that can't be determined on the current platform are
+// omitted.
+type infoData struct {
+	PID        int           `json:"pid"`
+	OS         string        `json:"os"`
+	Backend    string        `json:"backend"`
+	GoVersion  string        `json:"go_version"`
+	GOMAXPROCS int           `json:"gomaxprocs"`
+	OpenFDs    int           `json:"open_fds,omitzero"`
+	Inotify    *inotifyInfo  `json:"inotify,omitzero"`
+	Transport  transportInfo `json:"transport"`
+}
+
+// inotifyInfo holds the system's inotify limits and the process's
+// usage of them.
+type inotifyInfo struct {
+	MaxUserWatches   int `json:"max_user_watches,omitzero"`
+	MaxUserInstances int `json:"max_user_instances,omitzero"`
+	MaxQueuedEvents  int `json:"max_queued_events,omitzero"`
+	Watches          int `json:"watches"`
+	Instances        int `json:"instances"`
+}
+
+type transportInfo struct {
+	Transport   string  `json:"transport"`
+	Encoding    string  `json:"encoding"`
+	DropPolicy  string  `json:"drop_policy"`
+	DropTimeout string  `json:"drop_timeout"`
+	BufferSize  int     `json:"buffer_size"`
+	Playback    string  `json:"playback,omitzero"`
+	MaxWatches  int     `json:"max_watches,omitzero"`
+	CommandRate float64 `json:"command_rate,omitzero"`
+	Timestamps  bool    `json:"timestamps,omitzero"`
+	Batch       bool    `json:"batch,omitzero"`
+}
+
+// backend returns the name of the kernel interface that fsnotify uses
+// on the current platform.
+func backend() string {
+	switch runtime.GOOS {
+	case "linux", "android":
+		return "inotify"
+	case "darwin", "freebsd", "openbsd", "netbsd", "dragonfly":
+		return "kqueue"
+	case "windows":
+		return "ReadDirectoryChangesW"
+	case "illumos", "solaris":
+		return "fen"
+	default:
+		return "unknown"
+	}
+}
+
+func (s *Server) info(c *conn) infoData {
+	return infoData{
+		PID:        os.Getpid(),
+		OS:         runtime.GOOS,
+		Backend:    backend(),
+		GoVersion:  runtime.Version(),
+		GOMAXPROCS: runtime.GOMAXPROCS(0),
+		OpenFDs:    openFDs(),
+		Inotify:    readInotifyInfo(),
+		Transport: transportInfo{
+			Transport:   c.transport,
+			Encoding:    "json",
+			DropPolicy:  s.config.DropPolicy.String(),
+			DropTimeout: s.config.DropTimeout.String(),
+			BufferSize:  s.config.BufferSize,
+			Playback:    s.config.Playback,
+			MaxWatches:  s.config.MaxWatches,
+			CommandRate: s.config.CommandRate,
+			Timestamps:  s.config.Timestamps,
+			Batch:       s.config.Batch,
+		},
+	}
+}
+
+// capabilitiesData describes what the port can do and whether any of
+// it is currently unavailable.
+type capabilitiesData struct {
+	Backend  string   `json:"backend"`
+	Features []string `json:"features"`
+	Circuit  string   `json:"circuit"`
+
+	// Compression lists the algorithms that the compress command
+	// accepts.
+	Compression []string `json:"compression"`
+}
+
+// features lists the optional functionality supported by the port.
+var features = []string{
+	"debounce",
+	"handles",
+	"pause",
+	"rate_limit",
+	"record",
+	"recursive",
+	"scan",
+	"sticky",
+	"tags",
+}
+
+func (s *Server) capabilities() capabilitiesData {
+	return capabilitiesData{
+		Backend:  backend(),
+		Features: features,
+		Circuit:  s.breaker.state(),
+
+		Compression: s.compression(),
+	}
+}
+
+// compression returns the compression algorithms that clients can
+// switch to.
+func (s *Server) compression() []string {
+	if s.config.Compress == "" {
+		return []string{}
+	}
+	return []string{s.config.Compress}
+}
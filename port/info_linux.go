@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+func openFDs() int {
+	fds, _ := os.ReadDir("/proc/self/fd")
+	return len(fds)
+}
+
+func readInotifyInfo() *inotifyInfo {
+	info := inotifyInfo{
+		MaxUserWatches:   readProcInt("/proc/sys/fs/inotify/max_user_watches"),
+		MaxUserInstances: readProcInt("/proc/sys/fs/inotify/max_user_instances"),
+		MaxQueuedEvents:  readProcInt("/proc/sys/fs/inotify/max_queued_events"),
+	}
+
+	fds, _ := os.ReadDir("/proc/self/fd")
+	for _, fd := range fds {
+		target, err := os.Readlink(filepath.Join("/proc/self/fd", fd.Name()))
+		if err != nil || target != "anon_inode:inotify" {
+			continue
+		}
+		info.Instances++
+		info.Watches += countInotifyWatches(filepath.Join("/proc/self/fdinfo", fd.Name()))
+	}
+
+	return &info
+}
+
+// countInotifyWatches counts the watches listed in the fdinfo file of
+// an inotify instance.
+func countInotifyWatches(path string) int {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+
+	var n int
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		if bytes.HasPrefix(s.Bytes(), []byte("inotify wd:")) {
+			n++
+		}
+	}
+	return n
+}
+
+// readProcInt reads a file containing a single integer, returning 0 if
+// it can't.
+func readProcInt(path string) int {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	n, _ := strconv.Atoi(string(bytes.TrimSpace(data)))
+	return n
+}
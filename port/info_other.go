@@ -0,0 +1,16 @@
+//go:build !linux
+
+package main
+
+import "os"
+
+func openFDs() int {
+	// /dev/fd is available on the BSDs and macOS but not on Windows.
+	fds, _ := os.ReadDir("/dev/fd")
+	return len(fds)
+}
+
+// readInotifyInfo returns nil because inotify only exists on Linux.
+func readInotifyInfo() *inotifyInfo {
+	return nil
+}
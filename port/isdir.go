@@ -0,0 +1,192 @@
+package main
+
+import (
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// dirCache remembers which watched paths, and which entries of
+// watched directories, are directories. This makes it possible to
+// tell clients whether a removed path was a directory after it is too
+// late to stat it.
+type dirCache struct {
+	m sync.Mutex
+
+	// watched holds whether each watched path is a directory.
+	watched map[string]bool
+
+	// children holds whether each entry of each watched directory is
+	// a directory, keyed by the directory and then the entry's name.
+	children map[string]map[string]bool
+}
+
+// seed records path as watched, along with the entries in it if it is
+// a directory.
+func (c *dirCache) seed(path string) {
+	path = filepath.Clean(path)
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+
+	var children map[string]bool
+	if info.IsDir() {
+		entries, _ := os.ReadDir(path)
+		children = make(map[string]bool, len(entries))
+		for _, entry := range entries {
+			children[entry.Name()] = entry.IsDir()
+		}
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.watched == nil {
+		c.watched = make(map[string]bool)
+		c.children = make(map[string]map[string]bool)
+	}
+	c.watched[path] = info.IsDir()
+	if children != nil {
+		c.children[path] = children
+	}
+}
+
+// forget discards everything known about path and its entries.
+func (c *dirCache) forget(path string) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	path = filepath.Clean(path)
+	delete(c.watched, path)
+	delete(c.children, path)
+}
+
+// lookup returns whether path is a directory if it is known. The
+// caller must hold c.m.
+func (c *dirCache) lookup(path string) (isDir, ok bool) {
+	if isDir, ok := c.watched[path]; ok {
+		return isDir, true
+	}
+	isDir, ok = c.children[filepath.Dir(path)][filepath.Base(path)]
+	return isDir, ok
+}
+
+// observe updates the cache from event, returning whether its path is
+// a directory, or nil if that can't be determined. It must be called
+// for every event as it is received, before later events can change
+// the answer.
+func (c *dirCache) observe(event fsnotify.Event) *bool {
+	path := filepath.Clean(event.Name)
+	if event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename) {
+		c.m.Lock()
+		defer c.m.Unlock()
+
+		isDir, ok := c.lookup(path)
+		delete(c.children[filepath.Dir(path)], filepath.Base(path))
+		delete(c.watched, path)
+		delete(c.children, path)
+		if !ok {
+			return nil
+		}
+		return &isDir
+	}
+
+	if !event.Has(fsnotify.Create) {
+		if isDir := c.isDir(path); isDir != nil {
+			return isDir
+		}
+	}
+
+	// The path is new or unknown, so find out by asking.
+	info, err := os.Lstat(path)
+	if err != nil {
+		return nil
+	}
+	isDir := info.IsDir()
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if children, ok := c.children[filepath.Dir(path)]; ok {
+		children[filepath.Base(path)] = isDir
+	}
+	return &isDir
+}
+
+// orphan is an entry of a removed directory.
+type orphan struct {
+	path  string
+	isDir bool
+}
+
+// orphans forgets the entries of the directory at path, along with
+// those of any watched directories among them, returning them with the
+// entries of each directory before the directory itself. It must be
+// called before observe for the directory's removal.
+func (c *dirCache) orphans(path string) []orphan {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	return c.orphansLocked(filepath.Clean(path))
+}
+
+func (c *dirCache) orphansLocked(dir string) []orphan {
+	children, ok := c.children[dir]
+	if !ok {
+		return nil
+	}
+	delete(c.children, dir)
+
+	names := slices.Sorted(maps.Keys(children))
+	var orphans []orphan
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		if children[name] {
+			orphans = append(orphans, c.orphansLocked(path)...)
+			delete(c.watched, path)
+		}
+		orphans = append(orphans, orphan{path: path, isDir: children[name]})
+	}
+	return orphans
+}
+
+// isDir returns whether path is a directory according to the cache,
+// or nil if it isn't known.
+func (c *dirCache) isDir(path string) *bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	isDir, ok := c.lookup(filepath.Clean(path))
+	if !ok {
+		return nil
+	}
+	return &isDir
+}
+
+// dirCacheWatcher is a Watcher that keeps a dirCache up to date with
+// the paths that it watches.
+type dirCacheWatcher struct {
+	Watcher
+	dirs *dirCache
+}
+
+func (w dirCacheWatcher) Add(path string) error {
+	err := w.Watcher.Add(path)
+	if err == nil {
+		w.dirs.seed(path)
+	}
+	return err
+}
+
+func (w dirCacheWatcher) Remove(path string) error {
+	err := w.Watcher.Remove(path)
+	if err == nil {
+		w.dirs.forget(path)
+	}
+	return err
+}
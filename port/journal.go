@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json/v2"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// journalMagic starts every journal file.
+const journalMagic = "FSNJRNL\x01"
+
+// A journal file consists of journalMagic followed by records, each of
+// which is a big-endian uint32 length, a big-endian uint32 CRC-32 of
+// the payload, and the payload, which is the JSON of a single event
+// frame. An empty record marks where an instance of the port started
+// appending, after which event IDs can start over.
+const journalRecordHeader = 8
+
+// journalOptions are the arguments of journal_start. They can be
+// given either as a bare path or as a JSON object.
+type journalOptions struct {
+	Path string `json:"path"`
+
+	// Fsync is "always" to sync after every event, "never" to leave
+	// it to the OS, or a duration such as "1s" to sync at most that
+	// often. The default is "always".
+	Fsync string `json:"fsync,omitzero"`
+}
+
+func parseJournalOptions(arg string) (opts journalOptions, err error) {
+	if !strings.HasPrefix(arg, "{") {
+		return journalOptions{Path: arg}, nil
+	}
+
+	err = json.Unmarshal([]byte(arg), &opts)
+	return opts, err
+}
+
+// journal appends every event sent to clients to a file so that they
+// can be replayed by another instance after a restart.
+type journal struct {
+	m    sync.Mutex
+	file *os.File
+
+	// interval is how often to sync the file. Zero syncs after every
+	// event and a negative value never syncs.
+	interval time.Duration
+	synced   time.Time
+}
+
+func parseFsync(fsync string) (time.Duration, error) {
+	switch fsync {
+	case "", "always":
+		return 0, nil
+	case "never":
+		return -1, nil
+	default:
+		d, err := time.ParseDuration(fsync)
+		if err != nil || d <= 0 {
+			return 0, fmt.Errorf("invalid fsync policy: %q", fsync)
+		}
+		return d, nil
+	}
+}
+
+func (j *journal) start(opts journalOptions) error {
+	interval, err := parseFsync(opts.Fsync)
+	if err != nil {
+		return err
+	}
+
+	j.m.Lock()
+	defer j.m.Unlock()
+
+	if j.file != nil {
+		return fmt.Errorf("already journaling to %q", j.file.Name())
+	}
+
+	file, err := os.OpenFile(opts.Path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	err = checkJournalHeader(file)
+	if err == nil {
+		_, err = file.Write(make([]byte, journalRecordHeader))
+	}
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	j.file = file
+	j.interval = interval
+	j.synced = time.Now()
+	return nil
+}
+
+// checkJournalHeader writes the header to a new journal file or makes
+// sure that an existing one has it.
+func checkJournalHeader(file *os.File) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		_, err := io.WriteString(file, journalMagic)
+		return err
+	}
+
+	magic := make([]byte, len(journalMagic))
+	_, err = file.ReadAt(magic, 0)
+	if err != nil || string(magic) != journalMagic {
+		return fmt.Errorf("%q is not a journal", file.Name())
+	}
+	return nil
+}
+
+func (j *journal) stop() error {
+	j.m.Lock()
+	defer j.m.Unlock()
+
+	if j.file == nil {
+		return errors.New("not journaling")
+	}
+
+	err := j.file.Sync()
+	err = errors.Join(err, j.file.Close())
+	j.file = nil
+	return err
+}
+
+// append writes event to the journal, if there is one. If that
+// fails, journaling is stopped, since a journal with events missing
+// from it can't be relied on, and the error is returned.
+func (j *journal) append(event []byte) error {
+	j.m.Lock()
+	defer j.m.Unlock()
+
+	if j.file == nil {
+		return nil
+	}
+
+	record := make([]byte, journalRecordHeader, journalRecordHeader+len(event))
+	binary.BigEndian.PutUint32(record, uint32(len(event)))
+	binary.BigEndian.PutUint32(record[4:], crc32.ChecksumIEEE(event))
+	record = append(record, event...)
+	_, err := j.file.Write(record)
+	if err == nil && j.interval >= 0 {
+		if now := time.Now(); now.Sub(j.synced) >= j.interval {
+			err = j.file.Sync()
+			j.synced = now
+		}
+	}
+	if err != nil {
+		name := j.file.Name()
+		j.file.Close()
+		j.file = nil
+		return &codedError{Code: "journal_failed", Err: fmt.Errorf("journaling to %q stopped: %w", name, err)}
+	}
+	return nil
+}
+
+type replayData struct {
+	Replayed int `json:"replayed"`
+
+	// Duplicates is how many events weren't sent because an event
+	// with the same ID already was.
+	Duplicates int `json:"duplicates,omitzero"`
+
+	// Truncated is true if the journal ended partway through a
+	// record, which happens if the process was killed while writing
+	// it.
+	Truncated bool `json:"truncated,omitzero"`
+}
+
+// replayJournal sends every event in the journal at path to clients,
+// skipping any with an ID that was already sent since the last time
+// that IDs could have started over. Replay stops with an error at the
+// first corrupt record, which includes any too large to send.
+func (s *Server) replayJournal(path string) (replayData, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return replayData{}, err
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+	magic := make([]byte, len(journalMagic))
+	_, err = io.ReadFull(r, magic)
+	if err != nil || !bytes.Equal(magic, []byte(journalMagic)) {
+		return replayData{}, fmt.Errorf("%q is not a journal", path)
+	}
+
+	var result replayData
+	var lastID uint64
+	limit := s.config.frameFormat().maxPayload()
+	offset := int64(len(journalMagic))
+	header := make([]byte, journalRecordHeader)
+	for {
+		_, err := io.ReadFull(r, header)
+		if err != nil {
+			result.Truncated = errors.Is(err, io.ErrUnexpectedEOF)
+			return result, nil
+		}
+
+		size := binary.BigEndian.Uint32(header)
+		if int64(size) > int64(limit) {
+			return result, journalCorrupt(offset, result, "record too large")
+		}
+		event := make([]byte, size)
+		_, err = io.ReadFull(r, event)
+		if err != nil {
+			result.Truncated = true
+			return result, nil
+		}
+		if crc32.ChecksumIEEE(event) != binary.BigEndian.Uint32(header[4:]) {
+			return result, journalCorrupt(offset, result, "checksum mismatch")
+		}
+
+		offset += int64(journalRecordHeader) + int64(size)
+
+		if size == 0 {
+			lastID = 0
+			continue
+		}
+		id := journalEventID(event)
+		if id != 0 && id <= lastID {
+			result.Duplicates++
+			continue
+		}
+		lastID = max(lastID, id)
+		s.bcast.send(broadcastFrame{data: s.eventPayload(event)})
+		result.Replayed++
+	}
+}
+
+// journalEventID returns the ID of a journaled event, or 0 if it
+// doesn't have one.
+func journalEventID(event []byte) uint64 {
+	var ids struct {
+		ID uint64 `json:"id"`
+	}
+	json.Unmarshal(event, &ids)
+	return ids.ID
+}
+
+func journalCorrupt(offset int64, result replayData, reason string) error {
+	return &codedError{
+		Code: "journal_corrupt",
+		Err:  fmt.Errorf("journal is corrupt at offset %v: %v", offset, reason),
+		Details: map[string]any{
+			"offset":   offset,
+			"replayed": result.Replayed,
+		},
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func TestJournalWriteError(t *testing.T) {
+	ts := newTestServer(t)
+	path := filepath.Join(t.TempDir(), "journal")
+
+	ts.send(1, "journal_start "+path)
+	ts.expect(1, `"ok"`)
+	ts.send(2, "add_watch /src")
+	ts.expect(2, `"ok"`)
+
+	// Closing the file out from under the journal makes the next
+	// write fail.
+	ts.server.journal.file.Close()
+	go ts.watcher.Inject(fsnotify.Event{Name: "/src/a", Op: fsnotify.Write})
+	ts.expect(0, `{"Err":"journaling to \"`+path+`\" stopped: write `+path+`: file already closed","code":"journal_failed"}`)
+	ts.expect(0, `{"id":1,"Name":"/src/a","root":"/src","op":["write"],"is_dir":null}`)
+
+	ts.send(3, "journal_stop")
+	ts.expect(3, `{"Err":"not journaling"}`)
+}
+
+// journalRecords returns a journal containing records, where an empty
+// record is the marker written by journal_start.
+func journalRecords(records ...string) []byte {
+	data := []byte(journalMagic)
+	for _, record := range records {
+		data = binary.BigEndian.AppendUint32(data, uint32(len(record)))
+		data = binary.BigEndian.AppendUint32(data, crc32.ChecksumIEEE([]byte(record)))
+		data = append(data, record...)
+	}
+	return data
+}
+
+func writeJournal(t *testing.T, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "journal")
+	err := os.WriteFile(path, data, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestJournalReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	events := []string{
+		`{"id":1,"Name":"/src/a","root":"/src","op":["create"],"is_dir":null}`,
+		`{"id":2,"Name":"/src/a","root":"/src","op":["write"],"is_dir":null}`,
+		// IDs start over after a restart.
+		`{"id":1,"Name":"/src/b","root":"/src","op":["create"],"is_dir":null}`,
+	}
+
+	// run journals the injected events with a new instance of the
+	// port.
+	run := func(events []string, injected ...fsnotify.Event) {
+		ts := newTestServer(t)
+		ts.send(1, "journal_start "+path)
+		ts.expect(1, `"ok"`)
+		ts.send(2, "add_watch /src")
+		ts.expect(2, `"ok"`)
+		go func() {
+			for _, event := range injected {
+				ts.watcher.Inject(event)
+			}
+		}()
+		for _, event := range events {
+			ts.expect(0, event)
+		}
+		ts.send(3, "journal_stop")
+		ts.expect(3, `"ok"`)
+	}
+	run(events[:2],
+		fsnotify.Event{Name: "/src/a", Op: fsnotify.Create},
+		fsnotify.Event{Name: "/src/a", Op: fsnotify.Write},
+	)
+	run(events[2:], fsnotify.Event{Name: "/src/b", Op: fsnotify.Create})
+
+	ts := newTestServer(t)
+	ts.send(1, "journal_replay "+path)
+	for _, event := range events {
+		ts.expect(0, event)
+	}
+	ts.expect(1, `{"replayed":3}`)
+}
+
+func TestJournalReplayDuplicates(t *testing.T) {
+	a := `{"id":1,"Name":"/src/a","root":"/src","op":["create"],"is_dir":null}`
+	b := `{"id":2,"Name":"/src/b","root":"/src","op":["create"],"is_dir":null}`
+	path := writeJournal(t, journalRecords("", a, b, a, b, "", a))
+
+	ts := newTestServer(t)
+	ts.send(1, "journal_replay "+path)
+	ts.expect(0, a)
+	ts.expect(0, b)
+	ts.expect(0, a)
+	ts.expect(1, `{"replayed":3,"duplicates":2}`)
+}
+
+// TestJournalReplayLarge checks that events are limited by the frame
+// format in use rather than by the older format.
+func TestJournalReplayLarge(t *testing.T) {
+	event := fmt.Sprintf(`{"id":1,"Name":"/src/%v","root":"/src","op":["create"],"is_dir":null}`, strings.Repeat("a", maxPayloadSize))
+	path := writeJournal(t, journalRecords("", event))
+
+	ts := newTestServer(t)
+	ts.send(1, "journal_replay "+path)
+	ts.expect(0, event)
+	ts.expect(1, `{"replayed":1}`)
+}
+
+func TestJournalReplayTruncated(t *testing.T) {
+	a := `{"id":1,"Name":"/src/a","root":"/src","op":["create"],"is_dir":null}`
+	b := `{"id":2,"Name":"/src/b","root":"/src","op":["create"],"is_dir":null}`
+	data := journalRecords("", a, b)
+
+	tests := []struct {
+		name string
+		cut  int
+	}{
+		{"Header", len(b) + 5},
+		{"Payload", len(b) - 5},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := writeJournal(t, data[:len(data)-test.cut])
+			ts := newTestServer(t)
+			ts.send(1, "journal_replay "+path)
+			ts.expect(0, a)
+			ts.expect(1, `{"replayed":1,"truncated":true}`)
+		})
+	}
+}
+
+func TestJournalReplayCorrupt(t *testing.T) {
+	a := `{"id":1,"Name":"/src/a","root":"/src","op":["create"],"is_dir":null}`
+	b := `{"id":2,"Name":"/src/b","root":"/src","op":["create"],"is_dir":null}`
+	offset := len(journalRecords("", a))
+
+	checksum := journalRecords("", a, b)
+	checksum[len(checksum)-2] ^= 0xFF
+	size := journalRecords("", a, b)
+	binary.BigEndian.PutUint32(size[offset:], maxCRCFrameSize)
+
+	tests := []struct {
+		name   string
+		data   []byte
+		reason string
+	}{
+		{"Checksum", checksum, "checksum mismatch"},
+		{"Size", size, "record too large"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := writeJournal(t, test.data)
+			ts := newTestServer(t)
+			ts.send(1, "journal_replay "+path)
+			ts.expect(0, a)
+			// The members of errors with details are in no particular
+			// order.
+			id, payload := ts.next()
+			want := []string{
+				fmt.Sprintf(`"Err":"journal is corrupt at offset %v: %v"`, offset, test.reason),
+				`"code":"journal_corrupt"`,
+				fmt.Sprintf(`"offset":%v`, offset),
+				`"replayed":1`,
+			}
+			for _, member := range want {
+				if id != 1 || !strings.Contains(payload, member) {
+					t.Fatalf("got %v: %s, expected 1: {%s}", id, payload, strings.Join(want, ","))
+				}
+			}
+		})
+	}
+
+	path := writeJournal(t, []byte("not a journal"))
+	ts := newTestServer(t)
+	ts.send(1, "journal_replay "+path)
+	ts.expect(1, `{"Err":"\"`+path+`\" is not a journal"}`)
+}
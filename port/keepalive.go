@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// keepalive sends a keepalive frame to each client whenever nothing
+// else has been sent to it for interval, until ctx is canceled. This
+// keeps idle connections from being closed by routers and load
+// balancers in between.
+func (s *Server) keepalive(ctx context.Context, interval time.Duration) {
+	payload := []byte(`{"op":"Keepalive"}`)
+
+	t := time.NewTimer(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		idle, next := s.bcast.idle(interval)
+		for _, c := range idle {
+			s.bcast.send(broadcastFrame{data: payload, to: c})
+		}
+		t.Reset(next)
+	}
+}
+
+// idle returns the connections that haven't been sent anything for at
+// least d, along with how long it will be until the next of the
+// others will have been idle for that long.
+func (b *broadcaster) idle(d time.Duration) (idle []*conn, next time.Duration) {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	now := time.Now()
+	next = d
+	for c := range b.conns {
+		since := now.Sub(c.out.lastWrite())
+		if since >= d {
+			idle = append(idle, c)
+			continue
+		}
+		next = min(next, d-since)
+	}
+	return idle, next
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/pierrec/lz4/v4"
+)
+
+// Names of compression algorithms for -compress and the compress
+// command.
+const (
+	compressNone = "none"
+	compressLZ4  = "lz4"
+)
+
+// errCompressionDisabled is reported by the compress command for
+// algorithms that weren't enabled with -compress.
+var errCompressionDisabled = &codedError{Code: "not_supported", Err: errors.New("compression is disabled; see -compress")}
+
+// lz4Overhead returns the most that compressing n bytes with
+// compressPayload can add to them.
+func lz4Overhead(n int) int {
+	return 4 + lz4.CompressBlockBound(n) - n
+}
+
+// compressPayload returns payload compressed as an LZ4 block, preceded
+// by its uncompressed size as a big-endian uint32 since the block
+// format doesn't record it.
+func compressPayload(payload []byte) []byte {
+	dst := make([]byte, 4+lz4.CompressBlockBound(len(payload)))
+	binary.BigEndian.PutUint32(dst, uint32(len(payload)))
+
+	// The destination is large enough for anything, so compression
+	// can't fail.
+	var c lz4.Compressor
+	n, err := c.CompressBlock(payload, dst[4:])
+	if err != nil {
+		panic(err)
+	}
+	return dst[:4+n]
+}
+
+// parseCompression checks the value of -compress.
+func parseCompression(name string) (string, error) {
+	switch name {
+	case "", compressNone:
+		return "", nil
+	case compressLZ4:
+		return name, nil
+	default:
+		return "", fmt.Errorf("unknown compression %q", name)
+	}
+}
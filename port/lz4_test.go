@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math/rand/v2"
+	"strings"
+	"testing"
+
+	"github.com/pierrec/lz4/v4"
+)
+
+// decompressPayload reverses compressPayload.
+func decompressPayload(payload []byte) ([]byte, error) {
+	if len(payload) < 4 {
+		return nil, errors.New("missing size")
+	}
+	dst := make([]byte, binary.BigEndian.Uint32(payload))
+	n, err := lz4.UncompressBlock(payload[4:], dst)
+	if err != nil {
+		return nil, err
+	}
+	if n != len(dst) {
+		return nil, errors.New("size mismatch")
+	}
+	return dst, nil
+}
+
+func TestLZ4RoundTrip(t *testing.T) {
+	r := rand.New(rand.NewPCG(1, 2))
+	random := make([]byte, 100000)
+	for i := range random {
+		random[i] = byte(r.Uint32())
+	}
+	event := `{"Name":"/home/user/project/build/output/file.o","root":"/home/user/project","op":["write"],"is_dir":false}`
+
+	tests := []struct {
+		name  string
+		input []byte
+	}{
+		{"Empty", nil},
+		{"Short", []byte("ok")},
+		{"Events", []byte("[" + strings.Repeat(event+",", 500) + event + "]")},
+		{"Random", random},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := decompressPayload(compressPayload(test.input))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, test.input) {
+				t.Fatalf("round trip changed the payload")
+			}
+		})
+	}
+
+	compressed := compressPayload(tests[2].input)
+	if len(compressed) > len(tests[2].input)/10 {
+		t.Fatalf("compressed %v bytes of events to %v", len(tests[2].input), len(compressed))
+	}
+}
+
+func TestCompress(t *testing.T) {
+	config := DefaultConfig
+	config.Compress = compressLZ4
+	ts := newTestServerConfig(t, config)
+	text := strings.Repeat("compressible ", 100)
+
+	// next returns the next frame's payload after checking that it
+	// is the reply to id and decompressing it.
+	next := func(id uint64) string {
+		t.Helper()
+		got, payload := ts.next()
+		if got != id {
+			t.Fatalf("got reply to %v, expected %v", got, id)
+		}
+		decompressed, err := decompressPayload([]byte(payload))
+		if err != nil {
+			t.Fatalf("decompress %q: %v", payload, err)
+		}
+		return string(decompressed)
+	}
+
+	// Frames are compressed from the start.
+	ts.send(1, "echo "+text)
+	if got := next(1); got != text {
+		t.Fatalf("got %q", got)
+	}
+
+	ts.send(2, "capabilities")
+	if caps := next(2); !strings.Contains(caps, `"compression":["lz4"]`) {
+		t.Fatalf("capabilities don't list lz4: %s", caps)
+	}
+
+	ts.send(3, "compress gzip")
+	if got := next(3); got != `{"Err":"compression is disabled; see -compress","code":"not_supported"}` {
+		t.Fatalf("got %s", got)
+	}
+
+	// The reply to compress none is the last compressed frame.
+	ts.send(4, "compress none")
+	if got := next(4); got != `"ok"` {
+		t.Fatalf("got %s", got)
+	}
+	ts.send(5, "echo "+text)
+	ts.expect(5, text)
+
+	ts.send(6, "compress lz4")
+	ts.expect(6, `"ok"`)
+	ts.send(7, "echo "+text)
+	if got := next(7); got != text {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestCompressDisabled(t *testing.T) {
+	ts := newTestServer(t)
+
+	ts.send(1, "capabilities")
+	_, caps := ts.next()
+	if !strings.Contains(caps, `"compression":[]`) {
+		t.Fatalf("capabilities list compression: %s", caps)
+	}
+
+	ts.send(2, "compress lz4")
+	ts.expect(2, `{"Err":"compression is disabled; see -compress","code":"not_supported"}`)
+	ts.send(3, "compress none")
+	ts.expect(3, `"ok"`)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// opMoved is the operation of events that pair a rename with the
+// create that it caused. It isn't one of fsnotify's operations, so it
+// uses a bit that fsnotify doesn't.
+const opMoved fsnotify.Op = 1 << 31
+
+// watcherReportsRenames is true on platforms where fsnotify reports
+// the path that a created path was renamed from, in which case pairs
+// don't have to be guessed at.
+const watcherReportsRenames = runtime.GOOS == "linux" || runtime.GOOS == "windows"
+
+// renamedFrom returns the path that the path created by event was
+// renamed from if fsnotify reported it. fsnotify only exposes it via
+// the event's String method, which quotes both paths.
+func renamedFrom(event fsnotify.Event) (string, bool) {
+	str := event.String()
+	start := strings.IndexByte(str, '"')
+	if start < 0 {
+		return "", false
+	}
+	name, err := strconv.QuotedPrefix(str[start:])
+	if err != nil {
+		return "", false
+	}
+
+	rest, ok := strings.CutPrefix(str[start+len(name):], " ← ")
+	if !ok {
+		return "", false
+	}
+	from, err := strconv.Unquote(rest)
+	return from, err == nil
+}
+
+// heldRename is a rename that is waiting to be paired with a create.
+type heldRename struct {
+	path  string
+	data  eventData
+	timer timer
+}
+
+// mover pairs renames with the creates that they cause, sending a
+// single moved event in their place. Renames are held for up to a
+// window waiting for their create, after which they are sent on their
+// own.
+type mover struct {
+	clock  clock
+	window time.Duration
+	emit   func(eventData)
+
+	// reported is true if the watcher reports what created paths were
+	// renamed from. Otherwise, a create is paired with the oldest held
+	// rename, which is usually, but not always, right.
+	reported bool
+
+	m    sync.Mutex
+	held []*heldRename
+}
+
+func newMover(clock clock, window time.Duration, reported bool, emit func(eventData)) *mover {
+	return &mover{
+		clock:    clock,
+		window:   window,
+		reported: reported,
+		emit:     emit,
+	}
+}
+
+// handle passes data, which was created for event, to send unless it
+// is a rename that is being held. If it is a create that pairs with a
+// held rename, it is turned into a moved event first.
+func (m *mover) handle(event fsnotify.Event, data eventData, send func(any)) {
+	if m.window <= 0 {
+		send(data)
+		return
+	}
+
+	switch {
+	case event.Op == fsnotify.Rename:
+		m.hold(filepath.Clean(event.Name), data)
+		return
+	case event.Has(fsnotify.Create):
+		if from, ok := m.pair(event); ok {
+			data.From, data.To = from.Name, data.Name
+			if data.LegacyOp != nil {
+				op := opMoved
+				data.LegacyOp = &op
+			} else {
+				data.Op = eventOp(opMoved)
+			}
+		}
+	}
+	send(data)
+}
+
+// hold holds a rename until it is paired or the window has passed.
+func (m *mover) hold(path string, data eventData) {
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	r := &heldRename{path: path, data: data}
+	r.timer = m.clock.AfterFunc(m.window, func() { m.expire(r) })
+	m.held = append(m.held, r)
+}
+
+// pair returns the held rename that the create event pairs with, if
+// any, and stops holding it.
+func (m *mover) pair(event fsnotify.Event) (eventData, bool) {
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	i := -1
+	if m.reported {
+		from, ok := renamedFrom(event)
+		if !ok {
+			return eventData{}, false
+		}
+		from = filepath.Clean(from)
+		i = slices.IndexFunc(m.held, func(r *heldRename) bool { return r.path == from })
+	} else if len(m.held) > 0 {
+		i = 0
+	}
+	if i < 0 {
+		return eventData{}, false
+	}
+
+	r := m.held[i]
+	r.timer.Stop()
+	m.held = append(m.held[:i], m.held[i+1:]...)
+	return r.data, true
+}
+
+// expire sends r on its own if it is still being held.
+func (m *mover) expire(r *heldRename) {
+	m.m.Lock()
+	i := slices.IndexFunc(m.held, func(h *heldRename) bool { return h == r })
+	if i < 0 {
+		m.m.Unlock()
+		return
+	}
+	m.held = append(m.held[:i], m.held[i+1:]...)
+	m.m.Unlock()
+
+	m.emit(r.data)
+}
+
+// dropAll discards all held renames without sending them.
+func (m *mover) dropAll() {
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	for _, r := range m.held {
+		r.timer.Stop()
+	}
+	m.held = nil
+}
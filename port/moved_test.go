@@ -0,0 +1,105 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func newTestMover(reported bool) (*mover, *fakeClock, *[]eventData, *[]eventData) {
+	var emitted, sent []eventData
+	clock := newFakeClock()
+	m := newMover(clock, 50*time.Millisecond, reported, func(data eventData) {
+		emitted = append(emitted, data)
+	})
+	return m, clock, &emitted, &sent
+}
+
+func moverEvent(m *mover, sent *[]eventData, name string, op fsnotify.Op) {
+	event := fsnotify.Event{Name: name, Op: op}
+	m.handle(event, eventData{Name: name, Op: eventOp(op)}, func(data any) {
+		*sent = append(*sent, data.(eventData))
+	})
+}
+
+func TestMoverPair(t *testing.T) {
+	m, clock, emitted, sent := newTestMover(false)
+
+	moverEvent(m, sent, "/data/old", fsnotify.Rename)
+	if len(*sent) != 0 {
+		t.Fatalf("rename was not held: %v", *sent)
+	}
+	clock.Advance(10 * time.Millisecond)
+	moverEvent(m, sent, "/data/new", fsnotify.Create)
+
+	if len(*sent) != 1 {
+		t.Fatalf("got %v, expected a single moved event", *sent)
+	}
+	got := (*sent)[0]
+	if got.Name != "/data/new" || got.From != "/data/old" || got.To != "/data/new" || fsnotify.Op(got.Op) != opMoved {
+		t.Fatalf("got %+v, expected a move from /data/old to /data/new", got)
+	}
+
+	clock.Advance(time.Second)
+	if len(*emitted) != 0 {
+		t.Fatalf("paired rename was also emitted: %v", *emitted)
+	}
+}
+
+func TestMoverExpire(t *testing.T) {
+	m, clock, emitted, sent := newTestMover(false)
+
+	moverEvent(m, sent, "/data/old", fsnotify.Rename)
+	clock.Advance(60 * time.Millisecond)
+	if len(*emitted) != 1 || (*emitted)[0].Name != "/data/old" || fsnotify.Op((*emitted)[0].Op) != fsnotify.Rename {
+		t.Fatalf("got %v, expected the rename on its own", *emitted)
+	}
+
+	moverEvent(m, sent, "/data/new", fsnotify.Create)
+	if len(*sent) != 1 || (*sent)[0].From != "" {
+		t.Fatalf("got %v, expected a plain create", *sent)
+	}
+}
+
+func TestMoverReported(t *testing.T) {
+	m, clock, emitted, sent := newTestMover(true)
+
+	// Without fsnotify saying where the create came from, nothing is
+	// paired.
+	moverEvent(m, sent, "/data/old", fsnotify.Rename)
+	moverEvent(m, sent, "/data/new", fsnotify.Create)
+	if len(*sent) != 1 || (*sent)[0].From != "" {
+		t.Fatalf("got %v, expected a plain create", *sent)
+	}
+
+	m.dropAll()
+	clock.Advance(time.Second)
+	if len(*emitted) != 0 {
+		t.Fatalf("dropped rename was emitted: %v", *emitted)
+	}
+}
+
+func TestMoved(t *testing.T) {
+	if !watcherReportsRenames {
+		t.Skip("fsnotify doesn't report renames on this platform")
+	}
+
+	dir := t.TempDir()
+	old := filepath.Join(dir, "old")
+	err := os.WriteFile(old, nil, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := startPort(t, "-move-window", "1s")
+	p.roundTrip(1, "add_watch "+dir, `"ok"`)
+
+	err = os.Rename(old, filepath.Join(dir, "new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.expect(0, `{"id":1,"Name":"`+dir+`/new","root":"`+dir+`","op":["moved"],"from":"`+dir+`/old","to":"`+dir+`/new","is_dir":false}`)
+}
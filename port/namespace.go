@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// namespaceFlag is the suffix that selects the namespace that a
+// command operates on.
+const namespaceFlag = "--ns"
+
+// namespaces maps names to the handles of the watchers that were
+// created for them.
+type namespaces struct {
+	m       sync.Mutex
+	handles map[string]uint64
+}
+
+// cutNamespace splits a trailing --ns <name> off of the argument of a
+// command, returning the rest of the argument and the name.
+func cutNamespace(arg string) (rest, ns string) {
+	i := strings.LastIndex(arg, namespaceFlag+" ")
+	if i < 0 || (i > 0 && arg[i-1] != ' ') {
+		return arg, ""
+	}
+	ns = arg[i+len(namespaceFlag)+1:]
+	if !validNamespace(ns) {
+		return arg, ""
+	}
+	return strings.TrimSuffix(arg[:i], " "), ns
+}
+
+// validNamespace returns whether name can be used as the name of a
+// namespace.
+func validNamespace(name string) bool {
+	return name != "" && !strings.ContainsFunc(name, unicode.IsSpace)
+}
+
+// createNamespace creates a new watcher under the given name.
+func (s *Server) createNamespace(name string) (*handle, error) {
+	if !validNamespace(name) {
+		return nil, errors.New("namespace names must not be empty or contain spaces")
+	}
+
+	s.namespaces.m.Lock()
+	defer s.namespaces.m.Unlock()
+
+	if _, ok := s.namespaces.handles[name]; ok {
+		return nil, fmt.Errorf("namespace %q already exists", name)
+	}
+	watcher, err := s.newWatcher()
+	if err != nil {
+		return nil, err
+	}
+	// Like any other handle, a namespace outlives the connection that
+	// created it.
+	h := s.startHandle(s.ctx, watcher, name)
+	if s.namespaces.handles == nil {
+		s.namespaces.handles = make(map[string]uint64)
+	}
+	s.namespaces.handles[name] = h.id
+	return h, nil
+}
+
+// list returns the names of every namespace in order.
+func (n *namespaces) list() []string {
+	n.m.Lock()
+	defer n.m.Unlock()
+
+	names := make([]string, 0, len(n.handles))
+	for name := range n.handles {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// lookup returns the handle of the namespace with the given name.
+func (n *namespaces) lookup(name string) (uint64, error) {
+	n.m.Lock()
+	defer n.m.Unlock()
+
+	id, ok := n.handles[name]
+	if !ok {
+		return 0, fmt.Errorf("no namespace named %q", name)
+	}
+	return id, nil
+}
+
+// forget removes the namespace with the given name, if there is one.
+func (n *namespaces) forget(name string) {
+	n.m.Lock()
+	defer n.m.Unlock()
+
+	delete(n.handles, name)
+}
+
+// clear removes every namespace.
+func (n *namespaces) clear() {
+	n.m.Lock()
+	defer n.m.Unlock()
+
+	n.handles = nil
+}
+
+// requestHandle returns the handle that req operates on, given the
+// handle that was parsed from its arguments. A namespace given with
+// --ns takes the place of a handle.
+func (s *Server) requestHandle(req request, id uint64) (*handle, error) {
+	if req.ns == "" {
+		return s.handle(id)
+	}
+	if id != defaultHandle {
+		return nil, errors.New("a handle and a namespace can't both be given")
+	}
+	id, err := s.namespaces.lookup(req.ns)
+	if err != nil {
+		return nil, err
+	}
+	return s.handle(id)
+}
@@ -0,0 +1,27 @@
+package main
+
+import "syscall"
+
+// Magic numbers from statfs(2) of filesystems whose changes aren't
+// reported by inotify when they are made by other machines.
+var networkFilesystems = map[int64]bool{
+	0x6969:     true, // NFS_SUPER_MAGIC
+	0x517b:     true, // SMB_SUPER_MAGIC
+	0xfe534d42: true, // SMB2_MAGIC_NUMBER
+	0xff534d42: true, // CIFS_MAGIC_NUMBER
+	0x73757245: true, // CODA_SUPER_MAGIC
+	0x5346414f: true, // AFS_SUPER_MAGIC
+	0x6b414653: true, // AFS_FS_MAGIC
+	0x01021997: true, // V9FS_MAGIC
+	0x00c36400: true, // CEPH_SUPER_MAGIC
+}
+
+// isNetworkFilesystem reports whether path is on a network filesystem.
+func isNetworkFilesystem(path string) bool {
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(path, &stat)
+	if err != nil {
+		return false
+	}
+	return networkFilesystems[int64(stat.Type)]
+}
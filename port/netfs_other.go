@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+// isNetworkFilesystem always returns false because network
+// filesystems are only detected on Linux.
+func isNetworkFilesystem(path string) bool {
+	return false
+}
@@ -0,0 +1,22 @@
+//go:build !unix
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// openNoFollow opens the file at path for reading, failing if it is a
+// symlink. There's no O_NOFOLLOW, so the path is checked first, which
+// leaves a window for it to be replaced with one in between.
+func openNoFollow(path string) (*os.File, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		return nil, &os.PathError{Op: "open", Path: path, Err: fmt.Errorf("is a symlink")}
+	}
+	return os.Open(path)
+}
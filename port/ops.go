@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json/jsontext"
+	"encoding/json/v2"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+type opName struct {
+	op   fsnotify.Op
+	name string
+}
+
+// opNames lists the names used for each operation in events, in the
+// order in which they appear.
+var opNames = []opName{
+	{fsnotify.Create, "create"},
+	{fsnotify.Write, "write"},
+	{fsnotify.Remove, "remove"},
+	{fsnotify.Rename, "rename"},
+	{fsnotify.Chmod, "chmod"},
+	{opMoved, "moved"},
+}
+
+// eventOp is an operation that is encoded as an array of the names of
+// the operations that it is made up of instead of as fsnotify's
+// bitmask, which clients would otherwise have to hardcode.
+type eventOp fsnotify.Op
+
+func (op eventOp) names() []string {
+	names := []string{}
+	for _, n := range opNames {
+		if fsnotify.Op(op).Has(n.op) {
+			names = append(names, n.name)
+		}
+	}
+	return names
+}
+
+func (op eventOp) MarshalJSON() ([]byte, error) {
+	return json.Marshal(op.names())
+}
+
+func (op *eventOp) UnmarshalJSON(data []byte) error {
+	var names []string
+	err := json.Unmarshal(data, &names)
+	if err != nil {
+		return err
+	}
+	*op, err = parseOps(names)
+	return err
+}
+
+// parseOps returns the operation made up of the named operations,
+// which are matched regardless of case. Only operations that fsnotify
+// reports can be named.
+func parseOps(names []string) (eventOp, error) {
+	var op fsnotify.Op
+	for _, name := range names {
+		i := slices.IndexFunc(opNames, func(n opName) bool {
+			return strings.EqualFold(n.name, name) && n.op != opMoved
+		})
+		if i < 0 {
+			return 0, fmt.Errorf("unknown operation %q", name)
+		}
+		op |= opNames[i].op
+	}
+	return eventOp(op), nil
+}
+
+// opTitle returns the names of the operations that op is made up of,
+// capitalized as they are in fsnotify and separated by "|".
+func opTitle(op fsnotify.Op) string {
+	names := eventOp(op).names()
+	for i, name := range names {
+		names[i] = strings.ToUpper(name[:1]) + name[1:]
+	}
+	return strings.Join(names, "|")
+}
+
+// opTable maps the names of operations, capitalized as they are in
+// fsnotify, to their bits in -legacy-ops bitmasks. fsnotify's other
+// operations are only available on some platforms and can't be turned
+// on through its API, so the port never reports them.
+type opTable struct{}
+
+func (opTable) MarshalJSONTo(enc *jsontext.Encoder) error {
+	err := enc.WriteToken(jsontext.BeginObject)
+	if err != nil {
+		return err
+	}
+	for _, n := range opNames {
+		err = enc.WriteToken(jsontext.String(opTitle(n.op)))
+		if err != nil {
+			return err
+		}
+		err = enc.WriteToken(jsontext.Uint(uint64(n.op)))
+		if err != nil {
+			return err
+		}
+	}
+	return enc.WriteToken(jsontext.EndObject)
+}
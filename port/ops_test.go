@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json/v2"
+	"testing"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func TestEventOpJSON(t *testing.T) {
+	tests := []struct {
+		op       fsnotify.Op
+		expected string
+	}{
+		{fsnotify.Create, `["create"]`},
+		{fsnotify.Write, `["write"]`},
+		{fsnotify.Remove, `["remove"]`},
+		{fsnotify.Rename, `["rename"]`},
+		{fsnotify.Chmod, `["chmod"]`},
+		{fsnotify.Create | fsnotify.Write, `["create","write"]`},
+		{fsnotify.Write | fsnotify.Chmod, `["write","chmod"]`},
+		{fsnotify.Remove | fsnotify.Rename, `["remove","rename"]`},
+		{fsnotify.Chmod | fsnotify.Create, `["create","chmod"]`},
+		{fsnotify.Create | fsnotify.Write | fsnotify.Remove | fsnotify.Rename | fsnotify.Chmod, `["create","write","remove","rename","chmod"]`},
+		{0, `[]`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.op.String(), func(t *testing.T) {
+			data, err := json.Marshal(eventOp(test.op))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != test.expected {
+				t.Fatalf("got %s, expected %s", data, test.expected)
+			}
+		})
+	}
+}
+
+func TestEventOpFormats(t *testing.T) {
+	event := fsnotify.Event{Name: "/data/file", Op: fsnotify.Create | fsnotify.Write}
+
+	ts := newTestServer(t)
+	ts.send(1, "add_watch /data")
+	ts.expect(1, `"ok"`)
+	go ts.watcher.Inject(event)
+	ts.expect(0, `{"id":1,"Name":"/data/file","root":"/data","op":["create","write"],"is_dir":null}`)
+
+	config := DefaultConfig
+	config.LegacyOps = true
+	ts = newTestServerConfig(t, config)
+	ts.send(1, "add_watch /data")
+	ts.expect(1, `"ok"`)
+	go ts.watcher.Inject(event)
+	ts.expect(0, `{"id":1,"Name":"/data/file","root":"/data","Op":3,"is_dir":null}`)
+}
+
+func TestListOps(t *testing.T) {
+	ts := newTestServer(t)
+	ts.send(1, "list_ops")
+	ts.expect(1, `{"Create":1,"Write":2,"Remove":4,"Rename":8,"Chmod":16,"Moved":2147483648}`)
+}
+
+func TestSetOps(t *testing.T) {
+	ts := newTestServer(t)
+	ts.send(1, `add_watch {"path":"/data","ops":["Create","write"]}`)
+	ts.expect(1, `"ok"`)
+
+	inject := func() {
+		ts.watcher.Inject(fsnotify.Event{Name: "/data/file", Op: fsnotify.Remove})
+		ts.watcher.Inject(fsnotify.Event{Name: "/data/file", Op: fsnotify.Create})
+	}
+	go inject()
+	ts.expect(0, `{"Warn":"events are being dropped (op_filtered); see the counters command"}`)
+	ts.expect(0, `{"id":1,"Name":"/data/file","root":"/data","op":["create"],"is_dir":null}`)
+
+	ts.send(2, "set_ops /data remove")
+	ts.expect(2, `["remove"]`)
+	go inject()
+	ts.expect(0, `{"id":2,"Name":"/data/file","root":"/data","op":["remove"],"is_dir":null}`)
+
+	ts.send(3, `set_ops {"path":"/data","ops":["create","remove"]}`)
+	ts.expect(3, `["create","remove"]`)
+	ts.send(4, "watch_list")
+	ts.expect(4, `[{"path":"/data","ops":["create","remove"]}]`)
+
+	ts.send(5, "set_ops /other create")
+	ts.expect(5, `{"Err":"not watching \"/other\"","code":"not_watching"}`)
+	ts.send(6, "set_ops /data open")
+	ts.expect(6, `{"Err":"unknown operation \"open\""}`)
+}
+
+func TestSubscribe(t *testing.T) {
+	ts := newTestServer(t)
+	ts.send(1, "add_watch /data")
+	ts.expect(1, `"ok"`)
+
+	ts.send(2, "subscribe Write,create")
+	ts.expect(2, `["create","write"]`)
+	go func() {
+		ts.watcher.Inject(fsnotify.Event{Name: "/data/file", Op: fsnotify.Create})
+		ts.watcher.Inject(fsnotify.Event{Name: "/data/file", Op: fsnotify.Remove})
+		ts.watcher.Inject(fsnotify.Event{Name: "/data/file", Op: fsnotify.Write})
+	}()
+	ts.expect(0, `{"id":1,"Name":"/data/file","root":"/data","op":["create"],"is_dir":null}`)
+	ts.expect(0, `{"id":3,"Name":"/data/file","root":"/data","op":["write"],"is_dir":null}`)
+
+	ts.send(3, "unsubscribe Create")
+	ts.expect(3, `["write"]`)
+	go func() {
+		ts.watcher.Inject(fsnotify.Event{Name: "/data/file", Op: fsnotify.Create})
+		ts.watcher.Inject(fsnotify.Event{Name: "/data/file", Op: fsnotify.Write | fsnotify.Chmod})
+	}()
+	ts.expect(0, `{"id":5,"Name":"/data/file","root":"/data","op":["write","chmod"],"is_dir":null}`)
+
+	ts.send(4, "subscribe *")
+	ts.expect(4, `["create","write","remove","rename","chmod"]`)
+	go ts.watcher.Inject(fsnotify.Event{Name: "/data/file", Op: fsnotify.Remove})
+	ts.expect(0, `{"id":6,"Name":"/data/file","root":"/data","op":["remove"],"is_dir":null}`)
+
+	ts.send(5, "subscribe open")
+	ts.expect(5, `{"Err":"unknown operation \"open\""}`)
+}
+
+func TestSubscribeBatch(t *testing.T) {
+	c := &conn{}
+	c.unsubscribed.Store(uint32(allOps &^ fsnotify.Write))
+
+	b := newBroadcaster(frameFormat{})
+	events := [][]byte{[]byte(`{"id":1}`), []byte(`{"id":2}`), []byte(`{"id":3}`)}
+	f := broadcastFrame{
+		data:   joinEvents(events),
+		ops:    []fsnotify.Op{fsnotify.Create, fsnotify.Write, 0},
+		events: events,
+	}
+	got, _ := b.filter(f, c)
+	want := encodeFrame(0, []byte(`[{"id":2},{"id":3}]`), b.format)
+	if !bytes.Equal(got, want) {
+		t.Fatalf("got %q, expected %q", got, want)
+	}
+
+	f.ops = []fsnotify.Op{fsnotify.Create, fsnotify.Remove, fsnotify.Chmod}
+	if got, _ := b.filter(f, c); got != nil {
+		t.Fatalf("got %q, expected nothing", got)
+	}
+}
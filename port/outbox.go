@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultBlockMaxBytes is how large the frames queued for a client
+// with policyBlock can get before it is disconnected by default.
+const defaultBlockMaxBytes = 64 << 20
+
+// dropPolicy determines what happens to events when the client isn't
+// reading them fast enough.
+type dropPolicy int
+
+const (
+	// policyBlock never drops events. They are queued for as long as
+	// it takes the client to read them, up to a limit on the size of
+	// the queue past which the client is disconnected instead, so that
+	// a client that stops reading can't make the port's memory grow
+	// without limit.
+	policyBlock dropPolicy = iota
+
+	// policyDrop queues events and drops them if they can't be queued
+	// within a deadline. Events that are waiting for room don't hold
+	// up other clients.
+	policyDrop
+
+	// policyBuffer queues events in a ring buffer, overwriting the
+	// oldest queued events when it is full.
+	policyBuffer
+)
+
+var dropPolicyNames = map[dropPolicy]string{
+	policyBlock:  "block",
+	policyDrop:   "drop",
+	policyBuffer: "buffer",
+}
+
+func (p dropPolicy) String() string {
+	return dropPolicyNames[p]
+}
+
+func (p *dropPolicy) Set(name string) error {
+	for policy, n := range dropPolicyNames {
+		if n == name {
+			*p = policy
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown drop policy %q", name)
+}
+
+type queuedFrame struct {
+	data      []byte
+	droppable bool
+	urgent    bool
+
+	// barrier frames aren't overtaken by urgent frames, since the
+	// frames after them are encoded differently.
+	barrier bool
+
+	// deadline, if set, is when a droppable frame that is waiting for
+	// room in the queue with policyDrop is dropped instead.
+	deadline time.Time
+
+	// events holds the events in the frame, if it has any, for the
+	// dead letter file.
+	events [][]byte
+}
+
+// outbox writes frames to the client according to a drop policy.
+// Frames are queued without blocking and written by a separate
+// goroutine started by run, so that a slow client doesn't hold up
+// the others. With policyDrop, frames that don't fit in the queue wait
+// behind it until there's room or their deadline passes, and up to
+// capacity of them can wait before further frames are dropped
+// immediately. With policyBlock, writing fails once the queued frames
+// would take up more than maxBytes.
+type outbox struct {
+	w        io.Writer
+	policy   dropPolicy
+	timeout  time.Duration
+	capacity int
+	onDrop   func()
+	onError  func(error)
+
+	// undelivered, if set, is called with the events of every frame
+	// that isn't written because writing failed.
+	undelivered func(events [][]byte)
+
+	// maxBytes is how large the queued frames can get with
+	// policyBlock.
+	maxBytes int
+
+	m      sync.Mutex
+	cond   sync.Cond
+	queue  []queuedFrame
+	size   int
+	closed bool
+	err    error
+	done   chan struct{}
+
+	// expiry drops frames that have waited past their deadline. It is
+	// nil when none are waiting.
+	expiry *time.Timer
+
+	// written is when a frame was last written, in nanoseconds since
+	// the Unix epoch.
+	written atomic.Int64
+}
+
+// newOutbox returns an outbox that writes to w. onDrop is called for
+// each frame that is dropped and onError is called at most once if
+// writing fails, after which all frames are discarded.
+func newOutbox(w io.Writer, policy dropPolicy, timeout time.Duration, capacity int, onDrop func(), onError func(error)) *outbox {
+	o := outbox{
+		w:        w,
+		policy:   policy,
+		timeout:  timeout,
+		capacity: max(capacity, 1),
+		maxBytes: defaultBlockMaxBytes,
+		onDrop:   onDrop,
+		onError:  onError,
+		done:     make(chan struct{}),
+	}
+	o.cond.L = &o.m
+	o.written.Store(time.Now().UnixNano())
+	return &o
+}
+
+// lastWrite returns when a frame was last written, or when the outbox
+// was created if nothing has been written yet.
+func (o *outbox) lastWrite() time.Time {
+	return time.Unix(0, o.written.Load())
+}
+
+func encodeFrame[T string | []byte](id uint64, buf T, f frameFormat) []byte {
+	var frame bytes.Buffer
+	frame.Grow(16 + len(buf) + len(f.key))
+	sendData(&frame, id, buf, f)
+	return frame.Bytes()
+}
+
+// put sends a frame containing the given events, if any. Droppable
+// frames may be discarded depending on the policy. It never blocks.
+func (o *outbox) put(frame []byte, droppable bool, events [][]byte) {
+	dropped, lost, err := o.enqueue(queuedFrame{data: frame, droppable: droppable, events: events})
+	for range dropped {
+		o.onDrop()
+	}
+	o.fail(err, lost)
+}
+
+// putBarrier sends a frame that later urgent frames aren't sent ahead
+// of.
+func (o *outbox) putBarrier(frame []byte) {
+	_, lost, err := o.enqueue(queuedFrame{data: frame, barrier: true})
+	o.fail(err, lost)
+}
+
+// fail reports err, if it isn't nil, and passes the events that were
+// lost to o.undelivered.
+func (o *outbox) fail(err error, lost [][]byte) {
+	if err != nil {
+		o.onError(err)
+	}
+	o.lose(lost)
+}
+
+// lose passes the events of frames that weren't written because
+// writing failed to o.undelivered.
+func (o *outbox) lose(events [][]byte) {
+	if len(events) > 0 && o.undelivered != nil {
+		o.undelivered(events)
+	}
+}
+
+// enqueue queues a frame, returning the number of frames that were
+// dropped as a result. The events of the frame are returned as lost if
+// it isn't queued because writing has already failed. With
+// policyBlock, if the frame doesn't fit, writing fails with the
+// returned error and the events of every queued frame are lost too.
+func (o *outbox) enqueue(f queuedFrame) (dropped int, lost [][]byte, err error) {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	if o.closed {
+		return 0, nil, nil
+	}
+	if o.err != nil {
+		return 0, f.events, nil
+	}
+
+	switch {
+	case o.policy == policyBlock:
+		if len(o.queue) > 0 && o.size+len(f.data) > o.maxBytes {
+			o.err = fmt.Errorf("client fell more than %v bytes behind", o.maxBytes)
+			return 0, append(o.discard(), f.events...), o.err
+		}
+
+	case o.policy == policyBuffer && f.droppable:
+		if len(o.queue) >= o.capacity {
+			if !o.evict() {
+				return 1, nil, nil
+			}
+			dropped++
+		}
+
+	case o.policy == policyDrop && f.droppable:
+		if len(o.queue) >= 2*o.capacity {
+			return 1, nil, nil
+		}
+		if len(o.queue) >= o.capacity {
+			f.deadline = time.Now().Add(o.timeout)
+		}
+	}
+
+	o.queue = append(o.queue, f)
+	o.size += len(f.data)
+	if !f.deadline.IsZero() {
+		o.scheduleExpiry()
+	}
+	o.cond.Broadcast()
+	return dropped, nil, nil
+}
+
+// discard empties the queue after writing has failed, returning the
+// events of the frames that were in it, and wakes up the writer so
+// that it can stop. o.m must be held.
+func (o *outbox) discard() [][]byte {
+	var lost [][]byte
+	for _, f := range o.queue {
+		lost = append(lost, f.events...)
+	}
+	o.queue = nil
+	o.size = 0
+	o.cond.Broadcast()
+	return lost
+}
+
+// putUrgent sends a frame ahead of every queued frame other than
+// urgent ones. Urgent frames aren't dropped and don't wait for room in
+// the queue.
+func (o *outbox) putUrgent(frame []byte) {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	if o.err != nil || o.closed {
+		return
+	}
+	i := 0
+	for j, f := range o.queue {
+		if f.barrier {
+			i = j + 1
+		}
+	}
+	for i < len(o.queue) && o.queue[i].urgent {
+		i++
+	}
+	o.queue = slices.Insert(o.queue, i, queuedFrame{data: frame, urgent: true})
+	o.size += len(frame)
+	o.cond.Broadcast()
+}
+
+// expire drops the frames waiting for room in the queue whose
+// deadlines have passed, returning how many it dropped, and lets in
+// the ones that there is now room for. o.m must be held.
+func (o *outbox) expire(now time.Time) (dropped int) {
+	if o.policy != policyDrop {
+		return 0
+	}
+
+	// Every frame that fit in the queue when this was last run was let
+	// in then, and popping a frame moves at most one more up into it.
+	start := min(max(o.capacity-1, 0), len(o.queue))
+	kept := o.queue[:start]
+	for _, f := range o.queue[start:] {
+		if !f.deadline.IsZero() {
+			if !now.Before(f.deadline) {
+				o.size -= len(f.data)
+				dropped++
+				continue
+			}
+			if len(kept) < o.capacity {
+				f.deadline = time.Time{}
+			}
+		}
+		kept = append(kept, f)
+	}
+	clear(o.queue[len(kept):])
+	o.queue = kept
+	return dropped
+}
+
+// scheduleExpiry makes sure that expire is run when the first frame
+// that is waiting for room in the queue reaches its deadline. o.m must
+// be held.
+func (o *outbox) scheduleExpiry() {
+	if o.expiry != nil {
+		return
+	}
+	i := slices.IndexFunc(o.queue, func(f queuedFrame) bool { return !f.deadline.IsZero() })
+	if i < 0 {
+		return
+	}
+	o.expiry = time.AfterFunc(time.Until(o.queue[i].deadline), func() {
+		o.m.Lock()
+		o.expiry = nil
+		dropped := o.expire(time.Now())
+		o.scheduleExpiry()
+		o.m.Unlock()
+
+		for range dropped {
+			o.onDrop()
+		}
+	})
+}
+
+// evict removes the oldest droppable frame from the queue, reporting
+// whether there was one. o.m must be held.
+func (o *outbox) evict() bool {
+	for i, f := range o.queue {
+		if f.droppable {
+			o.size -= len(f.data)
+			o.queue = append(o.queue[:i], o.queue[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// len returns the number of frames waiting to be written.
+func (o *outbox) len() int {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	return len(o.queue)
+}
+
+// run writes queued frames until close is called and the queue has
+// been drained.
+func (o *outbox) run() {
+	defer close(o.done)
+
+	lost, err := o.write()
+	o.fail(err, lost)
+}
+
+// write writes queued frames until close is called and the queue has
+// been drained or writing fails. If it fails, the events of every
+// frame that wasn't written are returned along with the error, which
+// is nil if it was already reported by enqueue.
+func (o *outbox) write() ([][]byte, error) {
+	o.m.Lock()
+	defer o.m.Unlock()
+	defer func() {
+		if o.expiry != nil {
+			o.expiry.Stop()
+			o.expiry = nil
+		}
+	}()
+
+	for {
+		for len(o.queue) == 0 && !o.closed && o.err == nil {
+			o.cond.Wait()
+		}
+		if len(o.queue) == 0 {
+			return nil, nil
+		}
+
+		frame := o.queue[0]
+		o.queue[0] = queuedFrame{}
+		o.queue = o.queue[1:]
+		o.size -= len(frame.data)
+		if dropped := o.expire(time.Now()); dropped > 0 {
+			o.m.Unlock()
+			for range dropped {
+				o.onDrop()
+			}
+			o.m.Lock()
+		}
+
+		o.m.Unlock()
+		_, err := o.w.Write(frame.data)
+		o.m.Lock()
+		if o.err != nil {
+			// enqueue failed while the frame was being written.
+			if err != nil {
+				return frame.events, nil
+			}
+			return nil, nil
+		}
+		if err != nil {
+			o.err = err
+			return append(frame.events, o.discard()...), err
+		}
+		o.written.Store(time.Now().UnixNano())
+	}
+}
+
+// stop stops the outbox once all queued frames have been written,
+// without waiting for them to be. It is safe to call more than once.
+func (o *outbox) stop() {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	o.closed = true
+	o.cond.Broadcast()
+}
+
+// close stops the outbox and waits for the queued frames to be
+// written.
+func (o *outbox) close() {
+	o.stop()
+	<-o.done
+}
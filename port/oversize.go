@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json/jsontext"
+	"encoding/json/v2"
+	"errors"
+	"log/slog"
+	"slices"
+	"strings"
+)
+
+// truncatedPathLen is how many bytes of each path are kept in events
+// that are too large to fit in a frame.
+const truncatedPathLen = 1024
+
+// errFrameTooLarge is sent in place of a message that is too large to
+// fit in a frame and can't be reduced to fit.
+var errFrameTooLarge = &codedError{Code: "frame_too_large", Err: errors.New("message too large to fit in a frame")}
+
+// truncatedKeep are the members of an event that are kept when it is
+// too large to fit in a frame. Members that are paths are truncated to
+// truncatedPathLen bytes.
+var truncatedKeep = map[string]bool{
+	"seq":    false,
+	"id":     false,
+	"Name":   true,
+	"name":   true,
+	"root":   true,
+	"from":   true,
+	"to":     true,
+	"op":     false,
+	"Op":     false,
+	"handle": false,
+	"ns":     false,
+	"tag":    false,
+	"is_dir": false,
+}
+
+// fitPayload returns payload if it is no more than limit bytes, and
+// otherwise a reduced version of it that is. Events are reduced to the
+// members in truncatedKeep with their paths truncated, followed by
+// "truncated":true and the SHA-256 of the full name as "name_sha256",
+// so that clients can still correlate them. The full name is logged.
+// Each event in a batch is reduced in turn, largest first, until the
+// batch fits. Anything else is replaced with errFrameTooLarge.
+func fitPayload(id uint64, payload []byte, limit int) []byte {
+	if len(payload) <= limit {
+		return payload
+	}
+
+	var reduced []byte
+	switch jsontext.Value(payload).Kind() {
+	case '{':
+		var name string
+		reduced, name = truncateEvent(payload)
+		if reduced != nil {
+			slog.Warn("event too large to fit in a frame; sent truncated", "id", id, "size", len(payload), "name", name)
+		}
+	case '[':
+		reduced = truncateBatch(id, payload, limit)
+	}
+	if reduced != nil && len(reduced) <= limit {
+		return reduced
+	}
+
+	slog.Warn("message too large to fit in a frame; sent an error instead", "id", id, "size", len(payload))
+	data, err := json.Marshal(newErrorData(errFrameTooLarge))
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+// truncateEvent returns the reduced form of the event in payload as
+// described by fitPayload, along with its full name. It returns nil if
+// payload isn't a JSON object.
+func truncateEvent(payload []byte) ([]byte, string) {
+	dec := jsontext.NewDecoder(bytes.NewReader(payload), lossyUTF8)
+	tok, err := dec.ReadToken()
+	if err != nil || tok.Kind() != '{' {
+		return nil, ""
+	}
+
+	var buf bytes.Buffer
+	enc := jsontext.NewEncoder(&buf, lossyUTF8)
+	var name string
+	var named bool
+	var encErr error
+	write := func(tokens ...jsontext.Token) {
+		for _, tok := range tokens {
+			if encErr == nil {
+				encErr = enc.WriteToken(tok)
+			}
+		}
+	}
+
+	write(jsontext.BeginObject)
+	for dec.PeekKind() == '"' {
+		tok, err = dec.ReadToken()
+		if err != nil {
+			return nil, ""
+		}
+		key := tok.String()
+		isPath, keep := truncatedKeep[key]
+		if !keep {
+			err = dec.SkipValue()
+			if err != nil {
+				return nil, ""
+			}
+			continue
+		}
+
+		if !isPath || dec.PeekKind() != '"' {
+			var value jsontext.Value
+			value, err = dec.ReadValue()
+			if err != nil {
+				return nil, ""
+			}
+			write(jsontext.String(key))
+			if encErr == nil {
+				encErr = enc.WriteValue(value)
+			}
+			continue
+		}
+
+		tok, err = dec.ReadToken()
+		if err != nil {
+			return nil, ""
+		}
+		path := tok.String()
+		if !named && (key == "Name" || key == "name") {
+			name, named = path, true
+		}
+		if len(path) > truncatedPathLen {
+			path = strings.ToValidUTF8(path[:truncatedPathLen], "")
+		}
+		write(jsontext.String(key), jsontext.String(path))
+	}
+
+	sum := sha256.Sum256([]byte(name))
+	write(
+		jsontext.String("truncated"), jsontext.True,
+		jsontext.String("name_sha256"), jsontext.String(hex.EncodeToString(sum[:])),
+		jsontext.EndObject,
+	)
+	if encErr != nil {
+		return nil, ""
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), name
+}
+
+// truncateBatch reduces the largest events in the batch in payload
+// until it fits in limit bytes. It returns nil if it can't.
+func truncateBatch(id uint64, payload []byte, limit int) []byte {
+	var values []jsontext.Value
+	err := json.Unmarshal(payload, &values, lossyUTF8)
+	if err != nil {
+		return nil
+	}
+	events := make([][]byte, len(values))
+	for i, value := range values {
+		events[i] = value
+	}
+
+	size := len(payload)
+	order := make([]int, len(events))
+	for i := range order {
+		order[i] = i
+	}
+	slices.SortFunc(order, func(a, b int) int { return len(events[b]) - len(events[a]) })
+	for _, i := range order {
+		if size <= limit {
+			break
+		}
+		reduced, name := truncateEvent(events[i])
+		if reduced == nil {
+			return nil
+		}
+		slog.Warn("event too large to fit in a frame; sent truncated", "id", id, "size", len(events[i]), "name", name)
+		size -= len(events[i]) - len(reduced)
+		events[i] = reduced
+	}
+	if size > limit {
+		return nil
+	}
+	return joinEvents(events)
+}
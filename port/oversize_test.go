@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json/v2"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestFitPayload(t *testing.T) {
+	small := `{"id":1,"Name":"/data/a","root":"/data","op":["write"],"is_dir":false}`
+	if got := fitPayload(0, []byte(small), maxPayloadSize); string(got) != small {
+		t.Fatalf("got %s, expected it unchanged", got)
+	}
+
+	// The limit falls in the middle of a character, which is dropped.
+	name := "/data/x" + strings.Repeat("é", maxPayloadSize/2)
+	sum := sha256.Sum256([]byte(name))
+	large := fmt.Sprintf(`{"seq":3,"id":2,"Name":%q,"root":"/data","op":["create"],"is_dir":false,"mode":"0644","tag":"t"}`, name)
+	want := fmt.Sprintf(`{"seq":3,"id":2,"Name":%q,"root":"/data","op":["create"],"is_dir":false,"tag":"t","truncated":true,"name_sha256":%q}`, name[:truncatedPathLen-1], hex.EncodeToString(sum[:]))
+	got := fitPayload(0, []byte(large), maxPayloadSize)
+	if string(got) != want {
+		t.Fatalf("got %.200s..., expected %.200s...", got, want)
+	}
+
+	// Only events in a batch that have to be truncated are.
+	got = fitPayload(0, []byte("["+small+","+large+"]"), maxPayloadSize)
+	if want := "[" + small + "," + want + "]"; string(got) != want {
+		t.Fatalf("got %.200s..., expected %.200s...", got, want)
+	}
+
+	reply, err := json.Marshal([]string{name})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = fitPayload(1, reply, maxPayloadSize)
+	if want := `{"Err":"message too large to fit in a frame","code":"frame_too_large"}`; string(got) != want {
+		t.Fatalf("got %.200s..., expected %s", got, want)
+	}
+}
+
+func TestSendDataOversized(t *testing.T) {
+	name := "/data/" + strings.Repeat("a", maxPayloadSize)
+	payload := fmt.Sprintf(`{"id":1,"Name":%q}`, name)
+
+	for _, f := range []frameFormat{{}, {key: []byte("key")}} {
+		var buf bytes.Buffer
+		sendData(&buf, 0, payload, f)
+		size := binary.BigEndian.Uint16(buf.Bytes())
+		if int(size) != buf.Len()-2 {
+			t.Fatalf("frame declares %v bytes but has %v", size, buf.Len()-2)
+		}
+		if !strings.Contains(buf.String(), `"truncated":true`) {
+			t.Fatalf("got %.200s..., expected a truncated event", buf.Bytes()[10:])
+		}
+	}
+}
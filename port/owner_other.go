@@ -0,0 +1,11 @@
+//go:build !unix && !windows
+
+package main
+
+import "os"
+
+// statOwner adds the full mode of a file to data. Files don't have
+// owners that can be found out on this platform.
+func statOwner(data *eventData, info os.FileInfo) {
+	data.ModeStr = info.Mode().String()
+}
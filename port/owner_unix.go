@@ -0,0 +1,19 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// statOwner adds the owner, group, and full mode of a file to data.
+func statOwner(data *eventData, info os.FileInfo) {
+	data.ModeStr = info.Mode().String()
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return
+	}
+	uid, gid := uint32(st.Uid), uint32(st.Gid)
+	data.UID, data.GID = &uid, &gid
+}
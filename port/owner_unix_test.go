@@ -0,0 +1,68 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"os/user"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func TestStatOwner(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+	err := os.WriteFile(path, nil, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chmod(path, 0o646)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var data eventData
+	statEvent(&data, fsnotify.Event{Name: path, Op: fsnotify.Create}, nil)
+	if data.ModeStr != "-rw-r--rw-" {
+		t.Fatalf("got mode_str %q, expected -rw-r--rw-", data.ModeStr)
+	}
+	if data.UID == nil || int(*data.UID) != os.Getuid() || data.GID == nil || int(*data.GID) != os.Getgid() {
+		t.Fatalf("got uid %v and gid %v, expected %v and %v", data.UID, data.GID, os.Getuid(), os.Getgid())
+	}
+	if data.ModeBits != nil {
+		t.Fatalf("got mode_bits %v for a create", *data.ModeBits)
+	}
+
+	// Chmods are stat'd afresh, with the mode as a number as well.
+	cache := statCache{clock: newFakeClock(), ttl: time.Hour}
+	statEvent(&eventData{}, fsnotify.Event{Name: path, Op: fsnotify.Write}, &cache)
+	err = os.Chmod(path, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var chmod eventData
+	statEvent(&chmod, fsnotify.Event{Name: path, Op: fsnotify.Chmod}, &cache)
+	if chmod.ModeBits == nil || *chmod.ModeBits != 420 || chmod.ModeStr != "-rw-r--r--" {
+		t.Fatalf("got mode_bits %v and mode_str %q, expected 420 and -rw-r--r--", chmod.ModeBits, chmod.ModeStr)
+	}
+
+	current, err := user.Current()
+	if err != nil {
+		t.Skip(err)
+	}
+	owners := newOwnerNames()
+	owners.run(t.Context())
+
+	// The name isn't known until it has been looked up in the
+	// background.
+	owners.resolve(&data)
+	for data.Owner == "" {
+		time.Sleep(time.Millisecond)
+		owners.resolve(&data)
+	}
+	if data.Owner != current.Username {
+		t.Fatalf("got owner %q, expected %q", data.Owner, current.Username)
+	}
+}
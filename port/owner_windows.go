@@ -0,0 +1,32 @@
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileAttributes are the attributes that are reported by statOwner,
+// in the order that they are listed.
+var fileAttributes = []struct {
+	attr uint32
+	name string
+}{
+	{syscall.FILE_ATTRIBUTE_READONLY, "readonly"},
+	{syscall.FILE_ATTRIBUTE_HIDDEN, "hidden"},
+	{syscall.FILE_ATTRIBUTE_SYSTEM, "system"},
+}
+
+// statOwner adds a file's attributes to data. Windows doesn't have
+// Unix owners or modes, so they are left out.
+func statOwner(data *eventData, info os.FileInfo) {
+	attrs, ok := info.Sys().(*syscall.Win32FileAttributeData)
+	if !ok {
+		return
+	}
+	data.Attributes = []string{}
+	for _, a := range fileAttributes {
+		if attrs.FileAttributes&a.attr != 0 {
+			data.Attributes = append(data.Attributes, a.name)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"os/user"
+	"strconv"
+	"sync"
+)
+
+const (
+	// ownerWorkers is the number of uids and gids that can be looked
+	// up at once.
+	ownerWorkers = 2
+
+	// ownerQueueSize is the number of lookups that can be waiting
+	// before further ones are put off until another event needs them.
+	ownerQueueSize = 256
+
+	// maxOwnerNames is the most names that are cached at once.
+	maxOwnerNames = 4096
+)
+
+// ownerID is a uid or a gid waiting to be looked up.
+type ownerID struct {
+	id    uint32
+	group bool
+}
+
+// ownerNames resolves the uids and gids of stat metadata to names with
+// -owner-names. Looking them up can block for as long as NSS takes, so
+// it is done by a pool of goroutines, and the names are cached. Events
+// for owners that haven't been looked up yet are sent without names.
+type ownerNames struct {
+	m       sync.Mutex
+	names   map[ownerID]string
+	pending map[ownerID]bool
+	jobs    chan ownerID
+}
+
+func newOwnerNames() *ownerNames {
+	return &ownerNames{
+		names:   make(map[ownerID]string),
+		pending: make(map[ownerID]bool),
+		jobs:    make(chan ownerID, ownerQueueSize),
+	}
+}
+
+// run looks up names until ctx is canceled.
+func (o *ownerNames) run(ctx context.Context) {
+	for range ownerWorkers {
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case id := <-o.jobs:
+					o.store(id, lookupOwner(id))
+				}
+			}
+		}()
+	}
+}
+
+// lookupOwner returns the name of a uid or gid, or an empty string if
+// it doesn't have one.
+func lookupOwner(id ownerID) string {
+	s := strconv.FormatUint(uint64(id.id), 10)
+	if id.group {
+		g, err := user.LookupGroupId(s)
+		if err != nil {
+			return ""
+		}
+		return g.Name
+	}
+	u, err := user.LookupId(s)
+	if err != nil {
+		return ""
+	}
+	return u.Username
+}
+
+func (o *ownerNames) store(id ownerID, name string) {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	delete(o.pending, id)
+	if len(o.names) >= maxOwnerNames {
+		clear(o.names)
+	}
+	o.names[id] = name
+}
+
+// name returns the cached name of id, queueing it to be looked up if
+// it isn't cached yet.
+func (o *ownerNames) name(id ownerID) string {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	name, ok := o.names[id]
+	if ok || o.pending[id] {
+		return name
+	}
+	select {
+	case o.jobs <- id:
+		o.pending[id] = true
+	default:
+	}
+	return ""
+}
+
+// resolve adds the names of the owner and group in data, if they are
+// known.
+func (o *ownerNames) resolve(data *eventData) {
+	if data.UID != nil {
+		data.Owner = o.name(ownerID{id: *data.UID})
+	}
+	if data.GID != nil {
+		data.Group = o.name(ownerID{id: *data.GID, group: true})
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json/jsontext"
+	"path/filepath"
+	"unicode/utf8"
+)
+
+// lossyUTF8 is passed when encoding anything that might contain a
+// path so that paths that aren't valid UTF-8, which are perfectly
+// legal on some systems, have the invalid bytes replaced instead of
+// failing to encode. Where the exact bytes matter, the path is also
+// sent in base64. See encodePath.
+var lossyUTF8 = jsontext.AllowInvalidUTF8(true)
+
+// pathEncodingBase64 is the value of "path_encoding" for paths that
+// are also sent in base64.
+const pathEncodingBase64 = "base64"
+
+// encodePath returns the base64 encoding of path and the name of the
+// encoding if path isn't valid UTF-8, and empty strings otherwise.
+func encodePath(path string) (b64, encoding string) {
+	if utf8.ValidString(path) {
+		return "", ""
+	}
+	return base64.StdEncoding.EncodeToString([]byte(path)), pathEncodingBase64
+}
+
+// decodePath returns the path given in base64 as b64 if there is one,
+// and path otherwise.
+func decodePath(path, b64 string) (string, error) {
+	if b64 == "" {
+		return path, nil
+	}
+	raw, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil {
+		return "", &codedError{Code: "invalid_path", Err: err}
+	}
+	return string(raw), nil
+}
+
+// canonicalPath returns path as a clean, absolute path. If resolve is
+// true, symlinks in the directory containing it are resolved too. The
+// last element is left alone so that events on a symlink refer to the
+// symlink rather than what it points to, and so that paths that no
+// longer exist, such as those of removals, can still be resolved.
+func canonicalPath(path string, resolve bool) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		abs = filepath.Clean(path)
+	}
+	if !resolve {
+		return abs
+	}
+
+	dir, err := filepath.EvalSymlinks(filepath.Dir(abs))
+	if err != nil {
+		return abs
+	}
+	return filepath.Join(dir, filepath.Base(abs))
+}
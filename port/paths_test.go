@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// createInvalidUTF8 creates a file or directory in dir with a name
+// that isn't valid UTF-8, skipping the test if the filesystem doesn't
+// allow it.
+func createInvalidUTF8(t *testing.T, dir string, mkdir bool) string {
+	t.Helper()
+
+	path := filepath.Join(dir, "bad\xff\xfename")
+	var err error
+	if mkdir {
+		err = os.Mkdir(path, 0o755)
+	} else {
+		err = os.WriteFile(path, nil, 0o644)
+	}
+	if err != nil {
+		t.Skipf("filesystem doesn't allow names that aren't valid UTF-8: %v", err)
+	}
+	return path
+}
+
+func TestInvalidUTF8Event(t *testing.T) {
+	dir := t.TempDir()
+	p := startPort(t)
+
+	p.roundTrip(1, "add_watch "+dir, `"ok"`)
+
+	path := createInvalidUTF8(t, dir, false)
+	b64 := base64.StdEncoding.EncodeToString([]byte(path))
+	p.expect(0, `{"id":1,"Name":"`+dir+`/bad`+"��"+`name","path_b64":"`+b64+`","path_encoding":"base64","root":"`+dir+`","op":["create"],"is_dir":false}`)
+}
+
+func TestInvalidUTF8Watch(t *testing.T) {
+	path := createInvalidUTF8(t, t.TempDir(), true)
+	b64 := base64.StdEncoding.EncodeToString([]byte(path))
+	lossy := filepath.Dir(path) + "/bad��name"
+
+	p := startPort(t)
+
+	// Bare paths are passed through as is, but JSON can't carry them,
+	// so they have to be sent in base64 instead.
+	p.roundTrip(1, `add_watch {"path_b64":"`+b64+`"}`, `"ok"`)
+	p.roundTrip(2, "watch_list", `[{"path":"`+lossy+`","path_b64":"`+b64+`","path_encoding":"base64"}]`)
+	p.roundTrip(3, `remove {"path_b64":"`+b64+`"}`, `"ok"`)
+	p.roundTrip(4, "add_watch "+path, `"ok"`)
+	p.roundTrip(5, "watch_list", `[{"path":"`+lossy+`","path_b64":"`+b64+`","path_encoding":"base64"}]`)
+	p.roundTrip(6, `add_watch {"path_b64":"not base64"}`, `{"Err":"illegal base64 data at input byte 3","code":"invalid_path"}`)
+}
+
+func TestCanonicalPath(t *testing.T) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	real := filepath.Join(dir, "real")
+	err = os.Mkdir(real, 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "link")
+	err = os.Symlink(real, link)
+	if err != nil {
+		t.Skipf("can't create symlinks: %v", err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path    string
+		resolve bool
+		want    string
+	}{
+		{dir + "//real/./file", false, real + "/file"},
+		{"rel/../file", false, filepath.Join(wd, "file")},
+		{link + "/file", false, link + "/file"},
+		{link + "/file", true, real + "/file"},
+		{link + "/missing/file", true, link + "/missing/file"},
+		{link, true, link},
+	}
+	for _, test := range tests {
+		got := canonicalPath(test.path, test.resolve)
+		if got != test.want {
+			t.Errorf("canonicalPath(%q, %v) = %q, expected %q", test.path, test.resolve, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"cmp"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+const (
+	// maxPathStats is the most paths whose events are counted. Once
+	// there are this many, the quietest path is forgotten to make room
+	// for a new one.
+	maxPathStats = 4096
+
+	// defaultTopPaths is the number of paths that top_paths returns if
+	// it isn't given one.
+	defaultTopPaths = 10
+)
+
+// pathStat is the number of events that have been received for a
+// path, along with the operation of the last one.
+type pathStat struct {
+	Path   string `json:"path"`
+	Events uint64 `json:"events"`
+	LastOp string `json:"last_op"`
+}
+
+// pathStats counts the events received from watchers for each path,
+// before any of them are filtered.
+type pathStats struct {
+	m     sync.Mutex
+	paths map[string]*pathStat
+}
+
+func (p *pathStats) observe(event fsnotify.Event) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	path := filepath.Clean(event.Name)
+	stat, ok := p.paths[path]
+	if !ok {
+		if p.paths == nil {
+			p.paths = make(map[string]*pathStat)
+		}
+		if len(p.paths) >= maxPathStats {
+			p.evict()
+		}
+		stat = &pathStat{Path: path}
+		p.paths[path] = stat
+	}
+	stat.Events++
+	stat.LastOp = opTitle(event.Op)
+}
+
+// evict forgets the path with the fewest events. p.m must be held.
+func (p *pathStats) evict() {
+	var quietest *pathStat
+	for _, stat := range p.paths {
+		if quietest == nil || stat.Events < quietest.Events {
+			quietest = stat
+		}
+	}
+	delete(p.paths, quietest.Path)
+}
+
+// top returns the n paths with the most events, from most to least.
+func (p *pathStats) top(n int) []pathStat {
+	p.m.Lock()
+	stats := make([]pathStat, 0, len(p.paths))
+	for _, stat := range p.paths {
+		stats = append(stats, *stat)
+	}
+	p.m.Unlock()
+
+	slices.SortFunc(stats, func(a, b pathStat) int {
+		return cmp.Or(cmp.Compare(b.Events, a.Events), strings.Compare(a.Path, b.Path))
+	})
+	return stats[:min(n, len(stats))]
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"path/filepath"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+type pauseState struct {
+	coalesce   bool
+	suppressed int
+
+	// held holds the combined ops of each path's suppressed events
+	// when coalescing.
+	held map[string]fsnotify.Op
+	// order is the order in which paths were first held.
+	order []string
+}
+
+// pauses tracks which watch roots of a handle are paused.
+type pauses struct {
+	m     sync.Mutex
+	roots map[string]*pauseState
+}
+
+func (p *pauses) pause(root string, coalesce bool) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	root = filepath.Clean(root)
+	if _, ok := p.roots[root]; ok {
+		return
+	}
+	if p.roots == nil {
+		p.roots = make(map[string]*pauseState)
+	}
+	p.roots[root] = &pauseState{coalesce: coalesce}
+}
+
+// resume unpauses root, returning its state or nil if it wasn't
+// paused.
+func (p *pauses) resume(root string) *pauseState {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	root = filepath.Clean(root)
+	state := p.roots[root]
+	delete(p.roots, root)
+	return state
+}
+
+func (p *pauses) paused(root string) bool {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	_, ok := p.roots[filepath.Clean(root)]
+	return ok
+}
+
+// hold reports whether event, which belongs to the watch root, was
+// held because root is paused.
+func (p *pauses) hold(root string, event fsnotify.Event) bool {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	state, ok := p.roots[root]
+	if !ok {
+		return false
+	}
+
+	state.suppressed++
+	if state.coalesce {
+		if state.held == nil {
+			state.held = make(map[string]fsnotify.Op)
+		}
+		if _, ok := state.held[event.Name]; !ok {
+			state.order = append(state.order, event.Name)
+		}
+		state.held[event.Name] |= event.Op
+	}
+	return true
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"testing"
+)
+
+type frame struct {
+	id      uint64
+	payload string
+}
+
+func appendCRCFrame(buf []byte, id uint64, payload string) []byte {
+	buf = binary.BigEndian.AppendUint32(buf, uint32(12+len(payload)))
+	buf = binary.BigEndian.AppendUint64(buf, id)
+	sum := crc32.ChecksumIEEE(append(binary.BigEndian.AppendUint64(nil, id), payload...))
+	buf = binary.BigEndian.AppendUint32(buf, sum)
+	return append(buf, payload...)
+}
+
+func appendFrame(buf []byte, id uint64, payload string) []byte {
+	buf = binary.BigEndian.AppendUint16(buf, uint16(8+len(payload)))
+	buf = binary.BigEndian.AppendUint64(buf, id)
+	return append(buf, payload...)
+}
+
+// parseFrames is a straightforward reference parser used to check
+// the output of commands.
+func parseFrames(data []byte) (frames []frame) {
+	for len(data) >= 2 {
+		size := int(binary.BigEndian.Uint16(data))
+		data = data[2:]
+		if len(data) < size {
+			return frames
+		}
+
+		buf := data[:size]
+		data = data[size:]
+		if len(buf) < 8 {
+			continue
+		}
+		frames = append(frames, frame{
+			id:      binary.BigEndian.Uint64(buf),
+			payload: string(buf[8:]),
+		})
+	}
+	return frames
+}
+
+// parseCRCFrames is like parseFrames but for checksummed frames. It
+// also reports whether it stopped at a frame that failed its checksum.
+func parseCRCFrames(data []byte) (frames []frame, corrupt bool) {
+	for len(data) >= 4 {
+		size := binary.BigEndian.Uint32(data)
+		data = data[4:]
+		if size > maxCRCFrameSize {
+			return frames, true
+		}
+		if uint32(len(data)) < size {
+			return frames, false
+		}
+
+		buf := data[:size]
+		data = data[size:]
+		if len(buf) < 12 {
+			continue
+		}
+		if crc32.ChecksumIEEE(append(buf[:8:8], buf[12:]...)) != binary.BigEndian.Uint32(buf[8:]) {
+			return frames, true
+		}
+		frames = append(frames, frame{
+			id:      binary.BigEndian.Uint64(buf),
+			payload: string(buf[12:]),
+		})
+	}
+	return frames, false
+}
+
+func FuzzParseFrame(f *testing.F) {
+	f.Add([]byte{})
+	f.Add(appendFrame(nil, 1, "add_watch /tmp"))
+	f.Add(appendFrame(appendFrame(nil, 1, "watch_list"), 2, "remove /tmp"))
+	f.Add(appendFrame(nil, 3, ""))
+	f.Add(appendFrame(nil, 4, "add_watch /tmp")[:9])
+	f.Add([]byte{0})
+	f.Add([]byte{0xFF, 0xFF, 0, 0, 0, 0, 0, 0, 0, 1})
+	f.Add([]byte{0, 3, 1, 2, 3})
+	f.Add([]byte{0, 0})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r, w := io.Pipe()
+		go func() {
+			w.Write(data)
+			w.Close()
+		}()
+		defer r.Close()
+
+		var got []frame
+		for id, payload := range commands(r, frameFormat{}, nil) {
+			got = append(got, frame{id: id, payload: payload})
+		}
+
+		want := parseFrames(data)
+		if len(got) != len(want) {
+			t.Fatalf("got %v frames, expected %v", len(got), len(want))
+		}
+		for i := range got {
+			if got[i] != want[i] {
+				t.Fatalf("frame %v: got %+v, expected %+v", i, got[i], want[i])
+			}
+		}
+	})
+}
+
+func FuzzParseCRCFrame(f *testing.F) {
+	f.Add([]byte{})
+	f.Add(appendCRCFrame(nil, 1, "add_watch /tmp"))
+	f.Add(appendCRCFrame(appendCRCFrame(nil, 1, "watch_list"), 2, "remove /tmp"))
+	f.Add(appendCRCFrame(nil, 3, ""))
+	f.Add(appendCRCFrame(nil, 4, "add_watch /tmp")[:13])
+	f.Add(appendFrame(nil, 5, "watch_list"))
+	f.Add([]byte{0xFF, 0xFF, 0xFF, 0xFF, 0, 0, 0, 0, 0, 0, 0, 1})
+	f.Add([]byte{0, 0, 0, 3, 1, 2, 3})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r, w := io.Pipe()
+		go func() {
+			w.Write(data)
+			w.Close()
+		}()
+		defer r.Close()
+
+		var got []frame
+		var corrupt bool
+		for id, payload := range commands(r, frameFormat{crc: true}, func() { corrupt = true }) {
+			got = append(got, frame{id: id, payload: payload})
+		}
+
+		want, wantCorrupt := parseCRCFrames(data)
+		if corrupt != wantCorrupt {
+			t.Fatalf("got corrupt %v, expected %v", corrupt, wantCorrupt)
+		}
+		if len(got) != len(want) {
+			t.Fatalf("got %v frames, expected %v", len(got), len(want))
+		}
+		for i := range got {
+			if got[i] != want[i] {
+				t.Fatalf("frame %v: got %+v, expected %+v", i, got[i], want[i])
+			}
+		}
+	})
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// reserveWatch counts a new watch against the connection's quota,
+// failing if the server's MaxWatches limit has been reached. A limit
+// of zero means that there is no limit.
+func (c *conn) reserveWatch(limit int) error {
+	if limit > 0 && c.watches.Load() >= int64(limit) {
+		return &codedError{
+			Code:    "quota_exceeded",
+			Err:     fmt.Errorf("watch limit of %v reached", limit),
+			Details: map[string]any{"limit": limit},
+		}
+	}
+	c.watches.Add(1)
+	return nil
+}
+
+// releaseWatches gives n watches back to the connection's quota.
+// Watches may be removed by a different connection than the one that
+// added them, so the count never drops below zero.
+func (c *conn) releaseWatches(n int) {
+	for {
+		old := c.watches.Load()
+		if c.watches.CompareAndSwap(old, max(old-int64(n), 0)) {
+			return
+		}
+	}
+}
+
+// allowCommand reports an error if the connection has exceeded its
+// command rate. Clients are told how long to wait instead of having
+// the command delayed so that a flood of commands can't stall the
+// command loop.
+func (c *conn) allowCommand() error {
+	if c.limiter == nil {
+		return nil
+	}
+
+	r := c.limiter.Reserve()
+	delay := r.Delay()
+	if delay == 0 {
+		return nil
+	}
+	r.Cancel()
+
+	return &codedError{
+		Code:    "rate_limited",
+		Err:     errors.New("command rate exceeded"),
+		Details: map[string]any{"retry_after_ms": max(delay.Milliseconds(), 1)},
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// summaryInterval is how often summaries of suppressed events are
+// sent for a rate limited watch.
+const summaryInterval = time.Second
+
+// rateLimiter limits the rate of events for a single watch root using
+// a token bucket. Events that exceed the limit are counted and
+// reported periodically in summary events.
+type rateLimiter struct {
+	root  string
+	rate  float64
+	burst float64
+
+	tokens     float64
+	last       time.Time
+	suppressed int
+	timer      timer
+}
+
+func (l *rateLimiter) allow(now time.Time) bool {
+	l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// rateLimits holds the rate limiters for the watches of a handle.
+type rateLimits struct {
+	clock clock
+
+	// summarize is called with the number of events suppressed for
+	// root since the last time it was called.
+	summarize func(root string, suppressed int)
+
+	m        sync.Mutex
+	limiters map[string]*rateLimiter
+}
+
+// set limits events under root to rate per second. A rate of zero
+// removes the limit.
+func (r *rateLimits) set(root string, rate float64) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	root = filepath.Clean(root)
+	r.removeLocked(root)
+	if rate <= 0 {
+		return
+	}
+
+	if r.limiters == nil {
+		r.limiters = make(map[string]*rateLimiter)
+	}
+	burst := max(rate, 1)
+	r.limiters[root] = &rateLimiter{
+		root:   root,
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   r.clock.Now(),
+	}
+}
+
+// remove removes the limiter for root, sending a final summary if
+// any events are still unreported.
+// rate returns the rate limit of root, or zero if it has none.
+func (r *rateLimits) rate(root string) float64 {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	l, ok := r.limiters[filepath.Clean(root)]
+	if !ok {
+		return 0
+	}
+	return l.rate
+}
+
+func (r *rateLimits) remove(root string) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	r.removeLocked(filepath.Clean(root))
+}
+
+func (r *rateLimits) removeLocked(root string) {
+	l, ok := r.limiters[root]
+	if !ok {
+		return
+	}
+	delete(r.limiters, root)
+
+	if l.timer != nil {
+		l.timer.Stop()
+	}
+	if l.suppressed > 0 {
+		r.summarize(l.root, l.suppressed)
+	}
+}
+
+// removeAll removes every limiter.
+func (r *rateLimits) removeAll() {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	for root := range r.limiters {
+		r.removeLocked(root)
+	}
+}
+
+// allow reports whether an event for the watch root should be
+// delivered.
+func (r *rateLimits) allow(root string) bool {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	l, ok := r.limiters[root]
+	if !ok || l.allow(r.clock.Now()) {
+		return true
+	}
+
+	l.suppressed++
+	if l.timer == nil {
+		l.timer = r.clock.AfterFunc(summaryInterval, func() {
+			r.m.Lock()
+			defer r.m.Unlock()
+
+			if r.limiters[root] != l {
+				return
+			}
+			l.timer = nil
+			if l.suppressed > 0 {
+				r.summarize(l.root, l.suppressed)
+				l.suppressed = 0
+			}
+		})
+	}
+	return false
+}
+
+// parseRateLimit parses the arguments of the set_rate_limit command,
+// which can either be a watchOptions object or have the form "<path>
+// <events-per-second>".
+func parseRateLimit(arg string) (opts watchOptions, err error) {
+	if strings.HasPrefix(arg, "{") {
+		return parseWatchOptions(arg)
+	}
+
+	i := strings.LastIndexByte(arg, ' ')
+	if i < 0 {
+		return opts, fmt.Errorf("expected <path> <events-per-second>, got %q", arg)
+	}
+	opts.Path = arg[:i]
+	opts.Rate, err = strconv.ParseFloat(arg[i+1:], 64)
+	return opts, err
+}
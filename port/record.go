@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json/jsontext"
+	"encoding/json/v2"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// recordedEvent is a single line of a recording.
+type recordedEvent struct {
+	Time  time.Time      `json:"time"`
+	Event jsontext.Value `json:"event"`
+}
+
+// recorder writes every event sent to the client to a file as
+// newline-delimited JSON so that it can be played back later.
+type recorder struct {
+	m    sync.Mutex
+	file *os.File
+	w    *bufio.Writer
+}
+
+func (r *recorder) start(path string) error {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if r.file != nil {
+		return fmt.Errorf("already recording to %q", r.file.Name())
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	r.file = file
+	r.w = bufio.NewWriter(file)
+	return nil
+}
+
+func (r *recorder) stop() error {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if r.file == nil {
+		return errors.New("not recording")
+	}
+
+	err := r.w.Flush()
+	err = errors.Join(err, r.file.Close())
+	r.file, r.w = nil, nil
+	return err
+}
+
+// record writes event to the recording, if there is one. If that
+// fails, recording is stopped and the error is returned.
+func (r *recorder) record(event []byte) error {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if r.file == nil {
+		return nil
+	}
+
+	line, err := json.Marshal(recordedEvent{Time: time.Now(), Event: event})
+	if err != nil {
+		panic(err)
+	}
+	_, err = r.w.Write(append(line, '\n'))
+	if err != nil {
+		name := r.file.Name()
+		r.file.Close()
+		r.file, r.w = nil, nil
+		return &codedError{Code: "record_failed", Err: fmt.Errorf("recording to %q stopped: %w", name, err)}
+	}
+	return nil
+}
+
+// playback sends the events recorded in r to the client with the same
+// relative timing with which they were recorded.
+func (s *Server) playback(ctx context.Context, r io.Reader) error {
+	dec := jsontext.NewDecoder(r)
+	start := time.Now()
+	var first time.Time
+	for {
+		var event recordedEvent
+		err := json.UnmarshalDecode(dec, &event)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		if first.IsZero() {
+			first = event.Time
+		}
+		wait := time.Until(start.Add(event.Time.Sub(first)))
+		if wait > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(wait):
+			}
+		}
+
+		s.bcast.send(broadcastFrame{data: s.eventPayload([]byte(event.Event)), droppable: true})
+	}
+}
+
+func (s *Server) playbackFile(ctx context.Context, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return s.playback(ctx, bufio.NewReader(file))
+}
+
+// errPlayback is returned when trying to watch something while playing
+// back a recording.
+var errPlayback = errors.New("watching is not available during playback")
+
+// playbackWatcher is the Watcher used while playing back a recording.
+// It never produces any events of its own.
+type playbackWatcher struct{}
+
+func newPlaybackWatcher() (Watcher, error) { return playbackWatcher{}, nil }
+
+func (playbackWatcher) Add(string) error              { return errPlayback }
+func (playbackWatcher) Remove(string) error           { return errPlayback }
+func (playbackWatcher) WatchList() []string           { return nil }
+func (playbackWatcher) Close() error                  { return nil }
+func (playbackWatcher) Events() <-chan fsnotify.Event { return nil }
+func (playbackWatcher) Errors() <-chan error          { return nil }
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func TestRecordPlayback(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "recording")
+	events := []string{
+		`{"id":1,"Name":"/src/a","root":"/src","op":["create"],"is_dir":null}`,
+		`{"id":2,"Name":"/src/a","root":"/src","op":["write"],"is_dir":null}`,
+		`{"id":3,"Name":"/src/` + "\ufffd" + `","path_b64":"L3NyYy//","path_encoding":"base64","root":"/src","op":["remove"],"is_dir":null}`,
+	}
+
+	ts := newTestServer(t)
+	ts.send(1, "record "+path)
+	ts.expect(1, `"ok"`)
+	ts.send(2, "add_watch /src")
+	ts.expect(2, `"ok"`)
+	go func() {
+		ts.watcher.Inject(fsnotify.Event{Name: "/src/a", Op: fsnotify.Create})
+		ts.watcher.Inject(fsnotify.Event{Name: "/src/a", Op: fsnotify.Write})
+		ts.watcher.Inject(fsnotify.Event{Name: "/src/\xff", Op: fsnotify.Remove})
+	}()
+	for _, event := range events {
+		ts.expect(0, event)
+	}
+	ts.send(3, "stop_record")
+	ts.expect(3, `"ok"`)
+
+	config := DefaultConfig
+	config.Playback = path
+	ts = newTestServerConfig(t, config)
+	for _, event := range events {
+		ts.expect(0, event)
+	}
+}
+
+func TestRecordWriteError(t *testing.T) {
+	ts := newTestServer(t)
+	path := filepath.Join(t.TempDir(), "recording")
+
+	ts.send(1, "record "+path)
+	ts.expect(1, `"ok"`)
+	ts.send(2, "add_watch /src")
+	ts.expect(2, `"ok"`)
+
+	// Events are buffered, so the write only fails once the buffer
+	// is flushed.
+	ts.server.recorder.file.Close()
+	ts.server.recorder.w.Reset(ts.server.recorder.file)
+	ts.server.recorder.w.Write(make([]byte, ts.server.recorder.w.Available()))
+	go ts.watcher.Inject(fsnotify.Event{Name: "/src/a", Op: fsnotify.Write})
+	ts.expect(0, `{"Err":"recording to \"`+path+`\" stopped: write `+path+`: file already closed","code":"record_failed"}`)
+	ts.expect(0, `{"id":1,"Name":"/src/a","root":"/src","op":["write"],"is_dir":null}`)
+
+	ts.send(3, "stop_record")
+	ts.expect(3, `{"Err":"not recording"}`)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// readStateFile reads the watches listed in a state file. Each line
+// holds the argument of an add_watch command, either a bare path or a
+// JSON object. Blank lines and lines starting with '#' are ignored.
+func readStateFile(path string) ([]watchOptions, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var watches []watchOptions
+	s := bufio.NewScanner(file)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		opts, err := parseWatchOptions(line)
+		if err != nil {
+			return nil, err
+		}
+		opts.Path = filepath.Clean(opts.Path)
+		watches = append(watches, opts)
+	}
+	return watches, s.Err()
+}
+
+// reloadResult describes the changes made by a reload.
+type reloadResult struct {
+	Added   []string
+	Removed []string
+}
+
+// reloadStateFile makes the watches of the default handle match the
+// state file. Either every new watch is added or, if one of them
+// fails, none of them are and nothing is removed.
+func (s *Server) reloadStateFile() (result reloadResult, err error) {
+	s.reloadm.Lock()
+	defer s.reloadm.Unlock()
+
+	watches, err := readStateFile(s.config.StateFile)
+	if err != nil {
+		return result, err
+	}
+	h, err := s.handle(defaultHandle)
+	if err != nil {
+		return result, err
+	}
+
+	current := make(map[string]bool)
+	for _, entry := range h.list() {
+		current[entry.Path] = true
+	}
+
+	wanted := make(map[string]bool, len(watches))
+	for _, opts := range watches {
+		wanted[opts.Path] = true
+		if current[opts.Path] {
+			h.watches.setTag(opts.Path, opts.Tag)
+			continue
+		}
+
+		err := s.checkAllowed(opts.Path)
+		if err == nil {
+			err = h.watcher.Add(opts.Path)
+		}
+		if err != nil {
+			for _, path := range result.Added {
+				h.remove(path)
+			}
+			return reloadResult{}, err
+		}
+		h.watches.set(opts)
+		result.Added = append(result.Added, opts.Path)
+	}
+
+	var errs []error
+	for path := range current {
+		if wanted[path] {
+			continue
+		}
+		err := h.remove(path)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		result.Removed = append(result.Removed, path)
+	}
+	return result, errors.Join(errs...)
+}
+
+// reload reloads the state file, logging the outcome.
+func (s *Server) reload() {
+	result, err := s.reloadStateFile()
+	if err != nil {
+		slog.Error("reload state file", "path", s.config.StateFile, "err", err)
+		return
+	}
+	slog.Info("reloaded state file", "path", s.config.StateFile, "added", result.Added, "removed", result.Removed)
+}
+
+// handleReloads reloads the state file whenever the process receives
+// SIGHUP until ctx is canceled.
+func (s *Server) handleReloads(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			s.reload()
+		}
+	}
+}
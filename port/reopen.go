@@ -0,0 +1,81 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// swapWatcher is a Watcher whose underlying watcher can be replaced.
+type swapWatcher struct {
+	m sync.RWMutex
+	w Watcher
+}
+
+func (w *swapWatcher) get() Watcher {
+	w.m.RLock()
+	defer w.m.RUnlock()
+
+	return w.w
+}
+
+// swap replaces the underlying watcher, returning the old one.
+func (w *swapWatcher) swap(watcher Watcher) Watcher {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	old := w.w
+	w.w = watcher
+	return old
+}
+
+func (w *swapWatcher) Add(path string) error         { return w.get().Add(path) }
+func (w *swapWatcher) Remove(path string) error      { return w.get().Remove(path) }
+func (w *swapWatcher) WatchList() []string           { return w.get().WatchList() }
+func (w *swapWatcher) Close() error                  { return w.get().Close() }
+func (w *swapWatcher) Events() <-chan fsnotify.Event { return w.get().Events() }
+func (w *swapWatcher) Errors() <-chan error          { return w.get().Errors() }
+
+type reopenData struct {
+	Readded int               `json:"readded"`
+	Failed  map[string]string `json:"failed"`
+}
+
+type noticeData struct {
+	Notice string
+	Handle uint64 `json:"handle,omitzero"`
+}
+
+// reopen replaces the handle's watcher with a new one, adding every
+// path that the old one was watching. Events that happen while this
+// is going on are lost, so clients are sent a notice telling them to
+// resynchronize.
+func (s *Server) reopen(h *handle) (reopenData, error) {
+	watcher, err := s.newWatcher()
+	if err != nil {
+		return reopenData{}, err
+	}
+
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	h.cancel()
+	<-h.done
+
+	paths := h.watcher.WatchList()
+	h.inner.swap(watcher).Close()
+
+	result := reopenData{Failed: make(map[string]string)}
+	for _, path := range paths {
+		err := h.watcher.Add(path)
+		if err != nil {
+			result.Failed[path] = err.Error()
+			continue
+		}
+		result.Readded++
+	}
+
+	s.run(h)
+	s.broadcast(noticeData{Notice: "reopened", Handle: h.id})
+	return result, nil
+}
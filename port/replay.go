@@ -0,0 +1,203 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// replayBuffer assigns sequence numbers to event frames and keeps the
+// most recent ones so that clients can have events that they might
+// not have processed sent again.
+type replayBuffer struct {
+	m sync.Mutex
+
+	// seq is the sequence number of the last event.
+	seq uint64
+
+	// events is a ring of the most recent events, starting at start.
+	events []sequencedEvent
+	start  int
+}
+
+// maxSeqSize is the most that adding a sequence number can grow an
+// event by.
+const maxSeqSize = len(`"seq":18446744073709551615,`)
+
+// prependField adds a member with the given name and value to the
+// start of an encoded JSON object. Every event is a JSON object, so
+// this can be used to add to them without decoding them.
+func prependField(data []byte, name string, value uint64) []byte {
+	field := fmt.Appendf(nil, `{%q:%v`, name, value)
+	if len(data) > 2 {
+		field = append(field, ',')
+	}
+	return append(field, data[1:]...)
+}
+
+type sequencedEvent struct {
+	seq  uint64
+	data []byte
+}
+
+func newReplayBuffer(size int) *replayBuffer {
+	return &replayBuffer{events: make([]sequencedEvent, 0, size)}
+}
+
+// add assigns the next sequence number to the encoded event data,
+// returning it with the sequence number added. The caller must hold
+// b.m.
+func (b *replayBuffer) add(data []byte) []byte {
+	b.seq++
+	data = prependField(data, "seq", b.seq)
+
+	event := sequencedEvent{seq: b.seq, data: data}
+	if len(b.events) < cap(b.events) {
+		b.events = append(b.events, event)
+		return data
+	}
+	b.events[b.start] = event
+	b.start = (b.start + 1) % len(b.events)
+	return data
+}
+
+// since calls yield with each buffered event after seq in order. If
+// events after seq have already been discarded, it returns an error
+// without calling yield at all. The caller must hold b.m.
+func (b *replayBuffer) since(seq uint64, yield func([]byte)) (int, error) {
+	if seq >= b.seq {
+		return 0, nil
+	}
+	if len(b.events) == 0 || b.events[b.start].seq > seq+1 {
+		var oldest uint64
+		if len(b.events) > 0 {
+			oldest = b.events[b.start].seq
+		}
+		return 0, &codedError{
+			Code:    "replay_unavailable",
+			Err:     fmt.Errorf("events after %v are no longer buffered", seq),
+			Details: map[string]any{"oldest": oldest},
+		}
+	}
+
+	var n int
+	for i := range b.events {
+		event := b.events[(b.start+i)%len(b.events)]
+		if event.seq > seq {
+			yield(event.data)
+			n++
+		}
+	}
+	return n, nil
+}
+
+var errReplayDisabled = &codedError{Code: "not_supported", Err: errors.New("the replay buffer is disabled; see -replay-buffer")}
+
+// sendEvents sends encoded events, whose operations are given by ops,
+// to every client subscribed to them, in a single frame with -batch
+// and otherwise in one frame each. If the replay buffer is enabled,
+// they are given sequence numbers and buffered.
+func (s *Server) sendEvents(events [][]byte, ops []fsnotify.Op) {
+	var first uint64
+	if s.replay != nil {
+		s.replay.m.Lock()
+		defer s.replay.m.Unlock()
+
+		first = s.replay.seq + 1
+		for i, data := range events {
+			events[i] = s.replay.add(data)
+		}
+	}
+	// seq returns the sequence number of the ith event, which is 0
+	// without the replay buffer.
+	seq := func(i int) uint64 {
+		if first == 0 {
+			return 0
+		}
+		return first + uint64(i)
+	}
+
+	if !s.config.Batch {
+		for i, data := range events {
+			s.bcast.send(broadcastFrame{data: data, droppable: true, ops: ops[i : i+1], seq: seq(i)})
+		}
+		return
+	}
+	s.bcast.send(broadcastFrame{data: joinEvents(events), droppable: true, ops: ops, events: events, seq: seq(len(events) - 1)})
+}
+
+// joinEvents returns a JSON array of encoded events.
+func joinEvents(events [][]byte) []byte {
+	frame := []byte{'['}
+	for i, data := range events {
+		if i > 0 {
+			frame = append(frame, ',')
+		}
+		frame = append(frame, data...)
+	}
+	return append(frame, ']')
+}
+
+type replayBufferData struct {
+	Replayed int `json:"replayed"`
+}
+
+// replayTo sends c every buffered event after seq. Events that c was
+// already sent after seq are sent again, so clients have to be able
+// to handle duplicates, but nothing is skipped.
+func (s *Server) replayTo(c *conn, seq uint64) (replayBufferData, error) {
+	if s.replay == nil {
+		return replayBufferData{}, errReplayDisabled
+	}
+
+	s.replay.m.Lock()
+	defer s.replay.m.Unlock()
+
+	n, err := s.replay.since(seq, func(data []byte) {
+		// Replayed events aren't droppable because the client is
+		// counting on getting them.
+		c.bcast.send(broadcastFrame{data: s.eventPayload(data), to: c})
+	})
+	return replayBufferData{Replayed: n}, err
+}
+
+// watchSince is like replayTo, except that events after seq that were
+// sent before the call, but that c hasn't been sent yet, are skipped
+// since they are replayed, so that c gets each event after seq once
+// and in order before it gets any new ones.
+func (s *Server) watchSince(c *conn, seq uint64) (replayBufferData, error) {
+	if s.replay == nil {
+		return replayBufferData{}, errReplayDisabled
+	}
+
+	s.replay.m.Lock()
+	defer s.replay.m.Unlock()
+
+	var events [][]byte
+	n, err := s.replay.since(seq, func(data []byte) {
+		events = append(events, data)
+	})
+	if err != nil {
+		return replayBufferData{}, err
+	}
+	// No events can be sent while s.replay.m is held, so everything
+	// after the replayed events is sent to c as usual.
+	s.bcast.skipThrough(c, s.replay.seq)
+	for _, data := range events {
+		c.bcast.send(broadcastFrame{data: s.eventPayload(data), to: c})
+	}
+	return replayBufferData{Replayed: n}, nil
+}
+
+// parseReplay parses the argument of replay, which is the sequence
+// number to replay after. It defaults to the last one checkpointed by
+// c.
+func parseReplay(c *conn, arg string) (uint64, error) {
+	if arg == "" {
+		return c.lastAcked.Load(), nil
+	}
+	return strconv.ParseUint(arg, 10, 64)
+}
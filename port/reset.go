@@ -0,0 +1,70 @@
+package main
+
+// reset returns the server to a blank state, as if the process had
+// been restarted, without dropping any connections. Every watcher is
+// closed and the default one is replaced with a new one, and all
+// per-path state, counters, and buffered events are discarded. The
+// background commands of c are finished first.
+func (s *Server) reset(c *conn) error {
+	c.inflight.wait()
+
+	watcher, err := s.newWatcher()
+	if err != nil {
+		return err
+	}
+
+	s.hmu.Lock()
+	handles := s.handles
+	s.handles = nil
+	s.nextHandle = defaultHandle
+	s.hmu.Unlock()
+	s.namespaces.clear()
+
+	for _, h := range handles {
+		h.stop()
+		h.watcher.Close()
+	}
+	s.startHandle(s.ctx, watcher, "")
+
+	s.debounceRules.clear()
+	s.counters.snapshot(true)
+	s.counters.warned.Store(false)
+	s.suppressed.Store(0)
+	if s.replay != nil {
+		s.replay.clear()
+	}
+	s.bcast.resetConns()
+	return nil
+}
+
+// clear removes every rule.
+func (r *debounceRules) clear() {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	r.rules = nil
+}
+
+// clear discards every buffered event and starts sequence numbers
+// over.
+func (b *replayBuffer) clear() {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	b.seq = 0
+	b.events = b.events[:0]
+	b.start = 0
+}
+
+// resetConns resets the number of watches counted against the quota
+// of every connection, along with the events that were replayed to
+// them, since sequence numbers start over.
+func (b *broadcaster) resetConns() {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	for c := range b.conns {
+		c.watches.Store(0)
+		c.replayedThrough = 0
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// scan emits a synthetic Create event for every entry in dir,
+// descending up to depth levels into subdirectories, and returns the
+// number of events emitted. Entries that disappear during the scan
+// are skipped. If ctx is canceled, the scan stops early.
+func (s *Server) scan(ctx context.Context, h *handle, dir string, depth int) (int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	var count int
+	for _, entry := range entries {
+		if ctx.Err() != nil {
+			return count, cancelledError(ctx, map[string]any{"count": count})
+		}
+
+		path := filepath.Join(dir, entry.Name())
+		data := s.newEventData(h, fsnotify.Event{Name: path, Op: fsnotify.Create})
+		data.Synthetic = true
+		s.sendEvent(data)
+		count++
+
+		if depth > 0 && entry.IsDir() {
+			n, _ := s.scan(ctx, h, path, depth-1)
+			count += n
+			if ctx.Err() != nil {
+				return count, cancelledError(ctx, map[string]any{"count": count})
+			}
+		}
+	}
+	return count, nil
+}
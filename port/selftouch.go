@@ -0,0 +1,118 @@
+package main
+
+import (
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+const (
+	// selfTouchWindow is how long after the port has finished reading
+	// a file that an event for it can still be put down to the read.
+	selfTouchWindow = 100 * time.Millisecond
+
+	// maxSelfTouches is the most reads that are tracked at once.
+	// Events caused by reads beyond that are delivered.
+	maxSelfTouches = 4096
+)
+
+// selfTouch is an event that the port expects to cause itself.
+type selfTouch struct {
+	path string
+	op   fsnotify.Op
+}
+
+type selfTouchState struct {
+	// active is the number of reads of the path that are still going.
+	active int
+
+	// until is when the last of them finished plus selfTouchWindow.
+	until time.Time
+}
+
+// selfTouches tracks files that the port itself is reading, to hash,
+// sniff, or tail them, so that the events that doing so causes on some
+// platforms, such as Chmod when the access time is updated, aren't fed
+// back into the pipeline. It errs on the side of delivering events:
+// only events whose op is exactly the one expected are dropped, and
+// each read accounts for at most one once it has finished.
+type selfTouches struct {
+	clock clock
+
+	m       sync.Mutex
+	touches map[selfTouch]*selfTouchState
+}
+
+// touch records that the port is about to do something to path that
+// can cause an event with op. The returned function must be called
+// once it is done. It is safe to call on a nil *selfTouches.
+func (t *selfTouches) touch(path string, op fsnotify.Op) (done func()) {
+	if t == nil {
+		return func() {}
+	}
+
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	key := selfTouch{path: filepath.Clean(path), op: op}
+	state, ok := t.touches[key]
+	if !ok {
+		if len(t.touches) >= maxSelfTouches && !t.prune() {
+			return func() {}
+		}
+		if t.touches == nil {
+			t.touches = make(map[selfTouch]*selfTouchState)
+		}
+		state = &selfTouchState{}
+		t.touches[key] = state
+	}
+	state.active++
+
+	return func() {
+		t.m.Lock()
+		defer t.m.Unlock()
+
+		state.active--
+		state.until = t.clock.Now().Add(selfTouchWindow)
+	}
+}
+
+// prune forgets reads whose window has passed, reporting whether any
+// were. t.m must be held.
+func (t *selfTouches) prune() bool {
+	now := t.clock.Now()
+	n := len(t.touches)
+	for key, state := range t.touches {
+		if state.active == 0 && now.After(state.until) {
+			delete(t.touches, key)
+		}
+	}
+	return len(t.touches) < n
+}
+
+// suppress reports whether event was caused by the port itself and
+// should be dropped.
+func (t *selfTouches) suppress(event fsnotify.Event) bool {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	if len(t.touches) == 0 {
+		return false
+	}
+	key := selfTouch{path: filepath.Clean(event.Name), op: event.Op}
+	state, ok := t.touches[key]
+	switch {
+	case !ok:
+		return false
+	case state.active > 0:
+		return true
+	case t.clock.Now().After(state.until):
+		delete(t.touches, key)
+		return false
+	default:
+		delete(t.touches, key)
+		return true
+	}
+}
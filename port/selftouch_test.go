@@ -0,0 +1,66 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func TestSelfTouches(t *testing.T) {
+	clock := newFakeClock()
+	touches := selfTouches{clock: clock}
+	chmod := fsnotify.Event{Name: "/data/a", Op: fsnotify.Chmod}
+
+	done := touches.touch("/data/a", fsnotify.Chmod)
+	if !touches.suppress(chmod) {
+		t.Fatal("chmod during read was delivered")
+	}
+	if !touches.suppress(chmod) {
+		t.Fatal("second chmod during read was delivered")
+	}
+	if touches.suppress(fsnotify.Event{Name: "/data/a", Op: fsnotify.Chmod | fsnotify.Write}) {
+		t.Fatal("chmod combined with write was suppressed")
+	}
+	if touches.suppress(fsnotify.Event{Name: "/data/b", Op: fsnotify.Chmod}) {
+		t.Fatal("chmod on another path was suppressed")
+	}
+	done()
+
+	// Once the read is done, it only accounts for one more event.
+	if !touches.suppress(chmod) {
+		t.Fatal("chmod right after read was delivered")
+	}
+	if touches.suppress(chmod) {
+		t.Fatal("second chmod after read was suppressed")
+	}
+
+	touches.touch("/data/a", fsnotify.Chmod)()
+	clock.Advance(selfTouchWindow + time.Millisecond)
+	if touches.suppress(chmod) {
+		t.Fatal("chmod after window was suppressed")
+	}
+	if n := len(touches.touches); n != 0 {
+		t.Fatalf("%v reads still tracked", n)
+	}
+}
+
+func TestSelfSuppressedStats(t *testing.T) {
+	ts := newTestServer(t)
+
+	ts.send(1, "add_watch /data")
+	ts.expect(1, `"ok"`)
+
+	done := ts.server.touches.touch("/data/a", fsnotify.Chmod)
+	ts.watcher.Inject(fsnotify.Event{Name: "/data/a", Op: fsnotify.Chmod})
+	ts.watcher.Inject(fsnotify.Event{Name: "/data/b", Op: fsnotify.Chmod})
+	ts.expect(0, `{"id":1,"Name":"/data/b","root":"/data","op":["chmod"],"is_dir":null}`)
+	done()
+
+	ts.send(2, "watch_stats")
+	_, payload := ts.next()
+	if want := `"self_suppressed":1`; !strings.Contains(payload, want) {
+		t.Fatalf("got %s, expected it to contain %s", payload, want)
+	}
+}
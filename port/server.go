@@ -0,0 +1,1000 @@
+package main
+
+import (
+	"context"
+	"encoding/json/v2"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Config holds the settings of a Server that are fixed for its
+// lifetime.
+type Config struct {
+	DropPolicy  dropPolicy
+	DropTimeout time.Duration
+	BufferSize  int
+
+	// BlockMaxBytes is how large the frames queued for a client can
+	// get with policyBlock before it is disconnected.
+	BlockMaxBytes int
+
+	// Playback is the path of a recording to play back instead of
+	// watching the filesystem.
+	Playback string
+
+	// AllowPrefixes, if not empty, restricts watches to paths under
+	// one of the listed directories.
+	AllowPrefixes []string
+
+	// MaxWatches, if positive, limits the number of watches that each
+	// connection may add.
+	MaxWatches int
+
+	// CommandRate, if positive, limits the number of commands per
+	// second that each connection may send.
+	CommandRate float64
+
+	// CommandTimeout, if positive, cancels commands that run in the
+	// background once they have been running for this long.
+	CommandTimeout time.Duration
+
+	// StateFile is the path of a file listing watches to add to the
+	// default watcher. It is read on startup and again whenever the
+	// process receives SIGHUP.
+	StateFile string
+
+	// LegacyOps sends the operation of events as fsnotify's bitmask
+	// under "Op", as older versions did, instead of as an array of
+	// names under "op".
+	LegacyOps bool
+
+	// Timestamps adds the time at which each event or error was
+	// received from the watcher to the frames sent for them.
+	Timestamps bool
+
+	// StatEvents adds the size, permissions, modification time, and
+	// type of the file to events for every watch, rather than just
+	// those added with the stat option.
+	StatEvents bool
+
+	// StatCacheTTL is how long the metadata of a path is reused for by
+	// later writes with StatEvents. Zero stats every event.
+	StatCacheTTL time.Duration
+
+	// OwnerNames adds the names of the owner and group of files to
+	// stat metadata, along with their uid and gid.
+	OwnerNames bool
+
+	// Keepalive, if positive, is how long a client can go without
+	// being sent anything before it is sent a keepalive frame.
+	Keepalive time.Duration
+
+	// Batch sends events that arrive together as a JSON array in a
+	// single frame. Every event frame is an array when this is set.
+	Batch bool
+
+	// ReplayBuffer, if positive, is how many of the most recent events
+	// are kept, with sequence numbers, for the replay command.
+	ReplayBuffer int
+
+	// NoCRC uses the older frame format, which doesn't have a
+	// checksum.
+	NoCRC bool
+
+	// Compress, if not empty, is the compression algorithm used for
+	// the payloads of frames sent to clients, which can turn it off
+	// and on again with the compress command. The only one is "lz4".
+	Compress string
+
+	// HMACKey, if not nil, requires every command to be tagged with an
+	// HMAC-SHA256 using it, and tags everything sent to clients.
+	HMACKey []byte
+
+	// DedupWindow, if positive, suppresses events that have the same
+	// path and operation as the previous event for that path if they
+	// arrive within the window.
+	DedupWindow time.Duration
+
+	// WriteSettle, if positive, holds back bursts of writes to a path
+	// until it has been quiet for this long, sending a single settled
+	// write instead. It can also be set for individual watches.
+	WriteSettle time.Duration
+
+	// BurstThreshold, if positive, replaces the events for paths that
+	// get more than this many within BurstWindow with a summary every
+	// window until they calm down. If BurstWindow is zero, it is a
+	// second.
+	BurstThreshold int
+	BurstWindow    time.Duration
+
+	// RelativePaths sends the names of events relative to the root of
+	// the watch that they belong to, which is sent alongside them.
+	RelativePaths bool
+
+	// MoveWindow, if positive, holds renames for up to this long so
+	// that they can be paired with the creates that they cause and
+	// sent as single moved events.
+	MoveWindow time.Duration
+
+	// AtomicWindow, if positive, holds the events for newly created
+	// paths for up to this long in case they turn out to be the
+	// temporary file of an atomic write, in which case a single
+	// WriteAtomic event is sent in their place.
+	AtomicWindow time.Duration
+
+	// IgnoreChmod drops events that are only Chmod. It can be
+	// overridden for individual watches.
+	IgnoreChmod bool
+
+	// IgnoreHidden drops events for files whose names start with a
+	// dot, or that have the hidden attribute on Windows. It can be
+	// overridden for individual watches.
+	IgnoreHidden bool
+
+	// FilterVCS drops events for paths in version control
+	// directories, such as .git. It can be changed with
+	// set_filter_vcs.
+	FilterVCS bool
+
+	// FilterEditors drops events for the temporary files that editors
+	// create, such as Vim's swap files.
+	FilterEditors bool
+
+	// FilterPatterns drops events for paths matching any of these
+	// globs. Globs without a separator are matched against the last
+	// element of the path.
+	FilterPatterns []string
+
+	// Extensions is a comma-separated list of the file extensions to
+	// deliver events for. If it is empty, events are delivered for
+	// every file. It can be changed with set_ext_filter.
+	Extensions string
+
+	// ResolveSymlinks resolves symlinks in the directories of the
+	// paths of events. Paths are always made absolute either way.
+	ResolveSymlinks bool
+
+	// HashMaxSize is the size of the largest file that is hashed for
+	// watches with "hash". Larger files are skipped. If it is zero,
+	// a default of 64 MiB is used.
+	HashMaxSize int64
+
+	// HashTimeout is how long hashing a file can take before it is
+	// given up on. If it is zero, a default of 10 seconds is used.
+	HashTimeout time.Duration
+
+	// HashEvents adds the SHA-256 hash of the file's contents to every
+	// create and write event for a regular file.
+	HashEvents bool
+
+	// Cookies adds inotify's cookies to events caused by moves on
+	// Linux.
+	Cookies bool
+
+	// SizeCache is the number of paths whose last size is remembered
+	// to report how much writes changed it with stat metadata. If it
+	// is zero, size_delta isn't reported.
+	SizeCache int
+
+	// DeadLetter is the path of a file that events are appended to
+	// when writing them to a client fails, up to DeadLetterMaxBytes.
+	DeadLetter         string
+	DeadLetterMaxBytes int64
+}
+
+// frameFormat returns the format of frames sent and received.
+func (c Config) frameFormat() frameFormat {
+	return frameFormat{crc: !c.NoCRC, key: c.HMACKey}
+}
+
+// newWatcher returns the function used to create watchers.
+func (c Config) newWatcher() func() (Watcher, error) {
+	switch {
+	case c.Playback != "":
+		return newPlaybackWatcher
+	case c.Cookies:
+		return newCookieWatcher
+	default:
+		return NewWatcher
+	}
+}
+
+// DefaultConfig is the configuration used when no options are
+// specified.
+var DefaultConfig = Config{
+	DropPolicy:     policyBlock,
+	DropTimeout:    100 * time.Millisecond,
+	BufferSize:     4096,
+	BlockMaxBytes:  defaultBlockMaxBytes,
+	HashMaxSize:    defaultHashMaxSize,
+	HashTimeout:    defaultHashTimeout,
+	StatCacheTTL:   defaultStatCacheTTL,
+	SizeCache:      defaultSizeCache,
+	CommandTimeout: defaultCommandTimeout,
+
+	DeadLetterMaxBytes: defaultDeadLetterMaxBytes,
+}
+
+// Server handles commands from clients, forwarding events from its
+// watchers to all of them.
+type Server struct {
+	config     Config
+	ctx        context.Context
+	watcher    Watcher
+	newWatcher func() (Watcher, error)
+	cancel     context.CancelFunc
+	bcast      *broadcaster
+	started    time.Time
+
+	allowPrefixes []string
+
+	debounceRules  debounceRules
+	counters       counters
+	suppressed     atomic.Uint64
+	draining       atomic.Bool
+	lastEventID    atomic.Uint64
+	pathStats      pathStats
+	touches        selfTouches
+	owners         *ownerNames
+	deadLetter     *deadLetter
+	sizes          sizeCache
+	statCache      statCache
+	filterVCS      atomic.Bool
+	extFilter      atomic.Pointer[extFilter]
+	filterPatterns []string
+	recorder       recorder
+	journal        journal
+	replay         *replayBuffer
+	breaker        breaker
+	reloadm        sync.Mutex
+	ready          sync.Once
+
+	hmu        sync.RWMutex
+	handles    map[uint64]*handle
+	nextHandle uint64
+	namespaces namespaces
+}
+
+// NewServer returns a Server that uses watcher as its default
+// watcher. The caller remains responsible for closing it.
+func NewServer(watcher Watcher, cancel context.CancelFunc, config Config) *Server {
+	s := Server{
+		config:     config,
+		watcher:    watcher,
+		newWatcher: config.newWatcher(),
+		cancel:     cancel,
+		bcast:      newBroadcaster(config.frameFormat()),
+		started:    time.Now(),
+		breaker:    breaker{clock: realClock{}},
+		sizes:      sizeCache{max: config.SizeCache},
+		touches:    selfTouches{clock: realClock{}},
+		statCache:  statCache{clock: realClock{}, ttl: config.StatCacheTTL},
+	}
+	s.filterVCS.Store(config.FilterVCS)
+	s.filterPatterns = filterPatterns(config)
+	extFilter := parseExtFilter(config.Extensions)
+	s.extFilter.Store(&extFilter)
+	if config.ReplayBuffer > 0 {
+		s.replay = newReplayBuffer(config.ReplayBuffer)
+	}
+	if config.OwnerNames {
+		s.owners = newOwnerNames()
+	}
+	if config.DeadLetter != "" {
+		s.deadLetter = &deadLetter{
+			path: config.DeadLetter,
+			max:  config.DeadLetterMaxBytes,
+			onDrop: func(n int) {
+				// This is called while frames are being fanned out, so
+				// the warning can't be sent synchronously.
+				if s.counters.drop(dropDeadLetter, uint64(n)) {
+					go s.broadcastWarning(dropWarning(dropDeadLetter))
+				}
+			},
+		}
+	}
+	for _, prefix := range config.AllowPrefixes {
+		resolved, err := resolvePath(prefix)
+		if err != nil {
+			resolved = filepath.Clean(prefix)
+		}
+		s.allowPrefixes = append(s.allowPrefixes, resolved)
+	}
+	return &s
+}
+
+// sendEvent sends an event frame to every client. It may be dropped,
+// depending on the drop policy, for clients that aren't keeping up.
+// With -batch, the event is sent as an array of one.
+func (s *Server) sendEvent(msg any) {
+	s.sendEvents([][]byte{s.encodeEvent(msg)}, []fsnotify.Op{messageOp(msg)})
+}
+
+// eventPayload returns the payload of a frame containing a single
+// encoded event.
+func (s *Server) eventPayload(data []byte) []byte {
+	if s.config.Batch {
+		data = append(append([]byte{'['}, data...), ']')
+	}
+	return data
+}
+
+// encodeEvent encodes an event with the next event ID, recording it
+// if a recording or journal is being made. If the event can't be
+// added to either, the error is sent to every client.
+func (s *Server) encodeEvent(msg any) []byte {
+	data, err := json.Marshal(msg, lossyUTF8)
+	if err != nil {
+		panic(err)
+	}
+	data = prependField(data, "id", s.lastEventID.Add(1))
+	err = s.recorder.record(data)
+	if err != nil {
+		s.broadcastError(err)
+	}
+	err = s.journal.append(data)
+	if err != nil {
+		s.broadcastError(err)
+	}
+	return data
+}
+
+// broadcast sends msg to every client without the possibility of it
+// being dropped.
+func (s *Server) broadcast(msg any) {
+	data, err := json.Marshal(msg, lossyUTF8)
+	if err != nil {
+		panic(err)
+	}
+	s.bcast.send(broadcastFrame{data: data})
+}
+
+// broadcastUrgent sends msg to every client ahead of any events that
+// are still queued.
+func (s *Server) broadcastUrgent(msg any) {
+	data, err := json.Marshal(msg, lossyUTF8)
+	if err != nil {
+		panic(err)
+	}
+	s.bcast.send(broadcastFrame{data: data, urgent: true})
+}
+
+func (s *Server) broadcastError(err error) {
+	s.broadcastUrgent(newErrorData(err))
+}
+
+func (s *Server) broadcastWarning(msg string) {
+	type warningData struct {
+		Warn string
+	}
+	s.broadcastUrgent(warningData{Warn: msg})
+}
+
+func dropWarning(reason dropReason) string {
+	return fmt.Sprintf("events are being dropped (%v); see the counters command", reason)
+}
+
+// drop records that n events were not delivered to the client.
+func (s *Server) drop(reason dropReason, n uint64) {
+	if s.counters.drop(reason, n) {
+		s.broadcastWarning(dropWarning(reason))
+	}
+}
+
+type eventData struct {
+	Name string
+
+	// PathB64 and PathEncoding are set if Name isn't valid UTF-8, in
+	// which case Name has the invalid bytes replaced. See encodePath.
+	PathB64      string `json:"path_b64,omitzero"`
+	PathEncoding string `json:"path_encoding,omitzero"`
+
+	// Root is the path of the watch that the event belongs to, as
+	// listed by watch_list.
+	Root string `json:"root,omitzero"`
+
+	// Op is the operation as an array of names. LegacyOp is
+	// fsnotify's bitmask, which is sent instead with -legacy-ops.
+	Op       eventOp      `json:"op,omitzero"`
+	LegacyOp *fsnotify.Op `json:"Op,omitzero"`
+
+	Handle uint64 `json:"handle,omitzero"`
+	NS     string `json:"ns,omitzero"`
+	Tag    string `json:"tag,omitzero"`
+
+	// Count is the number of events that were coalesced into this
+	// one by debouncing.
+	Count int `json:"count,omitzero"`
+
+	// Settled is true for writes that were held until the path
+	// stopped being written to, in which case Count is the number of
+	// writes and BurstMS is how long they went on for.
+	Settled bool  `json:"settled,omitzero"`
+	BurstMS int64 `json:"burst_ms,omitzero"`
+
+	// Coalesced is the number of duplicates of the previous event for
+	// the same path that were suppressed with -dedup-window.
+	Coalesced int `json:"coalesced,omitzero"`
+
+	// From and To are set for moved events, which pair a rename with
+	// the create that it caused, to the paths as they would have been
+	// sent in each.
+	From string `json:"from,omitzero"`
+	To   string `json:"to,omitzero"`
+
+	// Cookie is the cookie that inotify uses to pair the rename and
+	// create caused by a move, with -cookies on Linux.
+	Cookie uint32 `json:"cookie,omitzero"`
+
+	// Synthetic is true for events that were generated by the port
+	// rather than reported by the watcher.
+	Synthetic bool `json:"synthetic,omitzero"`
+
+	// IsDir is whether the path is a directory, or null if that isn't
+	// known. For removals, it is what the path was before it was
+	// removed.
+	IsDir *bool `json:"is_dir"`
+
+	// Time and MonoNS are set with -timestamps. See timestamp.
+	Time   string `json:"time,omitzero"`
+	MonoNS int64  `json:"mono_ns,omitzero"`
+
+	// These are set for watches with stat metadata enabled. See
+	// statEvent, which also updates IsDir.
+	Size      *int64 `json:"size,omitzero"`
+	SizeDelta *int64 `json:"size_delta,omitzero"`
+	Mode      string `json:"mode,omitzero"`
+	MTime     string `json:"mtime,omitzero"`
+	StatError string `json:"stat_error,omitzero"`
+
+	// ModeBits is the full mode as Go's os.FileMode, which is only
+	// sent for chmods so that clients can see what changed.
+	ModeBits *uint32 `json:"mode_bits,omitzero"`
+
+	// ModeStr is the full mode, such as "-rw-r--r--". UID and GID are
+	// only set on Unix, and Owner and Group are only set with
+	// -owner-names once they have been looked up. Attributes are only
+	// set on Windows.
+	ModeStr    string   `json:"mode_str,omitzero"`
+	UID        *uint32  `json:"uid,omitzero"`
+	GID        *uint32  `json:"gid,omitzero"`
+	Owner      string   `json:"owner,omitzero"`
+	Group      string   `json:"group,omitzero"`
+	Attributes []string `json:"attributes,omitzero"`
+
+	// Hash is the hash of the file's contents for writes in watches
+	// with "hash", as the algorithm followed by a colon and the hash in
+	// hex. If the file wasn't hashed, HashSkipped says why instead.
+	Hash        string `json:"hash,omitzero"`
+	HashSkipped string `json:"hash_skipped,omitzero"`
+
+	// SHA256 is the SHA-256 hash of the file's contents in hex for
+	// creates and writes with -hash-events. HashSkipped is set instead
+	// if it wasn't hashed.
+	SHA256 string `json:"sha256,omitzero"`
+
+	// ContentType and Ext are the detected content type and extension
+	// of regular files for creates and settled writes in watches with
+	// "sniff". If the file couldn't be read, SniffError says why
+	// instead.
+	ContentType string `json:"content_type,omitzero"`
+	Ext         string `json:"ext,omitzero"`
+	SniffError  string `json:"sniff_error,omitzero"`
+}
+
+// timestamp returns t formatted as RFC 3339 along with how long after
+// the server started it was according to the monotonic clock, which
+// unlike the wall clock can be used to reliably order frames. Both are
+// zero if timestamps are disabled.
+func (s *Server) timestamp(t time.Time) (string, int64) {
+	if !s.config.Timestamps {
+		return "", 0
+	}
+	return t.Format(time.RFC3339Nano), t.Sub(s.started).Nanoseconds()
+}
+
+func (s *Server) newEventData(h *handle, event fsnotify.Event) eventData {
+	entry, _ := h.watches.lookup(event.Name)
+	root, tag := entry.Path, entry.Tag
+	if stickyTag, ok := h.stickyTag(event.Name); ok {
+		root = filepath.Clean(event.Name)
+		if stickyTag != "" {
+			tag = stickyTag
+		}
+	}
+
+	data := eventData{
+		Name:   event.Name,
+		Root:   root,
+		Handle: h.id,
+		NS:     h.ns,
+		Tag:    tag,
+		IsDir:  h.dirs.isDir(event.Name),
+	}
+	if data.IsDir == nil && !event.Has(fsnotify.Remove) && !event.Has(fsnotify.Rename) {
+		if info, err := os.Lstat(event.Name); err == nil {
+			isDir := info.IsDir()
+			data.IsDir = &isDir
+		}
+	}
+	if s.config.LegacyOps {
+		data.LegacyOp = &event.Op
+	} else {
+		data.Op = eventOp(event.Op)
+	}
+	data.Time, data.MonoNS = s.timestamp(time.Now())
+	if s.config.StatEvents || entry.Stat {
+		statEvent(&data, event, &s.statCache)
+		data.SizeDelta = s.sizes.update(event, data.Size)
+		if s.owners != nil {
+			s.owners.resolve(&data)
+		}
+	}
+	data.Name = canonicalPath(event.Name, s.config.ResolveSymlinks)
+	if s.config.RelativePaths && root != "" {
+		if rel, err := filepath.Rel(root, event.Name); err == nil {
+			data.Name = rel
+		}
+	}
+	data.PathB64, data.PathEncoding = encodePath(data.Name)
+	return data
+}
+
+// summaryData is sent periodically in place of events suppressed by
+// a rate limit.
+type summaryData struct {
+	Name       string
+	Handle     uint64 `json:"handle,omitzero"`
+	NS         string `json:"ns,omitzero"`
+	Suppressed int    `json:"suppressed"`
+	Summary    string `json:"summary"`
+}
+
+// resume delivers the events that were held while root was paused,
+// followed by a summary of everything that was suppressed.
+func (s *Server) resume(h *handle, root string, state *pauseState) {
+	for _, path := range state.order {
+		s.sendEvent(s.newEventData(h, fsnotify.Event{Name: path, Op: state.held[path]}))
+	}
+
+	if state.suppressed > 0 {
+		s.sendEvent(summaryData{
+			Name:       root,
+			Handle:     h.id,
+			NS:         h.ns,
+			Suppressed: state.suppressed,
+			Summary:    fmt.Sprintf("suppressed %v events for %v while paused", state.suppressed, root),
+		})
+	}
+}
+
+// settleQuiet returns how long writes to paths in the watch described
+// by entry have to stop for before they are delivered.
+func (s *Server) settleQuiet(entry watchEntry) time.Duration {
+	if entry.SettleMS > 0 {
+		return time.Duration(entry.SettleMS) * time.Millisecond
+	}
+	return s.config.WriteSettle
+}
+
+// handleEvent handles an event that was received from the watcher at
+// the given time, passing anything that should be delivered right
+// away to send.
+func (s *Server) handleEvent(h *handle, event fsnotify.Event, received time.Time, send func(any)) {
+	s.pathStats.observe(event)
+	cookie := h.cookie(event)
+	var orphans []orphan
+	if event.Has(fsnotify.Remove) {
+		orphans = h.dirs.orphans(event.Name)
+		defer h.removeDead(event.Name)
+	}
+	isDir := h.dirs.observe(event)
+	if h.creates.duplicate(event, received) {
+		return
+	}
+	created := h.updateTree(event)
+	if created != nil {
+		defer s.sendCreated(h, created, received, send)
+	}
+	s.tail(h, event, send)
+
+	entry, _ := h.watches.lookup(event.Name)
+	if s.filtered(event, entry) {
+		return
+	}
+	if entry.DirsOnly && isDir != nil && !*isDir {
+		// Events for paths that might be directories are delivered,
+		// since it's better to send too many than to lose some.
+		return
+	}
+	if !s.allowsExt(entry, event.Name, isDir) {
+		return
+	}
+
+	coalesced, deliver := h.dedup.check(event, received)
+	if !deliver {
+		return
+	}
+
+	deliver, synthetic := h.handleSticky(event)
+	if deliver {
+		if h.pauses.hold(entry.Path, event) {
+			return
+		}
+		deliver = h.limits.allow(entry.Path) && !h.bursts.handle(event) && !h.settle.handle(event, s.settleQuiet(entry))
+	}
+	if deliver {
+		// Clients are told that the entries of a removed directory are
+		// gone before the directory itself.
+		s.sendOrphans(h, orphans, entry, received, send)
+	}
+	if deliver && !h.debounce.handle(event) {
+		data := s.newEventData(h, event)
+		data.Coalesced = coalesced
+		data.Cookie = cookie
+		data.Time, data.MonoNS = s.timestamp(received)
+		if data.Size == nil {
+			// The path wasn't stat'd just now, so what was known when
+			// the event was received is the best answer.
+			data.IsDir = isDir
+		}
+		h.atomic.handle(event, data, send)
+	}
+
+	for _, event := range synthetic {
+		if h.debounce.handle(event) {
+			continue
+		}
+		data := s.newEventData(h, event)
+		data.Synthetic = true
+		data.Time, data.MonoNS = s.timestamp(received)
+		send(data)
+	}
+}
+
+// sendOrphans sends synthetic removals for the entries of a removed
+// directory that weren't reported as removed on their own, as long as
+// they would have been delivered for the watch described by entry.
+func (s *Server) sendOrphans(h *handle, orphans []orphan, entry watchEntry, received time.Time, send func(any)) {
+	for _, o := range orphans {
+		event := fsnotify.Event{Name: o.path, Op: fsnotify.Remove}
+		if s.filtered(event, entry) || entry.DirsOnly && !o.isDir {
+			continue
+		}
+		if !s.allowsExt(entry, o.path, &o.isDir) {
+			continue
+		}
+		h.debounce.drop(o.path)
+		h.settle.drop(o.path)
+
+		data := s.newEventData(h, event)
+		data.IsDir = &o.isDir
+		data.Synthetic = true
+		data.Time, data.MonoNS = s.timestamp(received)
+		send(data)
+	}
+}
+
+func (s *Server) watch(ctx context.Context, h *handle) {
+	for {
+		// Errors are handled first when events are also waiting, so
+		// that clients don't hear about them late when the watcher is
+		// flooded with events.
+		select {
+		case err, ok := <-h.watcher.Errors():
+			if !ok {
+				return
+			}
+			s.handleError(h, err)
+			continue
+		default:
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+
+		case event, ok := <-h.watcher.Events():
+			if !ok {
+				return
+			}
+			if s.config.Batch {
+				if !s.handleBatch(h, event) {
+					return
+				}
+				continue
+			}
+			s.handleEvent(h, event, time.Now(), s.sendEvent)
+
+		case err, ok := <-h.watcher.Errors():
+			if !ok {
+				return
+			}
+			s.handleError(h, err)
+		}
+	}
+}
+
+// handleError sends an error from the handle's watcher to every
+// client ahead of any events that are still queued.
+func (s *Server) handleError(h *handle, err error) {
+	received := time.Now()
+	if errors.Is(err, fsnotify.ErrEventOverflow) {
+		s.drop(dropOverflow, 1)
+		h.trees.markOverflowed()
+		data := overflowData{Op: "Overflow", Handle: h.id, NS: h.ns}
+		data.Time, data.MonoNS = s.timestamp(received)
+		s.broadcastUrgent(data)
+		return
+	}
+	data := handleErrorData{Err: err.Error(), Handle: h.id, NS: h.ns}
+	data.Time, data.MonoNS = s.timestamp(received)
+	s.broadcastUrgent(data)
+}
+
+// overflowData tells clients that events were lost because the
+// kernel's queue overflowed and that they should rescan everything
+// that they're watching.
+type overflowData struct {
+	Op     string `json:"op"`
+	Name   string `json:"name"`
+	Handle uint64 `json:"handle,omitzero"`
+	NS     string `json:"ns,omitzero"`
+	Time   string `json:"time,omitzero"`
+	MonoNS int64  `json:"mono_ns,omitzero"`
+}
+
+type handleErrorData struct {
+	Err    string
+	Handle uint64 `json:"handle,omitzero"`
+	NS     string `json:"ns,omitzero"`
+	Time   string `json:"time,omitzero"`
+	MonoNS int64  `json:"mono_ns,omitzero"`
+}
+
+// parseHandle parses the optional handle argument of commands that
+// don't take any other arguments.
+func parseHandle(arg string) (uint64, error) {
+	if arg == "" {
+		return defaultHandle, nil
+	}
+	return strconv.ParseUint(arg, 10, 64)
+}
+
+// start starts forwarding events from the default watcher.
+func (s *Server) start(ctx context.Context) {
+	s.ctx = ctx
+	go s.bcast.run()
+	s.startHandle(ctx, s.watcher, "")
+	go s.handleDumps(ctx)
+	go s.watchdog(ctx)
+	if s.owners != nil {
+		s.owners.run(ctx)
+	}
+	if s.config.Keepalive > 0 {
+		go s.keepalive(ctx, s.config.Keepalive)
+	}
+
+	if s.config.StateFile != "" {
+		s.reload()
+		go s.handleReloads(ctx)
+	}
+
+	if s.config.Playback != "" {
+		go func() {
+			err := s.playbackFile(ctx, s.config.Playback)
+			if err != nil {
+				s.broadcastError(err)
+			}
+		}()
+	}
+}
+
+// shutdown stops all watchers and flushes everything that has been
+// sent to clients.
+func (s *Server) shutdown() {
+	s.stopHandles()
+	s.recorder.stop()
+	s.journal.stop()
+	s.bcast.close()
+	if s.deadLetter != nil {
+		s.deadLetter.close()
+	}
+	s.cancel()
+}
+
+// Run forwards events from the watcher and handles commands read from
+// r, writing replies and events to w, until the command stream ends
+// or ctx is canceled.
+func (s *Server) Run(ctx context.Context, r io.Reader, w io.Writer) {
+	s.start(ctx)
+	defer s.shutdown()
+
+	c := s.newConn(r, w, func(err error) {
+		// With a dead letter file, events are kept there until the
+		// client comes back.
+		if s.deadLetter == nil {
+			panic(err)
+		}
+	})
+	c.transport = "stdio"
+	s.serveConn(ctx, c)
+}
+
+// Serve accepts connections from l, handling commands from each of
+// them and forwarding events to all of them, until ctx is canceled or
+// accepting fails.
+func (s *Server) Serve(ctx context.Context, l net.Listener) error {
+	s.start(ctx)
+	defer s.shutdown()
+
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer cancel()
+
+	// There's no command loop until a client connects, so there's no
+	// reason to wait for one before being ready.
+	s.notifyReady()
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+
+	for {
+		nc, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		wg.Go(func() {
+			defer nc.Close()
+			stop := context.AfterFunc(ctx, func() { nc.Close() })
+			defer stop()
+
+			c := s.newConn(nc, nc, func(error) { nc.Close() })
+			c.transport = l.Addr().Network()
+			s.serveConn(ctx, c)
+		})
+	}
+}
+
+// serveConn handles commands from c until its command stream ends.
+func (s *Server) serveConn(ctx context.Context, c *conn) {
+	s.bcast.add(c)
+	defer s.bcast.remove(c)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer c.inflight.wait()
+	defer cancel()
+
+	corrupt := func() {
+		// The client is told why the connection is being closed,
+		// though if its input is being corrupted, it may well not get
+		// the message.
+		c.sendError(0, errFrameCorrupt)
+	}
+	format := s.config.frameFormat()
+	for id, cmd := range s.readyAfterFirst(commands(c.r, format, corrupt)) {
+		cmd, ok := format.open(id, cmd)
+		if !ok {
+			c.sendError(id, errAuthFailed)
+			continue
+		}
+
+		err := c.allowCommand()
+		if err != nil {
+			c.sendError(id, err)
+			continue
+		}
+
+		name, arg, _ := strings.Cut(cmd, " ")
+		command, ok := commandTable[name]
+		if !ok {
+			c.sendError(id, &codedError{Code: "unknown_command", Err: fmt.Errorf("unknown command: %q", name)})
+			continue
+		}
+		if s.draining.Load() && !allowedWhileDraining[name] {
+			c.sendError(id, errDraining)
+			continue
+		}
+
+		var ns string
+		if slices.Contains(command.Args, argHandle) {
+			arg, ns = cutNamespace(arg)
+		}
+		reply, err := command.run(s, request{ctx: ctx, c: c, id: id, arg: arg, ns: ns})
+		c.reply(id, reply, err)
+		if ctx.Err() != nil {
+			// The server was shut down.
+			return
+		}
+	}
+}
+
+// okData is a successful reply that comes with a warning.
+type okData struct {
+	OK      bool   `json:"ok"`
+	Warning string `json:"warning,omitzero"`
+
+	// Existing is the number of synthetic creates that were sent for
+	// a watch added with emit_existing.
+	Existing *int `json:"existing,omitzero"`
+}
+
+type scanData struct {
+	Count int `json:"count"`
+}
+
+type statsData struct {
+	DropPolicy string `json:"drop_policy"`
+	Queued     int    `json:"queued"`
+	Dropped    uint64 `json:"dropped"`
+	Suppressed uint64 `json:"suppressed"`
+	Overflows  uint64 `json:"overflows"`
+
+	// IgnoredChmod is the number of Chmod events that were dropped
+	// with -ignore-chmod or "ignore_chmod".
+	IgnoredChmod uint64 `json:"ignored_chmod"`
+
+	// IgnoredHidden is the number of events for hidden files that were
+	// dropped with -ignore-hidden or "ignore_hidden".
+	IgnoredHidden uint64 `json:"ignored_hidden"`
+
+	// SelfSuppressed is the number of events that were dropped because
+	// the port caused them itself by reading files.
+	SelfSuppressed uint64 `json:"self_suppressed"`
+
+	// ExtFiltered is the number of events that were dropped by -ext or
+	// by the "ext" and "ext_exclude" of their watches.
+	ExtFiltered uint64 `json:"ext_filtered"`
+
+	// LastEventID is the ID of the last event that was sent.
+	LastEventID uint64 `json:"last_event_id"`
+
+	// SizeCache is the number of paths whose last size is remembered
+	// for "size_delta", out of at most SizeCacheMax. SizeEvictions is
+	// the number that were forgotten to make room for others.
+	SizeCache     int    `json:"size_cache"`
+	SizeCacheMax  int    `json:"size_cache_max"`
+	SizeEvictions uint64 `json:"size_evictions"`
+
+	Watches    int `json:"watches"`
+	MaxWatches int `json:"max_watches,omitzero"`
+}
+
+func (s *Server) stats(c *conn) statsData {
+	sizes, evictions := s.sizes.stats()
+	return statsData{
+		DropPolicy:     s.config.DropPolicy.String(),
+		Queued:         c.out.len(),
+		Dropped:        s.counters.drops[dropQueueFull].Load(),
+		Suppressed:     s.suppressed.Load(),
+		Overflows:      s.counters.drops[dropOverflow].Load(),
+		IgnoredChmod:   s.counters.drops[dropChmod].Load(),
+		IgnoredHidden:  s.counters.drops[dropHidden].Load(),
+		SelfSuppressed: s.counters.drops[dropSelf].Load(),
+		ExtFiltered:    s.counters.drops[dropExt].Load(),
+		LastEventID:    s.lastEventID.Load(),
+		SizeCache:      sizes,
+		SizeCacheMax:   s.config.SizeCache,
+		SizeEvictions:  evictions,
+		Watches:        int(c.watches.Load()),
+		MaxWatches:     s.config.MaxWatches,
+	}
+}
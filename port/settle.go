@@ -0,0 +1,200 @@
+package main
+
+import (
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+const (
+	// settleTick is the resolution of the settler's timer wheel.
+	settleTick = 10 * time.Millisecond
+
+	// settleSlots is the number of slots in the wheel. Paths that
+	// settle further in the future than one turn of the wheel wait
+	// for more than one turn.
+	settleSlots = 512
+)
+
+// settling is a burst of writes to a single path that hasn't settled
+// yet.
+type settling struct {
+	event    fsnotify.Event
+	count    int
+	first    time.Time
+	last     time.Time
+	deadline time.Time
+}
+
+// settler holds back bursts of Write events until the path has been
+// quiet for a while, emitting a single event for the whole burst. All
+// pending paths share a single timer wheel instead of each having its
+// own timer, so that a large number of them doesn't mean a large
+// number of timers.
+type settler struct {
+	clock clock
+	emit  func(event fsnotify.Event, count int, burst time.Duration)
+
+	m       sync.Mutex
+	pending map[string]*settling
+
+	// slots holds the paths that may be due in each tick of the
+	// wheel. A path's deadline can be moved later without moving it to
+	// a different slot, so it may be due in a later turn instead.
+	slots  [settleSlots]map[string]struct{}
+	pos    int
+	cursor time.Time
+	timer  timer
+
+	// gen is incremented whenever the wheel stops so that a turn that
+	// was already underway when it was stopped doesn't keep it going.
+	gen int
+}
+
+func newSettler(clock clock, emit func(fsnotify.Event, int, time.Duration)) *settler {
+	return &settler{
+		clock:   clock,
+		emit:    emit,
+		pending: make(map[string]*settling),
+	}
+}
+
+// handle reports whether event was held because it is a write to a
+// path that is settling for the given quiet period. Removing or
+// renaming a settling path discards its held writes, since the file
+// they refer to is gone, while creating it again emits them first so
+// that ordering is preserved.
+func (s *settler) handle(event fsnotify.Event, quiet time.Duration) bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	path := filepath.Clean(event.Name)
+	switch {
+	case event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename):
+		delete(s.pending, path)
+		return false
+	case event.Has(fsnotify.Create):
+		s.flush(path)
+		return false
+	case event.Op != fsnotify.Write || quiet <= 0:
+		return false
+	}
+
+	now := s.clock.Now()
+	p, ok := s.pending[path]
+	if !ok {
+		p = &settling{event: event, first: now}
+		s.pending[path] = p
+		s.schedule(path, now.Add(quiet))
+	}
+	p.count++
+	p.last = now
+	p.deadline = now.Add(quiet)
+	return true
+}
+
+// schedule puts path in the slot for deadline, starting the wheel if
+// it isn't already turning. s.m must be held.
+func (s *settler) schedule(path string, deadline time.Time) {
+	if s.timer == nil {
+		s.cursor = s.clock.Now()
+		s.startTimer()
+	}
+
+	ticks := int((deadline.Sub(s.cursor) + settleTick - 1) / settleTick)
+	ticks = min(max(ticks, 1), settleSlots-1)
+	slot := &s.slots[(s.pos+ticks)%settleSlots]
+	if *slot == nil {
+		*slot = make(map[string]struct{})
+	}
+	(*slot)[path] = struct{}{}
+}
+
+// startTimer schedules the next turn of the wheel. s.m must be held.
+func (s *settler) startTimer() {
+	gen := s.gen
+	s.timer = s.clock.AfterFunc(settleTick, func() { s.turn(gen) })
+}
+
+// turn advances the wheel by one tick, emitting the paths in the new
+// slot that have settled and rescheduling the rest.
+func (s *settler) turn(gen int) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if gen != s.gen {
+		return
+	}
+
+	s.pos = (s.pos + 1) % settleSlots
+	s.cursor = s.cursor.Add(settleTick)
+	now := s.clock.Now()
+
+	slot := s.slots[s.pos]
+	s.slots[s.pos] = nil
+	for path := range slot {
+		p, ok := s.pending[path]
+		if !ok {
+			continue
+		}
+		if p.deadline.After(now) {
+			s.schedule(path, p.deadline)
+			continue
+		}
+		s.flush(path)
+	}
+
+	if len(s.pending) == 0 {
+		s.stop()
+		return
+	}
+	s.startTimer()
+}
+
+// flush emits the held writes for path, if any. s.m must be held.
+func (s *settler) flush(path string) {
+	p, ok := s.pending[path]
+	if !ok {
+		return
+	}
+	delete(s.pending, path)
+	s.emit(p.event, p.count, p.last.Sub(p.first))
+}
+
+// stop stops the wheel and empties it. s.m must be held.
+func (s *settler) stop() {
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	s.gen++
+	s.slots = [settleSlots]map[string]struct{}{}
+}
+
+// drop discards held writes for root and everything under it without
+// emitting them.
+func (s *settler) drop(root string) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	root = filepath.Clean(root)
+	for path := range s.pending {
+		if hasPathPrefix(path, root) {
+			delete(s.pending, path)
+		}
+	}
+	if len(s.pending) == 0 {
+		s.stop()
+	}
+}
+
+// dropAll discards all held writes without emitting them.
+func (s *settler) dropAll() {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	clear(s.pending)
+	s.stop()
+}
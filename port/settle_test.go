@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+type settled struct {
+	path  string
+	count int
+	burst time.Duration
+}
+
+func newTestSettler() (*settler, *fakeClock, *[]settled) {
+	var out []settled
+	clock := newFakeClock()
+	s := newSettler(clock, func(event fsnotify.Event, count int, burst time.Duration) {
+		out = append(out, settled{path: event.Name, count: count, burst: burst})
+	})
+	return s, clock, &out
+}
+
+func TestSettle(t *testing.T) {
+	s, clock, out := newTestSettler()
+	write := fsnotify.Event{Name: "/data/file", Op: fsnotify.Write}
+
+	for range 3 {
+		if !s.handle(write, 50*time.Millisecond) {
+			t.Fatal("write was not held")
+		}
+		clock.Advance(20 * time.Millisecond)
+	}
+	if len(*out) != 0 {
+		t.Fatalf("emitted %v before settling", *out)
+	}
+
+	clock.Advance(40 * time.Millisecond)
+	expected := settled{path: "/data/file", count: 3, burst: 40 * time.Millisecond}
+	if len(*out) != 1 || (*out)[0] != expected {
+		t.Fatalf("got %v, expected [%v]", *out, expected)
+	}
+	if s.timer != nil {
+		t.Fatal("wheel still turning with nothing pending")
+	}
+}
+
+func TestSettleRemove(t *testing.T) {
+	s, clock, out := newTestSettler()
+
+	s.handle(fsnotify.Event{Name: "/data/file", Op: fsnotify.Write}, 50*time.Millisecond)
+	if s.handle(fsnotify.Event{Name: "/data/file", Op: fsnotify.Remove}, 50*time.Millisecond) {
+		t.Fatal("remove was held")
+	}
+	clock.Advance(time.Second)
+	if len(*out) != 0 {
+		t.Fatalf("emitted %v after the file was removed", *out)
+	}
+}
+
+func TestSettleCreate(t *testing.T) {
+	s, _, out := newTestSettler()
+
+	s.handle(fsnotify.Event{Name: "/data/file", Op: fsnotify.Write}, 50*time.Millisecond)
+	if s.handle(fsnotify.Event{Name: "/data/file", Op: fsnotify.Create}, 50*time.Millisecond) {
+		t.Fatal("create was held")
+	}
+	if len(*out) != 1 {
+		t.Fatalf("held writes weren't flushed by create: %v", *out)
+	}
+}
+
+func TestSettleManyPaths(t *testing.T) {
+	s, clock, out := newTestSettler()
+
+	const n = 10000
+	for i := range n {
+		s.handle(fsnotify.Event{Name: fmt.Sprintf("/data/%v", i), Op: fsnotify.Write}, time.Duration(i%100)*time.Millisecond+time.Millisecond)
+	}
+	if len(clock.timers) != 1 {
+		t.Fatalf("%v timers for %v paths", len(clock.timers), n)
+	}
+
+	clock.Advance(10 * time.Second)
+	if len(*out) != n {
+		t.Fatalf("emitted %v events, expected %v", len(*out), n)
+	}
+}
+
+func TestSettleLongQuiet(t *testing.T) {
+	s, clock, out := newTestSettler()
+
+	quiet := 2 * settleSlots * settleTick
+	s.handle(fsnotify.Event{Name: "/data/file", Op: fsnotify.Write}, quiet)
+	clock.Advance(quiet - settleTick)
+	if len(*out) != 0 {
+		t.Fatalf("emitted %v before settling", *out)
+	}
+	clock.Advance(2 * settleTick)
+	if len(*out) != 1 {
+		t.Fatalf("emitted %v, expected one event", *out)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"container/list"
+	"path/filepath"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// defaultSizeCache is the number of paths whose last size is
+// remembered if -size-cache isn't given.
+const defaultSizeCache = 4096
+
+// sizeEntry is the last size reported for a path.
+type sizeEntry struct {
+	path string
+	size int64
+}
+
+// sizeCache remembers the last size reported for up to max paths so
+// that writes can report how much a file changed. When it is full, the
+// path that was reported least recently is forgotten.
+type sizeCache struct {
+	max int
+
+	m         sync.Mutex
+	order     list.List
+	paths     map[string]*list.Element
+	evictions uint64
+}
+
+// update records size as the size of the path that event is for,
+// returning how much it changed since the last time if event is a
+// write and the previous size is known. Paths that are removed or
+// renamed away are forgotten.
+func (c *sizeCache) update(event fsnotify.Event, size *int64) *int64 {
+	if c.max <= 0 {
+		return nil
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	path := filepath.Clean(event.Name)
+	e, ok := c.paths[path]
+	if size == nil {
+		if ok && (event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename)) {
+			c.order.Remove(e)
+			delete(c.paths, path)
+		}
+		return nil
+	}
+
+	if !ok {
+		if c.paths == nil {
+			c.paths = make(map[string]*list.Element)
+		}
+		if len(c.paths) >= c.max {
+			oldest := c.order.Back()
+			c.order.Remove(oldest)
+			delete(c.paths, oldest.Value.(*sizeEntry).path)
+			c.evictions++
+		}
+		c.paths[path] = c.order.PushFront(&sizeEntry{path: path, size: *size})
+		return nil
+	}
+
+	c.order.MoveToFront(e)
+	entry := e.Value.(*sizeEntry)
+	delta := *size - entry.size
+	entry.size = *size
+	if !event.Has(fsnotify.Write) {
+		return nil
+	}
+	return &delta
+}
+
+// stats returns the number of paths whose size is remembered and the
+// number that have been forgotten to make room for others.
+func (c *sizeCache) stats() (int, uint64) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	return len(c.paths), c.evictions
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func TestSizeCache(t *testing.T) {
+	c := sizeCache{max: 2}
+
+	update := func(path string, op fsnotify.Op, size int64) *int64 {
+		t.Helper()
+		return c.update(fsnotify.Event{Name: path, Op: op}, &size)
+	}
+	expect := func(got *int64, want int64) {
+		t.Helper()
+		if got == nil || *got != want {
+			t.Fatalf("got a delta of %v, expected %v", got, want)
+		}
+	}
+	expectNone := func(got *int64) {
+		t.Helper()
+		if got != nil {
+			t.Fatalf("got a delta of %v, expected none", *got)
+		}
+	}
+
+	expectNone(update("/a", fsnotify.Write, 10))
+	expect(update("/a", fsnotify.Write, 15), 5)
+	expect(update("/a", fsnotify.Write, 3), -12)
+
+	// Creates and chmods update the size without reporting a delta.
+	expectNone(update("/b", fsnotify.Create, 0))
+	expectNone(update("/b", fsnotify.Chmod, 4))
+	expect(update("/b", fsnotify.Write, 6), 2)
+
+	// /a was reported least recently, so it is forgotten first.
+	expectNone(update("/c", fsnotify.Write, 1))
+	expectNone(update("/a", fsnotify.Write, 3))
+	expect(update("/c", fsnotify.Write, 2), 1)
+	if n, evictions := c.stats(); n != 2 || evictions != 2 {
+		t.Fatalf("remembering %v paths after %v evictions, expected 2 and 2", n, evictions)
+	}
+
+	expectNone(c.update(fsnotify.Event{Name: "/c", Op: fsnotify.Remove}, nil))
+	expectNone(update("/c", fsnotify.Write, 2))
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+const (
+	// sniffWorkers is the number of files that can be sniffed at once.
+	sniffWorkers = 4
+
+	// sniffQueueSize is the number of events that can be waiting to be
+	// sniffed before further events are sent with a sniff_error.
+	sniffQueueSize = 1024
+
+	// sniffLen is how much of a file is read to detect its content
+	// type, which is all that http.DetectContentType looks at.
+	sniffLen = 512
+)
+
+// errSniffBusy is reported as the sniff_error of events that weren't
+// sniffed because too many were waiting.
+var errSniffBusy = errors.New("busy")
+
+// sniffJob is an event waiting for its file to be sniffed.
+type sniffJob struct {
+	path  string
+	event fsnotify.Event
+	data  eventData
+}
+
+// sniffer adds the content type and extension of files to create and
+// settled write events for watches with "sniff". Files are read by a
+// pool of goroutines so that a slow file system doesn't hold up other
+// events, which means that sniffed events can be delivered after
+// events that happened after them.
+type sniffer struct {
+	// entry returns the watch that a path belongs to.
+	entry func(path string) watchEntry
+
+	// emit is called with sniffed events, from one of the pool's
+	// goroutines.
+	emit func(event fsnotify.Event, data eventData)
+
+	// touches is told about files before they are read.
+	touches *selfTouches
+
+	once sync.Once
+	jobs chan sniffJob
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newSniffer(entry func(string) watchEntry, emit func(fsnotify.Event, eventData)) *sniffer {
+	return &sniffer{
+		entry: entry,
+		emit:  emit,
+		jobs:  make(chan sniffJob, sniffQueueSize),
+		quit:  make(chan struct{}),
+	}
+}
+
+// take queues data, which was created for event, to be sniffed and
+// emitted, reporting whether it did. If the event should have been
+// sniffed but there are too many waiting, data is marked with a
+// sniff_error instead.
+func (s *sniffer) take(event fsnotify.Event, data *eventData) bool {
+	if !event.Has(fsnotify.Create) && !data.Settled {
+		return false
+	}
+	if data.IsDir != nil && *data.IsDir {
+		return false
+	}
+	if !s.entry(event.Name).Sniff {
+		return false
+	}
+
+	s.once.Do(s.start)
+	select {
+	case s.jobs <- sniffJob{path: event.Name, event: event, data: *data}:
+		return true
+	default:
+		data.SniffError = errSniffBusy.Error()
+		return false
+	}
+}
+
+func (s *sniffer) start() {
+	s.wg.Add(sniffWorkers)
+	for range sniffWorkers {
+		go s.run()
+	}
+}
+
+func (s *sniffer) run() {
+	defer s.wg.Done()
+
+	for {
+		select {
+		case <-s.quit:
+			return
+		case job := <-s.jobs:
+			data := job.data
+			done := s.touches.touch(job.path, fsnotify.Chmod)
+			contentType, err := sniffFile(job.path)
+			done()
+			switch {
+			case err != nil:
+				data.SniffError = err.Error()
+			case contentType != "":
+				data.ContentType, data.Ext = contentType, filepath.Ext(job.path)
+			}
+			s.emit(job.event, data)
+		}
+	}
+}
+
+// stop stops sniffing. Events that were waiting to be sniffed are
+// dropped.
+func (s *sniffer) stop() {
+	close(s.quit)
+	s.wg.Wait()
+}
+
+// sniffFile returns the content type of the file at path as detected
+// from its first bytes, or "" if it isn't a regular file.
+func sniffFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+	if !info.Mode().IsRegular() {
+		return "", nil
+	}
+
+	buf := make([]byte, sniffLen)
+	n, err := io.ReadFull(file, buf)
+	if err != nil && !isEOF(err) {
+		return "", err
+	}
+	return http.DetectContentType(buf[:n]), nil
+}
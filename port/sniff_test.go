@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func TestSniff(t *testing.T) {
+	ts := newTestServer(t)
+	root := t.TempDir()
+
+	ts.send(1, `add_watch {"path":"`+root+`","sniff":true}`)
+	ts.expect(1, `"ok"`)
+
+	page := filepath.Join(root, "page.html")
+	err := os.WriteFile(page, []byte("<!DOCTYPE html><p>hello"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	empty := filepath.Join(root, "empty")
+	err = os.WriteFile(empty, nil, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(root, "dir")
+	err = os.Mkdir(dir, 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(root, "missing")
+
+	var id int
+	expect := func(path string, op fsnotify.Op, extra string) {
+		t.Helper()
+		go ts.watcher.Inject(fsnotify.Event{Name: path, Op: op})
+		id++
+		ts.expect(0, fmt.Sprintf(`{"id":%v,"Name":%q,"root":%q,"op":[%q]%v}`, id, path, root, strings.ToLower(op.String()), extra))
+	}
+
+	expect(page, fsnotify.Create, `,"is_dir":false,"content_type":"text/html; charset=utf-8","ext":".html"`)
+	expect(empty, fsnotify.Create, `,"is_dir":false,"content_type":"text/plain; charset=utf-8"`)
+	expect(missing, fsnotify.Create, `,"is_dir":null,"sniff_error":"open `+missing+`: no such file or directory"`)
+	expect(dir, fsnotify.Create, `,"is_dir":true`)
+
+	// Only creates are sniffed unless writes are settled.
+	expect(page, fsnotify.Write, `,"is_dir":false`)
+}
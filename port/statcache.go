@@ -0,0 +1,77 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultStatCacheTTL is how long the result of stat'ing a path is
+	// reused for if -stat-cache-ttl isn't given.
+	defaultStatCacheTTL = 10 * time.Millisecond
+
+	// maxStatCache is the most paths whose stat results are cached at
+	// once. They are all forgotten when it is reached.
+	maxStatCache = 4096
+)
+
+type statResult struct {
+	info os.FileInfo
+	err  error
+	at   time.Time
+}
+
+// statCache reuses the result of stat'ing a path for writes that
+// arrive within ttl of it, so that a burst of them doesn't stat the
+// file once for each. The metadata of all but the first of them can be
+// out of date by up to ttl as a result.
+type statCache struct {
+	clock clock
+	ttl   time.Duration
+
+	m       sync.Mutex
+	results map[string]statResult
+}
+
+// lstat returns the result of os.Lstat for path, reusing the last one
+// if it is recent enough. It is safe to call on a nil *statCache, which
+// doesn't cache anything.
+func (c *statCache) lstat(path string) (os.FileInfo, error) {
+	if c == nil || c.ttl <= 0 {
+		return os.Lstat(path)
+	}
+
+	path = filepath.Clean(path)
+	now := c.clock.Now()
+	c.m.Lock()
+	r, ok := c.results[path]
+	c.m.Unlock()
+	if ok && now.Sub(r.at) < c.ttl {
+		return r.info, r.err
+	}
+
+	info, err := os.Lstat(path)
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.results == nil || len(c.results) >= maxStatCache {
+		c.results = make(map[string]statResult)
+	}
+	c.results[path] = statResult{info: info, err: err, at: now}
+	return info, err
+}
+
+// forget discards the cached result for path, if there is one.
+func (c *statCache) forget(path string) {
+	if c == nil {
+		return
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	delete(c.results, filepath.Clean(path))
+}
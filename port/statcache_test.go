@@ -0,0 +1,50 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func TestStatCache(t *testing.T) {
+	clock := newFakeClock()
+	cache := statCache{clock: clock, ttl: defaultStatCacheTTL}
+	path := filepath.Join(t.TempDir(), "file")
+
+	resize := func(size int) {
+		t.Helper()
+		err := os.WriteFile(path, make([]byte, size), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect := func(op fsnotify.Op, size int64) {
+		t.Helper()
+		var data eventData
+		statEvent(&data, fsnotify.Event{Name: path, Op: op}, &cache)
+		if data.Size == nil || *data.Size != size {
+			t.Fatalf("got size %v for %v, expected %v", data.Size, op, size)
+		}
+	}
+
+	resize(5)
+	expect(fsnotify.Write, 5)
+	resize(10)
+	expect(fsnotify.Write, 5)
+	clock.Advance(defaultStatCacheTTL)
+	expect(fsnotify.Write, 10)
+
+	// Creates are always stat'd afresh.
+	resize(15)
+	expect(fsnotify.Create, 15)
+
+	var data eventData
+	statEvent(&data, fsnotify.Event{Name: path, Op: fsnotify.Remove}, &cache)
+	if data.Size != nil {
+		t.Fatalf("got size %v for a remove", *data.Size)
+	}
+	resize(20)
+	expect(fsnotify.Write, 20)
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// stickyTarget is a path that is watched by way of one of its
+// ancestors, known as its anchor, so that the watch survives the path
+// being deleted and recreated. The anchor is the target's parent
+// whenever it exists and otherwise the nearest ancestor that does.
+type stickyTarget struct {
+	path   string
+	tag    string
+	anchor string
+}
+
+type stickySet struct {
+	m       sync.Mutex
+	targets map[string]*stickyTarget
+
+	// anchors counts the number of targets using each anchored
+	// directory.
+	anchors map[string]int
+}
+
+// nearestDir returns path if it is an existing directory or otherwise
+// its closest ancestor that is.
+func nearestDir(path string) string {
+	for {
+		info, err := os.Stat(path)
+		if err == nil && info.IsDir() {
+			return path
+		}
+
+		parent := filepath.Dir(path)
+		if parent == path {
+			return path
+		}
+		path = parent
+	}
+}
+
+// deepestDir walks from dir toward target, which must be under dir,
+// and returns the deepest existing directory along the way, stopping
+// at target's parent.
+func deepestDir(dir, target string) string {
+	rel, err := filepath.Rel(dir, filepath.Dir(target))
+	if err != nil || rel == "." {
+		return dir
+	}
+
+	for _, name := range strings.Split(rel, string(filepath.Separator)) {
+		next := filepath.Join(dir, name)
+		info, err := os.Stat(next)
+		if err != nil || !info.IsDir() {
+			break
+		}
+		dir = next
+	}
+	return dir
+}
+
+// addSticky starts a sticky watch on opts.Path. If there already is
+// one, its tag is updated.
+func (h *handle) addSticky(opts watchOptions) error {
+	h.sticky.m.Lock()
+	defer h.sticky.m.Unlock()
+
+	path := filepath.Clean(opts.Path)
+	if t, ok := h.sticky.targets[path]; ok {
+		t.tag = opts.Tag
+		return nil
+	}
+
+	t := stickyTarget{
+		path:   path,
+		tag:    opts.Tag,
+		anchor: nearestDir(filepath.Dir(path)),
+	}
+	err := h.anchor(t.anchor)
+	if err != nil {
+		return err
+	}
+
+	if h.sticky.targets == nil {
+		h.sticky.targets = make(map[string]*stickyTarget)
+	}
+	h.sticky.targets[path] = &t
+	return nil
+}
+
+// removeSticky stops the sticky watch on path, reporting whether
+// there was one.
+func (h *handle) removeSticky(path string) bool {
+	h.sticky.m.Lock()
+	defer h.sticky.m.Unlock()
+
+	path = filepath.Clean(path)
+	t, ok := h.sticky.targets[path]
+	if !ok {
+		return false
+	}
+	delete(h.sticky.targets, path)
+	h.unanchor(t.anchor)
+	return true
+}
+
+// isAnchor reports whether dir is being watched on behalf of a sticky
+// target.
+func (h *handle) isAnchor(dir string) bool {
+	h.sticky.m.Lock()
+	defer h.sticky.m.Unlock()
+
+	return h.sticky.anchors[filepath.Clean(dir)] > 0
+}
+
+// stickyTargets returns copies of all sticky targets.
+func (h *handle) stickyTargets() []stickyTarget {
+	h.sticky.m.Lock()
+	defer h.sticky.m.Unlock()
+
+	targets := make([]stickyTarget, 0, len(h.sticky.targets))
+	for _, t := range h.sticky.targets {
+		targets = append(targets, *t)
+	}
+	return targets
+}
+
+// setStickyTag sets the tag of the sticky target at path, reporting
+// whether there was one.
+func (h *handle) setStickyTag(path, tag string) bool {
+	h.sticky.m.Lock()
+	defer h.sticky.m.Unlock()
+
+	t, ok := h.sticky.targets[filepath.Clean(path)]
+	if ok {
+		t.tag = tag
+	}
+	return ok
+}
+
+// stickyTag returns the tag of the sticky target at path and whether
+// there is one.
+func (h *handle) stickyTag(path string) (string, bool) {
+	h.sticky.m.Lock()
+	defer h.sticky.m.Unlock()
+
+	if t, ok := h.sticky.targets[filepath.Clean(path)]; ok {
+		return t.tag, true
+	}
+	return "", false
+}
+
+// anchor starts watching dir on behalf of a sticky target.
+// h.sticky.m must be held.
+func (h *handle) anchor(dir string) error {
+	if h.sticky.anchors[dir] == 0 {
+		err := h.watcher.Add(dir)
+		if err != nil {
+			return err
+		}
+	}
+
+	if h.sticky.anchors == nil {
+		h.sticky.anchors = make(map[string]int)
+	}
+	h.sticky.anchors[dir]++
+	return nil
+}
+
+// unanchor releases a reference to dir, removing its watch if it's no
+// longer needed. h.sticky.m must be held.
+func (h *handle) unanchor(dir string) {
+	h.sticky.anchors[dir]--
+	if h.sticky.anchors[dir] > 0 {
+		return
+	}
+	delete(h.sticky.anchors, dir)
+
+	if _, ok := h.watches.get(dir); !ok {
+		// The watch may already be gone if the directory was removed.
+		h.watcher.Remove(dir)
+	}
+}
+
+// reanchor moves t to a new anchor.
+func (h *handle) reanchor(t *stickyTarget, anchor string) {
+	if anchor == t.anchor {
+		return
+	}
+
+	old := t.anchor
+	err := h.anchor(anchor)
+	if err != nil {
+		// Stay anchored to the old directory and try again the next
+		// time something happens to it.
+		return
+	}
+	t.anchor = anchor
+	h.unanchor(old)
+}
+
+// userWatched reports whether events for path would be delivered by
+// a watch that was explicitly added, rather than one that only exists
+// for a sticky target.
+func (h *handle) userWatched(path string) bool {
+	if _, ok := h.watches.get(path); ok {
+		return true
+	}
+	_, ok := h.watches.get(filepath.Dir(path))
+	return ok
+}
+
+// handleSticky updates sticky targets in response to event. It
+// reports whether the event should be delivered and returns any
+// synthetic events that should be delivered after it.
+func (h *handle) handleSticky(event fsnotify.Event) (deliver bool, synthetic []fsnotify.Event) {
+	h.sticky.m.Lock()
+	defer h.sticky.m.Unlock()
+
+	if len(h.sticky.targets) == 0 {
+		return true, nil
+	}
+
+	path := filepath.Clean(event.Name)
+	deliver = h.userWatched(path)
+	for _, t := range h.sticky.targets {
+		switch {
+		case path == t.path:
+			deliver = true
+
+		case path == t.anchor && (event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename)):
+			h.reanchor(t, nearestDir(filepath.Dir(t.anchor)))
+
+		case event.Has(fsnotify.Create) && filepath.Dir(path) == t.anchor && hasPathPrefix(t.path, path):
+			h.reanchor(t, deepestDir(path, t.path))
+			if t.anchor != filepath.Dir(t.path) {
+				continue
+			}
+
+			// The chain of directories leading to the target has been
+			// recreated, possibly along with the target itself before
+			// the watch could catch it.
+			_, err := os.Lstat(t.path)
+			if err == nil {
+				synthetic = append(synthetic, fsnotify.Event{Name: t.path, Op: fsnotify.Create})
+			}
+		}
+	}
+
+	return deliver, synthetic
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// newStickyTest starts a server with a sticky watch on file, along
+// with a watch on /sentinel, events for which show that everything
+// injected before them has been handled.
+func newStickyTest(t *testing.T, file string) *testServer {
+	ts := newTestServer(t)
+	ts.send(1, "add_watch /sentinel")
+	ts.expect(1, `"ok"`)
+	ts.send(2, "add_sticky "+file)
+	ts.expect(2, `"ok"`)
+	return ts
+}
+
+// expectEvents injects events and checks that only the events in want
+// are delivered, in order, before the sentinel.
+func (ts *testServer) expectEvents(events []fsnotify.Event, want ...fsnotify.Event) {
+	ts.t.Helper()
+
+	go func() {
+		for _, event := range events {
+			ts.watcher.Inject(event)
+		}
+		ts.watcher.Inject(fsnotify.Event{Name: "/sentinel", Op: fsnotify.Write})
+	}()
+	for _, event := range want {
+		_, payload := ts.next()
+		name := fmt.Sprintf(`"Name":%q`, event.Name)
+		op := fmt.Sprintf(`"op":[%q]`, strings.ToLower(event.Op.String()))
+		if !strings.Contains(payload, name) || !strings.Contains(payload, op) {
+			ts.t.Fatalf("got %s, expected {%s,%s,...}", payload, name, op)
+		}
+	}
+	_, payload := ts.next()
+	if !strings.Contains(payload, `"Name":"/sentinel"`) {
+		ts.t.Fatalf("got %s, expected the sentinel", payload)
+	}
+}
+
+// expectAnchors checks that the watcher is watching exactly dirs, in
+// addition to /sentinel.
+func (ts *testServer) expectAnchors(dirs ...string) {
+	ts.t.Helper()
+
+	got := ts.watcher.WatchList()
+	want := append([]string{"/sentinel"}, dirs...)
+	slices.Sort(got)
+	slices.Sort(want)
+	if !slices.Equal(got, want) {
+		ts.t.Fatalf("watching %q, expected %q", got, want)
+	}
+}
+
+func TestStickyRecreated(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	ts := newStickyTest(t, file)
+	ts.expectAnchors(dir)
+
+	err := os.WriteFile(file, nil, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.expectEvents(
+		[]fsnotify.Event{
+			{Name: file, Op: fsnotify.Remove},
+			{Name: filepath.Join(dir, "other"), Op: fsnotify.Create},
+			{Name: file, Op: fsnotify.Create},
+			{Name: file, Op: fsnotify.Write},
+		},
+		fsnotify.Event{Name: file, Op: fsnotify.Remove},
+		fsnotify.Event{Name: file, Op: fsnotify.Create},
+		fsnotify.Event{Name: file, Op: fsnotify.Write},
+	)
+	ts.expectAnchors(dir)
+}
+
+func TestStickyParentRecreated(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "dir")
+	file := filepath.Join(dir, "file")
+	err := os.Mkdir(dir, 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := newStickyTest(t, file)
+	ts.expectAnchors(dir)
+
+	// The anchor moves up to root while dir is gone.
+	err = os.Remove(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.expectEvents([]fsnotify.Event{{Name: dir, Op: fsnotify.Remove}})
+	ts.expectAnchors(root)
+
+	// Once dir is back, it is the anchor again, and file, having been
+	// created before the watch on dir could see it, is reported as
+	// created.
+	err = os.Mkdir(dir, 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(file, nil, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.expectEvents(
+		[]fsnotify.Event{{Name: dir, Op: fsnotify.Create}},
+		fsnotify.Event{Name: file, Op: fsnotify.Create},
+	)
+	ts.expectAnchors(dir)
+
+	ts.expectEvents(
+		[]fsnotify.Event{{Name: file, Op: fsnotify.Write}},
+		fsnotify.Event{Name: file, Op: fsnotify.Write},
+	)
+}
+
+func TestStickyRootGone(t *testing.T) {
+	base := t.TempDir()
+	root := filepath.Join(base, "root")
+	dir := filepath.Join(root, "dir")
+	file := filepath.Join(dir, "file")
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := newStickyTest(t, file)
+
+	err = os.RemoveAll(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.expectEvents([]fsnotify.Event{
+		{Name: dir, Op: fsnotify.Remove},
+		{Name: root, Op: fsnotify.Remove},
+	})
+	ts.expectAnchors(base)
+
+	// Nothing else under base is delivered while waiting for root,
+	// including directories that only look like it.
+	err = os.Mkdir(root+"x", 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.expectEvents([]fsnotify.Event{
+		{Name: root + "x", Op: fsnotify.Create},
+		{Name: filepath.Join(base, "other"), Op: fsnotify.Write},
+	})
+	ts.expectAnchors(base)
+
+	ts.send(3, "remove "+file)
+	ts.expect(3, `"ok"`)
+	ts.expectAnchors()
+}
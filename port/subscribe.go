@@ -0,0 +1,50 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// allOps is every operation that fsnotify reports.
+const allOps = fsnotify.Create | fsnotify.Write | fsnotify.Remove | fsnotify.Rename | fsnotify.Chmod
+
+// messageOp returns the operation of msg for subscriptions. Moved
+// events count as both a rename and a create. Messages other than
+// events have no operation and are sent regardless of subscriptions.
+func messageOp(msg any) fsnotify.Op {
+	data, ok := msg.(eventData)
+	if !ok {
+		return 0
+	}
+	op := fsnotify.Op(data.Op)
+	if data.LegacyOp != nil {
+		op = *data.LegacyOp
+	}
+	if op.Has(opMoved) {
+		op = op&^opMoved | fsnotify.Rename | fsnotify.Create
+	}
+	return op
+}
+
+// wants reports whether c is subscribed to events with the given
+// operation.
+func (c *conn) wants(op fsnotify.Op) bool {
+	return op == 0 || op&^fsnotify.Op(c.unsubscribed.Load()) != 0
+}
+
+// subscribed returns the operations that c is subscribed to.
+func (c *conn) subscribed() eventOp {
+	return eventOp(allOps &^ fsnotify.Op(c.unsubscribed.Load()))
+}
+
+// parseSubscription parses the argument of subscribe and unsubscribe,
+// which is a comma-separated list of operations or "*" for all of
+// them.
+func parseSubscription(arg string) (fsnotify.Op, error) {
+	if arg == "*" {
+		return allOps, nil
+	}
+	op, err := parseOps(strings.Split(arg, ","))
+	return fsnotify.Op(op), err
+}
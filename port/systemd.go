@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"iter"
+	"log/slog"
+	"net"
+	"os"
+	"time"
+
+	"github.com/coreos/go-systemd/v22/activation"
+	"github.com/coreos/go-systemd/v22/daemon"
+)
+
+// systemdListener returns the socket passed to the process by systemd
+// socket activation, or nil if the process wasn't socket activated.
+func systemdListener() (net.Listener, error) {
+	if os.Getenv("LISTEN_FDS") == "" {
+		return nil, nil
+	}
+
+	listeners, err := activation.Listeners()
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range listeners {
+		if l != nil {
+			return l, nil
+		}
+	}
+	return nil, errors.New("socket activated without a usable socket")
+}
+
+// notifyReady tells systemd that the server is ready the first time
+// that it is called. It does nothing if the process isn't being run by
+// systemd with Type=notify.
+func (s *Server) notifyReady() {
+	s.ready.Do(func() {
+		_, err := daemon.SdNotify(false, daemon.SdNotifyReady)
+		if err != nil {
+			slog.Error("notify systemd", "err", err)
+		}
+	})
+}
+
+// readyAfterFirst wraps a command stream so that systemd is told that
+// the server is ready once the first command has been handled.
+func (s *Server) readyAfterFirst(commands iter.Seq2[uint64, string]) iter.Seq2[uint64, string] {
+	return func(yield func(uint64, string) bool) {
+		for id, cmd := range commands {
+			if !yield(id, cmd) {
+				return
+			}
+			s.notifyReady()
+		}
+	}
+}
+
+// watchdog pings the systemd watchdog at half of its configured
+// interval until ctx is canceled. A ping is only sent if frames are
+// still making it through the broadcaster, so a server that has
+// deadlocked gets restarted.
+func (s *Server) watchdog(ctx context.Context) {
+	interval, err := daemon.SdWatchdogEnabled(false)
+	if err != nil {
+		slog.Error("check systemd watchdog", "err", err)
+		return
+	}
+	if interval == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !s.bcast.ping(interval / 2) {
+				slog.Warn("broadcaster is unresponsive, skipping watchdog notification")
+				continue
+			}
+			daemon.SdNotify(false, daemon.SdNotifyWatchdog)
+		}
+	}
+}
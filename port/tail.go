@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// maxTailChunk is the most bytes of a tailed file that are sent in a
+// single frame. Base64 encoded, it still fits in a frame without a
+// checksum.
+const maxTailChunk = 32 << 10
+
+// tailData carries bytes appended to a file that is being tailed.
+type tailData struct {
+	Op     string `json:"op"`
+	Name   string `json:"name"`
+	Handle uint64 `json:"handle,omitzero"`
+	Tag    string `json:"tag,omitzero"`
+
+	// Offset is where in the file Data starts.
+	Offset int64  `json:"offset"`
+	Data   []byte `json:"data"`
+
+	// Truncated is set if the file shrank, in which case it is read
+	// from the start again. Rotated is set if it was replaced.
+	Truncated bool `json:"truncated,omitzero"`
+	Rotated   bool `json:"rotated,omitzero"`
+
+	Time   string `json:"time,omitzero"`
+	MonoNS int64  `json:"mono_ns,omitzero"`
+}
+
+// tailedFile is a file whose appended bytes are being sent.
+type tailedFile struct {
+	path   string
+	chunk  int
+	offset int64
+
+	// rotated is true if the file was removed or renamed since it was
+	// last read.
+	rotated bool
+}
+
+type tails struct {
+	// touches is told about files before they are read.
+	touches *selfTouches
+
+	m     sync.Mutex
+	files map[string]*tailedFile
+}
+
+// add starts tailing path from its current end, or from the start if
+// it doesn't exist yet. If it is already being tailed, its chunk size
+// is updated.
+func (t *tails) add(path string, chunk int) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	if f, ok := t.files[path]; ok {
+		f.chunk = chunk
+		return
+	}
+
+	f := tailedFile{path: path, chunk: chunk}
+	if info, err := os.Stat(path); err == nil {
+		f.offset = info.Size()
+	}
+	if t.files == nil {
+		t.files = make(map[string]*tailedFile)
+	}
+	t.files[path] = &f
+}
+
+// remove stops tailing path.
+func (t *tails) remove(path string) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	delete(t.files, path)
+}
+
+// handle updates the file that event is for if it is being tailed,
+// calling emit with each chunk of anything appended to it.
+func (t *tails) handle(event fsnotify.Event, emit func(tailData)) error {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	f, ok := t.files[filepath.Clean(event.Name)]
+	if !ok {
+		return nil
+	}
+
+	switch {
+	case event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename):
+		f.offset = 0
+		f.rotated = true
+		return nil
+	case event.Has(fsnotify.Create) || event.Has(fsnotify.Write):
+		defer t.touches.touch(f.path, fsnotify.Chmod)()
+		return f.read(emit)
+	}
+	return nil
+}
+
+// read reads everything from f's offset to the end of the file.
+func (f *tailedFile) read(emit func(tailData)) error {
+	file, err := os.Open(f.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			// It was removed again before it could be read, so there
+			// will be another event once it's back.
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	var truncated bool
+	if info.Size() < f.offset {
+		f.offset = 0
+		truncated = true
+	}
+
+	r := io.NewSectionReader(file, f.offset, info.Size()-f.offset)
+	buf := make([]byte, min(f.chunk, int(r.Size())))
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			emit(tailData{
+				Name:      f.path,
+				Offset:    f.offset,
+				Data:      buf[:n],
+				Truncated: truncated,
+				Rotated:   f.rotated,
+			})
+			f.offset += int64(n)
+			truncated, f.rotated = false, false
+		}
+		if err != nil {
+			if isEOF(err) {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// tail sends anything appended to the file that event is for if it is
+// being tailed.
+func (s *Server) tail(h *handle, event fsnotify.Event, send func(any)) {
+	err := h.tails.handle(event, func(data tailData) {
+		data.Op = "Tail"
+		data.Handle = h.id
+		data.Tag, _ = h.stickyTag(data.Name)
+		data.Time, data.MonoNS = s.timestamp(time.Now())
+		send(data)
+	})
+	if err != nil {
+		data := handleErrorData{Err: err.Error(), Handle: h.id, NS: h.ns}
+		data.Time, data.MonoNS = s.timestamp(time.Now())
+		s.broadcastUrgent(data)
+	}
+}
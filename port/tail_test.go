@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func TestTail(t *testing.T) {
+	ts := newTestServer(t)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "log")
+
+	err := os.WriteFile(path, []byte("old\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.send(1, `tail {"path":"`+path+`","tag":"log","chunk_size":4}`)
+	ts.expect(1, `"ok"`)
+
+	write := func(contents string, op fsnotify.Op) {
+		t.Helper()
+		err := os.WriteFile(path, []byte(contents), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go ts.watcher.Inject(fsnotify.Event{Name: path, Op: op})
+	}
+	var id int
+	expectEvent := func(op string) {
+		t.Helper()
+		id++
+		ts.expect(0, fmt.Sprintf(`{"id":%v,"Name":%q,"root":%q,"op":[%q],"tag":"log","is_dir":false}`, id, path, path, op))
+	}
+	expectTail := func(offset int, data, extra string) {
+		t.Helper()
+		id++
+		ts.expect(0, fmt.Sprintf(`{"id":%v,"op":"Tail","name":%q,"tag":"log","offset":%v,"data":%q%v}`, id, path, offset, data, extra))
+	}
+
+	// Only what was appended after tail is sent, split into chunks.
+	write("old\nnew line\n", fsnotify.Write)
+	expectTail(4, "bmV3IA==", "")
+	expectTail(8, "bGluZQ==", "")
+	expectTail(12, "Cg==", "")
+	expectEvent("write")
+
+	write("new\n", fsnotify.Write)
+	expectTail(0, "bmV3Cg==", `,"truncated":true`)
+	expectEvent("write")
+
+	err = os.Remove(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ts.watcher.Inject(fsnotify.Event{Name: path, Op: fsnotify.Remove})
+	expectEvent("remove")
+
+	write("abc", fsnotify.Create)
+	expectTail(0, "YWJj", `,"rotated":true`)
+	expectEvent("create")
+
+	ts.send(2, `tail {"path":"`+path+`","chunk_size":100000}`)
+	ts.expect(2, `{"Err":"chunk_size must be between 0 (the default) and 32768"}`)
+}
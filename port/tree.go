@@ -0,0 +1,516 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/bmatcuk/doublestar/v4"
+	"github.com/fsnotify/fsnotify"
+)
+
+// tree is a directory that is watched recursively. Subdirectories
+// created after it was added are watched automatically.
+type tree struct {
+	root    string
+	exclude []string
+
+	// filter, if not nil, selects the directories that are watched
+	// in place of exclude.
+	filter *treeFilter
+
+	// maxDepth is how many levels of subdirectories below the root
+	// are watched, or -1 if there's no limit.
+	maxDepth int
+
+	// dirs holds every directory in the tree that is being watched,
+	// including the root.
+	dirs map[string]struct{}
+
+	// failed holds the error for each directory in the tree that
+	// couldn't be watched.
+	failed map[string]error
+
+	// overflowed is set if the watcher's queue has overflowed since
+	// the tree was added, meaning that new subdirectories might have
+	// been missed.
+	overflowed bool
+
+	// owner is the connection that each directory in dirs counts
+	// against the watch quota of, including ones watched later, and
+	// limit is the quota. It is nil for trees that aren't counted.
+	owner *conn
+	limit int
+}
+
+// release gives n of the tree's directories back to its owner's quota.
+func (t *tree) release(n int) {
+	if t.owner != nil && n > 0 {
+		t.owner.releaseWatches(n)
+	}
+}
+
+// treeStatus describes how much of a tree is actually being watched.
+type treeStatus struct {
+	Root    string            `json:"root"`
+	Watched int               `json:"watched"`
+	Failed  map[string]string `json:"failed"`
+
+	// KeepingUp is false if new subdirectories may have been missed,
+	// either because adding them failed or because events were lost.
+	KeepingUp bool `json:"keeping_up"`
+}
+
+func (t *tree) status() treeStatus {
+	failed := make(map[string]string, len(t.failed))
+	for dir, err := range t.failed {
+		failed[dir] = err.Error()
+	}
+	return treeStatus{
+		Root:      t.root,
+		Watched:   len(t.dirs),
+		Failed:    failed,
+		KeepingUp: !t.overflowed && len(t.failed) == 0,
+	}
+}
+
+// treeResult reports the outcome of watching all or part of a tree.
+type treeResult struct {
+	Watched int `json:"watched"`
+	Skipped int `json:"skipped"`
+
+	// BeyondDepth counts the directories that weren't watched because
+	// they are just past the depth limit. Directories further down
+	// aren't looked at.
+	BeyondDepth int `json:"beyond_depth"`
+
+	// Existing is the number of synthetic creates that were sent for
+	// a tree added with emit_existing.
+	Existing *int `json:"existing,omitzero"`
+}
+
+// depth returns how many levels below the root dir is.
+func (t *tree) depth(dir string) int {
+	rel, err := filepath.Rel(t.root, dir)
+	if err != nil || rel == "." {
+		return 0
+	}
+	return strings.Count(rel, string(filepath.Separator)) + 1
+}
+
+// excluded reports whether dir matches one of the tree's exclude
+// patterns. Patterns without a separator are matched against just the
+// directory's name so that, for example, "node_modules" excludes
+// every directory with that name.
+func (t *tree) excluded(dir string) bool {
+	for _, pattern := range t.exclude {
+		if !strings.ContainsRune(pattern, filepath.Separator) {
+			if ok, _ := filepath.Match(pattern, filepath.Base(dir)); ok {
+				return true
+			}
+			continue
+		}
+		if matchGlob(pattern, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// treeFilter selects the directories of a tree added by
+// add_watch_tree_filtered using doublestar globs, which are matched
+// against paths relative to the root with forward slashes.
+type treeFilter struct {
+	include []string
+	exclude []string
+}
+
+// excluded reports whether the directory at rel matches an exclude
+// pattern, in which case nothing under it is watched either.
+func (f *treeFilter) excluded(rel string) bool {
+	return slices.ContainsFunc(f.exclude, func(pattern string) bool {
+		ok, _ := doublestar.Match(pattern, rel)
+		return ok
+	})
+}
+
+// included reports whether the directory at rel matches an include
+// pattern. Directories that don't are still walked, since directories
+// under them might.
+func (f *treeFilter) included(rel string) bool {
+	return slices.ContainsFunc(f.include, func(pattern string) bool {
+		ok, _ := doublestar.Match(pattern, rel)
+		return ok
+	})
+}
+
+// validateGlobs returns an error for the first of the include and
+// exclude patterns that isn't a valid doublestar glob.
+func validateGlobs(include, exclude []string) error {
+	for _, pattern := range slices.Concat(include, exclude) {
+		if !doublestar.ValidatePattern(pattern) {
+			return fmt.Errorf("invalid glob %q", pattern)
+		}
+	}
+	return nil
+}
+
+// trees holds the recursive watches of a handle.
+type trees struct {
+	m     sync.Mutex
+	roots map[string]*tree
+}
+
+// find returns the tree that contains path, or nil if there isn't
+// one. The caller must hold t.m.
+func (t *trees) find(path string) *tree {
+	var found *tree
+	for root, tree := range t.roots {
+		if hasPathPrefix(path, root) && (found == nil || len(root) > len(found.root)) {
+			found = tree
+		}
+	}
+	return found
+}
+
+func (t *trees) isRoot(path string) bool {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	_, ok := t.roots[filepath.Clean(path)]
+	return ok
+}
+
+// isSubdir reports whether path is watched only because it is inside
+// of a tree.
+func (t *trees) isSubdir(path string) bool {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	path = filepath.Clean(path)
+	if _, ok := t.roots[path]; ok {
+		return false
+	}
+	tree := t.find(path)
+	if tree == nil {
+		return false
+	}
+	_, ok := tree.dirs[path]
+	return ok
+}
+
+// addTree watches opts.Path and every directory under it that isn't
+// excluded, counting each of them against owner's quota of limit
+// watches if owner isn't nil. If ctx is canceled during the walk, the
+// directories that have been watched so far are either kept as a
+// complete tree or unwatched again, depending on the cause.
+func (h *handle) addTree(ctx context.Context, opts watchOptions, owner *conn, limit int) (treeResult, error) {
+	root := filepath.Clean(opts.Path)
+	info, err := os.Stat(root)
+	if err != nil {
+		return treeResult{}, err
+	}
+	if !info.IsDir() {
+		return treeResult{}, &os.PathError{Op: "add_watch_recursive", Path: root, Err: errors.New("not a directory")}
+	}
+
+	h.trees.m.Lock()
+	defer h.trees.m.Unlock()
+
+	t := tree{
+		root:     root,
+		exclude:  opts.Exclude,
+		maxDepth: -1,
+		dirs:     make(map[string]struct{}),
+		failed:   make(map[string]error),
+		owner:    owner,
+		limit:    limit,
+	}
+	if opts.MaxDepth != nil {
+		t.maxDepth = max(*opts.MaxDepth, 0)
+	}
+	if opts.Include != nil {
+		t.exclude = nil
+		t.filter = &treeFilter{include: opts.Include, exclude: opts.Exclude}
+	}
+	result, err := h.walkTree(ctx, &t, root)
+	if ctx.Err() != nil {
+		if rollback(ctx) {
+			for dir := range t.dirs {
+				h.watcher.Remove(dir)
+			}
+			t.release(len(t.dirs))
+			return result, cancelledError(ctx, map[string]any{"watched": result.Watched, "rolled_back": true})
+		}
+		err = cancelledError(ctx, map[string]any{"watched": result.Watched})
+	}
+	if len(t.dirs) == 0 {
+		return result, err
+	}
+
+	if h.trees.roots == nil {
+		h.trees.roots = make(map[string]*tree)
+	}
+	if old, ok := h.trees.roots[root]; ok {
+		// The directories are counted by the new tree instead.
+		old.release(len(old.dirs))
+	}
+	h.trees.roots[root] = &t
+	h.watches.set(opts)
+	return result, err
+}
+
+// walkTree watches dir and the directories under it, adding them to
+// t. Failing to watch dir itself is an error, but directories under it
+// that can't be watched are skipped. The walk stops early if ctx is
+// canceled. The caller must hold h.trees.m.
+func (h *handle) walkTree(ctx context.Context, t *tree, dir string) (result treeResult, err error) {
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if ctx.Err() != nil {
+			return filepath.SkipAll
+		}
+		if err != nil {
+			if path == dir {
+				return err
+			}
+			t.failed[path] = err
+			return nil
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if path != t.root && t.excluded(path) {
+			result.Skipped++
+			return filepath.SkipDir
+		}
+		if t.maxDepth >= 0 && t.depth(path) > t.maxDepth {
+			result.BeyondDepth++
+			return filepath.SkipDir
+		}
+		if t.filter != nil && path != t.root {
+			rel, _ := filepath.Rel(t.root, path)
+			rel = filepath.ToSlash(rel)
+			if t.filter.excluded(rel) {
+				result.Skipped++
+				return filepath.SkipDir
+			}
+			if !t.filter.included(rel) {
+				return nil
+			}
+		}
+
+		if _, ok := t.dirs[path]; ok {
+			return nil
+		}
+
+		if t.owner != nil {
+			err = t.owner.reserveWatch(t.limit)
+		}
+		if err == nil {
+			err = h.watcher.Add(path)
+			if err != nil {
+				t.release(1)
+			}
+		}
+		if err != nil {
+			if path == dir && path == t.root {
+				return err
+			}
+			t.failed[path] = err
+			return filepath.SkipDir
+		}
+		t.dirs[path] = struct{}{}
+		delete(t.failed, path)
+		result.Watched++
+		return nil
+	})
+	return result, err
+}
+
+// removeTree stops watching the subdirectories of the tree rooted at
+// root, leaving the root itself, and its place in the quota, to the
+// caller. It reports whether there was such a tree.
+func (h *handle) removeTree(root string) bool {
+	h.trees.m.Lock()
+	defer h.trees.m.Unlock()
+
+	root = filepath.Clean(root)
+	t, ok := h.trees.roots[root]
+	if !ok {
+		return false
+	}
+	delete(h.trees.roots, root)
+
+	for dir := range t.dirs {
+		if dir != root {
+			h.watcher.Remove(dir)
+		}
+	}
+	t.release(len(t.dirs) - 1)
+	return true
+}
+
+// updateTree keeps the tree containing event's path in sync with the
+// filesystem, watching new subdirectories and forgetting about ones
+// that have gone away. For new subdirectories, it returns the paths
+// of everything that was already in them once they were watched, which
+// might have been created too soon for there to be events for them.
+func (h *handle) updateTree(event fsnotify.Event) []string {
+	if !event.Has(fsnotify.Create) && !event.Has(fsnotify.Remove) && !event.Has(fsnotify.Rename) {
+		return nil
+	}
+
+	h.trees.m.Lock()
+	defer h.trees.m.Unlock()
+
+	path := filepath.Clean(event.Name)
+	t := h.trees.find(path)
+	if t == nil || path == t.root {
+		return nil
+	}
+
+	if event.Has(fsnotify.Create) {
+		info, err := os.Lstat(path)
+		if err != nil || !info.IsDir() || t.excluded(path) {
+			return nil
+		}
+		h.walkTree(context.Background(), t, path)
+		return t.entries(path)
+	}
+
+	for dir := range t.failed {
+		if hasPathPrefix(dir, path) {
+			delete(t.failed, dir)
+		}
+	}
+	for dir := range t.dirs {
+		if dir == t.root || !hasPathPrefix(dir, path) {
+			continue
+		}
+		delete(t.dirs, dir)
+		t.release(1)
+		if event.Has(fsnotify.Rename) {
+			// Removed directories lose their watches on their own,
+			// but renamed ones don't.
+			h.watcher.Remove(dir)
+		}
+	}
+	return nil
+}
+
+// entries returns the paths of everything in the watched directories
+// at or under dir, with the entries of each directory before those of
+// the directories under it.
+func (t *tree) entries(dir string) []string {
+	var dirs []string
+	for d := range t.dirs {
+		if hasPathPrefix(d, dir) {
+			dirs = append(dirs, d)
+		}
+	}
+	slices.Sort(dirs)
+
+	var paths []string
+	for _, d := range dirs {
+		entries, _ := os.ReadDir(d)
+		for _, entry := range entries {
+			paths = append(paths, filepath.Join(d, entry.Name()))
+		}
+	}
+	return paths
+}
+
+// treeStatus returns the status of the tree rooted at root.
+func (h *handle) treeStatus(root string) (treeStatus, bool) {
+	h.trees.m.Lock()
+	defer h.trees.m.Unlock()
+
+	t, ok := h.trees.roots[filepath.Clean(root)]
+	if !ok {
+		return treeStatus{}, false
+	}
+	return t.status(), true
+}
+
+// markOverflowed records that events for every tree may have been
+// lost.
+func (t *trees) markOverflowed() {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	for _, tree := range t.roots {
+		tree.overflowed = true
+	}
+}
+
+// options returns the options that the tree rooted at root was added
+// with.
+func (t *trees) options(root string) (opts watchOptions, ok bool) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	tree, ok := t.roots[filepath.Clean(root)]
+	if !ok {
+		return opts, false
+	}
+	opts = watchOptions{Path: tree.root, Exclude: tree.exclude}
+	if tree.filter != nil {
+		opts.Include, opts.Exclude = tree.filter.include, tree.filter.exclude
+	}
+	if tree.maxDepth >= 0 {
+		opts.MaxDepth = &tree.maxDepth
+	}
+	return opts, true
+}
+
+// parseFilteredTree parses the arguments of add_watch_tree_filtered,
+// which can either be a watchOptions object or have the form "<path>
+// [--include <glob>]... [--exclude <glob>]...". If no include patterns
+// are given, every directory that isn't excluded is watched.
+func parseFilteredTree(arg string) (opts watchOptions, err error) {
+	if strings.HasPrefix(arg, "{") {
+		opts, err = parseWatchOptions(arg)
+	} else {
+		opts, err = parseFilteredTreeFlags(arg)
+	}
+	if err != nil {
+		return opts, err
+	}
+	if opts.Include == nil {
+		opts.Include = []string{"**"}
+	}
+	return opts, validateGlobs(opts.Include, opts.Exclude)
+}
+
+func parseFilteredTreeFlags(arg string) (opts watchOptions, err error) {
+	fields := strings.Fields(arg)
+	i := slices.IndexFunc(fields, func(field string) bool { return strings.HasPrefix(field, "--") })
+	if i < 0 {
+		i = len(fields)
+	}
+	opts.Path = strings.Join(fields[:i], " ")
+	if opts.Path == "" {
+		return opts, errors.New("expected <path> [--include <glob>]... [--exclude <glob>]...")
+	}
+
+	for flags := fields[i:]; len(flags) > 0; flags = flags[2:] {
+		if len(flags) < 2 {
+			return opts, fmt.Errorf("missing glob after %v", flags[0])
+		}
+		switch flags[0] {
+		case "--include":
+			opts.Include = append(opts.Include, flags[1])
+		case "--exclude":
+			opts.Exclude = append(opts.Exclude, flags[1])
+		default:
+			return opts, fmt.Errorf("unknown flag %q", flags[0])
+		}
+	}
+	return opts, nil
+}
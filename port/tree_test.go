@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json/v2"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func TestTreeCreateRace(t *testing.T) {
+	root := t.TempDir()
+	p := startPort(t)
+	p.roundTrip(1, "add_watch_recursive "+root, `{"watched":1,"skipped":0,"beyond_depth":0}`)
+
+	// The files are created before the port can possibly have watched
+	// the new directory, and possibly after.
+	const files = 200
+	dir := filepath.Join(root, "new")
+	err := os.Mkdir(dir, 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range files {
+		f, err := os.Create(filepath.Join(dir, fmt.Sprint(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+	}
+
+	// Give duplicates time to show up before the reply to ping marks
+	// the end.
+	time.Sleep(200 * time.Millisecond)
+	p.send(2, "ping")
+
+	created := make(map[string]int)
+	for {
+		id, payload := p.next()
+		if id == 2 {
+			break
+		}
+		var event struct {
+			Name string
+			Op   []string `json:"op"`
+		}
+		err = json.Unmarshal(payload, &event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if slices.Contains(event.Op, "create") {
+			created[event.Name]++
+		}
+	}
+
+	if created[dir] != 1 {
+		t.Errorf("directory was reported as created %v times", created[dir])
+	}
+	for i := range files {
+		path := filepath.Join(dir, fmt.Sprint(i))
+		if created[path] != 1 {
+			t.Errorf("%v was reported as created %v times", path, created[path])
+		}
+	}
+}
+
+func TestTreeQuota(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"a", "b"} {
+		err := os.Mkdir(filepath.Join(root, dir), 0o755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	config := DefaultConfig
+	config.MaxWatches = 3
+	ts := newTestServerConfig(t, config)
+
+	id := uint64(0)
+	watches := func() int {
+		t.Helper()
+
+		id++
+		ts.send(id, "watch_stats")
+		for {
+			gotID, payload := ts.next()
+			if gotID != id {
+				continue
+			}
+			var stats struct {
+				Watches int `json:"watches"`
+			}
+			err := json.Unmarshal([]byte(payload), &stats)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return stats.Watches
+		}
+	}
+
+	// Every directory counts.
+	id++
+	ts.send(id, "add_watch_recursive "+root)
+	ts.expect(id, `{"watched":3,"skipped":0,"beyond_depth":0}`)
+	if got := watches(); got != 3 {
+		t.Fatalf("tree counts as %v watches, expected 3", got)
+	}
+	id++
+	ts.send(id, "add_watch /other")
+	if _, payload := ts.next(); !strings.Contains(payload, `"code":"quota_exceeded"`) {
+		t.Fatalf("got %s, expected the quota to be exceeded", payload)
+	}
+
+	// So do directories that are created later, which aren't watched
+	// once the quota has been used up.
+	c := filepath.Join(root, "c")
+	err := os.Mkdir(c, 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ts.watcher.Inject(fsnotify.Event{Name: c, Op: fsnotify.Create})
+	ts.next()
+	if got := watches(); got != 3 {
+		t.Fatalf("tree counts as %v watches after a create, expected 3", got)
+	}
+	if slices.Contains(ts.watcher.WatchList(), c) {
+		t.Fatalf("%v was watched beyond the quota", c)
+	}
+
+	b := filepath.Join(root, "b")
+	err = os.Remove(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ts.watcher.Inject(fsnotify.Event{Name: b, Op: fsnotify.Remove})
+	ts.next()
+	if got := watches(); got != 2 {
+		t.Fatalf("tree counts as %v watches after a removal, expected 2", got)
+	}
+
+	id++
+	ts.send(id, "remove "+root)
+	ts.expect(id, `"ok"`)
+	if got := watches(); got != 0 {
+		t.Fatalf("got %v watches after removing the tree, expected 0", got)
+	}
+}
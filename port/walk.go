@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// pathFailure is a path that a command couldn't act on.
+type pathFailure struct {
+	Path  string `json:"path"`
+	Error string `json:"error"`
+}
+
+type watchTreeData struct {
+	Added  int           `json:"added"`
+	Failed []pathFailure `json:"failed"`
+}
+
+type pruneTreeData struct {
+	Removed int           `json:"removed"`
+	Failed  []pathFailure `json:"failed"`
+}
+
+// watchTree adds an ordinary watch on opts.Path and every directory
+// under it that isn't excluded, on behalf of c. Unlike addTree, it
+// doesn't rely on the backend or on events to find subdirectories, and
+// directories created later aren't watched. Directories that are
+// already watched are left as they are.
+func (s *Server) watchTree(ctx context.Context, c *conn, h *handle, opts watchOptions) (watchTreeData, error) {
+	root := filepath.Clean(opts.Path)
+	info, err := os.Stat(root)
+	if err != nil {
+		return watchTreeData{}, err
+	}
+	if !info.IsDir() {
+		return watchTreeData{}, &os.PathError{Op: "watch_tree", Path: root, Err: errors.New("not a directory")}
+	}
+
+	t := tree{root: root, exclude: opts.Exclude, maxDepth: -1}
+	if opts.MaxDepth != nil {
+		t.maxDepth = max(*opts.MaxDepth, 0)
+	}
+
+	result := watchTreeData{Failed: []pathFailure{}}
+	var added []string
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if ctx.Err() != nil {
+			return filepath.SkipAll
+		}
+		if err != nil {
+			if path == root {
+				return err
+			}
+			result.Failed = append(result.Failed, pathFailure{Path: path, Error: err.Error()})
+			return nil
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if path != root && t.excluded(path) {
+			return filepath.SkipDir
+		}
+		if t.maxDepth >= 0 && t.depth(path) > t.maxDepth {
+			return filepath.SkipDir
+		}
+		if _, ok := h.watches.get(path); ok {
+			return nil
+		}
+
+		sub := opts
+		sub.Path = path
+		_, err = s.addWatch(c, h, sub)
+		if err != nil {
+			if path == root {
+				return err
+			}
+			result.Failed = append(result.Failed, pathFailure{Path: path, Error: err.Error()})
+			return filepath.SkipDir
+		}
+		added = append(added, path)
+		result.Added++
+		return nil
+	})
+	if ctx.Err() != nil {
+		if rollback(ctx) {
+			for _, path := range added {
+				if h.remove(path) == nil {
+					c.releaseWatches(1)
+				}
+			}
+			return result, cancelledError(ctx, map[string]any{"added": result.Added, "rolled_back": true})
+		}
+		return result, cancelledError(ctx, map[string]any{"added": result.Added})
+	}
+	return result, err
+}
+
+// pruneTree removes every watch of the handle on root or a path under
+// it, on behalf of c.
+func (h *handle) pruneTree(c *conn, root string) pruneTreeData {
+	root = filepath.Clean(root)
+
+	result := pruneTreeData{Failed: []pathFailure{}}
+	for _, entry := range h.list() {
+		if !hasPathPrefix(entry.Path, root) {
+			continue
+		}
+
+		err := h.remove(entry.Path)
+		if err != nil {
+			result.Failed = append(result.Failed, pathFailure{Path: entry.Path, Error: err.Error()})
+			continue
+		}
+		c.releaseWatches(1)
+		result.Removed++
+	}
+	return result
+}
@@ -0,0 +1,40 @@
+package main
+
+import "github.com/fsnotify/fsnotify"
+
+// Watcher is the subset of the functionality of an
+// [fsnotify.Watcher] that the server needs.
+type Watcher interface {
+	Add(path string) error
+	Remove(path string) error
+	WatchList() []string
+	Close() error
+	Events() <-chan fsnotify.Event
+	Errors() <-chan error
+}
+
+// cookieReporter is implemented by watchers that can report the
+// cookies of events caused by moves. See cookieWatcher.
+type cookieReporter interface {
+	cookie(event fsnotify.Event) uint32
+}
+
+type fsnotifyWatcher struct {
+	w *fsnotify.Watcher
+}
+
+// NewWatcher returns a Watcher backed by a real [fsnotify.Watcher].
+func NewWatcher() (Watcher, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	return fsnotifyWatcher{w: w}, nil
+}
+
+func (w fsnotifyWatcher) Add(path string) error         { return w.w.Add(path) }
+func (w fsnotifyWatcher) Remove(path string) error      { return w.w.Remove(path) }
+func (w fsnotifyWatcher) WatchList() []string           { return w.w.WatchList() }
+func (w fsnotifyWatcher) Close() error                  { return w.w.Close() }
+func (w fsnotifyWatcher) Events() <-chan fsnotify.Event { return w.w.Events }
+func (w fsnotifyWatcher) Errors() <-chan error          { return w.w.Errors }
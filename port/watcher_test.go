@@ -0,0 +1,691 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json/v2"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// mockWatcher is a Watcher that doesn't touch the filesystem. Events
+// and errors can be injected with Inject and InjectError.
+type mockWatcher struct {
+	m       sync.Mutex
+	watches []string
+	closed  bool
+
+	events chan fsnotify.Event
+	errors chan error
+}
+
+func newMockWatcher() *mockWatcher {
+	return &mockWatcher{
+		events: make(chan fsnotify.Event),
+		errors: make(chan error),
+	}
+}
+
+func (w *mockWatcher) Add(path string) error {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	if w.closed {
+		return fsnotify.ErrClosed
+	}
+	path = filepath.Clean(path)
+	if !slices.Contains(w.watches, path) {
+		w.watches = append(w.watches, path)
+	}
+	return nil
+}
+
+func (w *mockWatcher) Remove(path string) error {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	path = filepath.Clean(path)
+	i := slices.Index(w.watches, path)
+	if i < 0 {
+		return &os.PathError{Op: "remove", Path: path, Err: fsnotify.ErrNonExistentWatch}
+	}
+	w.watches = slices.Delete(w.watches, i, i+1)
+	return nil
+}
+
+func (w *mockWatcher) WatchList() []string {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	return slices.Clone(w.watches)
+}
+
+func (w *mockWatcher) Close() error {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	if !w.closed {
+		w.closed = true
+		close(w.events)
+		close(w.errors)
+	}
+	return nil
+}
+
+func (w *mockWatcher) Events() <-chan fsnotify.Event { return w.events }
+func (w *mockWatcher) Errors() <-chan error          { return w.errors }
+
+func (w *mockWatcher) Inject(event fsnotify.Event) { w.events <- event }
+func (w *mockWatcher) InjectError(err error)       { w.errors <- err }
+
+// testServer runs a Server backed by a mockWatcher with its input and
+// output connected to pipes.
+type testServer struct {
+	t       *testing.T
+	server  *Server
+	watcher *mockWatcher
+	in      *io.PipeWriter
+	out     *io.PipeReader
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	return newTestServerConfig(t, DefaultConfig)
+}
+
+func newTestServerConfig(t *testing.T, config Config) *testServer {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(t.Context())
+	watcher := newMockWatcher()
+	inr, inw := io.Pipe()
+	outr, outw := io.Pipe()
+
+	s := NewServer(watcher, cancel, config)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Run(ctx, inr, outw)
+	}()
+	t.Cleanup(func() {
+		inw.Close()
+		outr.Close()
+		<-done
+		watcher.Close()
+	})
+
+	return &testServer{
+		t:       t,
+		server:  s,
+		watcher: watcher,
+		in:      inw,
+		out:     outr,
+	}
+}
+
+func (ts *testServer) send(id uint64, cmd string) {
+	ts.t.Helper()
+
+	var buf bytes.Buffer
+	sendData(&buf, id, cmd, ts.server.config.frameFormat())
+	_, err := ts.in.Write(buf.Bytes())
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+}
+
+func (ts *testServer) next() (uint64, string) {
+	ts.t.Helper()
+
+	format := ts.server.config.frameFormat()
+	if !format.crc {
+		var size uint16
+		err := binary.Read(ts.out, binary.BigEndian, &size)
+		if err != nil {
+			ts.t.Fatal(err)
+		}
+		buf := make([]byte, size)
+		_, err = io.ReadFull(ts.out, buf)
+		if err != nil {
+			ts.t.Fatal(err)
+		}
+		return ts.open(format, binary.BigEndian.Uint64(buf), string(buf[8:]))
+	}
+
+	var size uint32
+	err := binary.Read(ts.out, binary.BigEndian, &size)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	buf := make([]byte, size)
+	_, err = io.ReadFull(ts.out, buf)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	sum := crc32.Update(crc32.ChecksumIEEE(buf[:8]), crc32.IEEETable, buf[12:])
+	if sum != binary.BigEndian.Uint32(buf[8:]) {
+		ts.t.Fatalf("frame checksum mismatch: %q", buf)
+	}
+	return ts.open(format, binary.BigEndian.Uint64(buf), string(buf[12:]))
+}
+
+// open checks and removes the HMAC tag of a frame sent by the server.
+func (ts *testServer) open(format frameFormat, id uint64, payload string) (uint64, string) {
+	ts.t.Helper()
+
+	payload, ok := format.open(id, payload)
+	if !ok {
+		ts.t.Fatalf("frame %v has an invalid HMAC tag", id)
+	}
+	return id, payload
+}
+
+func (ts *testServer) expect(id uint64, payload string) {
+	ts.t.Helper()
+
+	gotID, got := ts.next()
+	if gotID != id || got != payload {
+		ts.t.Fatalf("got frame %v %s, expected %v %s", gotID, got, id, payload)
+	}
+}
+
+func TestMockWatcher(t *testing.T) {
+	ts := newTestServer(t)
+
+	ts.send(1, `add_watch {"path":"/data","tag":"data"}`)
+	ts.expect(1, `"ok"`)
+
+	go ts.watcher.Inject(fsnotify.Event{Name: "/data/file", Op: fsnotify.Create})
+	ts.expect(0, `{"id":1,"Name":"/data/file","root":"/data","op":["create"],"tag":"data","is_dir":null}`)
+
+	go ts.watcher.InjectError(fsnotify.ErrEventOverflow)
+	ts.expect(0, `{"Warn":"events are being dropped (overflow); see the counters command"}`)
+	ts.expect(0, `{"op":"Overflow","name":""}`)
+}
+
+func TestWatchCount(t *testing.T) {
+	ts := newTestServer(t)
+
+	ts.send(1, "watch_count")
+	ts.expect(1, `0`)
+
+	ts.send(2, "add_watch /data")
+	ts.expect(2, `"ok"`)
+	ts.send(3, "add_sticky /data/file")
+	ts.expect(3, `"ok"`)
+	ts.send(4, "add_watch /other")
+	ts.expect(4, `"ok"`)
+
+	ts.send(5, "watch_count")
+	ts.expect(5, `3`)
+
+	ts.send(6, "remove /other")
+	ts.expect(6, `"ok"`)
+	ts.send(7, "watch_count 0")
+	ts.expect(7, `2`)
+
+	ts.send(8, "watch_count 5")
+	ts.expect(8, `{"Err":"no watcher with handle 5"}`)
+}
+
+func TestEventRoot(t *testing.T) {
+	ts := newTestServer(t)
+
+	ts.send(1, "add_watch /data")
+	ts.expect(1, `"ok"`)
+	ts.send(2, "add_watch /data/a/")
+	ts.expect(2, `"ok"`)
+
+	tests := []struct {
+		name string
+		root string
+	}{
+		{"/data/a/file", "/data/a"},
+		{"/data/a", "/data/a"},
+		{"/data/ab", "/data"},
+		{"/data/ab/file", "/data"},
+	}
+	for i, test := range tests {
+		go ts.watcher.Inject(fsnotify.Event{Name: test.name, Op: fsnotify.Write})
+		ts.expect(0, `{"id":`+strconv.Itoa(i+1)+`,"Name":"`+test.name+`","root":"`+test.root+`","op":["write"],"is_dir":null}`)
+	}
+}
+
+func TestRelativePaths(t *testing.T) {
+	config := DefaultConfig
+	config.RelativePaths = true
+	ts := newTestServerConfig(t, config)
+
+	ts.send(1, "add_watch /data")
+	ts.expect(1, `"ok"`)
+	ts.send(2, "add_watch /data/a/")
+	ts.expect(2, `"ok"`)
+
+	tests := []struct {
+		name string
+		rel  string
+		root string
+	}{
+		{"/data/a/file", "file", "/data/a"},
+		{"/data/a", ".", "/data/a"},
+		{"/data/a/", ".", "/data/a"},
+		{"/data/ab/file", "ab/file", "/data"},
+		{"/data", ".", "/data"},
+	}
+	for i, test := range tests {
+		go ts.watcher.Inject(fsnotify.Event{Name: test.name, Op: fsnotify.Write})
+		ts.expect(0, `{"id":`+strconv.Itoa(i+1)+`,"Name":"`+test.rel+`","root":"`+test.root+`","op":["write"],"is_dir":null}`)
+	}
+
+	// Paths outside of any watch are left as they are.
+	go ts.watcher.Inject(fsnotify.Event{Name: "/other/file", Op: fsnotify.Write})
+	ts.expect(0, `{"id":6,"Name":"/other/file","op":["write"],"is_dir":null}`)
+}
+
+func TestHMAC(t *testing.T) {
+	config := DefaultConfig
+	config.HMACKey = []byte("secret")
+	ts := newTestServerConfig(t, config)
+
+	ts.send(1, "watch_list")
+	ts.expect(1, `[]`)
+
+	for id, format := range map[uint64]frameFormat{
+		2: {crc: true},
+		3: {crc: true, key: []byte("wrong")},
+	} {
+		var buf bytes.Buffer
+		sendData(&buf, id, "watch_list", format)
+		_, err := ts.in.Write(buf.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		ts.expect(id, `{"Err":"missing or invalid HMAC tag","code":"auth_failed"}`)
+	}
+
+	// A valid tag for a different ID is rejected, so tags can't be
+	// replayed onto other commands.
+	tag := config.frameFormat().tag(4, []byte("watch_list"))
+	var buf bytes.Buffer
+	sendData(&buf, 5, "watch_list"+string(tag), frameFormat{crc: true})
+	_, err := ts.in.Write(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.expect(5, `{"Err":"missing or invalid HMAC tag","code":"auth_failed"}`)
+}
+
+func TestIgnoreChmod(t *testing.T) {
+	config := DefaultConfig
+	config.IgnoreChmod = true
+	ts := newTestServerConfig(t, config)
+
+	ts.send(1, "add_watch /data")
+	ts.expect(1, `"ok"`)
+	ts.send(2, `add_watch {"path":"/other","ignore_chmod":false}`)
+	ts.expect(2, `"ok"`)
+
+	go func() {
+		ts.watcher.Inject(fsnotify.Event{Name: "/data/file", Op: fsnotify.Chmod})
+		ts.watcher.Inject(fsnotify.Event{Name: "/data/file", Op: fsnotify.Write | fsnotify.Chmod})
+		ts.watcher.Inject(fsnotify.Event{Name: "/other/file", Op: fsnotify.Chmod})
+	}()
+	ts.expect(0, `{"id":1,"Name":"/data/file","root":"/data","op":["write","chmod"],"is_dir":null}`)
+	ts.expect(0, `{"id":2,"Name":"/other/file","root":"/other","op":["chmod"],"is_dir":null}`)
+
+	if n := ts.server.counters.drops[dropChmod].Load(); n != 1 {
+		t.Fatalf("counted %v ignored chmod events, expected 1", n)
+	}
+}
+
+func TestEventIDs(t *testing.T) {
+	config := DefaultConfig
+	config.ReplayBuffer = 8
+	ts := newTestServerConfig(t, config)
+
+	ts.send(1, "add_watch /data")
+	ts.expect(1, `"ok"`)
+	go func() {
+		ts.watcher.Inject(fsnotify.Event{Name: "/data/a", Op: fsnotify.Create})
+		ts.watcher.Inject(fsnotify.Event{Name: "/data/b", Op: fsnotify.Create})
+	}()
+	ts.expect(0, `{"seq":1,"id":1,"Name":"/data/a","root":"/data","op":["create"],"is_dir":null}`)
+	ts.expect(0, `{"seq":2,"id":2,"Name":"/data/b","root":"/data","op":["create"],"is_dir":null}`)
+
+	// Replayed events keep their IDs.
+	ts.send(2, "replay 1")
+	ts.expect(0, `{"seq":2,"id":2,"Name":"/data/b","root":"/data","op":["create"],"is_dir":null}`)
+	ts.expect(2, `{"replayed":1}`)
+
+	ts.send(3, "watch_stats")
+	_, reply := ts.next()
+	var stats statsData
+	err := json.Unmarshal([]byte(reply), &stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.LastEventID != 2 {
+		t.Fatalf("last_event_id is %v, expected 2", stats.LastEventID)
+	}
+}
+
+func TestWatchSince(t *testing.T) {
+	config := DefaultConfig
+	config.ReplayBuffer = 16
+	ts := newTestServerConfig(t, config)
+
+	inject := func(names ...string) {
+		for _, name := range names {
+			ts.watcher.Inject(fsnotify.Event{Name: "/data/" + name, Op: fsnotify.Create})
+		}
+	}
+	seq := func(payload string) uint64 {
+		t.Helper()
+
+		var event struct {
+			Seq uint64 `json:"seq"`
+		}
+		err := json.Unmarshal([]byte(payload), &event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return event.Seq
+	}
+
+	ts.send(1, "add_watch /data")
+	ts.expect(1, `"ok"`)
+	go inject("a", "b", "c")
+	for range 3 {
+		ts.next()
+	}
+
+	// Events 4 to 6 are still waiting to be sent when watch_since is,
+	// so some of them might be sent live first, but the rest must only
+	// be sent as part of the replay.
+	inject("d", "e", "f")
+	for {
+		ts.server.replay.m.Lock()
+		seq := ts.server.replay.seq
+		ts.server.replay.m.Unlock()
+		if seq == 6 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	ts.send(2, "watch_since 2")
+	var got []uint64
+	for {
+		id, payload := ts.next()
+		if id == 2 {
+			if payload != `{"replayed":4}` {
+				t.Fatalf("got reply %s", payload)
+			}
+			break
+		}
+		got = append(got, seq(payload))
+	}
+	replayed := []uint64{3, 4, 5, 6}
+	live := got[:max(len(got)-len(replayed), 0)]
+	if !slices.Equal(got[len(live):], replayed) || len(live) > 3 || !slices.Equal(live, []uint64{4, 5, 6}[:len(live)]) {
+		t.Fatalf("got events %v", got)
+	}
+
+	go inject("g")
+	_, payload := ts.next()
+	if seq := seq(payload); seq != 7 {
+		t.Fatalf("got event %v after the replay, expected 7", seq)
+	}
+}
+
+// TestSkipReplayed checks that events that were replayed by
+// watch_since aren't sent again if they were still queued.
+func TestSkipReplayed(t *testing.T) {
+	var buf bytes.Buffer
+	c := &conn{out: newOutbox(&buf, policyBlock, 0, 1, func() {}, func(error) {})}
+	go c.out.run()
+
+	b := newBroadcaster(frameFormat{})
+	b.add(c)
+	for seq := range uint64(3) {
+		seq++
+		b.send(broadcastFrame{data: fmt.Appendf(nil, `{"seq":%v}`, seq), droppable: true, seq: seq})
+	}
+	b.skipThrough(c, 2)
+	go b.run()
+	b.close()
+
+	want := encodeFrame(0, `{"seq":3}`, b.format)
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Fatalf("got %q, expected %q", buf.Bytes(), want)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	ts := newTestServer(t)
+
+	ts.send(1, "add_watch /data")
+	ts.expect(1, `"ok"`)
+	ts.send(2, "drain")
+	ts.expect(2, `"ok"`)
+
+	ts.send(3, "add_watch /other")
+	ts.expect(3, `{"Err":"the port is draining; only shutdown and ping are accepted","code":"draining"}`)
+	ts.send(4, "ping")
+	ts.expect(4, `"ok"`)
+
+	// Events are still sent until the port is shut down.
+	go ts.watcher.Inject(fsnotify.Event{Name: "/data/a", Op: fsnotify.Create})
+	ts.expect(0, `{"id":1,"Name":"/data/a","root":"/data","op":["create"],"is_dir":null}`)
+
+	ts.send(5, "shutdown")
+	ts.expect(5, `"ok"`)
+}
+
+func TestUnknownCommand(t *testing.T) {
+	ts := newTestServer(t)
+
+	ts.send(1, "bogus /data")
+	ts.expect(1, `{"Err":"unknown command: \"bogus\"","code":"unknown_command"}`)
+
+	// The port keeps going.
+	ts.send(2, "ping")
+	ts.expect(2, `"ok"`)
+}
+
+func TestTopPaths(t *testing.T) {
+	ts := newTestServer(t)
+
+	ts.send(1, "add_watch /data")
+	ts.expect(1, `"ok"`)
+	go func() {
+		ts.watcher.Inject(fsnotify.Event{Name: "/data/a", Op: fsnotify.Create})
+		ts.watcher.Inject(fsnotify.Event{Name: "/data/b", Op: fsnotify.Create})
+		ts.watcher.Inject(fsnotify.Event{Name: "/data/b", Op: fsnotify.Write | fsnotify.Chmod})
+	}()
+	ts.expect(0, `{"id":1,"Name":"/data/a","root":"/data","op":["create"],"is_dir":null}`)
+	ts.expect(0, `{"id":2,"Name":"/data/b","root":"/data","op":["create"],"is_dir":null}`)
+	ts.expect(0, `{"id":3,"Name":"/data/b","root":"/data","op":["write","chmod"],"is_dir":null}`)
+
+	ts.send(2, "top_paths")
+	ts.expect(2, `[{"path":"/data/b","events":2,"last_op":"Write|Chmod"},{"path":"/data/a","events":1,"last_op":"Create"}]`)
+	ts.send(3, "top_paths 1")
+	ts.expect(3, `[{"path":"/data/b","events":2,"last_op":"Write|Chmod"}]`)
+	ts.send(4, "top_paths -1")
+	ts.expect(4, `{"Err":"the number of paths must not be negative"}`)
+}
+
+func TestRemoveOrphans(t *testing.T) {
+	ts := newTestServer(t)
+	dir := filepath.Join(t.TempDir(), "dir")
+	for _, path := range []string{"sub/c", "x", "y"} {
+		path = filepath.Join(dir, path)
+		err := os.MkdirAll(filepath.Dir(path), 0o755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(path, nil, 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ts.send(1, "add_watch "+dir)
+	ts.expect(1, `"ok"`)
+	err := os.RemoveAll(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// x was reported on its own, so only the rest are synthesized,
+	// before the directory itself.
+	go func() {
+		ts.watcher.Inject(fsnotify.Event{Name: filepath.Join(dir, "x"), Op: fsnotify.Remove})
+		ts.watcher.Inject(fsnotify.Event{Name: dir, Op: fsnotify.Remove})
+	}()
+	ts.expect(0, fmt.Sprintf(`{"id":1,"Name":%q,"root":%q,"op":["remove"],"is_dir":false}`, filepath.Join(dir, "x"), dir))
+	ts.expect(0, fmt.Sprintf(`{"id":2,"Name":%q,"root":%q,"op":["remove"],"synthetic":true,"is_dir":true}`, filepath.Join(dir, "sub"), dir))
+	ts.expect(0, fmt.Sprintf(`{"id":3,"Name":%q,"root":%q,"op":["remove"],"synthetic":true,"is_dir":false}`, filepath.Join(dir, "y"), dir))
+	ts.expect(0, fmt.Sprintf(`{"id":4,"Name":%q,"root":%q,"op":["remove"],"is_dir":true}`, dir, dir))
+
+	ts.send(2, "watch_list")
+	ts.expect(2, `[]`)
+}
+
+func TestNamespaces(t *testing.T) {
+	ts := newTestServer(t)
+	a, b := t.TempDir(), t.TempDir()
+
+	ts.send(1, "create_namespace a")
+	ts.expect(1, `1`)
+	ts.send(2, "create_namespace b")
+	ts.expect(2, `2`)
+	ts.send(3, "create_namespace a")
+	ts.expect(3, `{"Err":"namespace \"a\" already exists"}`)
+	ts.send(4, "list_namespaces")
+	ts.expect(4, `["a","b"]`)
+
+	ts.send(5, "add_watch "+a+" --ns a")
+	ts.expect(5, `"ok"`)
+	ts.send(6, "add_watch "+b+" --ns b")
+	ts.expect(6, `"ok"`)
+	ts.send(7, "remove_all --ns b")
+	ts.expect(7, `"ok"`)
+	ts.send(8, "watch_count --ns a")
+	ts.expect(8, `1`)
+	ts.send(9, "watch_count --ns b")
+	ts.expect(9, `0`)
+	ts.send(10, "watch_count --ns c")
+	ts.expect(10, `{"Err":"no namespace named \"c\""}`)
+	ts.send(11, "watch_count 1 --ns a")
+	ts.expect(11, `{"Err":"a handle and a namespace can't both be given"}`)
+
+	path := filepath.Join(a, "x")
+	err := os.WriteFile(path, nil, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.expect(0, fmt.Sprintf(`{"id":1,"Name":%q,"root":%q,"op":["create"],"handle":1,"ns":"a","is_dir":false}`, path, a))
+}
+
+func TestHandleQuota(t *testing.T) {
+	config := DefaultConfig
+	config.MaxWatches = 2
+	ts := newTestServerConfig(t, config)
+
+	exceeded := func(id uint64) {
+		t.Helper()
+		got, payload := ts.next()
+		if got != id || !strings.Contains(payload, `"code":"quota_exceeded"`) {
+			t.Fatalf("got %v: %s, expected quota_exceeded for %v", got, payload, id)
+		}
+	}
+
+	ts.send(1, "create_watcher")
+	ts.expect(1, `1`)
+	ts.send(2, "create_namespace a")
+	ts.expect(2, `2`)
+	ts.send(3, "create_watcher")
+	exceeded(3)
+	ts.send(4, "add_watch "+t.TempDir())
+	exceeded(4)
+	ts.send(5, "reopen")
+	exceeded(5)
+
+	ts.send(6, "destroy_watcher 1")
+	ts.expect(6, `"ok"`)
+	ts.send(7, "reopen")
+	ts.expect(0, `{"Notice":"reopened"}`)
+	ts.expect(7, `{"readded":0,"failed":{}}`)
+	ts.send(8, "create_watcher")
+	ts.expect(8, `3`)
+}
+
+func TestErrorPriority(t *testing.T) {
+	ts := newTestServer(t)
+
+	ts.send(1, "add_watch /data")
+	ts.expect(1, `"ok"`)
+
+	// Flood the port with more events than it can queue while nothing
+	// is being read, and then report an error.
+	const flood = 1000
+	var injected atomic.Int64
+	go func() {
+		for i := range flood {
+			ts.watcher.Inject(fsnotify.Event{Name: fmt.Sprintf("/data/%v", i), Op: fsnotify.Write})
+			injected.Add(1)
+		}
+	}()
+	for injected.Load() < 256 {
+		time.Sleep(time.Millisecond)
+	}
+	started := make(chan struct{})
+	go func() {
+		close(started)
+		ts.watcher.InjectError(errors.New("boom"))
+	}()
+	// Give the error a chance to be waiting before anything is read.
+	<-started
+	time.Sleep(10 * time.Millisecond)
+
+	// Everything is read before checking so that the port isn't left
+	// blocked.
+	var events []string
+	errorAt := -1
+	for range flood + 1 {
+		id, payload := ts.next()
+		if id != 0 {
+			t.Fatalf("got unexpected frame %v %s", id, payload)
+		}
+		if payload == `{"Err":"boom"}` {
+			errorAt = len(events)
+			continue
+		}
+		events = append(events, payload)
+	}
+	if errorAt < 0 || errorAt > 10 {
+		t.Fatalf("got the error after %v events", errorAt)
+	}
+
+	// The events themselves are still in order.
+	for i, event := range events {
+		expected := fmt.Sprintf(`{"id":%v,"Name":"/data/%v","root":"/data","op":["write"],"is_dir":null}`, i+1, i)
+		if event != expected {
+			t.Fatalf("got event %s, expected %s", event, expected)
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/json/v2"
+	"maps"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// watchOptions are the arguments accepted by commands that operate
+// on a single watch. They can be given either as a bare path or as a
+// JSON object.
+type watchOptions struct {
+	Path string `json:"path"`
+
+	// PathB64 is Path encoded in base64, for paths that aren't valid
+	// UTF-8. It takes precedence over Path if given.
+	PathB64 string `json:"path_b64,omitzero"`
+
+	Handle uint64 `json:"handle,omitzero"`
+	Tag    string `json:"tag,omitzero"`
+
+	// Depth is how many levels of subdirectories to descend into for
+	// commands that operate on a directory tree.
+	Depth int `json:"depth,omitzero"`
+
+	// MaxDepth limits how many levels of subdirectories are watched
+	// by add_watch_recursive. Zero watches just the root. If it isn't
+	// given, there's no limit.
+	MaxDepth *int `json:"max_depth,omitzero"`
+
+	// Exclude lists glob patterns of directories to skip when
+	// watching a tree.
+	Exclude []string `json:"exclude,omitzero"`
+
+	// Include, if not nil, lists doublestar glob patterns of the
+	// directories to watch in a tree added by add_watch_tree_filtered.
+	// Exclude is then matched the same way, against paths relative to
+	// the root of the tree.
+	Include []string `json:"include,omitzero"`
+
+	// Rate is the maximum number of events per second for
+	// set_rate_limit.
+	Rate float64 `json:"rate,omitzero"`
+
+	// Coalesce determines whether pause_path holds events to be
+	// delivered on resume rather than dropping them.
+	Coalesce bool `json:"coalesce,omitzero"`
+
+	// ChunkSize is the most bytes of a tailed file that are sent in
+	// a single frame.
+	ChunkSize int `json:"chunk_size,omitzero"`
+
+	// EmitExisting sends a synthetic create for everything that is
+	// already in the watch once it has been added.
+	EmitExisting bool `json:"emit_existing,omitzero"`
+
+	deliveryOptions
+}
+
+// deliveryOptions are the options of a watch that determine which of
+// its events are delivered and what they carry. The watch table keeps
+// them for as long as the watch exists.
+type deliveryOptions struct {
+	// Stat adds metadata about the file to the watch's events, as if
+	// -stat-events were given.
+	Stat bool `json:"stat,omitzero"`
+
+	// SettleMS holds back bursts of writes until they have stopped for
+	// this many milliseconds, as if -write-settle were given.
+	SettleMS int `json:"settle_ms,omitzero"`
+
+	// IgnoreChmod overrides -ignore-chmod for the watch if it is
+	// given.
+	IgnoreChmod *bool `json:"ignore_chmod,omitzero"`
+
+	// IgnoreHidden overrides -ignore-hidden for the watch if it is
+	// given.
+	IgnoreHidden *bool `json:"ignore_hidden,omitzero"`
+
+	// DirsOnly only delivers events for directories.
+	DirsOnly bool `json:"dirs_only,omitzero"`
+
+	// Ops, if not zero, only delivers events that include at least
+	// one of its operations.
+	Ops eventOp `json:"ops,omitzero"`
+
+	// Hash adds a hash of the file's contents to write events using
+	// the given algorithm, either "sha256" or "xxhash". With
+	// HashDedup, writes that leave the contents as they were the last
+	// time they were hashed aren't delivered at all.
+	Hash      string `json:"hash,omitzero"`
+	HashDedup bool   `json:"hash_dedup,omitzero"`
+
+	// Sniff adds the content type and extension of regular files to
+	// create and settled write events.
+	Sniff bool `json:"sniff,omitzero"`
+
+	// Ext, if not nil, only delivers events for files with one of the
+	// given extensions, and ExtExclude drops events for files with any
+	// of them. An empty string stands for files without an extension.
+	Ext        []string `json:"ext,omitzero"`
+	ExtExclude []string `json:"ext_exclude,omitzero"`
+
+	// Regex, if given, only delivers events for paths that match it.
+	// It is matched against the path relative to the root of the watch,
+	// with forward slashes, and isn't anchored unless it says so.
+	Regex string `json:"regex,omitzero"`
+}
+
+func parseWatchOptions(arg string) (opts watchOptions, err error) {
+	if !strings.HasPrefix(arg, "{") {
+		return watchOptions{Path: arg}, nil
+	}
+
+	err = json.Unmarshal([]byte(arg), &opts)
+	if err != nil {
+		return opts, err
+	}
+	if opts.Hash != "" {
+		_, err = newHash(opts.Hash)
+		if err != nil {
+			return opts, err
+		}
+	}
+	if opts.Include != nil {
+		err = validateGlobs(opts.Include, opts.Exclude)
+		if err != nil {
+			return opts, err
+		}
+	}
+	if opts.Regex != "" {
+		_, err = regexp.Compile(opts.Regex)
+		if err != nil {
+			return opts, err
+		}
+	}
+	opts.Path, err = decodePath(opts.Path, opts.PathB64)
+	return opts, err
+}
+
+type watchEntry struct {
+	Path         string `json:"path"`
+	PathB64      string `json:"path_b64,omitzero"`
+	PathEncoding string `json:"path_encoding,omitzero"`
+
+	Tag    string `json:"tag,omitzero"`
+	Sticky bool   `json:"sticky,omitzero"`
+	Paused bool   `json:"paused,omitzero"`
+
+	Recursive bool `json:"recursive,omitzero"`
+
+	// Regex is compiled once, when the watch is added, into regex.
+	deliveryOptions
+	regex *regexp.Regexp
+
+	// dir is true if the path was a directory when it was added.
+	dir bool
+}
+
+// watchTable tracks per-watch state that fsnotify itself doesn't
+// know about. It is keyed by cleaned path.
+type watchTable struct {
+	m       sync.RWMutex
+	entries map[string]*watchEntry
+}
+
+func (t *watchTable) set(opts watchOptions) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	if t.entries == nil {
+		t.entries = make(map[string]*watchEntry)
+	}
+
+	path := filepath.Clean(opts.Path)
+	info, err := os.Stat(path)
+	entry := watchEntry{
+		Path:            path,
+		Tag:             opts.Tag,
+		deliveryOptions: opts.deliveryOptions,
+		dir:             err == nil && info.IsDir(),
+	}
+	entry.Ext = normalizeExts(opts.Ext)
+	entry.ExtExclude = normalizeExts(opts.ExtExclude)
+	if opts.Regex != "" {
+		// It was validated when the options were parsed or imported.
+		entry.regex = regexp.MustCompile(opts.Regex)
+	}
+	t.entries[path] = &entry
+}
+
+// options returns the options that the watch described by entry was
+// added with, as far as the table keeps them.
+func (entry watchEntry) options() watchOptions {
+	return watchOptions{
+		Path:            entry.Path,
+		Tag:             entry.Tag,
+		deliveryOptions: entry.deliveryOptions,
+	}
+}
+
+func (t *watchTable) delete(path string) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	delete(t.entries, filepath.Clean(path))
+}
+
+func (t *watchTable) setTag(path, tag string) bool {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	entry, ok := t.entries[filepath.Clean(path)]
+	if !ok {
+		return false
+	}
+	entry.Tag = tag
+	return true
+}
+
+// setOps sets the operations that events for the watch on path are
+// delivered for, reporting whether there is one.
+func (t *watchTable) setOps(path string, ops eventOp) bool {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	entry, ok := t.entries[filepath.Clean(path)]
+	if !ok {
+		return false
+	}
+	entry.Ops = ops
+	return true
+}
+
+// get returns a copy of the entry for exactly path.
+func (t *watchTable) get(path string) (watchEntry, bool) {
+	t.m.RLock()
+	defer t.m.RUnlock()
+
+	entry, ok := t.entries[filepath.Clean(path)]
+	if !ok {
+		return watchEntry{Path: filepath.Clean(path)}, false
+	}
+	return *entry, true
+}
+
+// paths returns the path of every entry.
+func (t *watchTable) paths() []string {
+	t.m.RLock()
+	defer t.m.RUnlock()
+
+	return slices.Collect(maps.Keys(t.entries))
+}
+
+// lookup returns a copy of the entry for the longest watched path
+// that is either path itself or one of its ancestors.
+func (t *watchTable) lookup(path string) (watchEntry, bool) {
+	t.m.RLock()
+	defer t.m.RUnlock()
+
+	path = filepath.Clean(path)
+	for {
+		if entry, ok := t.entries[path]; ok {
+			return *entry, true
+		}
+
+		parent := filepath.Dir(path)
+		if parent == path {
+			return watchEntry{}, false
+		}
+		path = parent
+	}
+}
+
+// hasPathPrefix reports whether path is root or is located somewhere
+// under it. Both paths are expected to be clean.
+func hasPathPrefix(path, root string) bool {
+	if path == root {
+		return true
+	}
+	if !strings.HasSuffix(root, string(filepath.Separator)) {
+		root += string(filepath.Separator)
+	}
+	return strings.HasPrefix(path, root)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+const watchLimitHint = "increase /proc/sys/fs/inotify/max_user_watches"
+
+// watchLimitData describes the system's limit on the number of
+// watches.
+type watchLimitData struct {
+	CurrentLimit int    `json:"current_limit"`
+	InUse        int    `json:"in_use"`
+	Hint         string `json:"hint"`
+}
+
+var errNotSupported = &codedError{
+	Code: "not_supported",
+	Err:  errors.New("not supported on this platform"),
+}
+
+// watchLimitInfo returns the system's watch limit. It fails on
+// platforms that don't have one.
+func watchLimitInfo() (watchLimitData, error) {
+	info := readInotifyInfo()
+	if info == nil {
+		return watchLimitData{}, errNotSupported
+	}
+	return watchLimitData{
+		CurrentLimit: info.MaxUserWatches,
+		InUse:        info.Watches,
+		Hint:         watchLimitHint,
+	}, nil
+}
+
+// explainWatchLimit replaces the unhelpful "no space left on device"
+// error that is reported when the watch limit has been reached with
+// one that says what the problem is.
+func explainWatchLimit(err error) error {
+	if !errors.Is(err, syscall.ENOSPC) {
+		return err
+	}
+	limit, lerr := watchLimitInfo()
+	if lerr != nil {
+		return err
+	}
+	return &codedError{
+		Code: "too_many_watches",
+		Err:  err,
+		Details: map[string]any{
+			"current_limit": limit.CurrentLimit,
+			"hint":          limit.Hint,
+		},
+	}
+}
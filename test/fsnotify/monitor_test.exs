@@ -0,0 +1,71 @@
+defmodule FSNotify.MonitorTest do
+  use ExUnit.Case, async: true
+
+  import FSNotify.Supervisor, only: [registry_name: 1]
+
+  alias FSNotify.Monitor
+
+  setup context do
+    name = Module.concat(__MODULE__, context.test)
+    start_supervised!({Registry, name: registry_name(name), keys: :duplicate})
+    :ok = FSNotify.subscribe(name)
+
+    %{state: %{port: nil, name: name, compress: false}}
+  end
+
+  # Passes payload to the monitor as an event frame from the port.
+  defp receive_frame(state, payload) do
+    crc = :erlang.crc32(<<0::8*8, payload::binary>>)
+    frame = <<0::8*8, crc::8*4, payload::binary>>
+    assert {:noreply, ^state} = Monitor.handle_info({nil, {:data, frame}}, state)
+  end
+
+  test "events", %{state: state} do
+    receive_frame(state, ~s({"id":1,"Name":"/a","op":["create","write"]}))
+    assert_receive {:fsnotify_event, "/a", ops}
+    assert ops == MapSet.new([:create, :write])
+
+    receive_frame(state, ~s({"Name":"/a","Op":12}))
+    assert_receive {:fsnotify_event, "/a", ops}
+    assert ops == MapSet.new([:remove, :rename])
+  end
+
+  test "op names that aren't known", %{state: state} do
+    receive_frame(state, ~s({"id":1,"Name":"/a","op":["rename","moved"]}))
+    assert_receive {:fsnotify_event, "/a", ops}
+    assert ops == MapSet.new([:rename, :moved])
+
+    receive_frame(state, ~s({"id":2,"Name":"/a","op":["write","summary"]}))
+    assert_receive {:fsnotify_event, "/a", ops}
+    assert ops == MapSet.new([:write, "summary"])
+  end
+
+  test "frames that aren't known", %{state: state} do
+    receive_frame(state, ~s({"op":"Burst","name":"/a","summary":true,"events":{"write":100}}))
+    assert_receive {:fsnotify_other, %{"op" => "Burst", "name" => "/a", "summary" => true}}
+
+    receive_frame(state, ~s({"id":3,"op":"WriteAtomic","name":"/a","tmp":"/a.tmp"}))
+    assert_receive {:fsnotify_other, %{"op" => "WriteAtomic", "tmp" => "/a.tmp"}}
+
+    receive_frame(state, ~s({"something":"new"}))
+    assert_receive {:fsnotify_other, %{"something" => "new"}}
+
+    # Later events are still delivered.
+    receive_frame(state, ~s([{"id":4,"Name":"/b","op":["chmod"]}]))
+    assert_receive {:fsnotify_event, "/b", ops}
+    assert ops == MapSet.new([:chmod])
+  end
+
+  test "other messages", %{state: state} do
+    receive_frame(state, ~s({"op":"Keepalive"}))
+    receive_frame(state, ~s({"op":"Overflow","name":"/"}))
+    assert_receive :fsnotify_overflow
+    refute_received {:fsnotify_other, _}
+
+    receive_frame(state, ~s({"Warn":"events are being dropped"}))
+    assert_receive {:fsnotify_warning, "events are being dropped"}
+
+    receive_frame(state, ~s({"Name":"/","suppressed":5,"summary":"5 events suppressed"}))
+    assert_receive {:fsnotify_suppressed, "/", 5}
+  end
+end